@@ -0,0 +1,386 @@
+// Package audit provides an append-only audit log of tax decisions stored on disk as JSON lines.
+// Every record carries the hash of the record before it, so that editing or removing a record
+// breaks the chain and is detected by Verify.
+package audit
+
+import (
+	"bufio"
+	"congestion-calculator-manager/app/helpers"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Kinds of audit records.
+const (
+	KindCalculation = "calculation"
+	KindRulesEdit   = "rules_edit"
+)
+
+// maxRecordBytes is the size of the largest record read, enough for rules edits of large cities.
+const maxRecordBytes = 16 * 1024 * 1024
+
+// SystemActor is the actor of records whose context carries no authenticated caller.
+const SystemActor = "system"
+
+// Record represents an entry of the audit log.
+type Record struct {
+	Sequence     int64     `json:"sequence"`
+	Kind         string    `json:"kind"`
+	At           time.Time `json:"at"`
+	Actor        string    `json:"actor"`
+	LicensePlate string    `json:"licenseplate,omitempty"`
+	Cities       []string  `json:"cities"`
+
+	// Calculations: the hash of the vehicle and passages calculated, the rule version of every city and the outcome.
+	InputHash    string            `json:"input_hash,omitempty"`
+	RuleVersions map[string]string `json:"rule_versions,omitempty"`
+	TotalFee     int               `json:"total_fee"`
+	Error        string            `json:"error,omitempty"`
+
+	// Rules edits: the rules before and after the edit and the top-level fields that changed.
+	Before  json.RawMessage `json:"before,omitempty"`
+	After   json.RawMessage `json:"after,omitempty"`
+	Changes []string        `json:"changes,omitempty"`
+
+	PreviousHash string `json:"previous_hash"`
+	Hash         string `json:"hash"`
+}
+
+// Filter selects audit records; empty fields match every record.
+type Filter struct {
+	Kind         string
+	LicensePlate string
+	City         string
+	From         time.Time
+	To           time.Time
+}
+
+// Verification represents the outcome of checking the hash chain of the log.
+type Verification struct {
+	Valid    bool   `json:"valid"`
+	Records  int    `json:"records"`
+	BrokenAt int64  `json:"broken_at,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// Log represents the append-only audit log. Only the end of the chain is kept in memory;
+// queries read the records from the file.
+type Log struct {
+	path         string
+	file         *os.File
+	lastSequence int64
+	lastHash     string
+	mu           sync.RWMutex
+}
+
+// DefaultPath returns the location of the audit log in the data store.
+func DefaultPath() (string, error) {
+	dir, err := helpers.DataDirectory()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "audit", "audit.jsonl"), nil
+}
+
+// Open loads the audit log stored at the given path, creating it if it does not exist.
+// A record cut off by a crash while it was written is dropped, since it was never acknowledged;
+// corrupt records before the last one are an error. The chain is not verified when opening,
+// so a tampered log is still readable; use Verify.
+//
+// Parameters:
+//   - path: The path of the log file.
+//
+// Returns:
+//   - *Log: A pointer to the opened Log.
+//   - error: An error if the file could not be created or contains a corrupt entry.
+func Open(path string) (*Log, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := repairTail(file); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	log := &Log{path: path, file: file}
+	err = log.scan(func(lineNumber int, record Record, err error) bool {
+		if err != nil {
+			return false
+		}
+		log.lastSequence = record.Sequence
+		log.lastHash = record.Hash
+		return true
+	})
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return log, nil
+}
+
+// Append chains a record to the log and writes it.
+//
+// Parameters:
+//   - record: The record; its sequence and hashes are assigned, its time is set if zero.
+//
+// Returns:
+//   - Record: The record as written.
+//   - error: An error if the record could not be written.
+func (l *Log) Append(record Record) (Record, error) {
+	if record.At.IsZero() {
+		record.At = time.Now()
+	}
+	record.At = record.At.UTC()
+	if record.Actor == "" {
+		record.Actor = SystemActor
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	record.Sequence = l.lastSequence + 1
+	record.PreviousHash = l.lastHash
+	hash, err := record.computeHash()
+	if err != nil {
+		return Record{}, err
+	}
+	record.Hash = hash
+
+	line, err := json.Marshal(record)
+	if err != nil {
+		return Record{}, err
+	}
+	if _, err := l.file.Write(append(line, '\n')); err != nil {
+		return Record{}, err
+	}
+	l.lastSequence = record.Sequence
+	l.lastHash = record.Hash
+	return record, nil
+}
+
+// Query returns the records matching a filter, oldest first. Cities and plates are matched case-insensitively
+// and the time range includes From and excludes To.
+//
+// Returns:
+//   - []Record: The matching records.
+//   - error: An error if the log file could not be read.
+func (l *Log) Query(filter Filter) ([]Record, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	records := []Record{}
+	err := l.scan(func(lineNumber int, record Record, err error) bool {
+		if err == nil && filter.matches(record) {
+			records = append(records, record)
+		}
+		return true
+	})
+	return records, err
+}
+
+// Verify checks the hash chain of the log file as stored on disk, so edits made to the file
+// after it was opened are detected as well.
+//
+// Returns:
+//   - Verification: The outcome, with the sequence of the first record not matching its hash or predecessor.
+func (l *Log) Verify() Verification {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	file, err := os.Open(l.path)
+	if err != nil {
+		return Verification{Error: err.Error()}
+	}
+	defer file.Close()
+
+	verification := Verification{Valid: true}
+	previousHash := ""
+	var previousSequence int64
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), maxRecordBytes)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var record Record
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return Verification{Records: verification.Records, BrokenAt: previousSequence + 1, Error: fmt.Sprintf("corrupt record: %v", err)}
+		}
+		verification.Records++
+		hash, err := record.computeHash()
+		switch {
+		case err != nil:
+			return Verification{Records: verification.Records, BrokenAt: record.Sequence, Error: err.Error()}
+		case record.Sequence != previousSequence+1:
+			return Verification{Records: verification.Records, BrokenAt: previousSequence + 1, Error: fmt.Sprintf("expected record %d, but found record %d", previousSequence+1, record.Sequence)}
+		case record.PreviousHash != previousHash:
+			return Verification{Records: verification.Records, BrokenAt: record.Sequence, Error: "record does not chain to the record before it"}
+		case record.Hash != hash:
+			return Verification{Records: verification.Records, BrokenAt: record.Sequence, Error: "record does not match its hash"}
+		}
+		previousHash = record.Hash
+		previousSequence = record.Sequence
+	}
+	if err := scanner.Err(); err != nil {
+		return Verification{Records: verification.Records, Error: err.Error()}
+	}
+	return verification
+}
+
+// repairTail drops a partial record at the end of the log file, written by a process that stopped
+// before finishing the line. A complete record missing only its line end gets it back.
+func repairTail(file *os.File) error {
+	info, err := file.Stat()
+	if err != nil || info.Size() == 0 {
+		return err
+	}
+
+	// records are written with their line end in a single write, so only the last line can be partial
+	reader := bufio.NewReader(io.NewSectionReader(file, 0, info.Size()))
+	var lastLineStart, offset int64
+	var line []byte
+	for {
+		line, err = reader.ReadBytes('\n')
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		offset += int64(len(line))
+		lastLineStart = offset
+	}
+	if len(line) == 0 {
+		return nil
+	}
+
+	var record Record
+	if json.Unmarshal(line, &record) == nil {
+		_, err = file.Write([]byte{'\n'})
+		return err
+	}
+	helpers.Log.Warn("audit log ends in a partial record, dropping it", "path", file.Name(), "offset", lastLineStart, "bytes", len(line))
+	return file.Truncate(lastLineStart)
+}
+
+// scan reads the records of the log file in order, passing each to visit with its line number,
+// or the error decoding it, until visit returns false.
+func (l *Log) scan(visit func(lineNumber int, record Record, err error) bool) error {
+	file, err := os.Open(l.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), maxRecordBytes)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var record Record
+		err := json.Unmarshal(scanner.Bytes(), &record)
+		if !visit(lineNumber, record, err) {
+			if err != nil {
+				return fmt.Errorf("corrupt audit record on line %d: %v", lineNumber, err)
+			}
+			return nil
+		}
+	}
+	return scanner.Err()
+}
+
+// Close closes the log file.
+func (l *Log) Close() error {
+	return l.file.Close()
+}
+
+// computeHash returns the SHA-256 hash of the record without its own hash, which covers the hash of its predecessor.
+func (r Record) computeHash() (string, error) {
+	r.Hash = ""
+	content, err := json.Marshal(r)
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.Sum256(content)
+	return hex.EncodeToString(hash[:]), nil
+}
+
+// matches checks if a record is selected by the filter.
+func (f Filter) matches(record Record) bool {
+	if f.Kind != "" && record.Kind != f.Kind {
+		return false
+	}
+	if f.LicensePlate != "" && !strings.EqualFold(record.LicensePlate, f.LicensePlate) {
+		return false
+	}
+	if !f.From.IsZero() && record.At.Before(f.From) {
+		return false
+	}
+	if !f.To.IsZero() && !record.At.Before(f.To) {
+		return false
+	}
+	if f.City == "" {
+		return true
+	}
+	for _, city := range record.Cities {
+		if strings.EqualFold(city, f.City) {
+			return true
+		}
+	}
+	return false
+}
+
+// InputHash returns the SHA-256 hash of the JSON encoding of a calculation input.
+func InputHash(input interface{}) string {
+	content, err := json.Marshal(input)
+	if err != nil {
+		return ""
+	}
+	hash := sha256.Sum256(content)
+	return hex.EncodeToString(hash[:])
+}
+
+// Changes returns the top-level fields of two JSON objects that differ, sorted by name.
+func Changes(before json.RawMessage, after json.RawMessage) []string {
+	var beforeFields, afterFields map[string]json.RawMessage
+	json.Unmarshal(before, &beforeFields)
+	json.Unmarshal(after, &afterFields)
+
+	changes := []string{}
+	for name, value := range afterFields {
+		if previous, exists := beforeFields[name]; !exists || !jsonEqual(previous, value) {
+			changes = append(changes, name)
+		}
+	}
+	for name := range beforeFields {
+		if _, exists := afterFields[name]; !exists {
+			changes = append(changes, name)
+		}
+	}
+	sort.Strings(changes)
+	return changes
+}
+
+// jsonEqual checks if two JSON values are equal regardless of their formatting.
+func jsonEqual(a json.RawMessage, b json.RawMessage) bool {
+	var decodedA, decodedB interface{}
+	json.Unmarshal(a, &decodedA)
+	json.Unmarshal(b, &decodedB)
+	encodedA, _ := json.Marshal(decodedA)
+	encodedB, _ := json.Marshal(decodedB)
+	return string(encodedA) == string(encodedB)
+}
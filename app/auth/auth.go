@@ -0,0 +1,282 @@
+// Package auth provides authentication of API callers by API key or HMAC-signed bearer token,
+// and the roles granting access to the routes of the server.
+package auth
+
+import (
+	"congestion-calculator-manager/app/helpers"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Roles granted to callers.
+const (
+	// RoleCalculator allows calculating taxes and ingesting passages.
+	RoleCalculator = "calculator"
+	// RoleAdmin allows everything, including invoicing and editing the rules of every city.
+	RoleAdmin = "admin"
+	// cityEditorPrefix prefixes the roles allowing to edit the rules of a single city.
+	cityEditorPrefix = "city-editor:"
+)
+
+// Environment variables configuring authentication.
+const (
+	// JWTSecretEnv holds the shared secret bearer tokens are signed with.
+	JWTSecretEnv = "CONGESTION_JWT_SECRET"
+	// DisabledEnv turns authentication off when set to true, for local development only.
+	DisabledEnv = "CONGESTION_AUTH_DISABLED"
+)
+
+// APIKeyHeader is the header carrying an API key.
+const APIKeyHeader = "X-API-Key"
+
+// Errors returned when a caller cannot be authenticated.
+var (
+	ErrNoCredentials  = errors.New("no credentials provided")
+	ErrInvalidAPIKey  = errors.New("invalid API key")
+	ErrInvalidToken   = errors.New("invalid bearer token")
+	ErrExpiredToken   = errors.New("bearer token expired")
+	ErrTokenNotActive = errors.New("bearer token not valid yet")
+)
+
+// CityEditorRole returns the role allowing to edit the rules of the given city.
+func CityEditorRole(city string) string {
+	return cityEditorPrefix + strings.ToLower(city)
+}
+
+// Principal represents an authenticated caller.
+type Principal struct {
+	Subject string   `json:"subject"`
+	Roles   []string `json:"roles"`
+}
+
+// HasRole checks if the caller was granted the role; admins have every role.
+func (p Principal) HasRole(role string) bool {
+	for _, granted := range p.Roles {
+		if granted == RoleAdmin || strings.EqualFold(granted, role) {
+			return true
+		}
+	}
+	return false
+}
+
+// CanEditCity checks if the caller may change the rules of the given city.
+func (p Principal) CanEditCity(city string) bool {
+	return p.HasRole(CityEditorRole(city))
+}
+
+// APIKey represents an API key as stored in the data store. Only the SHA-256 hash of the key is stored.
+type APIKey struct {
+	Name      string   `json:"name"`
+	KeySHA256 string   `json:"key_sha256"`
+	Roles     []string `json:"roles"`
+}
+
+// Authenticator verifies API keys and bearer tokens.
+type Authenticator struct {
+	mu        sync.RWMutex
+	keys      map[string]APIKey // keyed by the hash of the key
+	jwtSecret []byte
+	disabled  bool
+}
+
+// NewAuthenticator creates an authenticator accepting the given API keys and tokens signed with the secret.
+//
+// Parameters:
+//   - keys: The accepted API keys.
+//   - jwtSecret: The shared secret of bearer tokens, or nil to reject all bearer tokens.
+//
+// Returns:
+//   - *Authenticator: A pointer to the newly created Authenticator instance.
+func NewAuthenticator(keys []APIKey, jwtSecret []byte) *Authenticator {
+	a := &Authenticator{keys: make(map[string]APIKey), jwtSecret: jwtSecret}
+	for _, key := range keys {
+		a.keys[strings.ToLower(key.KeySHA256)] = key
+	}
+	return a
+}
+
+// LoadAuthenticator creates an authenticator with the API keys of auth/keys.json in the data store
+// and the token secret of CONGESTION_JWT_SECRET. If CONGESTION_AUTH_DISABLED is true every caller is
+// treated as an admin. The key file holds APIKey entries with the SHA-256 of every key, see HashKey;
+// no keys are shipped with the data store, operators add their own as described in the README.
+//
+// Returns:
+//   - *Authenticator: The authenticator; it rejects every API key if the key file could not be read.
+//   - error: An error if the key file could not be read or decoded.
+func LoadAuthenticator() (*Authenticator, error) {
+	var secret []byte
+	if value := os.Getenv(JWTSecretEnv); value != "" {
+		secret = []byte(value)
+	}
+
+	var keys []APIKey
+	content, err := helpers.ReadContentFromDataFile("auth", "keys")
+	if err == nil {
+		err = json.Unmarshal([]byte(content), &keys)
+	}
+
+	authenticator := NewAuthenticator(keys, secret)
+	authenticator.disabled = strings.EqualFold(os.Getenv(DisabledEnv), "true")
+	return authenticator, err
+}
+
+// Disabled checks if authentication is turned off.
+func (a *Authenticator) Disabled() bool {
+	return a.disabled
+}
+
+// HashKey returns the hex SHA-256 hash under which an API key is stored.
+func HashKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// Authenticate identifies the caller of a request by the X-API-Key header or an
+// "Authorization: Bearer" token.
+//
+// Parameters:
+//   - r: The request to authenticate.
+//
+// Returns:
+//   - Principal: The authenticated caller.
+//   - error: ErrNoCredentials if the request carries none, or the reason the credentials were rejected.
+func (a *Authenticator) Authenticate(r *http.Request) (Principal, error) {
+	if a.disabled {
+		return Principal{Subject: "anonymous", Roles: []string{RoleAdmin}}, nil
+	}
+
+	if key := r.Header.Get(APIKeyHeader); key != "" {
+		a.mu.RLock()
+		apiKey, exists := a.keys[HashKey(key)]
+		a.mu.RUnlock()
+		if !exists {
+			return Principal{}, ErrInvalidAPIKey
+		}
+		return Principal{Subject: apiKey.Name, Roles: apiKey.Roles}, nil
+	}
+
+	authorization := r.Header.Get("Authorization")
+	if len(authorization) > len("Bearer ") && strings.EqualFold(authorization[:len("Bearer ")], "Bearer ") {
+		return a.VerifyToken(strings.TrimSpace(authorization[len("Bearer "):]), time.Now())
+	}
+	return Principal{}, ErrNoCredentials
+}
+
+// tokenHeader represents the header of a bearer token.
+type tokenHeader struct {
+	Algorithm string `json:"alg"`
+	Type      string `json:"typ"`
+}
+
+// Claims represents the claims of a bearer token.
+type Claims struct {
+	Subject   string   `json:"sub"`
+	Roles     []string `json:"roles"`
+	ExpiresAt int64    `json:"exp"`
+	NotBefore int64    `json:"nbf,omitempty"`
+	IssuedAt  int64    `json:"iat,omitempty"`
+}
+
+// VerifyToken verifies a JWT signed with HS256 and returns the caller it identifies.
+// Tokens must carry an expiry; tokens with any other algorithm are rejected.
+//
+// Parameters:
+//   - token: The compact serialized token.
+//   - now: The time the expiry is checked against.
+//
+// Returns:
+//   - Principal: The caller named by the sub claim, with the roles of the roles claim.
+//   - error: ErrInvalidToken, ErrExpiredToken or ErrTokenNotActive if the token is rejected.
+func (a *Authenticator) VerifyToken(token string, now time.Time) (Principal, error) {
+	if len(a.jwtSecret) == 0 {
+		return Principal{}, ErrInvalidToken
+	}
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return Principal{}, ErrInvalidToken
+	}
+
+	var header tokenHeader
+	if err := decodeSegment(parts[0], &header); err != nil || header.Algorithm != "HS256" {
+		return Principal{}, ErrInvalidToken
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || !hmac.Equal(signature, sign(a.jwtSecret, parts[0]+"."+parts[1])) {
+		return Principal{}, ErrInvalidToken
+	}
+
+	var claims Claims
+	if err := decodeSegment(parts[1], &claims); err != nil || claims.Subject == "" || claims.ExpiresAt == 0 {
+		return Principal{}, ErrInvalidToken
+	}
+	if now.Unix() >= claims.ExpiresAt {
+		return Principal{}, ErrExpiredToken
+	}
+	if claims.NotBefore != 0 && now.Unix() < claims.NotBefore {
+		return Principal{}, ErrTokenNotActive
+	}
+	return Principal{Subject: claims.Subject, Roles: claims.Roles}, nil
+}
+
+// SignToken creates an HS256 JWT with the given claims, for issuing tokens to callers and in tests.
+//
+// Parameters:
+//   - secret: The shared secret.
+//   - claims: The claims of the token.
+//
+// Returns:
+//   - string: The compact serialized token.
+//   - error: An error if the claims could not be encoded.
+func SignToken(secret []byte, claims Claims) (string, error) {
+	header, err := json.Marshal(tokenHeader{Algorithm: "HS256", Type: "JWT"})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(sign(secret, signingInput)), nil
+}
+
+// sign returns the HMAC-SHA256 of the signing input.
+func sign(secret []byte, signingInput string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(signingInput))
+	return mac.Sum(nil)
+}
+
+// decodeSegment decodes a base64url encoded JSON segment of a token.
+func decodeSegment(segment string, v interface{}) error {
+	content, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return fmt.Errorf("invalid token segment: %v", err)
+	}
+	return json.Unmarshal(content, v)
+}
+
+// principalKey is the context key of the authenticated caller.
+type principalKey struct{}
+
+// ContextWithPrincipal returns a copy of the context carrying the authenticated caller.
+func ContextWithPrincipal(ctx context.Context, principal Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, principal)
+}
+
+// PrincipalFromContext returns the authenticated caller carried by the context.
+func PrincipalFromContext(ctx context.Context) (Principal, bool) {
+	principal, exists := ctx.Value(principalKey{}).(Principal)
+	return principal, exists
+}
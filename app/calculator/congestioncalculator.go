@@ -2,9 +2,14 @@
 package calculator
 
 import (
+	"congestion-calculator-manager/app/exemptions"
+	"congestion-calculator-manager/app/helpers"
 	taxrules "congestion-calculator-manager/app/tax_rules"
 	"congestion-calculator-manager/app/vehicles"
+	"context"
+	"fmt"
 	"sort"
+	"strings"
 	"time"
 )
 
@@ -28,38 +33,179 @@ func GetTax(vehicle vehicles.Vehicle, dates []time.Time, isCustom bool, taxRule
 		return dates[i].Before(dates[j])
 	})
 
-	intervalStart := dates[0]
-	totalFee := 0
-	highestFee := 0
-
-	for _, date := range dates {
-		var nextFee int
-		if isCustom {
-			nextFee = getTollCustomFee(date, vehicle, taxRule)
-		} else {
-			nextFee = getTollFee(date, vehicle)
+	fees := make([]int, len(dates))
+	for i, date := range dates {
+		fees[i] = getDatesFee(date, vehicle, isCustom, taxRule)
+	}
+
+	return applySingleChargeRule(dates, fees, datesMaxFee)
+}
+
+// GetDatesTax calculates the toll fee of the dates of a single-city request the way the /Gothenburg and
+// /City endpoints always have, with the exemptions of the vehicle applied to every passage. Unlike trips,
+// the single charge rule runs over all dates and their total is capped at 60, custom rules included, and
+// toll-free vehicle types are only exempt in the default city.
+//
+// Parameters:
+//   - ctx: The context of the calculation, carrying the logger of the request.
+//   - vehicle: The vehicle for which to calculate the toll fee.
+//   - city: The city of the dates.
+//   - dates: The passage times.
+//   - taxRule: The tax rules of the city; ignored for the default city.
+//   - exemptionLookup: Exemptions of the vehicle, consulted for every passage (can be nil).
+//
+// Returns:
+//   - TripResult: Total fee, the fee of the city and the fee of every passage; days are not capped separately.
+func GetDatesTax(ctx context.Context, vehicle vehicles.Vehicle, city string, dates []time.Time, taxRule taxrules.TaxRule, exemptionLookup exemptions.Lookup) TripResult {
+	result := TripResult{Cities: []CityFee{}, Days: []DayFee{}, Passages: []PassageFee{}}
+	if len(dates) == 0 {
+		return result
+	}
+	logger := helpers.LoggerFromContext(ctx)
+	isCustom := !strings.EqualFold(city, taxrules.DefaultCity)
+
+	sorted := append([]time.Time{}, dates...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Before(sorted[j])
+	})
+
+	fees := make([]int, len(sorted))
+	for i, date := range sorted {
+		passageFee := PassageFee{City: city, Time: date, Fee: getDatesFee(date, vehicle, isCustom, taxRule)}
+		if passageFee.Fee == 0 {
+			logger.Debug("passage not charged", "city", city, "time", date,
+				"reason", tollFreeReason(date, !isCustom && IsTollFreeVehicle(vehicle), isCustom, taxRule))
 		}
+		passageFee.Exemption = applyExemption(logger, exemptionLookup, city, date, &passageFee.Fee)
+		fees[i] = passageFee.Fee
+		result.Passages = append(result.Passages, passageFee)
+	}
+
+	cityFee := CityFee{City: city, RuleVersion: taxrules.DefaultRuleVersion, TotalFee: applySingleChargeRule(sorted, fees, datesMaxFee)}
+	if isCustom {
+		cityFee.RuleVersion = taxRule.Version()
+	}
+	if cityFee.TotalFee == datesMaxFee {
+		logger.Debug("cap reached", "city", city, "cap", datesMaxFee)
+	}
+	result.TotalFee = cityFee.TotalFee
+	result.Cities = append(result.Cities, cityFee)
+	return result
+}
+
+// datesMaxFee is the cap of the total fee of a single-city request.
+const datesMaxFee = 60
 
-		diffInMinutes := date.Sub(intervalStart).Minutes()
+// getDatesFee computes the fee of a single passage of a single-city request. Custom rules do not exempt
+// toll-free vehicle types there.
+func getDatesFee(date time.Time, vehicle vehicles.Vehicle, isCustom bool, taxRule taxrules.TaxRule) int {
+	if isCustom {
+		return getTollCustomFee(date, taxRule)
+	}
+	return getTollFee(date, vehicle)
+}
+
+// getPassageFee computes the fee of a single passage of a trip using either the default or the custom tax rules.
+func getPassageFee(date time.Time, vehicle vehicles.Vehicle, isCustom bool, taxRule taxrules.TaxRule) int {
+	if isCustom {
+		if IsTollFreeVehicle(vehicle) {
+			return 0
+		}
+		return getTollCustomFee(date, taxRule)
+	}
+	return getTollFee(date, vehicle)
+}
+
+// tollFreeReason returns why a passage is not charged, for passages whose fee is zero.
+func tollFreeReason(date time.Time, tollFreeVehicle bool, isCustom bool, taxRule taxrules.TaxRule) string {
+	switch {
+	case tollFreeVehicle:
+		return "toll-free vehicle"
+	case IsTollFreeDate(date):
+		return "toll-free date"
+	case isCustom && IsToolFreeDateWithCustomRules(date, taxRule):
+		return "date excluded by the city rules"
+	default:
+		return "no tariff charged at this time"
+	}
+}
+
+// getMaxFee returns the daily cap of the applied tax rules of a trip.
+func getMaxFee(isCustom bool, taxRule taxrules.TaxRule) int {
+	if isCustom && taxRule.MaxTaxedFee > 0 {
+		return taxRule.MaxTaxedFee
+	}
+	return 60
+}
+
+// SingleChargeWindow is the length of the window within which only the highest fee is charged.
+const SingleChargeWindow = 60 * time.Minute
+
+// ChargeWindow represents a single charge window: the passages from its start until it closes
+// are charged once, with the highest of their fees.
+type ChargeWindow struct {
+	Start    time.Time `json:"start"`
+	ClosesAt time.Time `json:"closes_at"`
+	Passages int       `json:"passages"`
+	Fee      int       `json:"fee"`
+}
+
+// DailyCap returns the maximum fee charged within a day in a city.
+//
+// Parameters:
+//   - city: The city.
+//   - taxRule: The tax rules of the city; ignored for the default city.
+//
+// Returns:
+//   - int: The daily cap.
+func DailyCap(city string, taxRule taxrules.TaxRule) int {
+	return getMaxFee(!strings.EqualFold(city, taxrules.DefaultCity), taxRule)
+}
 
-		if diffInMinutes <= 60 {
-			if nextFee > highestFee {
-				highestFee = nextFee
+// ChargeWindows groups sorted passages into single charge windows. A window opens with the first
+// passage after the previous one closed.
+//
+// Parameters:
+//   - dates: Sorted passage times.
+//   - fees: Fee of every passage, in the same order as dates.
+//
+// Returns:
+//   - []ChargeWindow: The windows in chronological order, each with the highest fee of its passages.
+func ChargeWindows(dates []time.Time, fees []int) []ChargeWindow {
+	windows := []ChargeWindow{}
+	for i, date := range dates {
+		last := len(windows) - 1
+		if last >= 0 && !date.After(windows[last].ClosesAt) {
+			windows[last].Passages++
+			if fees[i] > windows[last].Fee {
+				windows[last].Fee = fees[i]
 			}
-		} else {
-			totalFee += highestFee
-			intervalStart = date
-			highestFee = nextFee
+			continue
 		}
+		windows = append(windows, ChargeWindow{Start: date, ClosesAt: date.Add(SingleChargeWindow), Passages: 1, Fee: fees[i]})
 	}
+	return windows
+}
 
-	// Add the last highest fee for the 60-minute window
-	// that should be covering both cases if last one is within or more then 60min
-	totalFee += highestFee
+// applySingleChargeRule sums the fees of sorted passages, charging only the highest fee
+// within every 60-minute window, and caps the total at maxFee.
+//
+// Parameters:
+//   - dates: Sorted passage times.
+//   - fees: Fee of every passage, in the same order as dates.
+//   - maxFee: The maximum total fee.
+//
+// Returns:
+//   - int: Total toll fee for the passages.
+func applySingleChargeRule(dates []time.Time, fees []int, maxFee int) int {
+	totalFee := 0
+	for _, window := range ChargeWindows(dates, fees) {
+		totalFee += window.Fee
+	}
 
-	// Ensure totalFee does not exceed 60
-	if totalFee > 60 {
-		totalFee = 60
+	// Ensure totalFee does not exceed the daily cap of the applied rules
+	if totalFee > maxFee {
+		totalFee = maxFee
 	}
 
 	return totalFee
@@ -92,63 +238,93 @@ func getTollFee(t time.Time, v vehicles.Vehicle) int {
 		return 0
 	}
 
-	hour, minute := t.Hour(), t.Minute()
-
-	if hour == 6 && minute >= 0 && minute <= 29 {
-		return 8
-	}
-	if hour == 6 && minute >= 30 && minute <= 59 {
-		return 13
-	}
-	if hour == 7 && minute >= 0 && minute <= 59 {
-		return 18
-	}
-	if hour == 8 && minute >= 0 && minute <= 29 {
-		return 13
-	}
-	if hour >= 8 && hour <= 14 && minute >= 30 && minute <= 59 {
-		return 8
-	}
-	if hour == 15 && minute >= 0 && minute <= 29 {
-		return 13
-	}
-	if hour == 15 && minute >= 0 || hour == 16 && minute <= 59 {
-		return 18
-	}
-	if hour == 17 && minute >= 0 && minute <= 59 {
-		return 13
+	band, found := findDefaultBand(t)
+	if !found {
+		return 0
 	}
-	if hour == 18 && minute >= 0 && minute <= 29 {
-		return 8
+	return band.Rate
+}
+
+// TariffBand represents a period of the day charged with the same rate.
+type TariffBand struct {
+	Start string `json:"start"`
+	End   string `json:"end"`
+	Rate  int    `json:"rate"`
+}
+
+// defaultTariff holds the built-in hours and amounts of the default city, in minutes since midnight.
+var defaultTariff = []struct {
+	startMinute int
+	endMinute   int
+	rate        int
+}{
+	{6 * 60, 6*60 + 29, 8},
+	{6*60 + 30, 6*60 + 59, 13},
+	{7 * 60, 7*60 + 59, 18},
+	{8 * 60, 8*60 + 29, 13},
+	{8*60 + 30, 8*60 + 59, 8},
+	{9*60 + 30, 9*60 + 59, 8},
+	{10*60 + 30, 10*60 + 59, 8},
+	{11*60 + 30, 11*60 + 59, 8},
+	{12*60 + 30, 12*60 + 59, 8},
+	{13*60 + 30, 13*60 + 59, 8},
+	{14*60 + 30, 14*60 + 59, 8},
+	{15 * 60, 15*60 + 29, 13},
+	{15*60 + 30, 16*60 + 59, 18},
+	{17 * 60, 17*60 + 59, 13},
+	{18 * 60, 18*60 + 29, 8},
+}
+
+// findDefaultBand returns the band of the built-in tariff the time falls into.
+func findDefaultBand(t time.Time) (TariffBand, bool) {
+	minute := t.Hour()*60 + t.Minute()
+	for _, band := range defaultTariff {
+		if minute >= band.startMinute && minute <= band.endMinute {
+			return TariffBand{
+				Start: fmt.Sprintf("%02d:%02d", band.startMinute/60, band.startMinute%60),
+				End:   fmt.Sprintf("%02d:%02d", band.endMinute/60, band.endMinute%60),
+				Rate:  band.rate,
+			}, true
+		}
 	}
+	return TariffBand{}, false
+}
 
-	return 0
+// FindCustomBand returns the band of the custom hourly prices the time falls into.
+func FindCustomBand(t time.Time, taxRules taxrules.TaxRule) (TariffBand, bool) {
+	hour := t.Hour()
+	for _, taxFeeRule := range taxRules.HourlyPrices {
+		if hour >= taxFeeRule.StartHour && hour <= taxFeeRule.EndHour {
+			return TariffBand{
+				Start: fmt.Sprintf("%02d:00", taxFeeRule.StartHour),
+				End:   fmt.Sprintf("%02d:59", taxFeeRule.EndHour),
+				Rate:  taxFeeRule.Rate,
+			}, true
+		}
+	}
+	return TariffBand{}, false
 }
 
 // getTollCustomFee computes the toll fee based on custom tax rules.
 //
 // Parameters:
 //   - t: The time for which to calculate the toll fee.
-//   - v: The vehicle for which to calculate the toll fee.
 //   - taxRules: The custom tax rules to apply.
 //
 // Returns:
-//   - int: The toll fee for the provided time, vehicle, and custom tax rules.
-func getTollCustomFee(t time.Time, v vehicles.Vehicle, taxRules taxrules.TaxRule) int {
+//   - int: The toll fee for the provided time and custom tax rules.
+func getTollCustomFee(t time.Time, taxRules taxrules.TaxRule) int {
 	if IsTollFreeDate(t) || IsToolFreeDateWithCustomRules(t, taxRules) {
 		return 0
 	}
-	hour := t.Hour()
 
 	//Here we could add minutes,seconds it is same logic
 	//this is just for demonstration
-	for _, taxFeeRule := range taxRules.HourlyPrices {
-		if hour >= taxFeeRule.StartHour && hour <= taxFeeRule.EndHour {
-			return taxFeeRule.Rate
-		}
+	band, found := FindCustomBand(t, taxRules)
+	if !found {
+		return 0
 	}
-
-	return 0
+	return band.Rate
 }
 
 // isTollFreeDate checks if a given date is toll-free based on predefined conditions.
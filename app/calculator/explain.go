@@ -0,0 +1,160 @@
+package calculator
+
+import (
+	"congestion-calculator-manager/app/exemptions"
+	taxrules "congestion-calculator-manager/app/tax_rules"
+	"congestion-calculator-manager/app/vehicles"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Check represents a single condition evaluated while calculating the fee of a passage.
+type Check struct {
+	Name    string `json:"name"`
+	Applies bool   `json:"applies"`
+	Detail  string `json:"detail"`
+}
+
+// Explanation represents how the fee of a single passage was calculated.
+// Fees are those of the passage alone, before the single charge rule and the daily cap.
+type Explanation struct {
+	City        string                `json:"city"`
+	VehicleType string                `json:"vehicle_type"`
+	Time        time.Time             `json:"time"`
+	RuleVersion string                `json:"rule_version"`
+	Checks      []Check               `json:"checks"`
+	Band        *TariffBand           `json:"band,omitempty"`
+	Fee         int                   `json:"fee"`
+	Exemption   *exemptions.Exemption `json:"exemption,omitempty"`
+	FinalFee    int                   `json:"final_fee"`
+}
+
+// ExplainPassage evaluates the fee of a single passage step by step, the same way GetTripTax does.
+//
+// Parameters:
+//   - vehicle: The vehicle passing.
+//   - city: The city of the passage.
+//   - t: The time of the passage.
+//   - cityRules: Custom tax rules keyed by city name; the default city does not need an entry.
+//   - exemptionLookup: Exemptions of the vehicle (can be nil).
+//
+// Returns:
+//   - Explanation: Every check evaluated, the matched tariff band and the resulting fee.
+//   - error: An error if the city has no tax rules.
+func ExplainPassage(vehicle vehicles.Vehicle, city string, t time.Time, cityRules map[string]taxrules.TaxRule, exemptionLookup exemptions.Lookup) (Explanation, error) {
+	isCustom := !strings.EqualFold(city, taxrules.DefaultCity)
+	taxRule, exists := cityRules[city]
+	if isCustom && !exists {
+		return Explanation{}, fmt.Errorf("no tax rules found for city %s", city)
+	}
+
+	explanation := Explanation{
+		City:        city,
+		VehicleType: vehicle.GetVehicleType(),
+		Time:        t,
+		RuleVersion: taxrules.DefaultRuleVersion,
+	}
+
+	isWeekend := t.Weekday() == time.Saturday || t.Weekday() == time.Sunday
+	explanation.Checks = append(explanation.Checks,
+		Check{Name: "weekend", Applies: isWeekend, Detail: t.Weekday().String()},
+		Check{Name: "public holiday", Applies: IsTollFreeDate(t) && !isWeekend, Detail: "public holidays, days before them and July 2013"},
+	)
+
+	if isCustom {
+		explanation.RuleVersion = taxRule.Version()
+		weekendDetail := "weekends are not taxed"
+		if taxRule.TaxOnWeekend {
+			weekendDetail = "Saturdays are taxed, Sundays are not"
+		}
+		explanation.Checks = append(explanation.Checks,
+			Check{
+				Name:    "city weekend rule",
+				Applies: !taxRule.TaxOnWeekend && t.Weekday() == time.Saturday || t.Weekday() == time.Sunday,
+				Detail:  weekendDetail,
+			},
+			Check{Name: "excluded month", Applies: containsInt(taxRule.ExcludedMonths, int(t.Month())), Detail: fmt.Sprintf("excluded months %v", taxRule.ExcludedMonths)},
+			Check{Name: "excluded day", Applies: containsInt(taxRule.ExcludedDays, t.Day()), Detail: fmt.Sprintf("excluded days of month %v", taxRule.ExcludedDays)},
+			Check{Name: "excluded date", Applies: isExcludedDate(t, taxRule.ExcludedDates), Detail: fmt.Sprintf("%d excluded dates", len(taxRule.ExcludedDates))},
+		)
+	}
+
+	explanation.Checks = append(explanation.Checks,
+		Check{Name: "tax excluded vehicle", Applies: IsTollFreeVehicle(vehicle), Detail: fmt.Sprintf("vehicle type %s", vehicle.GetVehicleType())},
+	)
+
+	var band TariffBand
+	var found bool
+	if isCustom {
+		band, found = FindCustomBand(t, taxRule)
+	} else {
+		band, found = findDefaultBand(t)
+	}
+	if found {
+		explanation.Band = &band
+	}
+
+	explanation.Fee = getPassageFee(t, vehicle, isCustom, taxRule)
+	explanation.FinalFee = explanation.Fee
+	if exemptionLookup != nil {
+		exemption, exempt := exemptionLookup(city, t)
+		detail := "no exemption valid for this city and time"
+		if exempt {
+			explanation.Exemption = &exemption
+			explanation.FinalFee = exemption.Apply(explanation.Fee)
+			detail = fmt.Sprintf("%s, %d%% discount", exemption.Reason, exemption.DiscountPercentage)
+		}
+		explanation.Checks = append(explanation.Checks, Check{Name: "exemption", Applies: exempt, Detail: detail})
+	}
+
+	return explanation, nil
+}
+
+// Text returns the explanation in plain language.
+func (e Explanation) Text() string {
+	var builder strings.Builder
+	fmt.Fprintf(&builder, "Passage of a %s in %s at %s (%s).\n", e.VehicleType, e.City, e.Time.Format("2006-01-02 15:04"), e.Time.Weekday())
+	fmt.Fprintf(&builder, "Tax rules version %s were applied.\n", e.RuleVersion)
+
+	for _, check := range e.Checks {
+		outcome := "does not apply"
+		if check.Applies {
+			outcome = "applies"
+		}
+		fmt.Fprintf(&builder, "- %s: %s (%s)\n", check.Name, outcome, check.Detail)
+	}
+
+	if e.Band != nil {
+		fmt.Fprintf(&builder, "The passage falls into the tariff band %s-%s of %d SEK.\n", e.Band.Start, e.Band.End, e.Band.Rate)
+	} else {
+		fmt.Fprintf(&builder, "The passage falls outside of every tariff band.\n")
+	}
+	if e.Exemption != nil && e.FinalFee != e.Fee {
+		fmt.Fprintf(&builder, "The fee of %d SEK is reduced to %d SEK by the exemption.\n", e.Fee, e.FinalFee)
+	} else {
+		fmt.Fprintf(&builder, "The fee of the passage is %d SEK.\n", e.FinalFee)
+	}
+	fmt.Fprintf(&builder, "Other passages within 60 minutes and the daily cap may lower the amount charged.\n")
+	return builder.String()
+}
+
+// containsInt checks if the value is one of the values.
+func containsInt(values []int, value int) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// isExcludedDate checks if the time falls on one of the excluded dates.
+func isExcludedDate(t time.Time, excludedDates []time.Time) bool {
+	for _, excluded := range excludedDates {
+		if excluded.Year() == t.Year() && excluded.Month() == t.Month() && excluded.Day() == t.Day() {
+			return true
+		}
+	}
+	return false
+}
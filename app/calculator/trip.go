@@ -0,0 +1,170 @@
+package calculator
+
+import (
+	"congestion-calculator-manager/app/exemptions"
+	"congestion-calculator-manager/app/helpers"
+	taxrules "congestion-calculator-manager/app/tax_rules"
+	"congestion-calculator-manager/app/vehicles"
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Passage represents a single pass through a toll station of a specific city.
+type Passage struct {
+	City    string    `json:"city"`
+	Station string    `json:"station"`
+	Time    time.Time `json:"time"`
+}
+
+// PassageFee represents the fee of a single passage before the single charge rule and daily cap,
+// together with the exemption applied to it, if any.
+type PassageFee struct {
+	City      string                `json:"city"`
+	Time      time.Time             `json:"time"`
+	Fee       int                   `json:"fee"`
+	Exemption *exemptions.Exemption `json:"exemption,omitempty"`
+}
+
+// CityFee represents the fee charged within a single city of a trip.
+type CityFee struct {
+	City        string `json:"city"`
+	RuleVersion string `json:"rule_version"`
+	TotalFee    int    `json:"total_fee"`
+}
+
+// DayFee represents the fee charged within a single city on a single day, after the daily cap.
+type DayFee struct {
+	City     string `json:"city"`
+	Date     string `json:"date"`
+	Passages int    `json:"passages"`
+	TotalFee int    `json:"total_fee"`
+}
+
+// TripResult represents the result of a calculation over passages in several cities.
+type TripResult struct {
+	TotalFee int          `json:"total_fee"`
+	Cities   []CityFee    `json:"cities"`
+	Days     []DayFee     `json:"days"`
+	Passages []PassageFee `json:"passages"`
+}
+
+// GetTripTax calculates the toll fee for passages that may belong to different cities.
+// Passages are partitioned by city and day, so that every city applies its own tax rule,
+// daily cap and single charge window independently of the others. Passages not charged,
+// exemptions applied and daily caps reached are logged at debug level with the logger of the context.
+//
+// Parameters:
+//   - ctx: The context of the calculation, carrying the logger of the request.
+//   - vehicle: The vehicle for which to calculate the toll fee.
+//   - passages: Passages with the city already resolved.
+//   - cityRules: Custom tax rules keyed by city name; the default city does not need an entry.
+//   - exemptionLookup: Exemptions of the vehicle, consulted for every passage (can be nil).
+//
+// Returns:
+//   - TripResult: Total fee, per-city and per-day subtotals ordered by city name and the fee of every passage.
+//   - error: An error if a passage belongs to a city without tax rules.
+func GetTripTax(ctx context.Context, vehicle vehicles.Vehicle, passages []Passage, cityRules map[string]taxrules.TaxRule, exemptionLookup exemptions.Lookup) (TripResult, error) {
+	result := TripResult{Cities: []CityFee{}, Days: []DayFee{}, Passages: []PassageFee{}}
+	logger := helpers.LoggerFromContext(ctx)
+
+	// city -> day -> dates
+	datesByCity := make(map[string]map[string][]time.Time)
+	for _, passage := range passages {
+		if passage.City == "" {
+			return result, fmt.Errorf("passage at %v has no city", passage.Time)
+		}
+		city := passage.City
+		if datesByCity[city] == nil {
+			datesByCity[city] = make(map[string][]time.Time)
+		}
+		day := passage.Time.Format("2006-01-02")
+		datesByCity[city][day] = append(datesByCity[city][day], passage.Time)
+	}
+
+	for _, city := range sortedKeys(datesByCity) {
+		isCustom := !strings.EqualFold(city, taxrules.DefaultCity)
+		taxRule, exists := cityRules[city]
+		if isCustom && !exists {
+			return result, fmt.Errorf("no tax rules found for city %s", city)
+		}
+
+		cityFee := CityFee{City: city, RuleVersion: taxrules.DefaultRuleVersion}
+		if isCustom {
+			cityFee.RuleVersion = taxRule.Version()
+		}
+		for _, day := range sortedDays(datesByCity[city]) {
+			dates := datesByCity[city][day]
+			sort.Slice(dates, func(i, j int) bool {
+				return dates[i].Before(dates[j])
+			})
+
+			fees := make([]int, len(dates))
+			for i, date := range dates {
+				passageFee := PassageFee{City: city, Time: date, Fee: getPassageFee(date, vehicle, isCustom, taxRule)}
+				if passageFee.Fee == 0 {
+					logger.Debug("passage not charged", "city", city, "time", date, "reason", tollFreeReason(date, IsTollFreeVehicle(vehicle), isCustom, taxRule))
+				}
+				passageFee.Exemption = applyExemption(logger, exemptionLookup, city, date, &passageFee.Fee)
+				fees[i] = passageFee.Fee
+				result.Passages = append(result.Passages, passageFee)
+			}
+			maxFee := getMaxFee(isCustom, taxRule)
+			dayFee := DayFee{
+				City:     city,
+				Date:     day,
+				Passages: len(dates),
+				TotalFee: applySingleChargeRule(dates, fees, maxFee),
+			}
+			if dayFee.TotalFee == maxFee {
+				logger.Debug("daily cap reached", "city", city, "date", day, "daily_cap", maxFee)
+			}
+			cityFee.TotalFee += dayFee.TotalFee
+			result.Days = append(result.Days, dayFee)
+		}
+		result.TotalFee += cityFee.TotalFee
+		result.Cities = append(result.Cities, cityFee)
+	}
+
+	return result, nil
+}
+
+// applyExemption applies the exemption of a passage, if any, to its fee.
+//
+// Returns:
+//   - *exemptions.Exemption: The exemption applied, nil if the passage is not exempt.
+func applyExemption(logger *helpers.Logger, exemptionLookup exemptions.Lookup, city string, date time.Time, fee *int) *exemptions.Exemption {
+	if exemptionLookup == nil {
+		return nil
+	}
+	exemption, exempt := exemptionLookup(city, date)
+	if !exempt {
+		return nil
+	}
+	logger.Debug("exemption applied", "city", city, "time", date, "reason", exemption.Reason,
+		"discount_percentage", exemption.DiscountPercentage, "fee", *fee)
+	*fee = exemption.Apply(*fee)
+	return &exemption
+}
+
+// sortedKeys returns the cities of the partitioned passages in alphabetical order.
+func sortedKeys(datesByCity map[string]map[string][]time.Time) []string {
+	cities := make([]string, 0, len(datesByCity))
+	for city := range datesByCity {
+		cities = append(cities, city)
+	}
+	sort.Strings(cities)
+	return cities
+}
+
+// sortedDays returns the days of a city's passages in chronological order.
+func sortedDays(datesByDay map[string][]time.Time) []string {
+	days := make([]string, 0, len(datesByDay))
+	for day := range datesByDay {
+		days = append(days, day)
+	}
+	sort.Strings(days)
+	return days
+}
@@ -0,0 +1,155 @@
+// Package cli provides the command line interface of the congestion calculator,
+// answering questions about calculations without running the server.
+package cli
+
+import (
+	"congestion-calculator-manager/app/calculator"
+	"congestion-calculator-manager/app/server"
+	taxrules "congestion-calculator-manager/app/tax_rules"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"time"
+)
+
+// usage describes the available subcommands.
+const usage = `usage: congestion-cli <command> [flags]
+
+commands:
+  explain   explain the fee of a single passage
+  diff      compare two versions of tax rules, or the rules of a city with a draft
+`
+
+// Run executes the subcommand given in args and writes its output to stdout and errors to stderr.
+//
+// Parameters:
+//   - args: The command line arguments without the program name.
+//   - stdout: The writer for the output of the command.
+//   - stderr: The writer for usage and error messages.
+//
+// Returns:
+//   - int: The exit code of the command.
+func Run(args []string, stdout io.Writer, stderr io.Writer) int {
+	if len(args) == 0 {
+		fmt.Fprint(stderr, usage)
+		return 2
+	}
+
+	switch args[0] {
+	case "explain":
+		return explain(args[1:], stdout, stderr)
+	case "diff":
+		return diff(args[1:], stdout, stderr)
+	default:
+		fmt.Fprintf(stderr, "unknown command %s\n%s", args[0], usage)
+		return 2
+	}
+}
+
+// explain explains the fee of a single passage as plain text or JSON.
+func explain(args []string, stdout io.Writer, stderr io.Writer) int {
+	flags := flag.NewFlagSet("explain", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	city := flags.String("city", "", "city of the passage")
+	station := flags.String("station", "", "station of the passage, used when no city is given")
+	plate := flags.String("plate", "", "license plate of the vehicle")
+	vehicleType := flags.String("type", "", "type of the vehicle")
+	timestamp := flags.String("time", "", "time of the passage in RFC 3339 format")
+	asJSON := flags.Bool("json", false, "print the explanation as JSON")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	t, err := time.Parse(time.RFC3339, *timestamp)
+	if err != nil {
+		fmt.Fprintln(stderr, "invalid time:", err)
+		return 2
+	}
+
+	server.LoadCalculationData()
+	explanation, err := server.ExplainPassage(context.Background(), calculator.Passage{City: *city, Station: *station, Time: t}, *plate, *vehicleType)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+
+	if *asJSON {
+		encoder := json.NewEncoder(stdout)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(explanation)
+		return 0
+	}
+	fmt.Fprint(stdout, explanation.Text())
+	return 0
+}
+
+// diff compares two versions of tax rules as plain text or JSON. The rules are read from city files or
+// files holding only the rules; with -city, the current rules of the city are compared with -after.
+func diff(args []string, stdout io.Writer, stderr io.Writer) int {
+	flags := flag.NewFlagSet("diff", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	city := flags.String("city", "", "city whose current rules are compared, used when no -before file is given")
+	beforePath := flags.String("before", "", "file of the rules before the change")
+	afterPath := flags.String("after", "", "file of the rules after the change")
+	asJSON := flags.Bool("json", false, "print the changes as JSON")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if *afterPath == "" || (*beforePath == "") == (*city == "") {
+		fmt.Fprintln(stderr, "expected -after and either -before or -city")
+		return 2
+	}
+
+	after, err := readRules(*afterPath)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	var ruleDiff taxrules.RuleDiff
+	if *beforePath != "" {
+		before, err := readRules(*beforePath)
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return 1
+		}
+		ruleDiff = taxrules.Diff(before, after)
+	} else {
+		ruleDiff, err = server.DiffCityRules(context.Background(), *city, after)
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return 1
+		}
+	}
+
+	if *asJSON {
+		encoder := json.NewEncoder(stdout)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(ruleDiff)
+		return 0
+	}
+	fmt.Fprint(stdout, ruleDiff.Text())
+	return 0
+}
+
+// readRules reads tax rules from a city file, or from a file holding only the rules.
+func readRules(path string) (taxrules.TaxRule, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return taxrules.TaxRule{}, err
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(content, &fields); err != nil {
+		return taxrules.TaxRule{}, fmt.Errorf("%s is not valid JSON: %v", path, err)
+	}
+	if rules, isCityFile := fields["tax_rules"]; isCityFile {
+		content = rules
+	}
+	var taxRule taxrules.TaxRule
+	if err := json.Unmarshal(content, &taxRule); err != nil {
+		return taxrules.TaxRule{}, fmt.Errorf("%s does not hold tax rules: %v", path, err)
+	}
+	return taxRule, nil
+}
@@ -9,14 +9,18 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"os"
 	"time"
 )
 
+// APIKeyEnv is the environment variable holding the API key sent with every request.
+const APIKeyEnv = "CONGESTION_API_KEY"
+
 // RequestData represents the structure for congestion tax calculation request data.
 type RequestData struct {
-	Type         string
-	LicensePlate string
-	Dates        []time.Time
+	Type         string      `json:"type"`
+	LicensePlate string      `json:"licenseplate"`
+	Dates        []time.Time `json:"dates"`
 }
 
 // StartClient initializes and sends sample HTTP requests to the congestion tax calculation server.
@@ -36,7 +40,12 @@ func StartClient() {
 
 // SendGetRequest sends a GET request to the congestion tax calculation server for a specific city.
 func SendGetRequest(cityName string) {
-	resp, err := http.Get("http://localhost:8080/City?name=" + cityName)
+	req, err := http.NewRequest(http.MethodGet, "http://localhost:8080/City?name="+cityName, nil)
+	if err != nil {
+		fmt.Println("Error creating request:", err)
+		return
+	}
+	resp, err := send(req)
 	if err != nil {
 		fmt.Println("GET request failed:", err)
 		return
@@ -61,7 +70,13 @@ func SendPostRequest(data RequestData) {
 		return
 	}
 
-	resp, err := http.Post(url, "application/json", bytes.NewBuffer(payload))
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewBuffer(payload))
+	if err != nil {
+		fmt.Println("Error creating request:", err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := send(req)
 	if err != nil {
 		fmt.Println("POST request failed:", err)
 		return
@@ -76,3 +91,11 @@ func SendPostRequest(data RequestData) {
 
 	fmt.Printf("POST response Status: %v; Body: %v", resp.Status, string(body))
 }
+
+// send sends a request with the API key of CONGESTION_API_KEY, if set.
+func send(req *http.Request) (*http.Response, error) {
+	if key := os.Getenv(APIKeyEnv); key != "" {
+		req.Header.Set("X-API-Key", key)
+	}
+	return http.DefaultClient.Do(req)
+}
@@ -0,0 +1,261 @@
+// Package dailytotals maintains the running daily total of every vehicle as passages are ingested,
+// so the amount owed for a day is known without recalculating the ledger.
+package dailytotals
+
+import (
+	"congestion-calculator-manager/app/calculator"
+	"congestion-calculator-manager/app/ledger"
+	"congestion-calculator-manager/app/plates"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DateLayout is the layout of the dates totals are kept by.
+const DateLayout = "2006-01-02"
+
+// Calculate calculates the passages of a single vehicle, with registration and exemptions applied.
+type Calculate func(licensePlate string, vehicleType string, passages []calculator.Passage) (calculator.TripResult, error)
+
+// key identifies the passages of a vehicle in a city on a day.
+type key struct {
+	licensePlate string
+	city         string
+	date         string
+}
+
+// Total represents the running total of a vehicle in a city on a day.
+type Total struct {
+	LicensePlate string    `json:"licenseplate"`
+	City         string    `json:"city"`
+	Date         string    `json:"date"`
+	VehicleType  string    `json:"type,omitempty"`
+	Passages     int       `json:"passages"`
+	TotalFee     int       `json:"total_fee"`
+	UpdatedAt    time.Time `json:"updated_at"`
+}
+
+// Status represents the charges of a vehicle in a city on a day as of a point in time: the charge windows
+// so far, the window still open, if any, and how much can still be charged before the daily cap.
+type Status struct {
+	LicensePlate       string                    `json:"licenseplate"`
+	City               string                    `json:"city"`
+	Date               string                    `json:"date"`
+	AsOf               time.Time                 `json:"as_of"`
+	Passages           int                       `json:"passages"`
+	ChargedWindows     []calculator.ChargeWindow `json:"charged_windows"`
+	OpenWindow         *calculator.ChargeWindow  `json:"open_window"`
+	TotalFee           int                       `json:"total_fee"`
+	DailyCap           int                       `json:"daily_cap"`
+	RemainingBeforeCap int                       `json:"remaining_before_cap"`
+}
+
+// day holds the passages of a vehicle in a city on a day and the result of their last calculation.
+type day struct {
+	total    Total
+	passages []calculator.Passage
+	result   calculator.TripResult
+}
+
+// Update is called with the total of a vehicle before and after a recorded passage.
+type Update func(previous Total, current Total)
+
+// Tracker holds the running totals of the last days.
+type Tracker struct {
+	mu         sync.Mutex
+	days       map[key]*day
+	calculate  Calculate
+	onUpdate   Update
+	retainDays int
+	recorded   int
+}
+
+// NewTracker creates a tracker.
+//
+// Parameters:
+//   - calculate: The function calculating the passages of a vehicle.
+//   - retainDays: The number of days, today included, whose totals are kept.
+//   - onUpdate: Called after every recorded passage, outside of the tracker's lock; can be nil.
+//
+// Returns:
+//   - *Tracker: A pointer to the newly created Tracker instance.
+func NewTracker(calculate Calculate, retainDays int, onUpdate Update) *Tracker {
+	return &Tracker{days: make(map[key]*day), calculate: calculate, onUpdate: onUpdate, retainDays: retainDays}
+}
+
+// dayOf returns the key of a ledger entry. Days are taken in the location of the passage time,
+// the same way the calculator groups passages into days.
+func dayOf(entry ledger.Entry) key {
+	return key{licensePlate: plates.Normalize(entry.LicensePlate), city: entry.City, date: entry.Time.Format(DateLayout)}
+}
+
+// Record adds a passage recorded in the ledger to the total of its vehicle and day and recalculates the total.
+//
+// Parameters:
+//   - entry: The passage; its city must be resolved.
+//   - now: The time of ingestion.
+//
+// Returns:
+//   - Total: The total after the passage.
+//   - error: An error if the passages could not be calculated; the passage is kept and the previous total reported.
+func (t *Tracker) Record(entry ledger.Entry, now time.Time) (Total, error) {
+	previous, current, err := t.record(entry, now)
+	if err == nil && t.onUpdate != nil {
+		t.onUpdate(previous, current)
+	}
+	return current, err
+}
+
+// record adds a passage under the lock of the tracker and returns the total before and after it.
+func (t *Tracker) record(entry ledger.Entry, now time.Time) (Total, Total, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.recorded++
+	if t.recorded%1024 == 0 {
+		t.prune(now)
+	}
+
+	k := dayOf(entry)
+	d, exists := t.days[k]
+	if !exists {
+		d = &day{total: Total{LicensePlate: k.licensePlate, City: k.city, Date: k.date}}
+		t.days[k] = d
+	}
+	previous := d.total
+	if entry.VehicleType != "" {
+		d.total.VehicleType = entry.VehicleType
+	}
+	d.passages = append(d.passages, calculator.Passage{City: entry.City, Station: entry.Station, Time: entry.Time})
+	d.total.Passages = len(d.passages)
+	d.total.UpdatedAt = now.UTC()
+
+	result, err := t.calculate(d.total.LicensePlate, d.total.VehicleType, append([]calculator.Passage{}, d.passages...))
+	if err != nil {
+		return previous, d.total, err
+	}
+	d.result = result
+	d.total.TotalFee = result.TotalFee
+	return previous, d.total, nil
+}
+
+// Rebuild replaces the totals with those of the given passages, for example the recent passages
+// of the ledger on startup.
+//
+// Returns:
+//   - error: The first error of a calculation; the totals of the other vehicles are rebuilt regardless.
+func (t *Tracker) Rebuild(entries []ledger.Entry, now time.Time) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.days = make(map[key]*day)
+	for _, entry := range entries {
+		k := dayOf(entry)
+		d, exists := t.days[k]
+		if !exists {
+			d = &day{total: Total{LicensePlate: k.licensePlate, City: k.city, Date: k.date}}
+			t.days[k] = d
+		}
+		if entry.VehicleType != "" {
+			d.total.VehicleType = entry.VehicleType
+		}
+		d.passages = append(d.passages, calculator.Passage{City: entry.City, Station: entry.Station, Time: entry.Time})
+	}
+	t.prune(now)
+
+	var firstErr error
+	for _, d := range t.days {
+		d.total.Passages = len(d.passages)
+		d.total.UpdatedAt = now.UTC()
+		result, err := t.calculate(d.total.LicensePlate, d.total.VehicleType, append([]calculator.Passage{}, d.passages...))
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		d.result = result
+		d.total.TotalFee = result.TotalFee
+	}
+	return firstErr
+}
+
+// ForVehicle returns the totals of a vehicle on a day in every city, ordered by city.
+func (t *Tracker) ForVehicle(licensePlate string, date string) []Total {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	totals := []Total{}
+	plate := plates.Normalize(licensePlate)
+	for k, d := range t.days {
+		if k.licensePlate == plate && k.date == date {
+			totals = append(totals, d.total)
+		}
+	}
+	sort.Slice(totals, func(i, j int) bool { return totals[i].City < totals[j].City })
+	return totals
+}
+
+// Status returns the charges of a vehicle in a city on the day of the given time. Passages after that time
+// are left out, so the status can also be taken at an earlier moment of the day.
+//
+// Parameters:
+//   - licensePlate: The license plate.
+//   - city: The city, as resolved when the passages were recorded.
+//   - at: The point in time; its date selects the day.
+//   - dailyCap: The daily cap of the city.
+//
+// Returns:
+//   - Status: The status; without passages recorded the total is 0 and the whole cap remains.
+func (t *Tracker) Status(licensePlate string, city string, at time.Time, dailyCap int) Status {
+	status := Status{
+		LicensePlate:   plates.Normalize(licensePlate),
+		City:           city,
+		Date:           at.Format(DateLayout),
+		AsOf:           at,
+		ChargedWindows: []calculator.ChargeWindow{},
+		DailyCap:       dailyCap,
+	}
+
+	t.mu.Lock()
+	d, exists := t.days[key{licensePlate: status.LicensePlate, city: city, date: status.Date}]
+	var fees []calculator.PassageFee
+	if exists {
+		fees = append(fees, d.result.Passages...)
+	}
+	t.mu.Unlock()
+
+	var dates []time.Time
+	var amounts []int
+	for _, fee := range fees {
+		if fee.Time.After(at) {
+			continue
+		}
+		dates = append(dates, fee.Time)
+		amounts = append(amounts, fee.Fee)
+	}
+	status.Passages = len(dates)
+	status.ChargedWindows = calculator.ChargeWindows(dates, amounts)
+
+	for _, window := range status.ChargedWindows {
+		status.TotalFee += window.Fee
+	}
+	if status.TotalFee > dailyCap {
+		status.TotalFee = dailyCap
+	}
+	status.RemainingBeforeCap = dailyCap - status.TotalFee
+	if last := len(status.ChargedWindows) - 1; last >= 0 && !at.After(status.ChargedWindows[last].ClosesAt) {
+		status.OpenWindow = &status.ChargedWindows[last]
+	}
+	return status
+}
+
+// prune removes the days before the retained ones.
+func (t *Tracker) prune(now time.Time) {
+	oldest := now.AddDate(0, 0, 1-t.retainDays).Format(DateLayout)
+	for k := range t.days {
+		if k.date < oldest {
+			delete(t.days, k)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+// Package exemptions provides time-bounded, city-scoped and possibly partial exemptions from congestion tax.
+package exemptions
+
+import (
+	"congestion-calculator-manager/app/helpers"
+	"congestion-calculator-manager/app/plates"
+	"encoding/json"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Exemption represents an exemption granted to a single vehicle for a period of time.
+type Exemption struct {
+	LicensePlate       string    `json:"license_plate"`
+	Cities             []string  `json:"cities"`
+	Reason             string    `json:"reason"`
+	ValidFrom          time.Time `json:"valid_from"`
+	ValidTo            time.Time `json:"valid_to"`
+	DiscountPercentage int       `json:"discount_percentage"`
+}
+
+// Lookup returns the exemption of a single vehicle that applies to a passage in the given city at the given time.
+type Lookup func(city string, t time.Time) (Exemption, bool)
+
+// AppliesTo checks if the exemption covers a passage in the given city at the given time.
+// An exemption without cities covers all cities and a zero ValidTo means it does not expire.
+func (e Exemption) AppliesTo(city string, t time.Time) bool {
+	if t.Before(e.ValidFrom) || (!e.ValidTo.IsZero() && t.After(e.ValidTo)) {
+		return false
+	}
+	if len(e.Cities) == 0 {
+		return true
+	}
+	for _, exemptCity := range e.Cities {
+		if strings.EqualFold(exemptCity, city) {
+			return true
+		}
+	}
+	return false
+}
+
+// Apply returns the fee remaining after the exemption's discount has been applied.
+func (e Exemption) Apply(fee int) int {
+	discount := e.DiscountPercentage
+	if discount <= 0 {
+		return fee
+	}
+	if discount >= 100 {
+		return 0
+	}
+	return fee * (100 - discount) / 100
+}
+
+// Store represents an in-memory store of exemptions keyed by license plate.
+type Store struct {
+	data map[string][]Exemption // Exemptions keyed by normalized license plate
+	mu   sync.RWMutex           // Mutex for concurrent access
+}
+
+// NewStore creates a new, empty instance of the Store.
+func NewStore() *Store {
+	return &Store{
+		data: make(map[string][]Exemption),
+	}
+}
+
+// LoadStore creates a Store filled with the exemptions kept in "exemptions/exemptions.json" of the data store.
+//
+// Returns:
+//   - *Store: A pointer to the loaded Store instance.
+//   - error: An error if the file could not be read or decoded.
+func LoadStore() (*Store, error) {
+	store := NewStore()
+
+	jsonData, err := helpers.ReadContentFromDataFile("exemptions", "exemptions")
+	if err != nil {
+		return store, err
+	}
+
+	var exemptions []Exemption
+	err = json.Unmarshal([]byte(jsonData), &exemptions)
+	if err != nil {
+		return store, err
+	}
+
+	for _, exemption := range exemptions {
+		store.Add(exemption)
+	}
+	return store, nil
+}
+
+// Add stores a new exemption for the vehicle it was granted to.
+func (s *Store) Add(exemption Exemption) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	plate := plates.Normalize(exemption.LicensePlate)
+	s.data[plate] = append(s.data[plate], exemption)
+}
+
+// Find returns the exemption with the highest discount that covers the passage of a vehicle.
+//
+// Parameters:
+//   - licensePlate: The license plate of the vehicle.
+//   - city: The city of the passage.
+//   - t: The time of the passage.
+//
+// Returns:
+//   - Exemption: The applied exemption.
+//   - bool: A boolean indicating whether any exemption applies.
+func (s *Store) Find(licensePlate string, city string, t time.Time) (Exemption, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var found Exemption
+	exists := false
+	for _, exemption := range s.data[plates.Normalize(licensePlate)] {
+		if !exemption.AppliesTo(city, t) {
+			continue
+		}
+		if !exists || exemption.DiscountPercentage > found.DiscountPercentage {
+			found = exemption
+			exists = true
+		}
+	}
+	return found, exists
+}
+
+// ForVehicle returns a Lookup bound to the exemptions of a single vehicle.
+func (s *Store) ForVehicle(licensePlate string) Lookup {
+	return func(city string, t time.Time) (Exemption, bool) {
+		return s.Find(licensePlate, city, t)
+	}
+}
+
+// Expiring returns the exemptions that end within [from, to), ordered by their end.
+func (s *Store) Expiring(from time.Time, to time.Time) []Exemption {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	expiring := []Exemption{}
+	for _, exemptions := range s.data {
+		for _, exemption := range exemptions {
+			if !exemption.ValidTo.IsZero() && !exemption.ValidTo.Before(from) && exemption.ValidTo.Before(to) {
+				expiring = append(expiring, exemption)
+			}
+		}
+	}
+	sort.Slice(expiring, func(i, j int) bool { return expiring[i].ValidTo.Before(expiring[j].ValidTo) })
+	return expiring
+}
@@ -0,0 +1,473 @@
+// Package grpcapi holds the messages and method names of the congestion.v1.CongestionCalculator
+// gRPC service described in congestion.proto, with their protobuf encoding.
+package grpcapi
+
+import (
+	"congestion-calculator-manager/app/grpcwire"
+	"time"
+)
+
+// Service is the full name of the gRPC service.
+const Service = "congestion.v1.CongestionCalculator"
+
+// Paths of the methods of the service.
+const (
+	CalculateMethod       = "/" + Service + "/Calculate"
+	CalculateStreamMethod = "/" + Service + "/CalculateStream"
+	ExplainMethod         = "/" + Service + "/Explain"
+	ListCitiesMethod      = "/" + Service + "/ListCities"
+)
+
+// Passage represents a passage through a toll station.
+type Passage struct {
+	City    string
+	Station string
+	Time    time.Time
+}
+
+// Marshal encodes the message.
+func (m Passage) Marshal() []byte {
+	var e grpcwire.Encoder
+	e.String(1, m.City)
+	e.String(2, m.Station)
+	e.Timestamp(3, m.Time)
+	return e.Bytes()
+}
+
+// Unmarshal decodes the message.
+func (m *Passage) Unmarshal(data []byte) error {
+	return grpcwire.Decode(data, func(f grpcwire.Field) (err error) {
+		switch f.Number {
+		case 1:
+			m.City = f.String()
+		case 2:
+			m.Station = f.String()
+		case 3:
+			m.Time, err = f.Timestamp()
+		}
+		return err
+	})
+}
+
+// CalculateRequest represents a trip of a vehicle to calculate.
+type CalculateRequest struct {
+	LicensePlate string
+	VehicleType  string
+	Passages     []Passage
+}
+
+// Marshal encodes the message.
+func (m CalculateRequest) Marshal() []byte {
+	var e grpcwire.Encoder
+	e.String(1, m.LicensePlate)
+	e.String(2, m.VehicleType)
+	for _, passage := range m.Passages {
+		e.Message(3, passage.Marshal())
+	}
+	return e.Bytes()
+}
+
+// Unmarshal decodes the message.
+func (m *CalculateRequest) Unmarshal(data []byte) error {
+	return grpcwire.Decode(data, func(f grpcwire.Field) error {
+		switch f.Number {
+		case 1:
+			m.LicensePlate = f.String()
+		case 2:
+			m.VehicleType = f.String()
+		case 3:
+			var passage Passage
+			if err := passage.Unmarshal(f.Bytes); err != nil {
+				return err
+			}
+			m.Passages = append(m.Passages, passage)
+		}
+		return nil
+	})
+}
+
+// CityFee represents the fee charged in a single city.
+type CityFee struct {
+	City        string
+	RuleVersion string
+	TotalFee    int64
+}
+
+// Marshal encodes the message.
+func (m CityFee) Marshal() []byte {
+	var e grpcwire.Encoder
+	e.String(1, m.City)
+	e.String(2, m.RuleVersion)
+	e.Int64(3, m.TotalFee)
+	return e.Bytes()
+}
+
+// Unmarshal decodes the message.
+func (m *CityFee) Unmarshal(data []byte) error {
+	return grpcwire.Decode(data, func(f grpcwire.Field) error {
+		switch f.Number {
+		case 1:
+			m.City = f.String()
+		case 2:
+			m.RuleVersion = f.String()
+		case 3:
+			m.TotalFee = f.Int64()
+		}
+		return nil
+	})
+}
+
+// DayFee represents the fee charged for a single day in a single city.
+type DayFee struct {
+	City     string
+	Date     string
+	Passages int64
+	TotalFee int64
+}
+
+// Marshal encodes the message.
+func (m DayFee) Marshal() []byte {
+	var e grpcwire.Encoder
+	e.String(1, m.City)
+	e.String(2, m.Date)
+	e.Int64(3, m.Passages)
+	e.Int64(4, m.TotalFee)
+	return e.Bytes()
+}
+
+// Unmarshal decodes the message.
+func (m *DayFee) Unmarshal(data []byte) error {
+	return grpcwire.Decode(data, func(f grpcwire.Field) error {
+		switch f.Number {
+		case 1:
+			m.City = f.String()
+		case 2:
+			m.Date = f.String()
+		case 3:
+			m.Passages = f.Int64()
+		case 4:
+			m.TotalFee = f.Int64()
+		}
+		return nil
+	})
+}
+
+// PassageFee represents the fee charged for a single passage.
+type PassageFee struct {
+	City            string
+	Time            time.Time
+	Fee             int64
+	ExemptionReason string
+}
+
+// Marshal encodes the message.
+func (m PassageFee) Marshal() []byte {
+	var e grpcwire.Encoder
+	e.String(1, m.City)
+	e.Timestamp(2, m.Time)
+	e.Int64(3, m.Fee)
+	e.String(4, m.ExemptionReason)
+	return e.Bytes()
+}
+
+// Unmarshal decodes the message.
+func (m *PassageFee) Unmarshal(data []byte) error {
+	return grpcwire.Decode(data, func(f grpcwire.Field) (err error) {
+		switch f.Number {
+		case 1:
+			m.City = f.String()
+		case 2:
+			m.Time, err = f.Timestamp()
+		case 3:
+			m.Fee = f.Int64()
+		case 4:
+			m.ExemptionReason = f.String()
+		}
+		return err
+	})
+}
+
+// CalculateResponse represents the congestion tax of a trip.
+type CalculateResponse struct {
+	TotalFee int64
+	Cities   []CityFee
+	Days     []DayFee
+	Passages []PassageFee
+}
+
+// Marshal encodes the message.
+func (m CalculateResponse) Marshal() []byte {
+	var e grpcwire.Encoder
+	e.Int64(1, m.TotalFee)
+	for _, city := range m.Cities {
+		e.Message(2, city.Marshal())
+	}
+	for _, day := range m.Days {
+		e.Message(3, day.Marshal())
+	}
+	for _, passage := range m.Passages {
+		e.Message(4, passage.Marshal())
+	}
+	return e.Bytes()
+}
+
+// Unmarshal decodes the message.
+func (m *CalculateResponse) Unmarshal(data []byte) error {
+	return grpcwire.Decode(data, func(f grpcwire.Field) error {
+		switch f.Number {
+		case 1:
+			m.TotalFee = f.Int64()
+		case 2:
+			var city CityFee
+			if err := city.Unmarshal(f.Bytes); err != nil {
+				return err
+			}
+			m.Cities = append(m.Cities, city)
+		case 3:
+			var day DayFee
+			if err := day.Unmarshal(f.Bytes); err != nil {
+				return err
+			}
+			m.Days = append(m.Days, day)
+		case 4:
+			var passage PassageFee
+			if err := passage.Unmarshal(f.Bytes); err != nil {
+				return err
+			}
+			m.Passages = append(m.Passages, passage)
+		}
+		return nil
+	})
+}
+
+// StreamPassage represents a passage of a vehicle sent on a calculation stream.
+type StreamPassage struct {
+	LicensePlate string
+	VehicleType  string
+	Passage      Passage
+}
+
+// Marshal encodes the message.
+func (m StreamPassage) Marshal() []byte {
+	var e grpcwire.Encoder
+	e.String(1, m.LicensePlate)
+	e.String(2, m.VehicleType)
+	e.Message(3, m.Passage.Marshal())
+	return e.Bytes()
+}
+
+// Unmarshal decodes the message.
+func (m *StreamPassage) Unmarshal(data []byte) error {
+	return grpcwire.Decode(data, func(f grpcwire.Field) error {
+		switch f.Number {
+		case 1:
+			m.LicensePlate = f.String()
+		case 2:
+			m.VehicleType = f.String()
+		case 3:
+			return m.Passage.Unmarshal(f.Bytes)
+		}
+		return nil
+	})
+}
+
+// StreamResult represents the running total of a vehicle after a passage sent on a calculation stream.
+type StreamResult struct {
+	LicensePlate string
+	City         string
+	Time         time.Time
+	FeeAdded     int64
+	TotalFee     int64
+}
+
+// Marshal encodes the message.
+func (m StreamResult) Marshal() []byte {
+	var e grpcwire.Encoder
+	e.String(1, m.LicensePlate)
+	e.String(2, m.City)
+	e.Timestamp(3, m.Time)
+	e.Int64(4, m.FeeAdded)
+	e.Int64(5, m.TotalFee)
+	return e.Bytes()
+}
+
+// Unmarshal decodes the message.
+func (m *StreamResult) Unmarshal(data []byte) error {
+	return grpcwire.Decode(data, func(f grpcwire.Field) (err error) {
+		switch f.Number {
+		case 1:
+			m.LicensePlate = f.String()
+		case 2:
+			m.City = f.String()
+		case 3:
+			m.Time, err = f.Timestamp()
+		case 4:
+			m.FeeAdded = f.Int64()
+		case 5:
+			m.TotalFee = f.Int64()
+		}
+		return err
+	})
+}
+
+// ExplainRequest represents a passage whose fee is to be explained.
+type ExplainRequest struct {
+	LicensePlate string
+	VehicleType  string
+	Passage      Passage
+}
+
+// Marshal encodes the message.
+func (m ExplainRequest) Marshal() []byte {
+	return StreamPassage(m).Marshal()
+}
+
+// Unmarshal decodes the message.
+func (m *ExplainRequest) Unmarshal(data []byte) error {
+	return (*StreamPassage)(m).Unmarshal(data)
+}
+
+// Check represents a single check evaluated while explaining a fee.
+type Check struct {
+	Name    string
+	Applies bool
+	Detail  string
+}
+
+// Marshal encodes the message.
+func (m Check) Marshal() []byte {
+	var e grpcwire.Encoder
+	e.String(1, m.Name)
+	e.Bool(2, m.Applies)
+	e.String(3, m.Detail)
+	return e.Bytes()
+}
+
+// Unmarshal decodes the message.
+func (m *Check) Unmarshal(data []byte) error {
+	return grpcwire.Decode(data, func(f grpcwire.Field) error {
+		switch f.Number {
+		case 1:
+			m.Name = f.String()
+		case 2:
+			m.Applies = f.Varint != 0
+		case 3:
+			m.Detail = f.String()
+		}
+		return nil
+	})
+}
+
+// ExplainResponse represents the explanation of the fee of a passage.
+type ExplainResponse struct {
+	City        string
+	VehicleType string
+	RuleVersion string
+	Checks      []Check
+	Fee         int64
+	FinalFee    int64
+	Text        string
+}
+
+// Marshal encodes the message.
+func (m ExplainResponse) Marshal() []byte {
+	var e grpcwire.Encoder
+	e.String(1, m.City)
+	e.String(2, m.VehicleType)
+	e.String(3, m.RuleVersion)
+	for _, check := range m.Checks {
+		e.Message(4, check.Marshal())
+	}
+	e.Int64(5, m.Fee)
+	e.Int64(6, m.FinalFee)
+	e.String(7, m.Text)
+	return e.Bytes()
+}
+
+// Unmarshal decodes the message.
+func (m *ExplainResponse) Unmarshal(data []byte) error {
+	return grpcwire.Decode(data, func(f grpcwire.Field) error {
+		switch f.Number {
+		case 1:
+			m.City = f.String()
+		case 2:
+			m.VehicleType = f.String()
+		case 3:
+			m.RuleVersion = f.String()
+		case 4:
+			var check Check
+			if err := check.Unmarshal(f.Bytes); err != nil {
+				return err
+			}
+			m.Checks = append(m.Checks, check)
+		case 5:
+			m.Fee = f.Int64()
+		case 6:
+			m.FinalFee = f.Int64()
+		case 7:
+			m.Text = f.String()
+		}
+		return nil
+	})
+}
+
+// City represents a city with tax rules.
+type City struct {
+	Name        string
+	RuleVersion string
+	Stations    []string
+}
+
+// Marshal encodes the message.
+func (m City) Marshal() []byte {
+	var e grpcwire.Encoder
+	e.String(1, m.Name)
+	e.String(2, m.RuleVersion)
+	for _, station := range m.Stations {
+		e.String(3, station)
+	}
+	return e.Bytes()
+}
+
+// Unmarshal decodes the message.
+func (m *City) Unmarshal(data []byte) error {
+	return grpcwire.Decode(data, func(f grpcwire.Field) error {
+		switch f.Number {
+		case 1:
+			m.Name = f.String()
+		case 2:
+			m.RuleVersion = f.String()
+		case 3:
+			m.Stations = append(m.Stations, f.String())
+		}
+		return nil
+	})
+}
+
+// ListCitiesResponse represents the cities with tax rules; ListCitiesRequest has no fields.
+type ListCitiesResponse struct {
+	Cities []City
+}
+
+// Marshal encodes the message.
+func (m ListCitiesResponse) Marshal() []byte {
+	var e grpcwire.Encoder
+	for _, city := range m.Cities {
+		e.Message(1, city.Marshal())
+	}
+	return e.Bytes()
+}
+
+// Unmarshal decodes the message.
+func (m *ListCitiesResponse) Unmarshal(data []byte) error {
+	return grpcwire.Decode(data, func(f grpcwire.Field) error {
+		if f.Number == 1 {
+			var city City
+			if err := city.Unmarshal(f.Bytes); err != nil {
+				return err
+			}
+			m.Cities = append(m.Cities, city)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,311 @@
+// Package grpcwire implements the parts of the gRPC protocol the server needs on top of the HTTP/2
+// support of net/http: the protobuf wire format, length-prefixed message framing and status codes.
+package grpcwire
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// ContentType is the content type of gRPC requests and responses with protobuf messages.
+const ContentType = "application/grpc"
+
+// DefaultMaxMessageSize is the size above which messages are rejected when no maximum is given,
+// matching the default of gRPC servers.
+const DefaultMaxMessageSize = 4 << 20
+
+// Code represents a gRPC status code.
+type Code int
+
+// Status codes used by the server.
+const (
+	OK                Code = 0
+	InvalidArgument   Code = 3
+	NotFound          Code = 5
+	PermissionDenied  Code = 7
+	ResourceExhausted Code = 8
+	Unimplemented     Code = 12
+	Internal          Code = 13
+	Unavailable       Code = 14
+	Unauthenticated   Code = 16
+)
+
+// Status represents a failed call; it is sent to the caller in the grpc-status and grpc-message trailers.
+type Status struct {
+	Code    Code
+	Message string
+}
+
+// Error returns the message of the status.
+func (s *Status) Error() string {
+	return fmt.Sprintf("rpc error: code = %d desc = %s", s.Code, s.Message)
+}
+
+// Errorf creates a status with a formatted message.
+func Errorf(code Code, format string, args ...interface{}) *Status {
+	return &Status{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+// StatusOf returns the status of an error; errors that are not a *Status are internal errors.
+func StatusOf(err error) *Status {
+	if err == nil {
+		return &Status{Code: OK}
+	}
+	var status *Status
+	if errors.As(err, &status) {
+		return status
+	}
+	return &Status{Code: Internal, Message: err.Error()}
+}
+
+// WriteStatus writes the status of a call as trailers. The response must have been started with StartResponse.
+func WriteStatus(w http.ResponseWriter, err error) {
+	status := StatusOf(err)
+	w.Header().Set(http.TrailerPrefix+"Grpc-Status", strconv.Itoa(int(status.Code)))
+	if status.Message != "" {
+		w.Header().Set(http.TrailerPrefix+"Grpc-Message", encodeMessage(status.Message))
+	}
+}
+
+// StartResponse writes the headers of a gRPC response.
+func StartResponse(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", ContentType)
+	w.WriteHeader(http.StatusOK)
+	if flusher, ok := w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// encodeMessage percent-encodes a status message as required for the grpc-message trailer.
+func encodeMessage(message string) string {
+	encoded := make([]byte, 0, len(message))
+	for i := 0; i < len(message); i++ {
+		c := message[i]
+		if c < 0x20 || c > 0x7e || c == '%' {
+			encoded = append(encoded, fmt.Sprintf("%%%02X", c)...)
+			continue
+		}
+		encoded = append(encoded, c)
+	}
+	return string(encoded)
+}
+
+// ReadMessage reads a length-prefixed message.
+//
+// Parameters:
+//   - r: The request or response body.
+//   - maxSize: The size above which messages are rejected with ResourceExhausted; DefaultMaxMessageSize
+//     applies if it is 0.
+//
+// Returns:
+//   - []byte: The message.
+//   - error: io.EOF at the end of the stream, or a *Status for compressed or oversized messages.
+func ReadMessage(r io.Reader, maxSize int64) ([]byte, error) {
+	var prefix [5]byte
+	if _, err := io.ReadFull(r, prefix[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, Errorf(InvalidArgument, "truncated message prefix")
+		}
+		return nil, err
+	}
+	if prefix[0] != 0 {
+		return nil, Errorf(Unimplemented, "compressed messages are not supported")
+	}
+	if maxSize <= 0 {
+		maxSize = DefaultMaxMessageSize
+	}
+	size := int64(binary.BigEndian.Uint32(prefix[1:]))
+	if size > maxSize {
+		return nil, Errorf(ResourceExhausted, "message of %d bytes exceeds %d bytes", size, maxSize)
+	}
+	message := make([]byte, size)
+	if _, err := io.ReadFull(r, message); err != nil {
+		return nil, Errorf(InvalidArgument, "truncated message")
+	}
+	return message, nil
+}
+
+// WriteMessage writes a length-prefixed uncompressed message and flushes it to the caller.
+func WriteMessage(w io.Writer, message []byte) error {
+	var prefix [5]byte
+	binary.BigEndian.PutUint32(prefix[1:], uint32(len(message)))
+	if _, err := w.Write(prefix[:]); err != nil {
+		return err
+	}
+	if _, err := w.Write(message); err != nil {
+		return err
+	}
+	if flusher, ok := w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+	return nil
+}
+
+// Wire types of the protobuf encoding.
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+// Encoder builds a protobuf message. Fields with default values are omitted, as in proto3.
+type Encoder struct {
+	buffer []byte
+}
+
+// Bytes returns the encoded message.
+func (e *Encoder) Bytes() []byte {
+	return e.buffer
+}
+
+// tag appends the key of a field.
+func (e *Encoder) tag(field int, wireType int) {
+	e.buffer = appendUvarint(e.buffer, uint64(field)<<3|uint64(wireType))
+}
+
+// appendUvarint appends the varint encoding of a value.
+func appendUvarint(buffer []byte, value uint64) []byte {
+	var encoded [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(encoded[:], value)
+	return append(buffer, encoded[:n]...)
+}
+
+// Int64 appends an int64 or int32 field.
+func (e *Encoder) Int64(field int, value int64) {
+	if value == 0 {
+		return
+	}
+	e.tag(field, wireVarint)
+	e.buffer = appendUvarint(e.buffer, uint64(value))
+}
+
+// Bool appends a bool field.
+func (e *Encoder) Bool(field int, value bool) {
+	if value {
+		e.Int64(field, 1)
+	}
+}
+
+// String appends a string field.
+func (e *Encoder) String(field int, value string) {
+	if value == "" {
+		return
+	}
+	e.tag(field, wireBytes)
+	e.buffer = appendUvarint(e.buffer, uint64(len(value)))
+	e.buffer = append(e.buffer, value...)
+}
+
+// Message appends an embedded message field, which is encoded even if empty.
+func (e *Encoder) Message(field int, message []byte) {
+	e.tag(field, wireBytes)
+	e.buffer = appendUvarint(e.buffer, uint64(len(message)))
+	e.buffer = append(e.buffer, message...)
+}
+
+// Timestamp appends a google.protobuf.Timestamp field; the zero time is omitted.
+func (e *Encoder) Timestamp(field int, t time.Time) {
+	if t.IsZero() {
+		return
+	}
+	var timestamp Encoder
+	timestamp.Int64(1, t.Unix())
+	timestamp.Int64(2, int64(t.Nanosecond()))
+	e.Message(field, timestamp.Bytes())
+}
+
+// Field represents a decoded field of a message. Varint holds the value of varint fields
+// and Bytes the content of length-delimited fields.
+type Field struct {
+	Number int
+	Varint uint64
+	Bytes  []byte
+}
+
+// Int64 returns the value of an int64 or int32 field.
+func (f Field) Int64() int64 {
+	return int64(f.Varint)
+}
+
+// String returns the value of a string field.
+func (f Field) String() string {
+	return string(f.Bytes)
+}
+
+// Timestamp returns the value of a google.protobuf.Timestamp field in UTC.
+func (f Field) Timestamp() (time.Time, error) {
+	var seconds, nanos int64
+	err := Decode(f.Bytes, func(field Field) error {
+		switch field.Number {
+		case 1:
+			seconds = field.Int64()
+		case 2:
+			nanos = field.Int64()
+		}
+		return nil
+	})
+	if err != nil || nanos < 0 || nanos >= int64(time.Second) {
+		return time.Time{}, Errorf(InvalidArgument, "invalid timestamp")
+	}
+	return time.Unix(seconds, nanos).UTC(), nil
+}
+
+// Decode calls fn for every field of a message in order. Fixed-size fields are skipped,
+// as none of the server's messages use them.
+//
+// Parameters:
+//   - message: The encoded message.
+//   - fn: The function receiving the fields; decoding stops at its first error.
+//
+// Returns:
+//   - error: An InvalidArgument *Status if the message is malformed, or the error of fn.
+func Decode(message []byte, fn func(field Field) error) error {
+	for len(message) > 0 {
+		key, n := binary.Uvarint(message)
+		if n <= 0 || key>>3 == 0 || key>>3 > math.MaxInt32 {
+			return Errorf(InvalidArgument, "malformed message")
+		}
+		message = message[n:]
+		field := Field{Number: int(key >> 3)}
+
+		switch key & 7 {
+		case wireVarint:
+			field.Varint, n = binary.Uvarint(message)
+			if n <= 0 {
+				return Errorf(InvalidArgument, "malformed varint of field %d", field.Number)
+			}
+			message = message[n:]
+		case wireBytes:
+			size, n := binary.Uvarint(message)
+			if n <= 0 || size > uint64(len(message)-n) {
+				return Errorf(InvalidArgument, "malformed length of field %d", field.Number)
+			}
+			field.Bytes = message[n : n+int(size)]
+			message = message[n+int(size):]
+		case wireFixed64, wireFixed32:
+			size := 8
+			if key&7 == wireFixed32 {
+				size = 4
+			}
+			if len(message) < size {
+				return Errorf(InvalidArgument, "truncated field %d", field.Number)
+			}
+			message = message[size:]
+			continue
+		default:
+			return Errorf(InvalidArgument, "unsupported wire type of field %d", field.Number)
+		}
+
+		if err := fn(field); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -4,12 +4,22 @@ package helpers
 
 import (
 	"sync"
+	"sync/atomic"
 )
 
 // Cache represents a simple in-memory cache for storing serialized JSON objects.
 type Cache struct {
-	data map[string]string // Internal data store for the cache
-	mu   sync.RWMutex      // Mutex for concurrent access
+	hits   uint64            // Number of lookups that found their key, first for 64-bit atomic alignment
+	misses uint64            // Number of lookups that did not find their key
+	data   map[string]string // Internal data store for the cache
+	mu     sync.RWMutex      // Mutex for concurrent access
+}
+
+// CacheStats represents the usage of a cache since it was created.
+type CacheStats struct {
+	Hits    uint64 `json:"hits"`
+	Misses  uint64 `json:"misses"`
+	Entries int    `json:"entries"`
 }
 
 // NewCache creates a new instance of the Cache.
@@ -49,5 +59,34 @@ func (c *Cache) Get(key string) (string, bool) {
 	c.mu.RLock()
 	defer c.mu.RUnlock()
 	data, exists := c.data[key]
+	if exists {
+		atomic.AddUint64(&c.hits, 1)
+	} else {
+		atomic.AddUint64(&c.misses, 1)
+	}
 	return data, exists
 }
+
+// Delete removes the serialized JSON object stored under the provided key, if any.
+//
+// Parameters:
+//   - key: The key associated with the serialized JSON object.
+func (c *Cache) Delete(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.data, key)
+}
+
+// Stats returns the number of hits and misses of all lookups so far and the number of stored entries.
+//
+// Returns:
+//   - CacheStats: The usage of the cache.
+func (c *Cache) Stats() CacheStats {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return CacheStats{
+		Hits:    atomic.LoadUint64(&c.hits),
+		Misses:  atomic.LoadUint64(&c.misses),
+		Entries: len(c.data),
+	}
+}
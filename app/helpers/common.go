@@ -11,6 +11,28 @@ import (
 	"time"
 )
 
+// DataDirectoryEnv is the environment variable that can point the application to a different data store location.
+const DataDirectoryEnv = "CONGESTION_DATA_DIR"
+
+// DataDirectory returns the root directory of the data store.
+// It is taken from the CONGESTION_DATA_DIR environment variable and falls back to the working directory.
+//
+// Returns:
+//   - string: path of the data store root
+//   - err: An error if the working directory could not be determined.
+func DataDirectory() (string, error) {
+	if dir := os.Getenv(DataDirectoryEnv); dir != "" {
+		return dir, nil
+	}
+
+	wd, err := os.Getwd()
+	if err != nil {
+		Log.Error("working directory not available", "error", err)
+		return "", err
+	}
+	return wd, nil
+}
+
 // ReadCityDataFromFile reads city tax data from a JSON file located in the "cities" directory.
 //
 // Parameters:
@@ -20,26 +42,128 @@ import (
 //   - string: content of json file read from this
 //   - err: An error if any occurs during the file reading process.
 func ReadContentFromJsonFile(cityName string) (string, error) {
+	return ReadContentFromDataFile("cities", cityName)
+}
 
-	wd, err := os.Getwd()
+// ReadContentFromDataFile reads a JSON file from the given folder of the data store.
+//
+// Parameters:
+//   - folder: The folder of the data store, e.g. "cities" or "registry".
+//   - name: The name of the file without extension.
+//
+// Returns:
+//   - string: content of json file read from this
+//   - err: An error if any occurs during the file reading process.
+func ReadContentFromDataFile(folder string, name string) (string, error) {
+	dir, err := DataDirectory()
 	if err != nil {
-		fmt.Println("Error getting working directory:", err)
 		return "", err
 	}
 
-	// Construct the file path for the specified city
-	filePath := filepath.Join(wd, "cities", fmt.Sprintf("%s.json", strings.ToLower(cityName)))
+	// Construct the file path for the specified name
+	filePath := filepath.Join(dir, folder, fmt.Sprintf("%s.json", strings.ToLower(name)))
 
 	// Read the JSON file
 	fileContent, err := ioutil.ReadFile(filePath)
 	if err != nil {
-		fmt.Println("data for specified city does not exist on disk", err)
+		Log.Debug("data file not found", "folder", folder, "name", name, "error", err)
 		return "", err
 	}
 
 	return string(fileContent), nil
 }
 
+// WriteContentToDataFile replaces a JSON file in the given folder of the data store.
+// The content is written to a temporary file first and renamed, so readers never see a partial file.
+//
+// Parameters:
+//   - folder: The folder of the data store, e.g. "cities".
+//   - name: The name of the file without extension.
+//   - content: The new content of the file.
+//
+// Returns:
+//   - err: An error if the file could not be written.
+func WriteContentToDataFile(folder string, name string, content string) error {
+	dir, err := DataDirectory()
+	if err != nil {
+		return err
+	}
+
+	folderPath := filepath.Join(dir, folder)
+	if err := os.MkdirAll(folderPath, 0755); err != nil {
+		return err
+	}
+	temporary, err := ioutil.TempFile(folderPath, ".write-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temporary.Name())
+
+	if _, err := temporary.WriteString(content); err != nil {
+		temporary.Close()
+		return err
+	}
+	if err := temporary.Sync(); err != nil {
+		temporary.Close()
+		return err
+	}
+	if err := temporary.Close(); err != nil {
+		return err
+	}
+	return os.Rename(temporary.Name(), filepath.Join(folderPath, fmt.Sprintf("%s.json", strings.ToLower(name))))
+}
+
+// DataFileModTime returns the time a JSON file in the given folder of the data store was last modified.
+//
+// Parameters:
+//   - folder: The folder of the data store, e.g. "cities".
+//   - name: The name of the file without extension.
+//
+// Returns:
+//   - time.Time: modification time of the file
+//   - err: An error if the file does not exist or cannot be accessed.
+func DataFileModTime(folder string, name string) (time.Time, error) {
+	dir, err := DataDirectory()
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	info, err := os.Stat(filepath.Join(dir, folder, fmt.Sprintf("%s.json", strings.ToLower(name))))
+	if err != nil {
+		return time.Time{}, err
+	}
+	return info.ModTime(), nil
+}
+
+// ListJsonFiles returns the names, without extension, of all JSON files in the given folder of the data store.
+//
+// Parameters:
+//   - folder: The folder of the data store, e.g. "cities".
+//
+// Returns:
+//   - []string: names of the files on disk
+//   - err: An error if the directory could not be read.
+func ListJsonFiles(folder string) ([]string, error) {
+	dir, err := DataDirectory()
+	if err != nil {
+		return nil, err
+	}
+
+	files, err := ioutil.ReadDir(filepath.Join(dir, folder))
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, file := range files {
+		if file.IsDir() || filepath.Ext(file.Name()) != ".json" {
+			continue
+		}
+		names = append(names, strings.TrimSuffix(file.Name(), ".json"))
+	}
+	return names, nil
+}
+
 // generateRandomDate generates a random time within the specified year.
 // It takes the year as an input parameter and returns a random time.Time within that year.
 //
@@ -0,0 +1,185 @@
+package helpers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LogLevelEnv is the environment variable that sets the minimum level of logged messages.
+const LogLevelEnv = "CONGESTION_LOG_LEVEL"
+
+// Level represents the severity of a log message.
+type Level int
+
+// Levels of log messages, from the most verbose.
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+// String returns the name of the level as written to the log.
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "debug"
+	case LevelInfo:
+		return "info"
+	case LevelWarn:
+		return "warn"
+	default:
+		return "error"
+	}
+}
+
+// ParseLevel returns the level with the given name.
+//
+// Parameters:
+//   - name: The name of the level: debug, info, warn or error.
+//
+// Returns:
+//   - Level: The level with the given name.
+//   - err: An error if the name is not a known level.
+func ParseLevel(name string) (Level, error) {
+	for level := LevelDebug; level <= LevelError; level++ {
+		if strings.EqualFold(name, level.String()) {
+			return level, nil
+		}
+	}
+	return LevelInfo, fmt.Errorf("unknown log level %s", name)
+}
+
+// Logger writes leveled log messages as JSON lines, each with the key-value fields attached to the logger.
+type Logger struct {
+	out    io.Writer
+	level  Level
+	fields []interface{}
+	mu     *sync.Mutex // shared by loggers derived through With, so lines are never interleaved
+}
+
+// Log is the logger of the application; it writes to standard error at the level set by CONGESTION_LOG_LEVEL.
+var Log *Logger = newLogFromEnvironment()
+
+// NewLogger creates a logger writing messages of at least the given level.
+//
+// Parameters:
+//   - out: The writer the log lines are written to.
+//   - level: The minimum level of written messages.
+//
+// Returns:
+//   - *Logger: A pointer to the newly created Logger instance.
+func NewLogger(out io.Writer, level Level) *Logger {
+	return &Logger{out: out, level: level, mu: &sync.Mutex{}}
+}
+
+// newLogFromEnvironment creates the application logger, falling back to the info level.
+func newLogFromEnvironment() *Logger {
+	level := LevelInfo
+	if name := os.Getenv(LogLevelEnv); name != "" {
+		if parsed, err := ParseLevel(name); err == nil {
+			level = parsed
+		}
+	}
+	return NewLogger(os.Stderr, level)
+}
+
+// With returns a logger attaching the given key-value pairs to every message, in addition to its own fields.
+//
+// Parameters:
+//   - keyvals: Alternating keys and values.
+//
+// Returns:
+//   - *Logger: The derived logger, writing to the same output.
+func (l *Logger) With(keyvals ...interface{}) *Logger {
+	fields := make([]interface{}, 0, len(l.fields)+len(keyvals))
+	fields = append(fields, l.fields...)
+	fields = append(fields, keyvals...)
+	return &Logger{out: l.out, level: l.level, fields: fields, mu: l.mu}
+}
+
+// Debug logs a message useful when diagnosing a problem.
+func (l *Logger) Debug(msg string, keyvals ...interface{}) {
+	l.log(LevelDebug, msg, keyvals)
+}
+
+// Info logs a message about normal operation.
+func (l *Logger) Info(msg string, keyvals ...interface{}) {
+	l.log(LevelInfo, msg, keyvals)
+}
+
+// Warn logs a message about a problem the application recovered from.
+func (l *Logger) Warn(msg string, keyvals ...interface{}) {
+	l.log(LevelWarn, msg, keyvals)
+}
+
+// Error logs a message about a failed operation.
+func (l *Logger) Error(msg string, keyvals ...interface{}) {
+	l.log(LevelError, msg, keyvals)
+}
+
+// log writes a single JSON line with the time, level, message and all fields, in that order.
+func (l *Logger) log(level Level, msg string, keyvals []interface{}) {
+	if level < l.level {
+		return
+	}
+
+	var line strings.Builder
+	line.WriteString(`{"time":`)
+	writeJSONValue(&line, time.Now().UTC().Format(time.RFC3339Nano))
+	line.WriteString(`,"level":`)
+	writeJSONValue(&line, level.String())
+	line.WriteString(`,"msg":`)
+	writeJSONValue(&line, msg)
+
+	fields := append(append([]interface{}{}, l.fields...), keyvals...)
+	for i := 0; i < len(fields); i += 2 {
+		line.WriteString(",")
+		writeJSONValue(&line, fmt.Sprint(fields[i]))
+		line.WriteString(":")
+		if i+1 < len(fields) {
+			writeJSONValue(&line, fields[i+1])
+		} else {
+			line.WriteString("null")
+		}
+	}
+	line.WriteString("}\n")
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	io.WriteString(l.out, line.String())
+}
+
+// writeJSONValue writes the value as JSON; errors and values that cannot be encoded are written as strings.
+func writeJSONValue(line *strings.Builder, value interface{}) {
+	if err, isError := value.(error); isError {
+		value = err.Error()
+	}
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		encoded, _ = json.Marshal(fmt.Sprint(value))
+	}
+	line.Write(encoded)
+}
+
+// loggerKey is the context key of the request-scoped logger.
+type loggerKey struct{}
+
+// ContextWithLogger returns a copy of the context carrying the logger.
+func ContextWithLogger(ctx context.Context, logger *Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, logger)
+}
+
+// LoggerFromContext returns the logger carried by the context, or the application logger if there is none.
+func LoggerFromContext(ctx context.Context) *Logger {
+	if logger, exists := ctx.Value(loggerKey{}).(*Logger); exists {
+		return logger
+	}
+	return Log
+}
@@ -0,0 +1,153 @@
+package invoicing
+
+import (
+	"congestion-calculator-manager/app/ledger"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Kinds of adjustments.
+const (
+	KindCredit = "credit"
+	KindDebit  = "debit"
+)
+
+// AdjustmentLine represents the change of the amount charged for a single day.
+type AdjustmentLine struct {
+	Date           string `json:"date"`
+	PreviousAmount int    `json:"previous_amount"`
+	Amount         int    `json:"amount"`
+}
+
+// Adjustment represents a credit or debit note correcting the amount charged to a vehicle
+// in a city and billing period after the tax rules were corrected.
+type Adjustment struct {
+	Number              string           `json:"number"`
+	Kind                string           `json:"kind"`
+	InvoiceNumber       string           `json:"invoice_number"`
+	LicensePlate        string           `json:"license_plate"`
+	City                string           `json:"city"`
+	Period              string           `json:"period"`
+	Reason              string           `json:"reason"`
+	PreviousRuleVersion string           `json:"previous_rule_version"`
+	RuleVersion         string           `json:"rule_version"`
+	Lines               []AdjustmentLine `json:"lines"`
+	Amount              int              `json:"amount"`
+	Currency            string           `json:"currency"`
+	CreatedAt           time.Time        `json:"created_at"`
+}
+
+// Recalculate replays the ledger passages of a city and billing period with the current tax rules and
+// compares the result with what has been charged so far, the issued invoice together with all earlier
+// adjustments. Every invoiced vehicle with a changed day gets an adjustment, a credit if its net change is
+// negative and a debit otherwise; vehicles without an issued invoice for the period are skipped.
+// The returned adjustments are not numbered yet; they get their number when recorded through a Store.
+//
+// Parameters:
+//   - city: The city whose rules were corrected.
+//   - period: The billing period to recalculate.
+//   - entries: Ledger passages of the city within the billing period.
+//   - calculate: The calculation applied to every vehicle's passages.
+//   - store: The store with the issued invoices and earlier adjustments.
+//   - reason: The reason of the correction, recorded on every adjustment.
+//
+// Returns:
+//   - []Adjustment: Adjustments ordered by license plate.
+//   - []SkippedVehicle: Invoiced vehicles that could not be calculated, ordered by license plate.
+//   - error: An error if a calculation failed for a reason other than its vehicle.
+func Recalculate(city string, period Period, entries []ledger.Entry, calculate Calculate, store *Store, reason string) ([]Adjustment, []SkippedVehicle, error) {
+	adjustments := []Adjustment{}
+	skipped := []SkippedVehicle{}
+	for _, vehicle := range ledger.GroupByPlate(city, period.Start, period.End, entries) {
+		adjustment := Adjustment{
+			LicensePlate: vehicle.LicensePlate,
+			City:         vehicle.Passages[0].City,
+			Period:       period.Label(),
+			Reason:       reason,
+			Currency:     Currency,
+		}
+
+		// only issued invoices are adjusted; a vehicle that was never invoiced is charged by the next invoice run
+		invoices := store.Find(adjustment.City, adjustment.Period, adjustment.LicensePlate)
+		if len(invoices) == 0 {
+			continue
+		}
+
+		result, err := calculate(vehicle.LicensePlate, vehicle.VehicleType, vehicle.Passages)
+		var vehicleErr *VehicleError
+		if errors.As(err, &vehicleErr) {
+			skipped = append(skipped, SkippedVehicle{
+				LicensePlate: vehicle.LicensePlate,
+				VehicleType:  vehicle.VehicleType,
+				Passages:     len(vehicle.Passages),
+				Reason:       vehicleErr.Err.Error(),
+			})
+			continue
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("vehicle %s: %v", vehicle.LicensePlate, err)
+		}
+		ruleVersion, lines, _ := chargedDays(result, adjustment.City)
+		adjustment.RuleVersion = ruleVersion
+
+		charged := map[string]int{}
+		for _, invoice := range invoices {
+			adjustment.InvoiceNumber = invoice.Number
+			adjustment.PreviousRuleVersion = invoice.RuleVersion
+			for _, line := range invoice.Lines {
+				charged[line.Date] += line.Amount
+			}
+		}
+		for _, earlier := range store.FindAdjustments(adjustment.City, adjustment.Period, adjustment.LicensePlate) {
+			adjustment.PreviousRuleVersion = earlier.RuleVersion
+			for _, line := range earlier.Lines {
+				charged[line.Date] += line.Amount - line.PreviousAmount
+			}
+		}
+
+		recalculated := map[string]int{}
+		for _, line := range lines {
+			recalculated[line.Date] = line.Amount
+		}
+
+		// days moved between each other are adjusted even if they cancel out
+		adjustment.Lines, adjustment.Amount = diffDays(charged, recalculated)
+		if len(adjustment.Lines) == 0 {
+			continue
+		}
+		adjustment.Kind = KindDebit
+		if adjustment.Amount < 0 {
+			adjustment.Kind = KindCredit
+			adjustment.Amount = -adjustment.Amount
+		}
+		adjustments = append(adjustments, adjustment)
+	}
+	return adjustments, skipped, nil
+}
+
+// diffDays returns the days whose amount changed, ordered by date, and the net change of all days.
+func diffDays(charged map[string]int, recalculated map[string]int) ([]AdjustmentLine, int) {
+	dates := []string{}
+	for date := range charged {
+		dates = append(dates, date)
+	}
+	for date := range recalculated {
+		if _, exists := charged[date]; !exists {
+			dates = append(dates, date)
+		}
+	}
+	sort.Strings(dates)
+
+	lines := []AdjustmentLine{}
+	net := 0
+	for _, date := range dates {
+		if charged[date] == recalculated[date] {
+			continue
+		}
+		lines = append(lines, AdjustmentLine{Date: date, PreviousAmount: charged[date], Amount: recalculated[date]})
+		net += recalculated[date] - charged[date]
+	}
+	return lines, net
+}
@@ -0,0 +1,165 @@
+// Package invoicing provides monthly congestion tax invoices per vehicle, built from the passage ledger,
+// and renders them as JSON, CSV and printable HTML statements.
+package invoicing
+
+import (
+	"congestion-calculator-manager/app/calculator"
+	"congestion-calculator-manager/app/ledger"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Currency is the currency all congestion tax amounts are charged in.
+const Currency = "SEK"
+
+// PaymentTermDays is the payment term of invoices issued after the regular due date of their period.
+const PaymentTermDays = 30
+
+// Period represents a billing period, which is always a calendar month.
+type Period struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+}
+
+// ParsePeriod parses a billing period in the form "2013-02".
+func ParsePeriod(value string) (Period, error) {
+	start, err := time.Parse("2006-01", value)
+	if err != nil {
+		return Period{}, fmt.Errorf("invalid billing period %q, expected YYYY-MM", value)
+	}
+	return Period{Start: start, End: start.AddDate(0, 1, 0)}, nil
+}
+
+// Label returns the billing period in the form "2013-02".
+func (p Period) Label() string {
+	return p.Start.Format("2006-01")
+}
+
+// DueDate returns the date by which invoices of the period must be paid, the last day of the following month.
+func (p Period) DueDate() time.Time {
+	return time.Date(p.End.Year(), p.End.Month()+1, 0, 0, 0, 0, 0, time.UTC)
+}
+
+// Line represents the charge of a single day on an invoice.
+type Line struct {
+	Date     string `json:"date"`
+	Passages int    `json:"passages"`
+	Amount   int    `json:"amount"`
+}
+
+// Invoice represents the congestion tax charged to a single vehicle in a single city for a billing period.
+type Invoice struct {
+	Number       string    `json:"number"`
+	LicensePlate string    `json:"license_plate"`
+	VehicleType  string    `json:"vehicle_type"`
+	City         string    `json:"city"`
+	Period       string    `json:"period"`
+	RuleVersion  string    `json:"rule_version"`
+	IssuedAt     time.Time `json:"issued_at"`
+	DueDate      time.Time `json:"due_date"`
+	Lines        []Line    `json:"lines"`
+	Total        int       `json:"total"`
+	Currency     string    `json:"currency"`
+}
+
+// SkippedVehicle represents a vehicle whose passages could not be calculated and that was not invoiced.
+type SkippedVehicle struct {
+	LicensePlate string `json:"license_plate"`
+	VehicleType  string `json:"vehicle_type"`
+	Passages     int    `json:"passages"`
+	Reason       string `json:"reason"`
+}
+
+// Calculate computes the fees of a vehicle's passages, applying the daily cap of every city.
+type Calculate func(licensePlate string, vehicleType string, passages []calculator.Passage) (calculator.TripResult, error)
+
+// VehicleError marks an error of a single vehicle, such as an unregistered plate recorded without a vehicle type;
+// the vehicle is skipped instead of failing the invoices of every other vehicle.
+type VehicleError struct {
+	Err error
+}
+
+// Error returns the reason the vehicle could not be calculated.
+func (e *VehicleError) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap returns the reason the vehicle could not be calculated.
+func (e *VehicleError) Unwrap() error {
+	return e.Err
+}
+
+// Generate aggregates the ledger passages of a city and billing period into one invoice per license plate,
+// with one line per charged day. Vehicles without any charge are not invoiced, and vehicles whose
+// calculation fails with a VehicleError are skipped and reported.
+// The returned invoices are not numbered yet; they get their number when issued through a Store.
+//
+// Parameters:
+//   - city: The city to invoice.
+//   - period: The billing period.
+//   - entries: Ledger passages of the city within the billing period.
+//   - calculate: The calculation applied to every vehicle's passages.
+//
+// Returns:
+//   - []Invoice: Invoices ordered by license plate.
+//   - []SkippedVehicle: Vehicles that could not be calculated, ordered by license plate.
+//   - error: An error if a calculation failed for a reason other than its vehicle.
+func Generate(city string, period Period, entries []ledger.Entry, calculate Calculate) ([]Invoice, []SkippedVehicle, error) {
+	vehiclePassages := ledger.GroupByPlate(city, period.Start, period.End, entries)
+
+	invoices := []Invoice{}
+	skipped := []SkippedVehicle{}
+	for _, vehicle := range vehiclePassages {
+		result, err := calculate(vehicle.LicensePlate, vehicle.VehicleType, vehicle.Passages)
+		var vehicleErr *VehicleError
+		if errors.As(err, &vehicleErr) {
+			skipped = append(skipped, SkippedVehicle{
+				LicensePlate: vehicle.LicensePlate,
+				VehicleType:  vehicle.VehicleType,
+				Passages:     len(vehicle.Passages),
+				Reason:       vehicleErr.Err.Error(),
+			})
+			continue
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("vehicle %s: %v", vehicle.LicensePlate, err)
+		}
+
+		invoice := Invoice{
+			LicensePlate: vehicle.LicensePlate,
+			VehicleType:  vehicle.VehicleType,
+			City:         vehicle.Passages[0].City,
+			Period:       period.Label(),
+			DueDate:      period.DueDate(),
+			Currency:     Currency,
+		}
+		invoice.RuleVersion, invoice.Lines, invoice.Total = chargedDays(result, invoice.City)
+		if invoice.Total > 0 {
+			invoices = append(invoices, invoice)
+		}
+	}
+	return invoices, skipped, nil
+}
+
+// chargedDays returns the rule version, the charged days and the total of a single city in a calculation result.
+func chargedDays(result calculator.TripResult, city string) (string, []Line, int) {
+	ruleVersion := ""
+	for _, cityFee := range result.Cities {
+		if strings.EqualFold(cityFee.City, city) {
+			ruleVersion = cityFee.RuleVersion
+		}
+	}
+
+	lines := []Line{}
+	total := 0
+	for _, day := range result.Days {
+		if day.TotalFee == 0 || !strings.EqualFold(day.City, city) {
+			continue
+		}
+		lines = append(lines, Line{Date: day.Date, Passages: day.Passages, Amount: day.TotalFee})
+		total += day.TotalFee
+	}
+	return ruleVersion, lines, total
+}
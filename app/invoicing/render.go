@@ -0,0 +1,82 @@
+package invoicing
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"html/template"
+	"io"
+	"strconv"
+)
+
+// RenderJSON writes the invoices as a JSON array.
+func RenderJSON(w io.Writer, invoices []Invoice) error {
+	return json.NewEncoder(w).Encode(invoices)
+}
+
+// RenderCSV writes the invoices as CSV with one row per invoice line.
+func RenderCSV(w io.Writer, invoices []Invoice) error {
+	writer := csv.NewWriter(w)
+	err := writer.Write([]string{"number", "license_plate", "city", "period", "due_date", "date", "passages", "amount", "currency"})
+	if err != nil {
+		return err
+	}
+
+	for _, invoice := range invoices {
+		for _, line := range invoice.Lines {
+			err = writer.Write([]string{
+				invoice.Number,
+				invoice.LicensePlate,
+				invoice.City,
+				invoice.Period,
+				invoice.DueDate.Format("2006-01-02"),
+				line.Date,
+				strconv.Itoa(line.Passages),
+				strconv.Itoa(line.Amount),
+				invoice.Currency,
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	writer.Flush()
+	return writer.Error()
+}
+
+// statementTemplate is the printable HTML statement, one page per invoice.
+var statementTemplate = template.Must(template.New("statement").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Congestion tax statement</title>
+<style>
+body { font-family: sans-serif; }
+.statement { page-break-after: always; margin-bottom: 2em; }
+table { border-collapse: collapse; }
+th, td { border: 1px solid #999; padding: 4px 8px; text-align: left; }
+td.amount, th.amount { text-align: right; }
+</style>
+</head>
+<body>
+{{range .}}<div class="statement">
+<h1>Congestion tax {{.City}}</h1>
+<p>Invoice number: {{.Number}}<br>
+Vehicle: {{.LicensePlate}}<br>
+Billing period: {{.Period}}<br>
+Issued: {{.IssuedAt.Format "2006-01-02"}}<br>
+Due date: {{.DueDate.Format "2006-01-02"}}</p>
+<table>
+<tr><th>Date</th><th class="amount">Passages</th><th class="amount">Amount</th></tr>
+{{range .Lines}}<tr><td>{{.Date}}</td><td class="amount">{{.Passages}}</td><td class="amount">{{.Amount}}</td></tr>
+{{end}}<tr><th colspan="2">Total</th><th class="amount">{{.Total}} {{.Currency}}</th></tr>
+</table>
+</div>
+{{end}}</body>
+</html>
+`))
+
+// RenderHTML writes the invoices as a printable HTML statement, one page per invoice.
+func RenderHTML(w io.Writer, invoices []Invoice) error {
+	return statementTemplate.Execute(w, invoices)
+}
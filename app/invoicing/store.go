@@ -0,0 +1,250 @@
+package invoicing
+
+import (
+	"bufio"
+	"congestion-calculator-manager/app/helpers"
+	"congestion-calculator-manager/app/plates"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Store represents the append-only record of issued invoices and their adjustments,
+// stored on disk as JSON lines.
+type Store struct {
+	invoiceFile    *os.File     // File opened for appending newly issued invoices
+	adjustmentFile *os.File     // File opened for appending newly created adjustments
+	invoices       []Invoice    // All issued invoices in the order they were issued
+	adjustments    []Adjustment // All adjustments in the order they were created
+	mu             sync.RWMutex // Mutex for concurrent access
+}
+
+// DefaultDirectory returns the location of the invoice files in the data store.
+func DefaultDirectory() (string, error) {
+	dir, err := helpers.DataDirectory()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "invoices"), nil
+}
+
+// OpenStore loads the issued invoices and adjustments stored in the given directory, creating the files if they do not exist.
+//
+// Parameters:
+//   - dir: The directory of the invoice files.
+//
+// Returns:
+//   - *Store: A pointer to the opened Store.
+//   - error: An error if the files could not be created or contain a corrupt record.
+func OpenStore(dir string) (*Store, error) {
+	store := &Store{}
+
+	invoiceFile, err := openJSONLines(filepath.Join(dir, "invoices.jsonl"), func(line []byte) error {
+		var invoice Invoice
+		err := json.Unmarshal(line, &invoice)
+		store.invoices = append(store.invoices, invoice)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	adjustmentFile, err := openJSONLines(filepath.Join(dir, "adjustments.jsonl"), func(line []byte) error {
+		var adjustment Adjustment
+		err := json.Unmarshal(line, &adjustment)
+		store.adjustments = append(store.adjustments, adjustment)
+		return err
+	})
+	if err != nil {
+		invoiceFile.Close()
+		return nil, err
+	}
+
+	store.invoiceFile = invoiceFile
+	store.adjustmentFile = adjustmentFile
+	return store, nil
+}
+
+// Issue numbers and records an invoice. A vehicle is invoiced at most once per city and period,
+// so issuing it again returns the invoice issued earlier.
+//
+// Parameters:
+//   - invoice: The generated invoice.
+//   - issuedAt: The time of issue.
+//
+// Returns:
+//   - Invoice: The issued invoice.
+//   - bool: True if the invoice was newly issued, false if it had been issued before.
+//   - error: An error if the invoice could not be written.
+func (s *Store) Issue(invoice Invoice, issuedAt time.Time) (Invoice, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, issued := range s.invoices {
+		if issued.LicensePlate == invoice.LicensePlate && strings.EqualFold(issued.City, invoice.City) && issued.Period == invoice.Period {
+			return issued, false, nil
+		}
+	}
+
+	invoice.Number = documentNumber("", invoice.City, invoice.Period, len(s.invoices)+1)
+	invoice.IssuedAt = issuedAt
+	if invoice.DueDate.Before(issuedAt) {
+		invoice.DueDate = issuedAt.AddDate(0, 0, PaymentTermDays)
+	}
+
+	err := appendJSONLine(s.invoiceFile, invoice)
+	if err != nil {
+		return invoice, false, err
+	}
+
+	s.invoices = append(s.invoices, invoice)
+	return invoice, true, nil
+}
+
+// Record numbers and records an adjustment.
+//
+// Parameters:
+//   - adjustment: The adjustment created by a recalculation.
+//   - createdAt: The time of creation.
+//
+// Returns:
+//   - Adjustment: The recorded adjustment.
+//   - error: An error if the adjustment could not be written.
+func (s *Store) Record(adjustment Adjustment, createdAt time.Time) (Adjustment, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	prefix := "DB"
+	if adjustment.Kind == KindCredit {
+		prefix = "CR"
+	}
+	adjustment.Number = documentNumber(prefix, adjustment.City, adjustment.Period, len(s.adjustments)+1)
+	adjustment.CreatedAt = createdAt
+
+	err := appendJSONLine(s.adjustmentFile, adjustment)
+	if err != nil {
+		return adjustment, err
+	}
+
+	s.adjustments = append(s.adjustments, adjustment)
+	return adjustment, nil
+}
+
+// Find returns the issued invoices matching the given city, period and license plate.
+// Empty arguments match every invoice.
+func (s *Store) Find(city string, period string, licensePlate string) []Invoice {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	plate := plates.Normalize(licensePlate)
+	result := []Invoice{}
+	for _, invoice := range s.invoices {
+		if matches(invoice.City, invoice.Period, invoice.LicensePlate, city, period, plate) {
+			result = append(result, invoice)
+		}
+	}
+	return result
+}
+
+// FindAdjustments returns the adjustments matching the given city, period and license plate.
+// Empty arguments match every adjustment.
+func (s *Store) FindAdjustments(city string, period string, licensePlate string) []Adjustment {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	plate := plates.Normalize(licensePlate)
+	result := []Adjustment{}
+	for _, adjustment := range s.adjustments {
+		if matches(adjustment.City, adjustment.Period, adjustment.LicensePlate, city, period, plate) {
+			result = append(result, adjustment)
+		}
+	}
+	return result
+}
+
+// Close closes the underlying invoice files.
+func (s *Store) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := s.invoiceFile.Close()
+	if adjustmentErr := s.adjustmentFile.Close(); err == nil {
+		err = adjustmentErr
+	}
+	return err
+}
+
+// matches checks a record's city, period and license plate against filters, where empty filters match everything.
+func matches(city string, period string, licensePlate string, cityFilter string, periodFilter string, plateFilter string) bool {
+	if cityFilter != "" && !strings.EqualFold(city, cityFilter) {
+		return false
+	}
+	if periodFilter != "" && period != periodFilter {
+		return false
+	}
+	return plateFilter == "" || licensePlate == plateFilter
+}
+
+// documentNumber returns the number of an invoice or adjustment, e.g. GOT-201302-000001 or CR-GOT-201302-000001.
+func documentNumber(prefix string, city string, period string, sequence int) string {
+	cityPrefix := strings.ToUpper(city)
+	if len(cityPrefix) > 3 {
+		cityPrefix = cityPrefix[:3]
+	}
+	number := fmt.Sprintf("%s-%s-%06d", cityPrefix, strings.Replace(period, "-", "", 1), sequence)
+	if prefix != "" {
+		number = prefix + "-" + number
+	}
+	return number
+}
+
+// openJSONLines opens a JSON lines file for appending, creating it if it does not exist,
+// and passes every existing line to decode.
+func openJSONLines(path string, decode func(line []byte) error) (*os.File, error) {
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		err = decode(scanner.Bytes())
+		if err != nil {
+			file.Close()
+			return nil, fmt.Errorf("corrupt record on line %d of %s: %v", lineNumber, path, err)
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return file, nil
+}
+
+// appendJSONLine writes the value as a single JSON line and syncs it to disk.
+func appendJSONLine(file *os.File, value interface{}) error {
+	line, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(append(line, '\n'))
+	if err != nil {
+		return err
+	}
+	return file.Sync()
+}
@@ -0,0 +1,209 @@
+// Package jobs keeps track of asynchronous jobs, their progress and their results. Jobs are kept
+// in memory only; callers of jobs lost in a restart have to submit them again.
+package jobs
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"time"
+)
+
+// Status represents the state of a job.
+type Status string
+
+// States of a job. Queued jobs become running and then either succeeded or failed.
+const (
+	Queued    Status = "queued"
+	Running   Status = "running"
+	Succeeded Status = "succeeded"
+	Failed    Status = "failed"
+)
+
+// ErrTooManyJobs is returned when a job is created while the store holds the maximum number of unfinished jobs.
+var ErrTooManyJobs = errors.New("too many unfinished jobs")
+
+// Progress represents how many of the items of a job are done.
+type Progress struct {
+	Done  int `json:"done"`
+	Total int `json:"total"`
+}
+
+// Job represents an asynchronous job as reported to its owner.
+type Job struct {
+	ID         string    `json:"id"`
+	Owner      string    `json:"owner"`
+	Status     Status    `json:"status"`
+	Progress   Progress  `json:"progress"`
+	Error      string    `json:"error,omitempty"`
+	WebhookURL string    `json:"webhook_url,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+}
+
+// Finished checks if the job succeeded or failed.
+func (j Job) Finished() bool {
+	return j.Status == Succeeded || j.Status == Failed
+}
+
+// entry holds a job with the data only the server sees.
+type entry struct {
+	job           Job
+	webhookSecret string
+	results       interface{}
+}
+
+// Store holds the jobs of the server. Finished jobs are removed after the retention period.
+type Store struct {
+	mu            sync.Mutex
+	jobs          map[string]*entry
+	retention     time.Duration
+	maxUnfinished int
+}
+
+// NewStore creates a store.
+//
+// Parameters:
+//   - retention: How long finished jobs and their results are kept.
+//   - maxUnfinished: The number of queued and running jobs above which new jobs are rejected.
+//
+// Returns:
+//   - *Store: A pointer to the newly created Store instance.
+func NewStore(retention time.Duration, maxUnfinished int) *Store {
+	return &Store{jobs: make(map[string]*entry), retention: retention, maxUnfinished: maxUnfinished}
+}
+
+// Create adds a queued job.
+//
+// Parameters:
+//   - owner: The subject of the caller submitting the job.
+//   - total: The number of items of the job.
+//   - webhookURL: The URL notified when the job finishes, or empty.
+//   - webhookSecret: The secret signing the notification.
+//   - now: The time of submission.
+//
+// Returns:
+//   - Job: The created job.
+//   - error: ErrTooManyJobs if the store is full.
+func (s *Store) Create(owner string, total int, webhookURL string, webhookSecret string, now time.Time) (Job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	unfinished := 0
+	for id, e := range s.jobs {
+		switch {
+		case !e.job.Finished():
+			unfinished++
+		case now.Sub(e.job.FinishedAt) > s.retention:
+			delete(s.jobs, id)
+		}
+	}
+	if unfinished >= s.maxUnfinished {
+		return Job{}, ErrTooManyJobs
+	}
+
+	job := Job{
+		ID:         newID(),
+		Owner:      owner,
+		Status:     Queued,
+		Progress:   Progress{Total: total},
+		WebhookURL: webhookURL,
+		CreatedAt:  now.UTC(),
+	}
+	s.jobs[job.ID] = &entry{job: job, webhookSecret: webhookSecret}
+	return job, nil
+}
+
+// Get returns a job.
+func (s *Store) Get(id string) (Job, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, exists := s.jobs[id]
+	if !exists {
+		return Job{}, false
+	}
+	return e.job, true
+}
+
+// Results returns the results of a finished job.
+//
+// Returns:
+//   - Job: The job.
+//   - interface{}: The results, or nil if the job has not finished.
+//   - bool: False if the job does not exist.
+func (s *Store) Results(id string) (Job, interface{}, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, exists := s.jobs[id]
+	if !exists {
+		return Job{}, nil, false
+	}
+	return e.job, e.results, true
+}
+
+// Start marks a job as running.
+func (s *Store) Start(id string, now time.Time) {
+	s.update(id, func(e *entry) {
+		e.job.Status = Running
+		e.job.StartedAt = now.UTC()
+	})
+}
+
+// Advance counts an item of a running job as done.
+func (s *Store) Advance(id string) {
+	s.update(id, func(e *entry) {
+		e.job.Progress.Done++
+	})
+}
+
+// Finish records the results of a job; it failed if err is not nil.
+//
+// Returns:
+//   - Job: The finished job.
+//   - string: The secret of the job's webhook.
+func (s *Store) Finish(id string, results interface{}, err error, now time.Time) (Job, string) {
+	var job Job
+	var secret string
+	s.update(id, func(e *entry) {
+		e.job.Status = Succeeded
+		if err != nil {
+			e.job.Status = Failed
+			e.job.Error = err.Error()
+		}
+		e.job.FinishedAt = now.UTC()
+		e.results = results
+		job, secret = e.job, e.webhookSecret
+	})
+	return job, secret
+}
+
+// Counts returns the number of jobs in every state.
+func (s *Store) Counts() map[Status]int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	counts := make(map[Status]int)
+	for _, e := range s.jobs {
+		counts[e.job.Status]++
+	}
+	return counts
+}
+
+// update changes a job under the lock of the store.
+func (s *Store) update(id string, change func(e *entry)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e, exists := s.jobs[id]; exists {
+		change(e)
+	}
+}
+
+// newID returns a random, unguessable job id.
+func newID() string {
+	buffer := make([]byte, 16)
+	if _, err := rand.Read(buffer); err != nil {
+		return time.Now().UTC().Format("20060102150405.000000000")
+	}
+	return hex.EncodeToString(buffer)
+}
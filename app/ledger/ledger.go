@@ -0,0 +1,312 @@
+// Package ledger provides an append-only passage ledger stored on disk as JSON lines,
+// so that passages are billed once and fees can be recomputed at any time.
+package ledger
+
+import (
+	"bufio"
+	"congestion-calculator-manager/app/calculator"
+	"congestion-calculator-manager/app/helpers"
+	"congestion-calculator-manager/app/plates"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Entry represents a single passage recorded in the ledger.
+type Entry struct {
+	PassageId    string    `json:"passage_id"`
+	LicensePlate string    `json:"license_plate"`
+	VehicleType  string    `json:"vehicle_type,omitempty"`
+	City         string    `json:"city"`
+	Station      string    `json:"station,omitempty"`
+	Time         time.Time `json:"time"`
+	IngestedAt   time.Time `json:"ingested_at"`
+}
+
+// Ledger represents the append-only passage ledger.
+type Ledger struct {
+	file    *os.File            // File opened for appending new entries
+	entries []Entry             // All entries in the order they were appended
+	ids     map[string]struct{} // Passage ids already recorded
+	mu      sync.RWMutex        // Mutex for concurrent access
+}
+
+// DefaultPath returns the location of the ledger file in the data store.
+func DefaultPath() (string, error) {
+	dir, err := helpers.DataDirectory()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "ledger", "passages.jsonl"), nil
+}
+
+// Open loads the ledger stored at the given path, creating it if it does not exist.
+//
+// Parameters:
+//   - path: The path of the ledger file.
+//
+// Returns:
+//   - *Ledger: A pointer to the opened Ledger.
+//   - error: An error if the file could not be created or contains a corrupt entry before its last line.
+func Open(path string) (*Ledger, error) {
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	ledger := &Ledger{
+		file: file,
+		ids:  make(map[string]struct{}),
+	}
+
+	if err = repairTail(file); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if _, err = file.Seek(0, io.SeekStart); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	scanner := bufio.NewScanner(file)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var entry Entry
+		err = json.Unmarshal(scanner.Bytes(), &entry)
+		if err != nil {
+			file.Close()
+			return nil, fmt.Errorf("corrupt ledger entry on line %d: %v", lineNumber, err)
+		}
+		ledger.entries = append(ledger.entries, entry)
+		ledger.ids[entry.PassageId] = struct{}{}
+	}
+	if err = scanner.Err(); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return ledger, nil
+}
+
+// repairTail drops a partial entry at the end of the ledger file, written by a process that stopped
+// before finishing the line. A complete entry missing only its line end gets it back.
+func repairTail(file *os.File) error {
+	info, err := file.Stat()
+	if err != nil || info.Size() == 0 {
+		return err
+	}
+
+	// entries are written with their line end in a single write, so only the last line can be partial
+	reader := bufio.NewReader(io.NewSectionReader(file, 0, info.Size()))
+	var lastLineStart, offset int64
+	var line []byte
+	for {
+		line, err = reader.ReadBytes('\n')
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		offset += int64(len(line))
+		lastLineStart = offset
+	}
+	if len(line) == 0 {
+		return nil
+	}
+
+	var entry Entry
+	if json.Unmarshal(line, &entry) == nil {
+		_, err = file.Write([]byte{'\n'})
+		return err
+	}
+	helpers.Log.Warn("ledger ends in a partial entry, dropping it", "path", file.Name(), "offset", lastLineStart, "bytes", len(line))
+	return file.Truncate(lastLineStart)
+}
+
+// Append records a passage unless a passage with the same id was already recorded,
+// which makes retried ingestion idempotent.
+//
+// Parameters:
+//   - entry: The passage to record.
+//
+// Returns:
+//   - bool: True if the passage was recorded, false if it is a duplicate.
+//   - error: An error if the entry is incomplete or could not be written.
+func (l *Ledger) Append(entry Entry) (bool, error) {
+	if entry.PassageId == "" {
+		return false, errors.New("passage id is missing")
+	}
+	if entry.City == "" || entry.Time.IsZero() {
+		return false, fmt.Errorf("passage %s has no city or time", entry.PassageId)
+	}
+	entry.LicensePlate = plates.Normalize(entry.LicensePlate)
+	if entry.IngestedAt.IsZero() {
+		entry.IngestedAt = time.Now().UTC()
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if _, exists := l.ids[entry.PassageId]; exists {
+		return false, nil
+	}
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return false, err
+	}
+	_, err = l.file.Write(append(line, '\n'))
+	if err != nil {
+		return false, err
+	}
+	err = l.file.Sync()
+	if err != nil {
+		return false, err
+	}
+
+	l.entries = append(l.entries, entry)
+	l.ids[entry.PassageId] = struct{}{}
+	return true, nil
+}
+
+// Passages returns the recorded passages of a vehicle within [from, to), ordered by time.
+// A zero from or to leaves that side of the range open.
+func (l *Ledger) Passages(licensePlate string, from time.Time, to time.Time) []Entry {
+	plate := plates.Normalize(licensePlate)
+	return l.filter(func(entry Entry) bool {
+		return entry.LicensePlate == plate
+	}, from, to)
+}
+
+// PassagesInCity returns the recorded passages of all vehicles in a city within [from, to), ordered by time.
+// An empty city matches every city.
+func (l *Ledger) PassagesInCity(city string, from time.Time, to time.Time) []Entry {
+	return l.filter(func(entry Entry) bool {
+		return city == "" || strings.EqualFold(entry.City, city)
+	}, from, to)
+}
+
+// filter returns the entries accepted by match within [from, to), ordered by time.
+func (l *Ledger) filter(match func(Entry) bool, from time.Time, to time.Time) []Entry {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	var result []Entry
+	for _, entry := range l.entries {
+		if !match(entry) {
+			continue
+		}
+		if !from.IsZero() && entry.Time.Before(from) {
+			continue
+		}
+		if !to.IsZero() && !entry.Time.Before(to) {
+			continue
+		}
+		result = append(result, entry)
+	}
+
+	sort.SliceStable(result, func(i, j int) bool {
+		return result[i].Time.Before(result[j].Time)
+	})
+	return result
+}
+
+// Close closes the underlying ledger file.
+func (l *Ledger) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.file.Close()
+}
+
+// VehiclePassages represents the recorded passages of a single vehicle.
+type VehiclePassages struct {
+	LicensePlate string
+	VehicleType  string
+	Passages     []calculator.Passage
+}
+
+// VehicleType returns the vehicle type recorded with the latest of a vehicle's passages that states one,
+// so that every calculation of recorded passages classifies the vehicle the same way.
+//
+// Parameters:
+//   - entries: The recorded passages of a single vehicle, in any order.
+//
+// Returns:
+//   - string: The vehicle type, empty if no passage states one.
+func VehicleType(entries []Entry) string {
+	vehicleType := ""
+	var latest time.Time
+	for _, entry := range entries {
+		if entry.VehicleType == "" || (vehicleType != "" && entry.Time.Before(latest)) {
+			continue
+		}
+		vehicleType, latest = entry.VehicleType, entry.Time
+	}
+	return vehicleType
+}
+
+// GroupByPlate groups the passages of a city within [from, to) by license plate, ordered by license plate.
+// A zero from or to leaves that side of the range open. The vehicle type is chosen by VehicleType.
+//
+// Parameters:
+//   - city: The city whose passages are grouped.
+//   - from: The start of the range.
+//   - to: The end of the range, excluded.
+//   - entries: The recorded passages.
+//
+// Returns:
+//   - []VehiclePassages: The passages of every vehicle, each in the order of the entries.
+func GroupByPlate(city string, from time.Time, to time.Time, entries []Entry) []VehiclePassages {
+	byPlate := make(map[string]*VehiclePassages)
+	entriesByPlate := make(map[string][]Entry)
+	for _, entry := range entries {
+		if !strings.EqualFold(entry.City, city) {
+			continue
+		}
+		if (!from.IsZero() && entry.Time.Before(from)) || (!to.IsZero() && !entry.Time.Before(to)) {
+			continue
+		}
+		vehicle, exists := byPlate[entry.LicensePlate]
+		if !exists {
+			vehicle = &VehiclePassages{LicensePlate: entry.LicensePlate}
+			byPlate[entry.LicensePlate] = vehicle
+		}
+		vehicle.Passages = append(vehicle.Passages, calculator.Passage{
+			City:    entry.City,
+			Station: entry.Station,
+			Time:    entry.Time,
+		})
+		entriesByPlate[entry.LicensePlate] = append(entriesByPlate[entry.LicensePlate], entry)
+	}
+
+	licensePlates := make([]string, 0, len(byPlate))
+	for licensePlate := range byPlate {
+		licensePlates = append(licensePlates, licensePlate)
+	}
+	sort.Strings(licensePlates)
+
+	result := make([]VehiclePassages, 0, len(licensePlates))
+	for _, licensePlate := range licensePlates {
+		vehicle := byPlate[licensePlate]
+		vehicle.VehicleType = VehicleType(entriesByPlate[licensePlate])
+		result = append(result, *vehicle)
+	}
+	return result
+}
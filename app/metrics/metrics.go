@@ -0,0 +1,329 @@
+// Package metrics provides counters, gauges and histograms exposed in the Prometheus text exposition format.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultBuckets are the upper bounds, in seconds, of histograms measuring durations.
+var DefaultBuckets = []float64{0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 3}
+
+// Default is the registry exposed by the server.
+var Default = NewRegistry()
+
+// collector is a metric family that can write itself in the text exposition format.
+type collector interface {
+	write(w io.Writer) error
+}
+
+// Registry holds metric families in the order they were registered.
+type Registry struct {
+	mu         sync.Mutex
+	collectors []collector
+}
+
+// NewRegistry creates an empty registry.
+//
+// Returns:
+//   - *Registry: A pointer to the newly created Registry instance.
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+// register adds a metric family to the registry.
+func (r *Registry) register(c collector) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.collectors = append(r.collectors, c)
+}
+
+// WriteText writes all metric families in the Prometheus text exposition format.
+//
+// Parameters:
+//   - w: The writer the metrics are written to.
+//
+// Returns:
+//   - error: An error if writing failed.
+func (r *Registry) WriteText(w io.Writer) error {
+	r.mu.Lock()
+	collectors := append([]collector{}, r.collectors...)
+	r.mu.Unlock()
+
+	for _, c := range collectors {
+		if err := c.write(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// family holds the name, help text and label names shared by all series of a metric.
+type family struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+}
+
+// header writes the HELP and TYPE lines of the family.
+func (f family) header(w io.Writer) error {
+	_, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", f.name, f.help, f.name, f.kind)
+	return err
+}
+
+// key joins label values into a map key; label values never contain the separator.
+func (f family) key(labelValues []string) string {
+	if len(labelValues) != len(f.labels) {
+		panic(fmt.Sprintf("metric %s expects %d label values, got %d", f.name, len(f.labels), len(labelValues)))
+	}
+	return strings.Join(labelValues, "\xff")
+}
+
+// labelPairs formats label names and values, with an optional extra pair, as {name="value",...}.
+func (f family) labelPairs(labelValues []string, extraName string, extraValue string) string {
+	pairs := make([]string, 0, len(labelValues)+1)
+	for i, value := range labelValues {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, f.labels[i], labelEscaper.Replace(value)))
+	}
+	if extraName != "" {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, extraName, labelEscaper.Replace(extraValue)))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// labelEscaper escapes label values as required by the text exposition format.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// sortedKeys returns the keys of the series in a stable order.
+func sortedKeys(keys []string) []string {
+	sort.Strings(keys)
+	return keys
+}
+
+// formatValue formats a sample value the way Prometheus expects.
+func formatValue(value float64) string {
+	if math.IsInf(value, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// CounterVec is a counter partitioned by labels.
+type CounterVec struct {
+	family
+	mu     sync.Mutex
+	values map[string]float64
+	series map[string][]string
+}
+
+// NewCounterVec creates and registers a counter.
+//
+// Parameters:
+//   - name: The name of the metric, ending in _total by convention.
+//   - help: The description of the metric.
+//   - labels: The names of the labels partitioning the counter.
+//
+// Returns:
+//   - *CounterVec: A pointer to the newly created counter.
+func (r *Registry) NewCounterVec(name string, help string, labels ...string) *CounterVec {
+	c := &CounterVec{
+		family: family{name: name, help: help, kind: "counter", labels: labels},
+		values: make(map[string]float64),
+		series: make(map[string][]string),
+	}
+	r.register(c)
+	return c
+}
+
+// Inc increments the counter of the given label values by one.
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add increases the counter of the given label values; negative values are ignored.
+func (c *CounterVec) Add(value float64, labelValues ...string) {
+	if value < 0 {
+		return
+	}
+	key := c.key(labelValues)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, exists := c.series[key]; !exists {
+		c.series[key] = append([]string{}, labelValues...)
+	}
+	c.values[key] += value
+}
+
+// Value returns the counter of the given label values.
+func (c *CounterVec) Value(labelValues ...string) float64 {
+	key := c.key(labelValues)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.values[key]
+}
+
+// write writes the counter in the text exposition format.
+func (c *CounterVec) write(w io.Writer) error {
+	if err := c.header(w); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.labels) == 0 && len(c.series) == 0 {
+		// a counter without labels has a single series, which exists from the start
+		_, err := fmt.Fprintf(w, "%s 0\n", c.name)
+		return err
+	}
+	keys := make([]string, 0, len(c.series))
+	for key := range c.series {
+		keys = append(keys, key)
+	}
+	for _, key := range sortedKeys(keys) {
+		if _, err := fmt.Fprintf(w, "%s%s %s\n", c.name, c.labelPairs(c.series[key], "", ""), formatValue(c.values[key])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GaugeFunc is a gauge whose value is read when the metrics are written.
+type GaugeFunc struct {
+	family
+	value func() float64
+}
+
+// NewGaugeFunc creates and registers a gauge reading its value from a function.
+//
+// Parameters:
+//   - name: The name of the metric.
+//   - help: The description of the metric.
+//   - value: The function returning the current value; it must be safe for concurrent use.
+//
+// Returns:
+//   - *GaugeFunc: A pointer to the newly created gauge.
+func (r *Registry) NewGaugeFunc(name string, help string, value func() float64) *GaugeFunc {
+	g := &GaugeFunc{family: family{name: name, help: help, kind: "gauge"}, value: value}
+	r.register(g)
+	return g
+}
+
+// NewCounterFunc creates and registers a counter reading its value from a function,
+// for counts kept elsewhere, such as the statistics of a cache.
+//
+// Parameters:
+//   - name: The name of the metric, ending in _total by convention.
+//   - help: The description of the metric.
+//   - value: The function returning the current count; it must be safe for concurrent use.
+//
+// Returns:
+//   - *GaugeFunc: A pointer to the newly created counter.
+func (r *Registry) NewCounterFunc(name string, help string, value func() float64) *GaugeFunc {
+	g := &GaugeFunc{family: family{name: name, help: help, kind: "counter"}, value: value}
+	r.register(g)
+	return g
+}
+
+// write writes the gauge in the text exposition format.
+func (g *GaugeFunc) write(w io.Writer) error {
+	if err := g.header(w); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintf(w, "%s %s\n", g.name, formatValue(g.value()))
+	return err
+}
+
+// HistogramVec is a histogram partitioned by labels.
+type HistogramVec struct {
+	family
+	buckets []float64
+	mu      sync.Mutex
+	series  map[string]*histogramSeries
+}
+
+// histogramSeries holds the observations of a single combination of label values.
+type histogramSeries struct {
+	labelValues []string
+	counts      []uint64 // per bucket, not cumulative
+	count       uint64
+	sum         float64
+}
+
+// NewHistogramVec creates and registers a histogram.
+//
+// Parameters:
+//   - name: The name of the metric.
+//   - help: The description of the metric.
+//   - buckets: The increasing upper bounds of the buckets; the +Inf bucket is added implicitly.
+//   - labels: The names of the labels partitioning the histogram.
+//
+// Returns:
+//   - *HistogramVec: A pointer to the newly created histogram.
+func (r *Registry) NewHistogramVec(name string, help string, buckets []float64, labels ...string) *HistogramVec {
+	h := &HistogramVec{
+		family:  family{name: name, help: help, kind: "histogram", labels: labels},
+		buckets: buckets,
+		series:  make(map[string]*histogramSeries),
+	}
+	r.register(h)
+	return h
+}
+
+// Observe records a value for the given label values.
+func (h *HistogramVec) Observe(value float64, labelValues ...string) {
+	key := h.key(labelValues)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	series, exists := h.series[key]
+	if !exists {
+		series = &histogramSeries{labelValues: append([]string{}, labelValues...), counts: make([]uint64, len(h.buckets))}
+		h.series[key] = series
+	}
+	for i, bound := range h.buckets {
+		if value <= bound {
+			series.counts[i]++
+			break
+		}
+	}
+	series.count++
+	series.sum += value
+}
+
+// write writes the histogram in the text exposition format, with cumulative buckets.
+func (h *HistogramVec) write(w io.Writer) error {
+	if err := h.header(w); err != nil {
+		return err
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	keys := make([]string, 0, len(h.series))
+	for key := range h.series {
+		keys = append(keys, key)
+	}
+	for _, key := range sortedKeys(keys) {
+		series := h.series[key]
+		var cumulative uint64
+		for i, bound := range h.buckets {
+			cumulative += series.counts[i]
+			if _, err := fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.labelPairs(series.labelValues, "le", formatValue(bound)), cumulative); err != nil {
+				return err
+			}
+		}
+		labels := h.labelPairs(series.labelValues, "", "")
+		if _, err := fmt.Fprintf(w, "%s_bucket%s %d\n%s_sum%s %s\n%s_count%s %d\n",
+			h.name, h.labelPairs(series.labelValues, "le", "+Inf"), series.count,
+			h.name, labels, formatValue(series.sum),
+			h.name, labels, series.count); err != nil {
+			return err
+		}
+	}
+	return nil
+}
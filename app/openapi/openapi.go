@@ -0,0 +1,409 @@
+// Package openapi generates OpenAPI 3 documents from the Go types of requests and responses,
+// and validates JSON values against the generated schemas.
+package openapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Version is the OpenAPI version of generated documents.
+const Version = "3.0.3"
+
+// Schema represents an OpenAPI schema object.
+type Schema struct {
+	Ref                  string             `json:"$ref,omitempty"`
+	Type                 string             `json:"type,omitempty"`
+	Format               string             `json:"format,omitempty"`
+	Nullable             bool               `json:"nullable,omitempty"`
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	Items                *Schema            `json:"items,omitempty"`
+	AdditionalProperties *Schema            `json:"additionalProperties,omitempty"`
+}
+
+// Parameter represents a query parameter of an operation.
+type Parameter struct {
+	Name        string  `json:"name"`
+	In          string  `json:"in"`
+	Description string  `json:"description,omitempty"`
+	Required    bool    `json:"required,omitempty"`
+	Schema      *Schema `json:"schema"`
+}
+
+// Operation describes a single method of a path, in terms of Go values of its request and response types.
+type Operation struct {
+	Method             string
+	Summary            string
+	Query              []Parameter
+	Request            interface{} // a value of the request body type, or nil without a body
+	RequestContentType string      // the content type of the request body, application/json unless set
+	Response           interface{} // a value of the response type; a string is documented as text/plain
+	ContentType        string      // the content type of the response, application/json unless set
+	Status             int         // the status code of successful responses, 200 unless set
+}
+
+// Route describes the operations of a path and who may call them.
+type Route struct {
+	Path       string
+	Role       string // the role required to call the operations
+	Public     bool   // if true, callers need no credentials
+	Operations []Operation
+}
+
+// Document represents an OpenAPI document.
+type Document struct {
+	OpenAPI    string                          `json:"openapi"`
+	Info       Info                            `json:"info"`
+	Paths      map[string]map[string]operation `json:"paths"`
+	Components Components                      `json:"components"`
+}
+
+// Info represents the metadata of a document.
+type Info struct {
+	Title   string `json:"title"`
+	Version string `json:"version"`
+}
+
+// Components represents the reusable schemas and security schemes of a document.
+type Components struct {
+	Schemas         map[string]*Schema        `json:"schemas"`
+	SecuritySchemes map[string]securityScheme `json:"securitySchemes"`
+}
+
+// operation, requestBody, response, mediaType and securityScheme are the OpenAPI objects of an Operation.
+type (
+	operation struct {
+		Summary     string                `json:"summary,omitempty"`
+		Description string                `json:"description,omitempty"`
+		Parameters  []Parameter           `json:"parameters,omitempty"`
+		RequestBody *requestBody          `json:"requestBody,omitempty"`
+		Responses   map[string]response   `json:"responses"`
+		Security    []map[string][]string `json:"security"`
+	}
+	requestBody struct {
+		Required bool                 `json:"required"`
+		Content  map[string]mediaType `json:"content"`
+	}
+	response struct {
+		Description string               `json:"description"`
+		Content     map[string]mediaType `json:"content,omitempty"`
+	}
+	mediaType struct {
+		Schema *Schema `json:"schema"`
+	}
+	securityScheme struct {
+		Type         string `json:"type"`
+		Scheme       string `json:"scheme,omitempty"`
+		BearerFormat string `json:"bearerFormat,omitempty"`
+		In           string `json:"in,omitempty"`
+		Name         string `json:"name,omitempty"`
+	}
+)
+
+// errorResponses are documented for every operation; error bodies are plain text unless stated otherwise.
+var errorResponses = map[int]string{
+	http.StatusBadRequest:            "Invalid request",
+	http.StatusRequestEntityTooLarge: "Request body or number of passages exceeds the limit",
+	http.StatusTooManyRequests:       "Rate limit exceeded; see the Retry-After header",
+}
+
+// Build generates a document describing the routes.
+//
+// Parameters:
+//   - title: The title of the API.
+//   - version: The version of the API.
+//   - routes: The routes to describe.
+//
+// Returns:
+//   - Document: The generated document, with a component schema for every named struct type.
+func Build(title string, version string, routes []Route) Document {
+	document := Document{
+		OpenAPI: Version,
+		Info:    Info{Title: title, Version: version},
+		Paths:   make(map[string]map[string]operation),
+		Components: Components{
+			Schemas: make(map[string]*Schema),
+			SecuritySchemes: map[string]securityScheme{
+				"apiKey": {Type: "apiKey", In: "header", Name: "X-API-Key"},
+				"bearer": {Type: "http", Scheme: "bearer", BearerFormat: "JWT"},
+			},
+		},
+	}
+
+	for _, route := range routes {
+		item := make(map[string]operation)
+		for _, op := range route.Operations {
+			generated := operation{
+				Summary:    op.Summary,
+				Parameters: op.Query,
+				Responses:  make(map[string]response),
+				Security:   []map[string][]string{},
+			}
+			for i := range generated.Parameters {
+				generated.Parameters[i].In = "query"
+				if generated.Parameters[i].Schema == nil {
+					generated.Parameters[i].Schema = &Schema{Type: "string"}
+				}
+			}
+			if !route.Public {
+				generated.Security = []map[string][]string{{"apiKey": {}}, {"bearer": {}}}
+				generated.Description = "Requires an authenticated caller."
+				if route.Role != "" {
+					generated.Description = fmt.Sprintf("Requires the %s role.", route.Role)
+				}
+				generated.Responses["401"] = response{Description: "Missing or invalid credentials"}
+				generated.Responses["403"] = response{Description: "The caller lacks the required role"}
+			}
+			if op.Request != nil {
+				requestType := op.RequestContentType
+				if requestType == "" {
+					requestType = "application/json"
+				}
+				generated.RequestBody = &requestBody{
+					Required: true,
+					Content:  map[string]mediaType{requestType: {Schema: SchemaOf(reflect.TypeOf(op.Request), document.Components.Schemas)}},
+				}
+			}
+
+			status := op.Status
+			if status == 0 {
+				status = http.StatusOK
+			}
+			success := response{Description: http.StatusText(status)}
+			if op.Response != nil {
+				contentType := op.ContentType
+				if contentType == "" {
+					contentType = "application/json"
+				}
+				success.Content = map[string]mediaType{contentType: {Schema: SchemaOf(reflect.TypeOf(op.Response), document.Components.Schemas)}}
+			}
+			generated.Responses[strconv.Itoa(status)] = success
+			for code, description := range errorResponses {
+				generated.Responses[strconv.Itoa(code)] = response{Description: description}
+			}
+			item[strings.ToLower(op.Method)] = generated
+		}
+		document.Paths[route.Path] = item
+	}
+	return document
+}
+
+// timeType is documented as a date-time string, the way encoding/json writes it.
+var timeType = reflect.TypeOf(time.Time{})
+
+// rawMessageType holds JSON passed through as is, so it may be any value.
+var rawMessageType = reflect.TypeOf(json.RawMessage{})
+
+// SchemaOf returns the schema of a Go type as encoded by encoding/json. Named struct types are added
+// to the components and referenced.
+//
+// Parameters:
+//   - t: The type.
+//   - components: The component schemas, keyed by type name.
+//
+// Returns:
+//   - *Schema: The schema of the type.
+func SchemaOf(t reflect.Type, components map[string]*Schema) *Schema {
+	switch {
+	case t == timeType:
+		return &Schema{Type: "string", Format: "date-time"}
+	case t == rawMessageType:
+		return &Schema{}
+	case t.Kind() == reflect.Ptr:
+		schema := *SchemaOf(t.Elem(), components)
+		if schema.Ref != "" {
+			// siblings of $ref are ignored in OpenAPI 3.0, so a nullable reference cannot be expressed
+			return &schema
+		}
+		schema.Nullable = true
+		return &schema
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return &Schema{Type: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return &Schema{Type: "integer"}
+	case reflect.Float32, reflect.Float64:
+		return &Schema{Type: "number"}
+	case reflect.String:
+		return &Schema{Type: "string"}
+	case reflect.Slice, reflect.Array:
+		return &Schema{Type: "array", Items: SchemaOf(t.Elem(), components), Nullable: t.Kind() == reflect.Slice}
+	case reflect.Map:
+		return &Schema{Type: "object", AdditionalProperties: SchemaOf(t.Elem(), components), Nullable: true}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return structSchema(t, components)
+		}
+		name := componentName(t)
+		if _, exists := components[name]; !exists {
+			// registered before its fields, so recursive types terminate
+			components[name] = &Schema{}
+			*components[name] = *structSchema(t, components)
+		}
+		return &Schema{Ref: "#/components/schemas/" + name}
+	default:
+		// interfaces and other kinds may hold any value
+		return &Schema{}
+	}
+}
+
+// componentName names the component of a struct type after its package and type name, as in calculator.TripResult.
+func componentName(t reflect.Type) string {
+	return path.Base(t.PkgPath()) + "." + t.Name()
+}
+
+// structSchema returns the object schema of a struct type, following the rules of encoding/json
+// for field names, skipped fields and embedded structs.
+func structSchema(t reflect.Type, components map[string]*Schema) *Schema {
+	schema := &Schema{Type: "object", Properties: make(map[string]*Schema)}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("json")
+		if tag == "-" || (field.PkgPath != "" && !field.Anonymous) {
+			continue
+		}
+		name := strings.Split(tag, ",")[0]
+		if field.Anonymous && name == "" && field.Type.Kind() == reflect.Struct {
+			for key, property := range structSchema(field.Type, components).Properties {
+				schema.Properties[key] = property
+			}
+			continue
+		}
+		if field.PkgPath != "" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		schema.Properties[name] = SchemaOf(field.Type, components)
+	}
+	return schema
+}
+
+// Validate checks that a decoded JSON value matches a schema. Objects may not contain undocumented properties.
+//
+// Parameters:
+//   - value: The value as decoded by encoding/json into an interface{}.
+//   - schema: The schema.
+//   - components: The component schemas referenced by the schema.
+//
+// Returns:
+//   - error: An error naming the path of the first mismatch.
+func Validate(value interface{}, schema *Schema, components map[string]*Schema) error {
+	return validate("$", value, schema, components)
+}
+
+// validate checks a value at the given path.
+func validate(path string, value interface{}, schema *Schema, components map[string]*Schema) error {
+	if schema.Ref != "" {
+		referenced, exists := components[strings.TrimPrefix(schema.Ref, "#/components/schemas/")]
+		if !exists {
+			return fmt.Errorf("%s: unknown reference %s", path, schema.Ref)
+		}
+		return validate(path, value, referenced, components)
+	}
+	if value == nil {
+		if schema.Nullable || schema.Type == "" {
+			return nil
+		}
+		return fmt.Errorf("%s: null is not a %s", path, schema.Type)
+	}
+
+	switch schema.Type {
+	case "":
+		return nil
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			return fmt.Errorf("%s: %v is not a boolean", path, value)
+		}
+	case "integer":
+		number, ok := value.(float64)
+		if !ok || number != float64(int64(number)) {
+			return fmt.Errorf("%s: %v is not an integer", path, value)
+		}
+	case "number":
+		if _, ok := value.(float64); !ok {
+			return fmt.Errorf("%s: %v is not a number", path, value)
+		}
+	case "string":
+		text, ok := value.(string)
+		if !ok {
+			return fmt.Errorf("%s: %v is not a string", path, value)
+		}
+		if schema.Format == "date-time" {
+			if _, err := time.Parse(time.RFC3339Nano, text); err != nil {
+				return fmt.Errorf("%s: %q is not a date-time", path, text)
+			}
+		}
+	case "array":
+		items, ok := value.([]interface{})
+		if !ok {
+			return fmt.Errorf("%s: %v is not an array", path, value)
+		}
+		for i, item := range items {
+			if err := validate(fmt.Sprintf("%s[%d]", path, i), item, schema.Items, components); err != nil {
+				return err
+			}
+		}
+	case "object":
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("%s: %v is not an object", path, value)
+		}
+		keys := make([]string, 0, len(object))
+		for key := range object {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			property, documented := schema.Properties[key]
+			if !documented {
+				property = schema.AdditionalProperties
+			}
+			if property == nil {
+				return fmt.Errorf("%s: undocumented property %s", path, key)
+			}
+			if err := validate(path+"."+key, object[key], property, components); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("%s: unknown schema type %s", path, schema.Type)
+	}
+	return nil
+}
+
+// ResponseSchema returns the schema of the successful JSON response of an operation in a document.
+//
+// Parameters:
+//   - path: The path of the operation.
+//   - method: The HTTP method of the operation.
+//
+// Returns:
+//   - *Schema: The schema of the response.
+//   - bool: False if the document has no JSON response for the operation.
+func (d Document) ResponseSchema(path string, method string) (*Schema, bool) {
+	op, exists := d.Paths[path][strings.ToLower(method)]
+	if !exists {
+		return nil, false
+	}
+	for status, response := range op.Responses {
+		if !strings.HasPrefix(status, "2") {
+			continue
+		}
+		if media, exists := response.Content["application/json"]; exists {
+			return media.Schema, true
+		}
+	}
+	return nil, false
+}
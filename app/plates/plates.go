@@ -0,0 +1,135 @@
+// Package plates provides license plate normalization, per-country format validation
+// and detection of the country a vehicle is registered in.
+package plates
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+)
+
+// Countries with known license plate formats, as ISO 3166 codes.
+const (
+	Sweden = "SE"
+	Serbia = "RS"
+)
+
+// HomeCountry is the country in which vehicles are not considered foreign.
+const HomeCountry = Sweden
+
+// CountryUnknown is the country of plates matching no known format.
+const CountryUnknown = ""
+
+// Series of license plates within a country.
+const (
+	SeriesStandard     = "standard"
+	SeriesPersonalized = "personalized"
+	SeriesDiplomatic   = "diplomatic"
+	SeriesUnrecognized = "unrecognized"
+)
+
+// ErrInvalidPlate is returned for license plates that no country issues, such as plates with symbols or without letters.
+var ErrInvalidPlate = errors.New("license plate is not valid")
+
+// Plate represents a parsed license plate.
+type Plate struct {
+	Number  string `json:"number"`
+	Country string `json:"country"`
+	Series  string `json:"series"`
+}
+
+// IsForeign checks if the plate is registered outside of the home country.
+// Plates matching no known format are not known to be registered in the home country and are foreign as well.
+func (p Plate) IsForeign() bool {
+	return p.Country != HomeCountry
+}
+
+// IsDiplomatic checks if the plate belongs to a diplomatic series.
+func (p Plate) IsDiplomatic() bool {
+	return p.Series == SeriesDiplomatic
+}
+
+// formatRule represents a single license plate format of a country, matched against normalized plates.
+type formatRule struct {
+	country string
+	series  string
+	pattern *regexp.Regexp
+}
+
+// formatRules are checked in order, so more specific formats must come before more permissive ones.
+var formatRules = []formatRule{
+	// ABC123 and, since 2019, ABC12A
+	{country: Sweden, series: SeriesStandard, pattern: regexp.MustCompile(`^[A-Z]{3}[0-9]{2}[0-9A-Z]$`)},
+	// two letters of the mission, three digits and a letter, e.g. AB 123 C
+	{country: Sweden, series: SeriesDiplomatic, pattern: regexp.MustCompile(`^[A-Z]{2}[0-9]{3}[A-Z]$`)},
+	// city code, three to five digits and two letters, e.g. BG-123-AB
+	{country: Serbia, series: SeriesStandard, pattern: regexp.MustCompile(`^[A-Z]{2}[0-9]{3,5}[A-Z]{2}$`)},
+	// CD, CMD or CC followed by six digits, e.g. CD 123-456
+	{country: Serbia, series: SeriesDiplomatic, pattern: regexp.MustCompile(`^(CD|CMD|CC)[0-9]{6}$`)},
+}
+
+// plausiblePattern matches plates of formats not known here: letters and digits with at least one letter.
+var plausiblePattern = regexp.MustCompile(`^[A-ZÅÄÖ0-9]*[A-ZÅÄÖ][A-ZÅÄÖ0-9]*$`)
+
+// personalizedPattern matches the text of Swedish personalized plates: two to seven letters or digits
+// chosen by the owner, with at least one letter.
+var personalizedPattern = regexp.MustCompile(`^[A-ZÅÄÖ0-9]{0,6}[A-ZÅÄÖ][A-ZÅÄÖ0-9]{0,6}$`)
+
+// standardLookalikePattern matches texts starting with three letters and a digit, which are not issued
+// as personalized plates since they could be mistaken for a standard plate.
+var standardLookalikePattern = regexp.MustCompile(`^[A-Z]{3}[0-9]`)
+
+// Normalize removes spaces and dashes from the license plate and converts it to upper case.
+func Normalize(licensePlate string) string {
+	replacer := strings.NewReplacer(" ", "", "-", "", "\t", "")
+	return strings.ToUpper(replacer.Replace(licensePlate))
+}
+
+// Parse normalizes the license plate and detects its country and series.
+// A personalized plate cannot be told apart from a foreign plate by its text alone, so plates matching
+// no known format are parsed as unrecognized foreign plates; see Registered.
+//
+// Parameters:
+//   - licensePlate: The license plate as entered, with any spacing, case or dashes.
+//
+// Returns:
+//   - Plate: The normalized plate with its country and series.
+//   - error: ErrInvalidPlate if the plate is too short or too long, has symbols or has no letter.
+func Parse(licensePlate string) (Plate, error) {
+	number := Normalize(licensePlate)
+	length := len([]rune(number))
+	if length < 2 || length > 9 {
+		return Plate{}, ErrInvalidPlate
+	}
+
+	for _, rule := range formatRules {
+		if rule.pattern.MatchString(number) {
+			return Plate{Number: number, Country: rule.country, Series: rule.series}, nil
+		}
+	}
+	if plausiblePattern.MatchString(number) {
+		return Plate{Number: number, Country: CountryUnknown, Series: SeriesUnrecognized}, nil
+	}
+	return Plate{}, ErrInvalidPlate
+}
+
+// Registered returns a plate found in the vehicle registry. A plate of no known format is taken
+// as a personalized plate of the home country if it follows the rules of personalized plates.
+func Registered(plate Plate) Plate {
+	if plate.Series != SeriesUnrecognized || !IsPersonalized(plate.Number) {
+		return plate
+	}
+	return Plate{Number: plate.Number, Country: HomeCountry, Series: SeriesPersonalized}
+}
+
+// IsPersonalized checks if the license plate follows the rules of Swedish personalized plates.
+func IsPersonalized(licensePlate string) bool {
+	number := Normalize(licensePlate)
+	return personalizedPattern.MatchString(number) && !standardLookalikePattern.MatchString(number)
+}
+
+// IsValid checks if the license plate matches any known format.
+func IsValid(licensePlate string) bool {
+	_, err := Parse(licensePlate)
+	return err == nil
+}
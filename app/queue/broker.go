@@ -0,0 +1,160 @@
+package queue
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// Broker is an in-process message broker keeping the messages of every topic in memory, for
+// producers running in the same process and for tests. Offsets are the number of messages before.
+// Messages acknowledged by every subscriber of a topic are trimmed when the next message is published;
+// a topic without subscribers keeps its messages for the first one.
+type Broker struct {
+	mu     sync.Mutex
+	topics map[string]*brokerTopic
+	// published is closed and replaced whenever a message is published, waking up waiting receivers.
+	published chan struct{}
+}
+
+// brokerTopic holds the messages of a topic not yet acknowledged by all of its subscribers.
+type brokerTopic struct {
+	// first is the offset before the oldest message kept.
+	first    int64
+	messages [][]byte
+	// acked holds the offset acknowledged by every open subscriber.
+	acked map[*brokerSource]int64
+}
+
+// NewBroker creates an empty broker.
+//
+// Returns:
+//   - *Broker: A pointer to the newly created Broker instance.
+func NewBroker() *Broker {
+	return &Broker{topics: make(map[string]*brokerTopic), published: make(chan struct{})}
+}
+
+// topic returns a topic, creating it if needed. The caller must hold the lock.
+func (b *Broker) topic(name string) *brokerTopic {
+	topic, exists := b.topics[name]
+	if !exists {
+		topic = &brokerTopic{acked: make(map[*brokerSource]int64)}
+		b.topics[name] = topic
+	}
+	return topic
+}
+
+// Publish appends a message to a topic and trims the messages acknowledged by all of its subscribers.
+//
+// Returns:
+//   - int64: The offset after the message.
+func (b *Broker) Publish(topic string, data []byte) int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	t := b.topic(topic)
+	t.messages = append(t.messages, append([]byte{}, data...))
+	t.trim()
+	close(b.published)
+	b.published = make(chan struct{})
+	return t.first + int64(len(t.messages))
+}
+
+// trim drops the messages below the lowest offset acknowledged by the subscribers of the topic.
+func (t *brokerTopic) trim() {
+	if len(t.acked) == 0 {
+		return
+	}
+	lowest := t.first + int64(len(t.messages))
+	for _, offset := range t.acked {
+		if offset < lowest {
+			lowest = offset
+		}
+	}
+	if lowest <= t.first {
+		return
+	}
+	trimmed := lowest - t.first
+	for i := int64(0); i < trimmed; i++ {
+		t.messages[i] = nil
+	}
+	t.messages = t.messages[trimmed:]
+	t.first = lowest
+}
+
+// Subscribe returns a source reading a topic from an offset. The messages from the offset on are kept
+// until the source acknowledges them or is closed.
+func (b *Broker) Subscribe(topic string, offset int64) Source {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	source := &brokerSource{broker: b, topic: topic, offset: offset}
+	t := b.topic(topic)
+	// an offset already trimmed must not hold back the trimming of later messages
+	if offset < t.first {
+		offset = t.first
+	}
+	t.acked[source] = offset
+	return source
+}
+
+// brokerSource reads a topic of a broker.
+type brokerSource struct {
+	broker *Broker
+	topic  string
+	offset int64
+}
+
+// Name identifies the topic.
+func (s *brokerSource) Name() string {
+	return "broker:" + s.topic
+}
+
+// Receive returns the message at the offset of the source, waiting for it to be published.
+//
+// Returns:
+//   - Message: The next message of the topic.
+//   - error: ctx.Err() once ctx is done, or an error if the offset of the source was already trimmed.
+func (s *brokerSource) Receive(ctx context.Context) (Message, error) {
+	for {
+		s.broker.mu.Lock()
+		topic, published := s.broker.topic(s.topic), s.broker.published
+		if s.offset < topic.first {
+			s.broker.mu.Unlock()
+			return Message{}, fmt.Errorf("offset %d of topic %s was trimmed, the oldest message kept is after offset %d", s.offset, s.topic, topic.first)
+		}
+		var data []byte
+		if index := s.offset - topic.first; index < int64(len(topic.messages)) {
+			data = topic.messages[index]
+		}
+		s.broker.mu.Unlock()
+
+		if data != nil {
+			s.offset++
+			return Message{Offset: s.offset, Data: data}, nil
+		}
+		select {
+		case <-ctx.Done():
+			return Message{}, ctx.Err()
+		case <-published:
+		}
+	}
+}
+
+// Ack records that the messages up to the acknowledged one may be trimmed. The consumer's
+// checkpoint remains the record of progress across restarts.
+func (s *brokerSource) Ack(message Message) error {
+	s.broker.mu.Lock()
+	defer s.broker.mu.Unlock()
+	acked := s.broker.topic(s.topic).acked
+	if offset, open := acked[s]; open && message.Offset > offset {
+		acked[s] = message.Offset
+	}
+	return nil
+}
+
+// Close stops the source from holding back the trimming of its topic; the broker outlives its subscriptions.
+func (s *brokerSource) Close() error {
+	s.broker.mu.Lock()
+	defer s.broker.mu.Unlock()
+	delete(s.broker.topic(s.topic).acked, s)
+	return nil
+}
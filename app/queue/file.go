@@ -0,0 +1,128 @@
+package queue
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"time"
+)
+
+// FileSource tails a file of newline-delimited messages, such as the export of a gantry platform.
+// Offsets are byte positions, so the source resumes after the last processed line. A line is read
+// only once its newline has been written; a file shorter than the offset is taken as rotated and read from the start.
+type FileSource struct {
+	path         string
+	file         *os.File
+	reader       *bufio.Reader
+	offset       int64
+	partial      []byte
+	pollInterval time.Duration
+}
+
+// OpenFile opens a file source.
+//
+// Parameters:
+//   - path: The path of the file; it may not exist yet.
+//   - offset: The byte position to start reading at.
+//   - pollInterval: How often the file is checked for new lines once its end is reached.
+//
+// Returns:
+//   - *FileSource: A pointer to the opened FileSource.
+func OpenFile(path string, offset int64, pollInterval time.Duration) *FileSource {
+	return &FileSource{path: path, offset: offset, pollInterval: pollInterval}
+}
+
+// Name identifies the file.
+func (s *FileSource) Name() string {
+	return "file:" + s.path
+}
+
+// Receive returns the next complete line of the file, waiting for it to be written.
+func (s *FileSource) Receive(ctx context.Context) (Message, error) {
+	for {
+		if s.file == nil {
+			if err := s.open(); err != nil && !os.IsNotExist(err) {
+				return Message{}, err
+			}
+		}
+		if s.file != nil {
+			line, err := s.reader.ReadBytes('\n')
+			s.partial = append(s.partial, line...)
+			if err == nil {
+				data := bytes.TrimRight(s.partial, "\r\n")
+				s.offset += int64(len(s.partial))
+				s.partial = nil
+				if len(data) == 0 {
+					continue
+				}
+				return Message{Offset: s.offset, Data: data}, nil
+			}
+			if err != io.EOF {
+				return Message{}, err
+			}
+			if err := s.checkRotation(); err != nil {
+				return Message{}, err
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return Message{}, ctx.Err()
+		case <-time.After(s.pollInterval):
+		}
+	}
+}
+
+// open opens the file at the offset of the source.
+func (s *FileSource) open() error {
+	file, err := os.Open(s.path)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	if info.Size() < s.offset {
+		s.offset = 0
+	}
+	if _, err := file.Seek(s.offset, io.SeekStart); err != nil {
+		file.Close()
+		return err
+	}
+	s.file, s.reader, s.partial = file, bufio.NewReader(file), nil
+	return nil
+}
+
+// checkRotation reopens the file from the start if it was truncated or replaced by a shorter one.
+func (s *FileSource) checkRotation() error {
+	info, err := os.Stat(s.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if info.Size() >= s.offset+int64(len(s.partial)) {
+		return nil
+	}
+	s.file.Close()
+	s.file, s.offset = nil, 0
+	return nil
+}
+
+// Ack does nothing; the consumer's checkpoint is the only record of progress.
+func (s *FileSource) Ack(message Message) error {
+	return nil
+}
+
+// Close closes the file.
+func (s *FileSource) Close() error {
+	if s.file == nil {
+		return nil
+	}
+	return s.file.Close()
+}
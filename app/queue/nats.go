@@ -0,0 +1,265 @@
+package queue
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// natsPullExpiry is how long a pull request waits for a message before the server answers with a timeout.
+const natsPullExpiry = 5 * time.Second
+
+// natsMessage represents a message delivered to the inbox of a NATS source.
+type natsMessage struct {
+	reply  string
+	data   []byte
+	status string
+}
+
+// NATSSource reads messages from a durable pull consumer of a NATS JetStream stream, speaking the
+// NATS client protocol directly. JetStream keeps track of acknowledged messages itself and
+// redelivers unacknowledged ones, so the source resumes where the durable consumer stopped; the
+// offset of its messages is their stream sequence.
+type NATSSource struct {
+	address  string
+	stream   string
+	consumer string
+	conn     net.Conn
+	inbox    string
+	writeMu  sync.Mutex
+	messages chan natsMessage
+	done     chan struct{}
+	err      error
+	pulling  bool
+}
+
+// DialNATS connects to a NATS server.
+//
+// Parameters:
+//   - address: The host and port of the server.
+//   - stream: The JetStream stream holding the messages.
+//   - consumer: The durable pull consumer of the stream, which must exist.
+//
+// Returns:
+//   - *NATSSource: A pointer to the connected NATSSource.
+//   - error: An error if the server cannot be reached or rejects the connection.
+func DialNATS(address string, stream string, consumer string) (*NATSSource, error) {
+	conn, err := net.DialTimeout("tcp", address, 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	source := &NATSSource{
+		address:  address,
+		stream:   stream,
+		consumer: consumer,
+		conn:     conn,
+		inbox:    "_INBOX." + randomToken(),
+		messages: make(chan natsMessage, 16),
+		done:     make(chan struct{}),
+	}
+
+	reader := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	info, err := reader.ReadString('\n')
+	if err != nil || !strings.HasPrefix(info, "INFO ") {
+		conn.Close()
+		return nil, fmt.Errorf("NATS server %s did not introduce itself: %v", address, err)
+	}
+	source.write(`CONNECT {"verbose":false,"pedantic":false,"headers":true,"name":"congestion-calculator"}` + "\r\n" +
+		"SUB " + source.inbox + " 1\r\nPING\r\n")
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		if strings.HasPrefix(line, "-ERR") {
+			conn.Close()
+			return nil, fmt.Errorf("NATS server %s rejected the connection: %s", address, strings.TrimSpace(line))
+		}
+		if strings.HasPrefix(line, "PONG") {
+			break
+		}
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	go source.read(reader)
+	return source, nil
+}
+
+// Name identifies the stream and consumer.
+func (s *NATSSource) Name() string {
+	return fmt.Sprintf("nats:%s/%s/%s", s.address, s.stream, s.consumer)
+}
+
+// Receive pulls the next message of the consumer, waiting for one to be published.
+func (s *NATSSource) Receive(ctx context.Context) (Message, error) {
+	for {
+		if !s.pulling {
+			request, _ := json.Marshal(map[string]int64{"batch": 1, "expires": int64(natsPullExpiry)})
+			subject := fmt.Sprintf("$JS.API.CONSUMER.MSG.NEXT.%s.%s", s.stream, s.consumer)
+			if err := s.write(fmt.Sprintf("PUB %s %s %d\r\n%s\r\n", subject, s.inbox, len(request), request)); err != nil {
+				return Message{}, err
+			}
+			s.pulling = true
+		}
+
+		select {
+		case <-ctx.Done():
+			return Message{}, ctx.Err()
+		case <-s.done:
+			return Message{}, s.err
+		case message := <-s.messages:
+			s.pulling = false
+			if message.status != "" {
+				// 408: the pull request expired without messages; other statuses are retried after a pause
+				if message.status != "408" {
+					time.Sleep(100 * time.Millisecond)
+				}
+				continue
+			}
+			reply := message.reply
+			return Message{
+				Offset: streamSequence(reply),
+				Data:   message.data,
+				ack: func() error {
+					return s.write(fmt.Sprintf("PUB %s 4\r\n+ACK\r\n", reply))
+				},
+			}, nil
+		}
+	}
+}
+
+// Ack acknowledges a message to JetStream, so it is not redelivered.
+func (s *NATSSource) Ack(message Message) error {
+	if message.ack == nil {
+		return nil
+	}
+	return message.ack()
+}
+
+// Close closes the connection.
+func (s *NATSSource) Close() error {
+	return s.conn.Close()
+}
+
+// write sends protocol lines to the server.
+func (s *NATSSource) write(lines string) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	s.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	_, err := io.WriteString(s.conn, lines)
+	return err
+}
+
+// read parses the protocol lines of the server until the connection fails, delivering messages to Receive.
+func (s *NATSSource) read(reader *bufio.Reader) {
+	s.err = s.readLoop(reader)
+	close(s.done)
+}
+
+// readLoop parses protocol lines and returns the error that ended the connection.
+func (s *NATSSource) readLoop(reader *bufio.Reader) error {
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		switch strings.ToUpper(fields[0]) {
+		case "PING":
+			if err := s.write("PONG\r\n"); err != nil {
+				return err
+			}
+		case "-ERR":
+			return fmt.Errorf("NATS server error: %s", strings.TrimSpace(strings.TrimPrefix(line, fields[0])))
+		case "MSG", "HMSG":
+			message, err := readNATSMessage(reader, fields)
+			if err != nil {
+				return err
+			}
+			s.messages <- message
+		}
+	}
+}
+
+// readNATSMessage reads the payload of a MSG or HMSG line: MSG <subject> <sid> [reply] <size>
+// or HMSG <subject> <sid> [reply] <header size> <total size>. Messages with a status header
+// are replies of the server to the pull request rather than messages of the stream.
+func readNATSMessage(reader *bufio.Reader, fields []string) (natsMessage, error) {
+	withHeaders := strings.EqualFold(fields[0], "HMSG")
+	sizes := 1
+	if withHeaders {
+		sizes = 2
+	}
+	if len(fields) < 3+sizes || len(fields) > 4+sizes {
+		return natsMessage{}, fmt.Errorf("malformed NATS message line %q", strings.Join(fields, " "))
+	}
+	var message natsMessage
+	if len(fields) == 4+sizes {
+		message.reply = fields[3]
+	}
+	total, err := strconv.Atoi(fields[len(fields)-1])
+	if err != nil || total < 0 {
+		return natsMessage{}, fmt.Errorf("malformed NATS message size %q", fields[len(fields)-1])
+	}
+	headerSize := 0
+	if withHeaders {
+		headerSize, err = strconv.Atoi(fields[len(fields)-2])
+		if err != nil || headerSize < 0 || headerSize > total {
+			return natsMessage{}, fmt.Errorf("malformed NATS header size %q", fields[len(fields)-2])
+		}
+	}
+
+	payload := make([]byte, total+2)
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return natsMessage{}, err
+	}
+	if withHeaders {
+		// the first header line is "NATS/1.0" optionally followed by a status code and description
+		statusLine := strings.SplitN(string(payload[:headerSize]), "\r\n", 2)[0]
+		if status := strings.Fields(statusLine); len(status) > 1 {
+			message.status = status[1]
+		}
+	}
+	message.data = payload[headerSize:total]
+	return message, nil
+}
+
+// streamSequence returns the stream sequence in the ack subject of a JetStream message:
+// $JS.ACK.<stream>.<consumer>.<delivered>.<stream seq>... or, with a domain and account,
+// $JS.ACK.<domain>.<account>.<stream>.<consumer>.<delivered>.<stream seq>...
+func streamSequence(reply string) int64 {
+	tokens := strings.Split(reply, ".")
+	index := 5
+	if len(tokens) >= 12 {
+		index = 7
+	}
+	if len(tokens) <= index {
+		return 0
+	}
+	sequence, _ := strconv.ParseInt(tokens[index], 10, 64)
+	return sequence
+}
+
+// randomToken returns a random token for inbox subjects.
+func randomToken() string {
+	buffer := make([]byte, 8)
+	if _, err := rand.Read(buffer); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 36)
+	}
+	return hex.EncodeToString(buffer)
+}
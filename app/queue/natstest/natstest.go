@@ -0,0 +1,274 @@
+// Package natstest provides a local stand-in for a NATS server with a single JetStream stream and durable
+// pull consumer, for testing queue.NATSSource without a NATS installation. It implements only the parts of
+// the protocol the source uses: publishing, subscribing, pull requests with expiry, acknowledgements and
+// redelivery of messages not acknowledged in time.
+package natstest
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// message holds a message of the stream and its delivery state.
+type message struct {
+	sequence    int64
+	data        []byte
+	acked       bool
+	deliveries  int
+	deliveredAt time.Time
+}
+
+// pull holds a pending pull request of a client.
+type pull struct {
+	client  *client
+	inbox   string
+	expires time.Time
+}
+
+// client holds a connection and its subscriptions by subject.
+type client struct {
+	conn    net.Conn
+	writeMu sync.Mutex
+	sids    map[string]string
+}
+
+// Server is the stand-in server.
+type Server struct {
+	stream   string
+	consumer string
+	ackWait  time.Duration
+	listener net.Listener
+
+	mu        sync.Mutex
+	messages  []*message
+	pulls     []pull
+	clients   []*client
+	delivered int64
+	closed    chan struct{}
+}
+
+// NewServer starts a server listening on a local port.
+//
+// Parameters:
+//   - stream: The name of the stream.
+//   - consumer: The name of the durable pull consumer.
+//   - ackWait: How long a delivered message may stay unacknowledged before it is redelivered.
+//
+// Returns:
+//   - *Server: A pointer to the started Server.
+//   - error: An error if no local port could be opened.
+func NewServer(stream string, consumer string, ackWait time.Duration) (*Server, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	server := &Server{stream: stream, consumer: consumer, ackWait: ackWait, listener: listener, closed: make(chan struct{})}
+	go server.accept()
+	go server.dispatch()
+	return server, nil
+}
+
+// Addr returns the host and port the server listens on.
+func (s *Server) Addr() string {
+	return s.listener.Addr().String()
+}
+
+// Publish appends a message to the stream.
+//
+// Returns:
+//   - int64: The stream sequence of the message.
+func (s *Server) Publish(data []byte) int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sequence := int64(len(s.messages) + 1)
+	s.messages = append(s.messages, &message{sequence: sequence, data: append([]byte{}, data...)})
+	return sequence
+}
+
+// Acked returns the stream sequences of the acknowledged messages.
+func (s *Server) Acked() []int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var acked []int64
+	for _, m := range s.messages {
+		if m.acked {
+			acked = append(acked, m.sequence)
+		}
+	}
+	return acked
+}
+
+// Deliveries returns how often the message with the given stream sequence was delivered.
+func (s *Server) Deliveries(sequence int64) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if sequence < 1 || sequence > int64(len(s.messages)) {
+		return 0
+	}
+	return s.messages[sequence-1].deliveries
+}
+
+// Close stops the server and closes its connections.
+func (s *Server) Close() {
+	close(s.closed)
+	s.listener.Close()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range s.clients {
+		c.conn.Close()
+	}
+}
+
+// accept serves connections until the listener is closed.
+func (s *Server) accept() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		c := &client{conn: conn, sids: make(map[string]string)}
+		s.mu.Lock()
+		s.clients = append(s.clients, c)
+		s.mu.Unlock()
+		go s.serve(c)
+	}
+}
+
+// serve handles the protocol lines of a client.
+func (s *Server) serve(c *client) {
+	defer c.conn.Close()
+	c.write(`INFO {"server_id":"natstest","version":"2.10.0","headers":true,"max_payload":1048576}` + "\r\n")
+
+	reader := bufio.NewReader(c.conn)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		switch strings.ToUpper(fields[0]) {
+		case "PING":
+			c.write("PONG\r\n")
+		case "SUB":
+			if len(fields) >= 3 {
+				c.writeMu.Lock()
+				c.sids[fields[1]] = fields[len(fields)-1]
+				c.writeMu.Unlock()
+			}
+		case "PUB":
+			if len(fields) < 3 {
+				c.write("-ERR 'Unknown Protocol Operation'\r\n")
+				return
+			}
+			size, err := strconv.Atoi(fields[len(fields)-1])
+			if err != nil {
+				return
+			}
+			payload := make([]byte, size+2)
+			if _, err := io.ReadFull(reader, payload); err != nil {
+				return
+			}
+			reply := ""
+			if len(fields) == 4 {
+				reply = fields[2]
+			}
+			s.publish(c, fields[1], reply, payload[:size])
+		}
+	}
+}
+
+// publish handles a message published by a client: a pull request, an acknowledgement or a message for the stream.
+func (s *Server) publish(c *client, subject string, reply string, payload []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch {
+	case subject == fmt.Sprintf("$JS.API.CONSUMER.MSG.NEXT.%s.%s", s.stream, s.consumer):
+		expires := 30 * time.Second
+		if i := strings.Index(string(payload), `"expires":`); i >= 0 {
+			digits := strings.TrimLeft(string(payload[i+len(`"expires":`):]), " ")
+			if end := strings.IndexAny(digits, ",}"); end > 0 {
+				if nanoseconds, err := strconv.ParseInt(digits[:end], 10, 64); err == nil {
+					expires = time.Duration(nanoseconds)
+				}
+			}
+		}
+		s.pulls = append(s.pulls, pull{client: c, inbox: reply, expires: time.Now().Add(expires)})
+	case strings.HasPrefix(subject, fmt.Sprintf("$JS.ACK.%s.%s.", s.stream, s.consumer)):
+		tokens := strings.Split(subject, ".")
+		if sequence, err := strconv.ParseInt(tokens[5], 10, 64); err == nil && sequence >= 1 && sequence <= int64(len(s.messages)) {
+			s.messages[sequence-1].acked = true
+		}
+	default:
+		sequence := int64(len(s.messages) + 1)
+		s.messages = append(s.messages, &message{sequence: sequence, data: append([]byte{}, payload...)})
+	}
+}
+
+// dispatch answers pending pull requests with the next deliverable message, or a timeout once they expire.
+func (s *Server) dispatch() {
+	ticker := time.NewTicker(5 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.closed:
+			return
+		case <-ticker.C:
+		}
+
+		s.mu.Lock()
+		now := time.Now()
+		var waiting []pull
+		for _, p := range s.pulls {
+			if m := s.next(now); m != nil {
+				m.deliveries++
+				m.deliveredAt = now
+				s.delivered++
+				ack := fmt.Sprintf("$JS.ACK.%s.%s.%d.%d.%d.%d.%d", s.stream, s.consumer, m.deliveries, m.sequence, s.delivered, now.UnixNano(), 0)
+				p.client.write(fmt.Sprintf("MSG %s %s %s %d\r\n%s\r\n", p.inbox, p.client.sid(p.inbox), ack, len(m.data), m.data))
+				continue
+			}
+			if now.After(p.expires) {
+				header := "NATS/1.0 408 Request Timeout\r\n\r\n"
+				p.client.write(fmt.Sprintf("HMSG %s %s %d %d\r\n%s\r\n", p.inbox, p.client.sid(p.inbox), len(header), len(header), header))
+				continue
+			}
+			waiting = append(waiting, p)
+		}
+		s.pulls = waiting
+		s.mu.Unlock()
+	}
+}
+
+// next returns the first message that was never delivered or whose acknowledgement is overdue.
+func (s *Server) next(now time.Time) *message {
+	for _, m := range s.messages {
+		if !m.acked && (m.deliveries == 0 || now.Sub(m.deliveredAt) > s.ackWait) {
+			return m
+		}
+	}
+	return nil
+}
+
+// sid returns the subscription id of a subject of the client.
+func (c *client) sid(subject string) string {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return c.sids[subject]
+}
+
+// write sends protocol lines to the client.
+func (c *client) write(lines string) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(c.conn, lines)
+}
@@ -0,0 +1,299 @@
+// Package queue consumes events from message queues. A Consumer reads messages from a pluggable Source,
+// hands them to a handler and checkpoints the offset of every processed message. Processing is
+// at-least-once: a message is acknowledged only after its handler succeeded or it was dead-lettered,
+// so after a restart the messages since the last checkpoint are read again and handlers must be idempotent.
+package queue
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Message represents a single event read from a source.
+type Message struct {
+	// Offset is the position in the source after the message; a source opened at this offset starts with the next message.
+	Offset int64
+	Data   []byte
+	// ack acknowledges the message to sources that track delivery themselves.
+	ack func() error
+}
+
+// Source is a queue the consumer reads messages from.
+type Source interface {
+	// Name identifies the source in checkpoints, dead letters and logs.
+	Name() string
+	// Receive blocks until the next message is available or ctx is done.
+	Receive(ctx context.Context) (Message, error)
+	// Ack acknowledges a processed message.
+	Ack(message Message) error
+	// Close releases the source.
+	Close() error
+}
+
+// MalformedError marks a message that can never be processed; it is dead-lettered instead of retried.
+type MalformedError struct {
+	Err error
+}
+
+// Error returns the reason the message is malformed.
+func (e *MalformedError) Error() string {
+	return "malformed event: " + e.Err.Error()
+}
+
+// Unwrap returns the reason the message is malformed.
+func (e *MalformedError) Unwrap() error {
+	return e.Err
+}
+
+// Malformed wraps an error so the consumer dead-letters the message.
+func Malformed(err error) error {
+	return &MalformedError{Err: err}
+}
+
+// Handler processes a message. Errors other than MalformedError are transient and the message is retried.
+type Handler func(ctx context.Context, message Message) error
+
+// Consumer reads the messages of a source and processes them one at a time, in order.
+type Consumer struct {
+	Source      Source
+	Handler     Handler
+	Checkpoints *Checkpoints
+	DeadLetters *DeadLetters
+	// RetryBackoff is the wait before the first retry of a failed message; it doubles up to a minute.
+	RetryBackoff time.Duration
+	// CheckpointEvery is the number of processed messages after which the offset is saved, every message if 0;
+	// it is also saved when Run returns.
+	CheckpointEvery int
+	// OnProcessed, if set, is called with the outcome of every message: processed, dead_lettered or retried.
+	OnProcessed func(outcome string)
+}
+
+// Outcomes of a message reported to OnProcessed.
+const (
+	OutcomeProcessed    = "processed"
+	OutcomeDeadLettered = "dead_lettered"
+	OutcomeRetried      = "retried"
+)
+
+// Run consumes messages until ctx is done or the source fails.
+//
+// Returns:
+//   - error: The error of the source or checkpoint store, or ctx.Err() once ctx is done.
+func (c *Consumer) Run(ctx context.Context) error {
+	var offset int64
+	pending := 0
+	defer func() {
+		if pending > 0 {
+			c.Checkpoints.Save(c.Source.Name(), offset)
+		}
+	}()
+
+	for {
+		message, err := c.Source.Receive(ctx)
+		if err != nil {
+			return err
+		}
+		if err := c.process(ctx, message); err != nil {
+			return err
+		}
+		if err := c.Source.Ack(message); err != nil {
+			return err
+		}
+
+		offset = message.Offset
+		pending++
+		if pending >= c.CheckpointEvery {
+			if err := c.Checkpoints.Save(c.Source.Name(), offset); err != nil {
+				return err
+			}
+			pending = 0
+		}
+	}
+}
+
+// process handles a message, retrying transient failures and dead-lettering malformed messages.
+func (c *Consumer) process(ctx context.Context, message Message) error {
+	wait := c.RetryBackoff
+	for {
+		err := c.Handler(ctx, message)
+		var malformed *MalformedError
+		switch {
+		case err == nil:
+			c.report(OutcomeProcessed)
+			return nil
+		case errors.As(err, &malformed):
+			c.report(OutcomeDeadLettered)
+			return c.DeadLetters.Add(DeadLetter{
+				Source: c.Source.Name(),
+				Offset: message.Offset,
+				Data:   string(message.Data),
+				Error:  malformed.Err.Error(),
+				At:     time.Now().UTC(),
+			})
+		}
+
+		c.report(OutcomeRetried)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+		if wait *= 2; wait > time.Minute {
+			wait = time.Minute
+		}
+	}
+}
+
+// report passes the outcome of a message to OnProcessed.
+func (c *Consumer) report(outcome string) {
+	if c.OnProcessed != nil {
+		c.OnProcessed(outcome)
+	}
+}
+
+// Checkpoints stores the offset of every source in a JSON file, so consumers resume where they stopped.
+type Checkpoints struct {
+	mu      sync.Mutex
+	path    string
+	offsets map[string]int64
+}
+
+// OpenCheckpoints loads the checkpoints stored at the given path; a missing file holds no checkpoints.
+//
+// Parameters:
+//   - path: The path of the checkpoint file.
+//
+// Returns:
+//   - *Checkpoints: A pointer to the loaded Checkpoints.
+//   - error: An error if the file exists but cannot be read.
+func OpenCheckpoints(path string) (*Checkpoints, error) {
+	checkpoints := &Checkpoints{path: path, offsets: make(map[string]int64)}
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return checkpoints, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(content, &checkpoints.offsets); err != nil {
+		return nil, fmt.Errorf("corrupt checkpoint file %s: %v", path, err)
+	}
+	return checkpoints, nil
+}
+
+// Offset returns the checkpointed offset of a source, 0 if it has none.
+func (c *Checkpoints) Offset(source string) int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.offsets[source]
+}
+
+// Save records the offset of a source. The file is replaced atomically, so a crash leaves the previous checkpoint.
+func (c *Checkpoints) Save(source string, offset int64) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.offsets[source] = offset
+
+	content, err := json.MarshalIndent(c.offsets, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(c.path), 0755); err != nil {
+		return err
+	}
+	temporary := c.path + ".tmp"
+	if err := ioutil.WriteFile(temporary, content, 0644); err != nil {
+		return err
+	}
+	return os.Rename(temporary, c.path)
+}
+
+// DeadLetter represents a message that could not be processed.
+type DeadLetter struct {
+	Source string    `json:"source"`
+	Offset int64     `json:"offset"`
+	Data   string    `json:"data"`
+	Error  string    `json:"error"`
+	At     time.Time `json:"at"`
+}
+
+// DeadLetters stores dead-lettered messages as JSON lines, for operators to inspect and resend.
+type DeadLetters struct {
+	mu      sync.Mutex
+	file    *os.File
+	letters []DeadLetter
+}
+
+// OpenDeadLetters loads the dead letters stored at the given path, creating the file if it does not exist.
+//
+// Parameters:
+//   - path: The path of the dead letter file.
+//
+// Returns:
+//   - *DeadLetters: A pointer to the opened DeadLetters.
+//   - error: An error if the file could not be created or contains a corrupt entry.
+func OpenDeadLetters(path string) (*DeadLetters, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	content, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	deadLetters := &DeadLetters{letters: []DeadLetter{}}
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	for decoder.More() {
+		var letter DeadLetter
+		if err := decoder.Decode(&letter); err != nil {
+			return nil, fmt.Errorf("corrupt dead letter file %s: %v", path, err)
+		}
+		deadLetters.letters = append(deadLetters.letters, letter)
+	}
+
+	deadLetters.file, err = os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return deadLetters, nil
+}
+
+// Add records a dead letter.
+func (d *DeadLetters) Add(letter DeadLetter) error {
+	line, err := json.Marshal(letter)
+	if err != nil {
+		return err
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, err := d.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	d.letters = append(d.letters, letter)
+	return nil
+}
+
+// List returns the dead letters of a source, or of every source if it is empty, oldest first.
+func (d *DeadLetters) List(source string) []DeadLetter {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	letters := []DeadLetter{}
+	for _, letter := range d.letters {
+		if source == "" || letter.Source == source {
+			letters = append(letters, letter)
+		}
+	}
+	return letters
+}
+
+// Close closes the underlying dead letter file.
+func (d *DeadLetters) Close() error {
+	return d.file.Close()
+}
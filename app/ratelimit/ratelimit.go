@@ -0,0 +1,91 @@
+// Package ratelimit provides token-bucket rate limiting of callers identified by a key,
+// such as their API key or IP address.
+package ratelimit
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// sweepInterval is the number of calls after which buckets of idle callers are removed.
+const sweepInterval = 1024
+
+// bucket holds the tokens of a single caller.
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// Limiter allows every caller bursts of up to burst requests, refilled at rate requests per second.
+type Limiter struct {
+	rate    float64
+	burst   float64
+	mu      sync.Mutex
+	calls   int
+	buckets map[string]*bucket
+}
+
+// NewLimiter creates a limiter.
+//
+// Parameters:
+//   - rate: The sustained number of requests per second allowed per caller; 0 or less disables limiting.
+//   - burst: The number of requests a caller may make at once; it is raised to 1 if lower.
+//
+// Returns:
+//   - *Limiter: A pointer to the newly created Limiter instance.
+func NewLimiter(rate float64, burst int) *Limiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &Limiter{rate: rate, burst: float64(burst), buckets: make(map[string]*bucket)}
+}
+
+// Allow takes a token from the caller's bucket.
+//
+// Parameters:
+//   - key: The caller.
+//   - now: The time of the request.
+//
+// Returns:
+//   - bool: True if the request is allowed.
+//   - time.Duration: If not allowed, the time until the next token is available.
+func (l *Limiter) Allow(key string, now time.Time) (bool, time.Duration) {
+	if l.rate <= 0 {
+		return true, 0
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.calls++
+	if l.calls%sweepInterval == 0 {
+		l.sweep(now)
+	}
+
+	b, exists := l.buckets[key]
+	if !exists {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens = math.Min(l.burst, b.tokens+elapsed*l.rate)
+		b.last = now
+	}
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	wait := time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	return false, wait
+}
+
+// sweep removes the buckets of callers whose bucket has refilled completely, as they are indistinguishable from new callers.
+func (l *Limiter) sweep(now time.Time) {
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
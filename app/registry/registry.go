@@ -0,0 +1,101 @@
+// Package registry provides a vehicle registry keyed by license plate, used to classify vehicles
+// without relying on the type stated by the caller.
+package registry
+
+import (
+	"congestion-calculator-manager/app/helpers"
+	"congestion-calculator-manager/app/plates"
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// Certificate represents an exemption certificate issued for a registered vehicle,
+// exempting it from congestion tax in every city while it is valid.
+type Certificate struct {
+	Id        string    `json:"id"`
+	Reason    string    `json:"reason"`
+	ValidFrom time.Time `json:"valid_from"`
+	ValidTo   time.Time `json:"valid_to"`
+}
+
+// IsValidAt checks if the certificate is valid at the given time.
+// A zero ValidTo means the certificate does not expire.
+func (c Certificate) IsValidAt(t time.Time) bool {
+	if t.Before(c.ValidFrom) {
+		return false
+	}
+	return c.ValidTo.IsZero() || !t.After(c.ValidTo)
+}
+
+// Registration represents the registered information of a single vehicle.
+type Registration struct {
+	LicensePlate  string        `json:"license_plate"`
+	Type          string        `json:"type"`
+	Fuel          string        `json:"fuel"`
+	OwnerCategory string        `json:"owner_category"`
+	Certificates  []Certificate `json:"certificates"`
+}
+
+// ActiveCertificate returns the first certificate of the vehicle valid at the given time.
+func (r Registration) ActiveCertificate(t time.Time) (Certificate, bool) {
+	for _, certificate := range r.Certificates {
+		if certificate.IsValidAt(t) {
+			return certificate, true
+		}
+	}
+	return Certificate{}, false
+}
+
+// Registry represents an in-memory vehicle registry keyed by license plate.
+type Registry struct {
+	data map[string]Registration // Registrations keyed by normalized license plate
+	mu   sync.RWMutex            // Mutex for concurrent access
+}
+
+// NewRegistry creates a new, empty instance of the Registry.
+func NewRegistry() *Registry {
+	return &Registry{
+		data: make(map[string]Registration),
+	}
+}
+
+// LoadRegistry creates a Registry filled with the vehicles stored in "registry/vehicles.json" of the data store.
+//
+// Returns:
+//   - *Registry: A pointer to the loaded Registry instance.
+//   - error: An error if the file could not be read or decoded.
+func LoadRegistry() (*Registry, error) {
+	registry := NewRegistry()
+
+	jsonData, err := helpers.ReadContentFromDataFile("registry", "vehicles")
+	if err != nil {
+		return registry, err
+	}
+
+	var registrations []Registration
+	err = json.Unmarshal([]byte(jsonData), &registrations)
+	if err != nil {
+		return registry, err
+	}
+
+	for _, registration := range registrations {
+		registry.Register(registration)
+	}
+	return registry, nil
+}
+
+// Register adds or replaces the registration of a vehicle.
+func (r *Registry) Register(registration Registration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.data[plates.Normalize(registration.LicensePlate)] = registration
+}
+
+// Lookup returns the registration for the given license plate and whether it exists.
+func (r *Registry) Lookup(licensePlate string) (Registration, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	registration, exists := r.data[plates.Normalize(licensePlate)]
+	return registration, exists
+}
@@ -0,0 +1,233 @@
+package server
+
+import (
+	"congestion-calculator-manager/app/audit"
+	"congestion-calculator-manager/app/auth"
+	"congestion-calculator-manager/app/calculator"
+	"congestion-calculator-manager/app/helpers"
+	"congestion-calculator-manager/app/invoicing"
+	taxrules "congestion-calculator-manager/app/tax_rules"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+var (
+	// AuditLog records every calculation answered to a caller and every rules edit; it is nil if auditing is not configured.
+	AuditLog *audit.Log
+
+	// auditUnavailable holds why the audit log of the data store could not be opened. Calculations and rules
+	// edits are refused meanwhile, since they could not be defended later.
+	auditUnavailable error
+)
+
+// openAuditLog opens the audit log in the data store.
+func openAuditLog() error {
+	path, err := audit.DefaultPath()
+	if err == nil {
+		AuditLog, err = audit.Open(path)
+	}
+	auditUnavailable = err
+	return err
+}
+
+// appendAudit appends a record to the audit log, failing if the log should be kept but could not be opened.
+func appendAudit(record audit.Record) error {
+	if AuditLog == nil {
+		if auditUnavailable != nil {
+			return fmt.Errorf("audit log is not available: %v", auditUnavailable)
+		}
+		return nil
+	}
+	_, err := AuditLog.Append(record)
+	return err
+}
+
+// auditInput represents what a calculation's input hash is computed from.
+type auditInput struct {
+	Type         string               `json:"type"`
+	LicensePlate string               `json:"licenseplate"`
+	Passages     []calculator.Passage `json:"passages"`
+}
+
+// auditCalculation records a calculation answered to a caller in the audit log, with the caller of its context.
+// Calculations made for the server itself, such as running daily totals, are not audited.
+//
+// Parameters:
+//   - ctx: The context of the request, carrying the authenticated caller.
+//   - requestData: The request calculated, with its passages resolved.
+//   - result: The result of the calculation.
+//
+// Returns:
+//   - error: An error if the calculation could not be recorded.
+func auditCalculation(ctx context.Context, requestData RequestData, result ResultData) error {
+	passages, cityRules := requestData.Passages, requestData.CityRules
+	if len(passages) == 0 {
+		passages, cityRules = datesToPassages(requestData)
+	}
+	record := audit.Record{
+		Kind:         audit.KindCalculation,
+		LicensePlate: requestData.LicensePlate,
+		Cities:       []string{},
+		InputHash:    audit.InputHash(auditInput{Type: requestData.Type, LicensePlate: requestData.LicensePlate, Passages: passages}),
+		RuleVersions: map[string]string{},
+		TotalFee:     result.FeeInfo,
+	}
+	if principal, exists := auth.PrincipalFromContext(ctx); exists {
+		record.Actor = principal.Subject
+	}
+	for _, passage := range passages {
+		if _, listed := record.RuleVersions[passage.City]; listed {
+			continue
+		}
+		version := taxrules.DefaultRuleVersion
+		if taxRule, exists := cityRules[passage.City]; exists {
+			version = taxRule.Version()
+		}
+		record.Cities = append(record.Cities, passage.City)
+		record.RuleVersions[passage.City] = version
+	}
+	if result.Error != nil {
+		record.Error = result.Error.Error()
+	}
+	if err := appendAudit(record); err != nil {
+		helpers.LoggerFromContext(ctx).Error("calculation not audited", "license_plate", requestData.LicensePlate, "error", err)
+		return fmt.Errorf("calculation could not be audited: %v", err)
+	}
+	return nil
+}
+
+// writeAuditedCalculation audits a finished calculation of an HTTP request, answering 503 if it could not be recorded,
+// since a result that cannot be defended later must not be handed out.
+//
+// Returns:
+//   - bool: True if the calculation was recorded and its result may be written.
+func writeAuditedCalculation(w http.ResponseWriter, r *http.Request, requestData RequestData, result ResultData) bool {
+	if err := auditCalculation(r.Context(), requestData, result); err != nil {
+		http.Error(w, fmt.Sprintf("Error occurred %v", err), http.StatusServiceUnavailable)
+		return false
+	}
+	return true
+}
+
+// auditedVehicleCalculation returns the calculation of stored passages used for invoices, auditing every vehicle
+// under the caller of the context. Vehicles that cannot be calculated fail with an invoicing.VehicleError,
+// while an audit failure fails every vehicle.
+func auditedVehicleCalculation(ctx context.Context) invoicing.Calculate {
+	return func(licensePlate string, vehicleType string, passages []calculator.Passage) (calculator.TripResult, error) {
+		requestData, result, err := calculateVehicle(ctx, licensePlate, vehicleType, passages)
+		if err != nil {
+			// nothing was calculated, so there is nothing to audit
+			return calculator.TripResult{}, err
+		}
+		if err := auditCalculation(ctx, requestData, result); err != nil {
+			return calculator.TripResult{}, err
+		}
+		if result.Error != nil {
+			return calculator.TripResult{}, &invoicing.VehicleError{Err: result.Error}
+		}
+		return result.TripInfo, nil
+	}
+}
+
+// auditRulesEdit records an edit of the tax rules of a city in the audit log. It is recorded before the
+// city file is written, so an edit that cannot be audited is never applied.
+//
+// Returns:
+//   - error: An error if the edit could not be recorded.
+func auditRulesEdit(city string, editor string, before taxrules.TaxRule, after taxrules.TaxRule) error {
+	beforeContent, err := json.Marshal(before)
+	if err != nil {
+		return err
+	}
+	afterContent, err := json.Marshal(after)
+	if err != nil {
+		return err
+	}
+	return appendAudit(audit.Record{
+		Kind:         audit.KindRulesEdit,
+		Actor:        editor,
+		Cities:       []string{city},
+		RuleVersions: map[string]string{city: after.Version()},
+		Before:       beforeContent,
+		After:        afterContent,
+		Changes:      audit.Changes(beforeContent, afterContent),
+	})
+}
+
+// auditRulesEditFailed records that an audited edit of the tax rules of a city was not applied.
+func auditRulesEditFailed(city string, editor string, version string, cause error) error {
+	return appendAudit(audit.Record{
+		Kind:         audit.KindRulesEdit,
+		Actor:        editor,
+		Cities:       []string{city},
+		RuleVersions: map[string]string{city: version},
+		Error:        fmt.Sprintf("rules not written: %v", cause),
+	})
+}
+
+// auditHandler handles retrieval of audit records by kind, plate, city and time range.
+func auditHandler(w http.ResponseWriter, r *http.Request) {
+	if AuditLog == nil {
+		http.Error(w, "audit log is not available", http.StatusServiceUnavailable)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		queryParams := r.URL.Query()
+		filter := audit.Filter{
+			Kind:         queryParams.Get("kind"),
+			LicensePlate: queryParams.Get("plate"),
+			City:         queryParams.Get("city"),
+		}
+		var err error
+		if from := queryParams.Get("from"); from != "" {
+			if filter.From, err = time.Parse(time.RFC3339, from); err != nil {
+				http.Error(w, fmt.Sprintf("Error occurred %v", err), http.StatusBadRequest)
+				return
+			}
+		}
+		if to := queryParams.Get("to"); to != "" {
+			if filter.To, err = time.Parse(time.RFC3339, to); err != nil {
+				http.Error(w, fmt.Sprintf("Error occurred %v", err), http.StatusBadRequest)
+				return
+			}
+		}
+		records, err := AuditLog.Query(filter)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error occurred %v", err), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(records)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// auditVerificationHandler handles checking the hash chain of the audit log.
+// A broken chain is reported with 409, so monitoring can alert on the status alone.
+func auditVerificationHandler(w http.ResponseWriter, r *http.Request) {
+	if AuditLog == nil {
+		http.Error(w, "audit log is not available", http.StatusServiceUnavailable)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		verification := AuditLog.Verify()
+		if !verification.Valid {
+			helpers.LoggerFromContext(r.Context()).Error("audit log chain broken", "broken_at", verification.BrokenAt, "error", verification.Error)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if !verification.Valid {
+			w.WriteHeader(http.StatusConflict)
+		}
+		json.NewEncoder(w).Encode(verification)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,72 @@
+package server
+
+import (
+	"congestion-calculator-manager/app/helpers"
+	taxrules "congestion-calculator-manager/app/tax_rules"
+	"congestion-calculator-manager/app/tracing"
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// cachedCityVersions maps a lower-cased city name to the cache key of the version of its file last loaded.
+var (
+	cachedCityVersions     = make(map[string]string)
+	cachedCityVersionsLock sync.Mutex
+)
+
+// loadCityData loads the data of a city through LocalCityCache. Cache entries are keyed by the
+// modification time of the city file, so a changed file is read again and counted as a rule reload.
+//
+// Parameters:
+//   - ctx: The context of the caller, carrying its trace.
+//   - name: The name of the city, matched case-insensitively.
+//
+// Returns:
+//   - taxrules.CityData: The data of the city.
+//   - error: An error if the city file does not exist or is not valid.
+func loadCityData(ctx context.Context, name string) (taxrules.CityData, error) {
+	modTime, err := helpers.DataFileModTime("cities", name)
+	if err != nil {
+		return taxrules.CityData{}, err
+	}
+	city := strings.ToLower(name)
+	cacheKey := fmt.Sprintf("%s@%d", city, modTime.UnixNano())
+
+	_, span := tracing.Start(ctx, "cache access")
+	content, exists := LocalCityCache.Get(cacheKey)
+	span.SetAttribute("city", city)
+	span.SetAttribute("hit", exists)
+	span.End()
+	if !exists {
+		content, err = helpers.ReadContentFromJsonFile(name)
+		if err != nil {
+			return taxrules.CityData{}, err
+		}
+		if _, err := taxrules.ParseCityData(content); err != nil {
+			helpers.Log.Warn("city data is not valid JSON", "city", name, "error", err)
+			return taxrules.CityData{}, err
+		}
+		LocalCityCache.Set(cacheKey, content)
+		rememberCityVersion(city, cacheKey)
+	}
+	return taxrules.ParseCityData(content)
+}
+
+// rememberCityVersion records the cache key of the latest version of a city file and
+// evicts the previous version, counting the replacement as a rule reload.
+func rememberCityVersion(city string, cacheKey string) {
+	cachedCityVersionsLock.Lock()
+	defer cachedCityVersionsLock.Unlock()
+
+	previous, loaded := cachedCityVersions[city]
+	cachedCityVersions[city] = cacheKey
+	if !loaded || previous == cacheKey {
+		helpers.Log.Debug("city rules loaded", "city", city)
+		return
+	}
+	LocalCityCache.Delete(previous)
+	ruleReloads.Inc(city)
+	helpers.Log.Info("city rules reloaded", "city", city)
+}
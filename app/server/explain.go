@@ -0,0 +1,76 @@
+package server
+
+import (
+	"congestion-calculator-manager/app/calculator"
+	"congestion-calculator-manager/app/vehicles"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// ExplainPassage explains the fee of a single passage, with the vehicle classified and
+// its exemptions consulted the same way as calculation requests.
+//
+// Parameters:
+//   - ctx: The context of the caller, carrying its trace.
+//   - passage: The passage, given by city or station.
+//   - licensePlate: The license plate of the vehicle.
+//   - vehicleType: The vehicle type stated by the caller; the registered type wins.
+//
+// Returns:
+//   - calculator.Explanation: The checks evaluated, the matched tariff band and the fee.
+//   - error: An error if the plate is invalid or the city has no tax rules.
+func ExplainPassage(ctx context.Context, passage calculator.Passage, licensePlate string, vehicleType string) (calculator.Explanation, error) {
+	requestData := RequestData{Type: vehicleType, LicensePlate: licensePlate}
+	err := classifyVehicle(&requestData)
+	if err != nil {
+		return calculator.Explanation{}, err
+	}
+
+	passages := []calculator.Passage{passage}
+	cityRules, err := loadTripRules(ctx, passages)
+	if err != nil {
+		return calculator.Explanation{}, err
+	}
+
+	veh, err := vehicles.GetVehicle(requestData.Type, requestData.LicensePlate)
+	if err != nil {
+		return calculator.Explanation{}, err
+	}
+	return calculator.ExplainPassage(veh, passages[0].City, passages[0].Time, cityRules, vehicleExemptions(requestData.LicensePlate))
+}
+
+// explainHandler handles explanations of the fee of a single passage, as JSON or plain text.
+func explainHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		queryParams := r.URL.Query()
+		t, err := time.Parse(time.RFC3339, queryParams.Get("time"))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error occurred %v", err), http.StatusBadRequest)
+			return
+		}
+		passage := calculator.Passage{City: queryParams.Get("city"), Station: queryParams.Get("station"), Time: t}
+
+		explanation, err := ExplainPassage(r.Context(), passage, queryParams.Get("plate"), queryParams.Get("type"))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error occurred %v", err), http.StatusBadRequest)
+			return
+		}
+
+		switch queryParams.Get("format") {
+		case "", "json":
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(explanation)
+		case "text":
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			fmt.Fprint(w, explanation.Text())
+		default:
+			http.Error(w, fmt.Sprintf("unknown format %s", queryParams.Get("format")), http.StatusBadRequest)
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
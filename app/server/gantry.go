@@ -0,0 +1,281 @@
+package server
+
+import (
+	"bufio"
+	"congestion-calculator-manager/app/calculator"
+	"congestion-calculator-manager/app/dailytotals"
+	"congestion-calculator-manager/app/helpers"
+	"congestion-calculator-manager/app/websocket"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// Limits of the gantry connections.
+const (
+	// maxPassageEventBytes is the maximum size of a single passage event, a line of a stream or a WebSocket message.
+	maxPassageEventBytes = 64 << 10
+	// gantryIdleTimeout is how long a WebSocket connection may stay without events before it is closed.
+	gantryIdleTimeout = 5 * time.Minute
+)
+
+// Statuses of ingested passage events.
+const (
+	PassageAccepted  = "accepted"
+	PassageDuplicate = "duplicate"
+	PassageRejected  = "rejected"
+)
+
+// PassageAck represents the outcome of ingesting a single passage event, with the daily total
+// of the vehicle after the passage if it was accepted.
+type PassageAck struct {
+	PassageId  string             `json:"passage_id"`
+	Status     string             `json:"status"`
+	Error      string             `json:"error,omitempty"`
+	DailyTotal *dailytotals.Total `json:"daily_total,omitempty"`
+}
+
+// StreamRejection represents a line of a passage stream that was not ingested.
+type StreamRejection struct {
+	Line      int    `json:"line"`
+	PassageId string `json:"passage_id,omitempty"`
+	Error     string `json:"error"`
+}
+
+// StreamResultData represents the structure for the result of a passage stream.
+type StreamResultData struct {
+	Accepted   int               `json:"accepted"`
+	Duplicates int               `json:"duplicates"`
+	Rejected   int               `json:"rejected"`
+	Rejections []StreamRejection `json:"rejections"`
+}
+
+// DailyTotals holds the running daily totals of the vehicles whose passages were ingested today and yesterday.
+// Totals reaching the daily cap are published to the subscriptions of daily_cap_reached.
+var DailyTotals = dailytotals.NewTracker(calculateVehiclePassages, 2, notifyDailyCapReached)
+
+// ingestPassage validates a passage event, records it in the ledger and adds it to the daily total of its vehicle.
+//
+// Parameters:
+//   - ctx: The context of the request or connection the event arrived on.
+//   - event: The passage event.
+//
+// Returns:
+//   - PassageAck: The outcome to report to the gantry.
+//   - error: An error if the ledger could not record the passage; the event is then neither accepted nor rejected.
+func ingestPassage(ctx context.Context, event PassageEvent) (PassageAck, error) {
+	ack := PassageAck{PassageId: event.PassageId}
+	entries, err := toLedgerEntries(ctx, []PassageEvent{event})
+	if err != nil {
+		ack.Status = PassageRejected
+		ack.Error = err.Error()
+		return ack, nil
+	}
+
+	accepted, err := PassageLedger.Append(entries[0])
+	if err != nil {
+		return ack, err
+	}
+	if !accepted {
+		ack.Status = PassageDuplicate
+		return ack, nil
+	}
+
+	ack.Status = PassageAccepted
+	total, err := DailyTotals.Record(entries[0], time.Now())
+	if err != nil {
+		helpers.LoggerFromContext(ctx).Warn("daily total not recalculated", "passage_id", event.PassageId, "error", err)
+	}
+	ack.DailyTotal = &total
+	return ack, nil
+}
+
+// passageStreamHandler handles ingestion of a stream of passage events sent as newline-delimited JSON.
+// Every line is recorded as soon as it arrives, so gantries can keep a single request open for a batch
+// of passages; invalid lines are reported in the result instead of failing the stream.
+func passageStreamHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+		if PassageLedger == nil {
+			http.Error(w, "passage ledger is not available", http.StatusServiceUnavailable)
+			return
+		}
+
+		scanner := bufio.NewScanner(r.Body)
+		scanner.Buffer(make([]byte, 4096), maxPassageEventBytes)
+		result := StreamResultData{Rejections: []StreamRejection{}}
+		line := 0
+		for scanner.Scan() {
+			line++
+			if len(scanner.Bytes()) == 0 {
+				continue
+			}
+			var event PassageEvent
+			if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+				result.Rejected++
+				result.Rejections = append(result.Rejections, StreamRejection{Line: line, Error: "Error decoding JSON"})
+				gantryEvents.Inc("stream", PassageRejected)
+				continue
+			}
+
+			ack, err := ingestPassage(r.Context(), event)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Error occurred %v", err), http.StatusInternalServerError)
+				return
+			}
+			gantryEvents.Inc("stream", ack.Status)
+			switch ack.Status {
+			case PassageAccepted:
+				result.Accepted++
+			case PassageDuplicate:
+				result.Duplicates++
+			default:
+				result.Rejected++
+				result.Rejections = append(result.Rejections, StreamRejection{Line: line, PassageId: ack.PassageId, Error: ack.Error})
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			// the passages before the broken line are recorded; the gantry resends the rest
+			if errors.Is(err, bufio.ErrTooLong) {
+				writeLimitError(w, http.StatusRequestEntityTooLarge, "max_event_bytes",
+					fmt.Sprintf("line %d exceeds %d bytes", line+1, maxPassageEventBytes), 0)
+				return
+			}
+			http.Error(w, fmt.Sprintf("Error occurred %v", err), http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(result)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// passageSocketHandler handles ingestion of passage events over a WebSocket connection. Every text
+// message holds a single passage event and is answered with its PassageAck in the order received.
+func passageSocketHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		if PassageLedger == nil {
+			http.Error(w, "passage ledger is not available", http.StatusServiceUnavailable)
+			return
+		}
+		conn, err := websocket.Upgrade(w, r, maxPassageEventBytes)
+		if err != nil {
+			return
+		}
+
+		logger := helpers.LoggerFromContext(r.Context())
+		logger.Info("gantry connected")
+		for {
+			conn.SetReadDeadline(time.Now().Add(gantryIdleTimeout))
+			message, err := conn.ReadMessage()
+			if err != nil {
+				if err != io.EOF {
+					logger.Info("gantry disconnected", "error", err)
+				}
+				return
+			}
+
+			var event PassageEvent
+			ack := PassageAck{Status: PassageRejected, Error: "Error decoding JSON"}
+			if json.Unmarshal(message, &event) == nil {
+				ack, err = ingestPassage(r.Context(), event)
+				if err != nil {
+					logger.Error("passage not recorded", "passage_id", event.PassageId, "error", err)
+					conn.Close(websocket.CloseInternalError, "passage ledger is not available")
+					return
+				}
+			}
+			gantryEvents.Inc("websocket", ack.Status)
+
+			response, _ := json.Marshal(ack)
+			if err := conn.WriteText(response); err != nil {
+				logger.Info("gantry disconnected", "error", err)
+				conn.Close(websocket.CloseNormal, "")
+				return
+			}
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// dailyTotalsHandler handles retrieval of the running totals of a vehicle on a day, today by default.
+func dailyTotalsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		plate := r.URL.Query().Get("plate")
+		if plate == "" {
+			http.Error(w, "plate is required", http.StatusBadRequest)
+			return
+		}
+		date := r.URL.Query().Get("date")
+		if date == "" {
+			date = time.Now().Format(dailytotals.DateLayout)
+		} else if _, err := time.Parse(dailytotals.DateLayout, date); err != nil {
+			http.Error(w, fmt.Sprintf("Error occurred %v", err), http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(DailyTotals.ForVehicle(plate, date))
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// dailyStatusHandler handles retrieval of what a vehicle has been charged in a city today: the charge windows,
+// the window still open and when it closes, the running total and the amount left before the daily cap.
+func dailyStatusHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		plate := r.URL.Query().Get("plate")
+		city := r.URL.Query().Get("city")
+		if plate == "" || city == "" {
+			http.Error(w, "plate and city are required", http.StatusBadRequest)
+			return
+		}
+		at := time.Now()
+		if text := r.URL.Query().Get("time"); text != "" {
+			parsed, err := time.Parse(time.RFC3339, text)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Error occurred %v", err), http.StatusBadRequest)
+				return
+			}
+			at = parsed
+		}
+
+		// resolves the name the passages of the city are recorded under
+		passages := []calculator.Passage{{City: city, Time: at}}
+		cityRules, err := loadTripRules(r.Context(), passages)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error occurred %v", err), http.StatusNotFound)
+			return
+		}
+		city = passages[0].City
+		dailyCap := calculator.DailyCap(city, cityRules[city])
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(DailyTotals.Status(plate, city, at, dailyCap))
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// rebuildDailyTotals restores the running totals from the passages recorded in the ledger since yesterday.
+func rebuildDailyTotals(now time.Time) {
+	if PassageLedger == nil {
+		return
+	}
+	year, month, day := now.AddDate(0, 0, -1).Date()
+	since := time.Date(year, month, day, 0, 0, 0, 0, now.Location())
+	if err := DailyTotals.Rebuild(PassageLedger.PassagesInCity("", since, time.Time{}), now); err != nil {
+		helpers.Log.Warn("daily totals not fully restored", "error", err)
+	}
+}
@@ -0,0 +1,326 @@
+package server
+
+import (
+	"congestion-calculator-manager/app/auth"
+	"congestion-calculator-manager/app/calculator"
+	"congestion-calculator-manager/app/grpcapi"
+	"congestion-calculator-manager/app/grpcwire"
+	"congestion-calculator-manager/app/helpers"
+	taxrules "congestion-calculator-manager/app/tax_rules"
+	"context"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Environment variables configuring the gRPC server. The gRPC server only starts if an address is set,
+// and requires a TLS certificate, as net/http only speaks HTTP/2 over TLS at the Go version of this module.
+const (
+	GRPCAddressEnv  = "CONGESTION_GRPC_ADDRESS"
+	GRPCCertFileEnv = "CONGESTION_GRPC_CERT_FILE"
+	GRPCKeyFileEnv  = "CONGESTION_GRPC_KEY_FILE"
+)
+
+// unaryMethod handles a single request message of a gRPC call and returns the response message.
+type unaryMethod func(ctx context.Context, request []byte) ([]byte, error)
+
+// startGRPCServer serves the gRPC service on the address of CONGESTION_GRPC_ADDRESS, if set.
+func startGRPCServer() {
+	address := os.Getenv(GRPCAddressEnv)
+	if address == "" {
+		return
+	}
+	certFile, keyFile := os.Getenv(GRPCCertFileEnv), os.Getenv(GRPCKeyFileEnv)
+	if certFile == "" || keyFile == "" {
+		helpers.Log.Error("gRPC server not started, a TLS certificate is required", "cert_file_env", GRPCCertFileEnv, "key_file_env", GRPCKeyFileEnv)
+		return
+	}
+
+	helpers.Log.Info("gRPC server listening", "address", address)
+	err := http.ListenAndServeTLS(address, certFile, keyFile, GRPCHandler())
+	helpers.Log.Error("gRPC server stopped", "error", err)
+}
+
+// GRPCHandler returns the handler of the congestion.v1.CongestionCalculator gRPC service. It must be
+// served over HTTP/2; callers authenticate with the same API keys and tokens as on the HTTP API.
+func GRPCHandler() http.Handler {
+	return withTracing(withRequestLogging(http.HandlerFunc(grpcHandler)))
+}
+
+// grpcHandler dispatches gRPC calls to the methods of the service and reports their status in the trailers.
+func grpcHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || r.ProtoMajor != 2 || !strings.HasPrefix(r.Header.Get("Content-Type"), grpcwire.ContentType) {
+		http.Error(w, "gRPC calls must be HTTP/2 POST requests of content type application/grpc", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	grpcwire.StartResponse(w)
+	ctx, err := authenticateGRPC(r)
+	if err == nil {
+		switch r.URL.Path {
+		case grpcapi.CalculateMethod:
+			err = serveUnary(ctx, w, r, grpcCalculate)
+		case grpcapi.CalculateStreamMethod:
+			err = grpcCalculateStream(ctx, w, r)
+		case grpcapi.ExplainMethod:
+			err = serveUnary(ctx, w, r, grpcExplain)
+		case grpcapi.ListCitiesMethod:
+			err = serveUnary(ctx, w, r, grpcListCities)
+		default:
+			err = grpcwire.Errorf(grpcwire.Unimplemented, "unknown method %s", r.URL.Path)
+		}
+	}
+
+	status := grpcwire.StatusOf(err)
+	grpcRequests.Inc(r.URL.Path, strconv.Itoa(int(status.Code)))
+	if status.Code != grpcwire.OK {
+		helpers.LoggerFromContext(r.Context()).Warn("gRPC call failed", "method", r.URL.Path, "code", int(status.Code), "error", status.Message)
+	}
+	grpcwire.WriteStatus(w, err)
+}
+
+// authenticateGRPC authenticates the caller of a gRPC call from its metadata, requires the calculator
+// role and applies the caller's rate limit.
+//
+// Returns:
+//   - context.Context: The context of the call, carrying the caller.
+//   - error: An Unauthenticated, PermissionDenied or ResourceExhausted *grpcwire.Status if the call is rejected.
+func authenticateGRPC(r *http.Request) (context.Context, error) {
+	principal, err := Authenticator.Authenticate(r)
+	if err != nil {
+		return nil, grpcwire.Errorf(grpcwire.Unauthenticated, "%v", err)
+	}
+	if !principal.HasRole(auth.RoleCalculator) {
+		return nil, grpcwire.Errorf(grpcwire.PermissionDenied, "%s does not have the %s role", principal.Subject, auth.RoleCalculator)
+	}
+	if allowed, retryAfter := limitsInEffect().keyLimiter.Allow(principal.Subject, time.Now()); !allowed {
+		limitRejections.Inc("rate_per_key")
+		return nil, grpcwire.Errorf(grpcwire.ResourceExhausted, "too many requests for this API key, retry after %v", retryAfter.Round(time.Millisecond))
+	}
+
+	ctx := auth.ContextWithPrincipal(r.Context(), principal)
+	return helpers.ContextWithLogger(ctx, helpers.LoggerFromContext(ctx).With("subject", principal.Subject)), nil
+}
+
+// serveUnary reads the single request message of a call, passes it to the method and writes the response message.
+func serveUnary(ctx context.Context, w http.ResponseWriter, r *http.Request, method unaryMethod) error {
+	request, err := grpcwire.ReadMessage(r.Body, ServerLimits().MaxBodyBytes)
+	if err == io.EOF {
+		return grpcwire.Errorf(grpcwire.InvalidArgument, "request message missing")
+	}
+	if err != nil {
+		return err
+	}
+	response, err := method(ctx, request)
+	if err != nil {
+		return err
+	}
+	return grpcwire.WriteMessage(w, response)
+}
+
+// prepareTrip classifies the vehicle and loads the rules of the passages the same way as HTTP calculation requests.
+//
+// Returns:
+//   - RequestData: The request to pass to calculate.
+//   - error: An InvalidArgument or ResourceExhausted *grpcwire.Status if the trip cannot be calculated.
+func prepareTrip(ctx context.Context, licensePlate string, vehicleType string, passages []calculator.Passage) (RequestData, error) {
+	if len(passages) == 0 {
+		return RequestData{}, grpcwire.Errorf(grpcwire.InvalidArgument, "no passages provided")
+	}
+	if maxPassages := ServerLimits().MaxPassages; maxPassages > 0 && len(passages) > maxPassages {
+		limitRejections.Inc("max_passages")
+		return RequestData{}, grpcwire.Errorf(grpcwire.ResourceExhausted, "%d passages exceed the maximum of %d per request", len(passages), maxPassages)
+	}
+
+	requestData := RequestData{Type: vehicleType, LicensePlate: licensePlate, Passages: passages, Context: ctx}
+	if err := classifyVehicle(&requestData); err != nil {
+		return RequestData{}, grpcwire.Errorf(grpcwire.InvalidArgument, "%v", err)
+	}
+	cityRules, err := loadTripRules(ctx, requestData.Passages)
+	if err != nil {
+		return RequestData{}, grpcwire.Errorf(grpcwire.InvalidArgument, "%v", err)
+	}
+	requestData.CityRules = cityRules
+	return requestData, nil
+}
+
+// grpcCalculate implements the Calculate method.
+func grpcCalculate(ctx context.Context, message []byte) ([]byte, error) {
+	var request grpcapi.CalculateRequest
+	if err := request.Unmarshal(message); err != nil {
+		return nil, err
+	}
+	passages := make([]calculator.Passage, len(request.Passages))
+	for i, passage := range request.Passages {
+		passages[i] = calculator.Passage{City: passage.City, Station: passage.Station, Time: passage.Time}
+	}
+
+	requestData, err := prepareTrip(ctx, request.LicensePlate, request.VehicleType, passages)
+	if err != nil {
+		return nil, err
+	}
+	result := calculate(requestData)
+	if err := auditCalculation(ctx, requestData, result); err != nil {
+		return nil, grpcwire.Errorf(grpcwire.Unavailable, "%v", err)
+	}
+	if result.Error != nil {
+		return nil, grpcwire.Errorf(grpcwire.Internal, "%v", result.Error)
+	}
+	return toCalculateResponse(result.TripInfo).Marshal(), nil
+}
+
+// toCalculateResponse converts the result of a trip into its gRPC message.
+func toCalculateResponse(trip calculator.TripResult) grpcapi.CalculateResponse {
+	response := grpcapi.CalculateResponse{TotalFee: int64(trip.TotalFee)}
+	for _, city := range trip.Cities {
+		response.Cities = append(response.Cities, grpcapi.CityFee{City: city.City, RuleVersion: city.RuleVersion, TotalFee: int64(city.TotalFee)})
+	}
+	for _, day := range trip.Days {
+		response.Days = append(response.Days, grpcapi.DayFee{City: day.City, Date: day.Date, Passages: int64(day.Passages), TotalFee: int64(day.TotalFee)})
+	}
+	for _, passage := range trip.Passages {
+		fee := grpcapi.PassageFee{City: passage.City, Time: passage.Time, Fee: int64(passage.Fee)}
+		if passage.Exemption != nil {
+			fee.ExemptionReason = passage.Exemption.Reason
+		}
+		response.Passages = append(response.Passages, fee)
+	}
+	return response
+}
+
+// streamedDay holds the passages of a vehicle received on a calculation stream for a single city and day,
+// together with their fee after the single charge rule and daily cap.
+type streamedDay struct {
+	passages []calculator.Passage
+	fee      int
+}
+
+// streamedVehicle holds the days of a vehicle received on a calculation stream.
+type streamedVehicle struct {
+	days     map[string]*streamedDay
+	totalFee int
+}
+
+// grpcCalculateStream implements the CalculateStream method. Every passage is answered with the
+// running total of its vehicle. As fees are capped per city and day, only the passages of the
+// city and day of a new passage are recalculated, and a stream keeps at most as many passages
+// as a single Calculate request may carry.
+func grpcCalculateStream(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	streamed := make(map[string]*streamedVehicle)
+	retained := 0
+	for {
+		message, err := grpcwire.ReadMessage(r.Body, ServerLimits().MaxBodyBytes)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		var request grpcapi.StreamPassage
+		if err := request.Unmarshal(message); err != nil {
+			return err
+		}
+		if maxPassages := ServerLimits().MaxPassages; maxPassages > 0 && retained >= maxPassages {
+			limitRejections.Inc("max_passages")
+			return grpcwire.Errorf(grpcwire.ResourceExhausted, "stream exceeds the maximum of %d passages", maxPassages)
+		}
+
+		passage := calculator.Passage{City: request.Passage.City, Station: request.Passage.Station, Time: request.Passage.Time}
+		requestData, err := prepareTrip(ctx, request.LicensePlate, request.VehicleType, []calculator.Passage{passage})
+		if err != nil {
+			return err
+		}
+		resolved := requestData.Passages[0]
+
+		key := strings.ToUpper(request.LicensePlate) + "/" + request.VehicleType
+		vehicle, exists := streamed[key]
+		if !exists {
+			vehicle = &streamedVehicle{days: make(map[string]*streamedDay)}
+			streamed[key] = vehicle
+		}
+		dayKey := resolved.City + "/" + resolved.Time.Format("2006-01-02")
+		day, exists := vehicle.days[dayKey]
+		if !exists {
+			day = &streamedDay{}
+			vehicle.days[dayKey] = day
+		}
+		requestData.Passages = append(append([]calculator.Passage{}, day.passages...), resolved)
+
+		result := calculate(requestData)
+		if err := auditCalculation(ctx, requestData, result); err != nil {
+			return grpcwire.Errorf(grpcwire.Unavailable, "%v", err)
+		}
+		if result.Error != nil {
+			return grpcwire.Errorf(grpcwire.Internal, "%v", result.Error)
+		}
+
+		feeAdded := result.TripInfo.TotalFee - day.fee
+		day.passages = requestData.Passages
+		day.fee = result.TripInfo.TotalFee
+		vehicle.totalFee += feeAdded
+		retained++
+
+		response := grpcapi.StreamResult{
+			LicensePlate: requestData.LicensePlate,
+			City:         resolved.City,
+			Time:         resolved.Time,
+			FeeAdded:     int64(feeAdded),
+			TotalFee:     int64(vehicle.totalFee),
+		}
+		if err := grpcwire.WriteMessage(w, response.Marshal()); err != nil {
+			return err
+		}
+	}
+}
+
+// grpcExplain implements the Explain method.
+func grpcExplain(ctx context.Context, message []byte) ([]byte, error) {
+	var request grpcapi.ExplainRequest
+	if err := request.Unmarshal(message); err != nil {
+		return nil, err
+	}
+	passage := calculator.Passage{City: request.Passage.City, Station: request.Passage.Station, Time: request.Passage.Time}
+	explanation, err := ExplainPassage(ctx, passage, request.LicensePlate, request.VehicleType)
+	if err != nil {
+		return nil, grpcwire.Errorf(grpcwire.InvalidArgument, "%v", err)
+	}
+
+	response := grpcapi.ExplainResponse{
+		City:        explanation.City,
+		VehicleType: explanation.VehicleType,
+		RuleVersion: explanation.RuleVersion,
+		Fee:         int64(explanation.Fee),
+		FinalFee:    int64(explanation.FinalFee),
+		Text:        explanation.Text(),
+	}
+	for _, check := range explanation.Checks {
+		response.Checks = append(response.Checks, grpcapi.Check{Name: check.Name, Applies: check.Applies, Detail: check.Detail})
+	}
+	return response.Marshal(), nil
+}
+
+// grpcListCities implements the ListCities method. Cities with invalid rules are left out.
+func grpcListCities(ctx context.Context, message []byte) ([]byte, error) {
+	cityNames, err := helpers.ListJsonFiles("cities")
+	if err != nil {
+		return nil, grpcwire.Errorf(grpcwire.Unavailable, "rules store not reachable: %v", err)
+	}
+
+	response := grpcapi.ListCitiesResponse{Cities: []grpcapi.City{{Name: taxrules.DefaultCity, RuleVersion: taxrules.DefaultRuleVersion, Stations: taxrules.DefaultStations}}}
+	for _, name := range cityNames {
+		cityData, err := loadCityData(ctx, name)
+		if err != nil {
+			continue
+		}
+		if cityData.CityName == "" {
+			cityData.CityName = name
+		}
+		response.Cities = append(response.Cities, grpcapi.City{Name: cityData.CityName, RuleVersion: cityData.TaxRules.Version(), Stations: cityData.Stations})
+	}
+	sort.Slice(response.Cities, func(i, j int) bool { return response.Cities[i].Name < response.Cities[j].Name })
+	return response.Marshal(), nil
+}
@@ -0,0 +1,138 @@
+package server
+
+import (
+	"congestion-calculator-manager/app/helpers"
+	taxrules "congestion-calculator-manager/app/tax_rules"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"runtime"
+	"sync/atomic"
+)
+
+// Build information, set at build time with
+// -ldflags "-X congestion-calculator-manager/app/server.Version=... -X congestion-calculator-manager/app/server.Commit=...".
+var (
+	Version = "dev"
+	Commit  = "unknown"
+)
+
+// workerRunning is 1 while the calculation worker is accepting requests.
+var workerRunning int32
+
+// ReadinessCheck represents the outcome of a single readiness condition.
+type ReadinessCheck struct {
+	Name   string `json:"name"`
+	Ok     bool   `json:"ok"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// Readiness represents whether the server can serve calculation requests.
+type Readiness struct {
+	Ready  bool             `json:"ready"`
+	Checks []ReadinessCheck `json:"checks"`
+}
+
+// BuildInfo represents the build of the server and the versions of the tax rules it loaded.
+type BuildInfo struct {
+	Version      string            `json:"version"`
+	Commit       string            `json:"commit"`
+	GoVersion    string            `json:"go_version"`
+	RuleVersions map[string]string `json:"rule_versions"`
+}
+
+// healthHandler reports that the process is alive.
+func healthHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		fmt.Fprintln(w, "ok")
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// readyHandler reports whether the rules store is reachable, at least one city has valid rules,
+// the calculation worker is running and the audit log can be written; it responds with 503 if any of them fails.
+func readyHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		readiness := CheckReadiness()
+		w.Header().Set("Content-Type", "application/json")
+		if !readiness.Ready {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(readiness)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// versionHandler reports the build of the server and the rule version of every city.
+func versionHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		ruleVersions, _ := loadRuleVersions()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(BuildInfo{
+			Version:      Version,
+			Commit:       Commit,
+			GoVersion:    runtime.Version(),
+			RuleVersions: ruleVersions,
+		})
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// CheckReadiness evaluates every readiness condition of the server.
+//
+// Returns:
+//   - Readiness: The outcome of every check; Ready only if all of them passed.
+func CheckReadiness() Readiness {
+	ruleVersions, err := loadRuleVersions()
+	storeCheck := ReadinessCheck{Name: "rules store", Ok: err == nil}
+	if err != nil {
+		storeCheck.Detail = err.Error()
+	}
+
+	// the built-in rules of the default city are always present, so only city files count
+	cityCheck := ReadinessCheck{Name: "valid city", Ok: len(ruleVersions) > 1, Detail: fmt.Sprintf("valid city files: %d", len(ruleVersions)-1)}
+
+	workerCheck := ReadinessCheck{Name: "calculation worker", Ok: atomic.LoadInt32(&workerRunning) == 1}
+
+	// calculations are refused while the audit log cannot be written
+	auditCheck := ReadinessCheck{Name: "audit log", Ok: auditUnavailable == nil}
+	if auditUnavailable != nil {
+		auditCheck.Detail = auditUnavailable.Error()
+	}
+
+	readiness := Readiness{Ready: true, Checks: []ReadinessCheck{storeCheck, cityCheck, workerCheck, auditCheck}}
+	for _, check := range readiness.Checks {
+		readiness.Ready = readiness.Ready && check.Ok
+	}
+	return readiness
+}
+
+// loadRuleVersions returns the rule version of the default city and of every city file with valid rules.
+// Invalid city files are logged and left out.
+func loadRuleVersions() (map[string]string, error) {
+	ruleVersions := map[string]string{taxrules.DefaultCity: taxrules.DefaultRuleVersion}
+	cityNames, err := helpers.ListJsonFiles("cities")
+	if err != nil {
+		return ruleVersions, err
+	}
+
+	for _, name := range cityNames {
+		cityData, err := loadCityData(context.Background(), name)
+		if err != nil {
+			helpers.Log.Warn("city rules not valid", "city", name, "error", err)
+			continue
+		}
+		if cityData.CityName == "" {
+			cityData.CityName = name
+		}
+		ruleVersions[cityData.CityName] = cityData.TaxRules.Version()
+	}
+	return ruleVersions, nil
+}
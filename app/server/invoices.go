@@ -0,0 +1,222 @@
+package server
+
+import (
+	"congestion-calculator-manager/app/calculator"
+	"congestion-calculator-manager/app/helpers"
+	"congestion-calculator-manager/app/invoicing"
+	"congestion-calculator-manager/app/subscriptions"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// InvoiceRequestData represents the structure for incoming invoice generation and recalculation requests.
+type InvoiceRequestData struct {
+	City   string `json:"city"`
+	Period string `json:"period"`
+	Reason string `json:"reason"`
+}
+
+// InvoiceResultData represents the response to an invoice generation request.
+type InvoiceResultData struct {
+	Invoices []invoicing.Invoice        `json:"invoices"`
+	Skipped  []invoicing.SkippedVehicle `json:"skipped"`
+}
+
+// RecalculationResultData represents the response to a recalculation request.
+type RecalculationResultData struct {
+	Adjustments []invoicing.Adjustment     `json:"adjustments"`
+	Skipped     []invoicing.SkippedVehicle `json:"skipped"`
+}
+
+// invoicesHandler handles generation of monthly invoices from the passage ledger (POST)
+// and retrieval of issued invoices as JSON, CSV or HTML (GET).
+func invoicesHandler(w http.ResponseWriter, r *http.Request) {
+	if InvoiceStore == nil {
+		http.Error(w, "invoice store is not available", http.StatusServiceUnavailable)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		queryParams := r.URL.Query()
+		invoices := InvoiceStore.Find(queryParams.Get("city"), queryParams.Get("period"), queryParams.Get("plate"))
+		err := renderInvoices(w, queryParams.Get("format"), invoices)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error occurred %v", err), http.StatusBadRequest)
+		}
+	case http.MethodPost:
+		if PassageLedger == nil {
+			http.Error(w, "passage ledger is not available", http.StatusServiceUnavailable)
+			return
+		}
+
+		var requestData InvoiceRequestData
+		if !decodeJSON(w, r, &requestData) {
+			return
+		}
+		if requestData.City == "" {
+			http.Error(w, "city not provided", http.StatusBadRequest)
+			return
+		}
+		period, err := invoicing.ParsePeriod(requestData.Period)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error occurred %v", err), http.StatusBadRequest)
+			return
+		}
+
+		entries := PassageLedger.PassagesInCity(requestData.City, period.Start, period.End)
+		invoices, skipped, err := invoicing.Generate(requestData.City, period, entries, auditedVehicleCalculation(r.Context()))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error occurred %v", err), http.StatusInternalServerError)
+			return
+		}
+		for _, vehicle := range skipped {
+			helpers.LoggerFromContext(r.Context()).Warn("vehicle not invoiced", "city", requestData.City, "period", requestData.Period,
+				"license_plate", vehicle.LicensePlate, "error", vehicle.Reason)
+		}
+
+		issuedAt := time.Now().UTC()
+		for i := range invoices {
+			var issued bool
+			invoices[i], issued, err = InvoiceStore.Issue(invoices[i], issuedAt)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Error occurred %v", err), http.StatusInternalServerError)
+				return
+			}
+			if issued {
+				publishEvent(subscriptions.EventInvoiceIssued, subscriptions.EventInvoiceIssued+":"+invoices[i].Number, invoices[i])
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(InvoiceResultData{Invoices: invoices, Skipped: skipped})
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// recalculationLock serializes recalculations.
+var recalculationLock sync.Mutex
+
+// recalculationsHandler handles recalculation of issued invoices after a correction of the tax rules (POST)
+// and retrieval of the resulting credit and debit adjustments (GET).
+func recalculationsHandler(w http.ResponseWriter, r *http.Request) {
+	if InvoiceStore == nil {
+		http.Error(w, "invoice store is not available", http.StatusServiceUnavailable)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		queryParams := r.URL.Query()
+		adjustments := InvoiceStore.FindAdjustments(queryParams.Get("city"), queryParams.Get("period"), queryParams.Get("plate"))
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(adjustments)
+	case http.MethodPost:
+		if PassageLedger == nil {
+			http.Error(w, "passage ledger is not available", http.StatusServiceUnavailable)
+			return
+		}
+
+		var requestData InvoiceRequestData
+		if !decodeJSON(w, r, &requestData) {
+			return
+		}
+		if requestData.City == "" || requestData.Reason == "" {
+			http.Error(w, "city and reason must be provided", http.StatusBadRequest)
+			return
+		}
+		period, err := invoicing.ParsePeriod(requestData.Period)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error occurred %v", err), http.StatusBadRequest)
+			return
+		}
+
+		// recalculations of the same invoices must not interleave, or both would adjust the same difference
+		recalculationLock.Lock()
+		defer recalculationLock.Unlock()
+
+		entries := PassageLedger.PassagesInCity(requestData.City, period.Start, period.End)
+		adjustments, skipped, err := invoicing.Recalculate(requestData.City, period, entries, auditedVehicleCalculation(r.Context()), InvoiceStore, requestData.Reason)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error occurred %v", err), http.StatusInternalServerError)
+			return
+		}
+		for _, vehicle := range skipped {
+			helpers.LoggerFromContext(r.Context()).Warn("vehicle not recalculated", "city", requestData.City, "period", requestData.Period,
+				"license_plate", vehicle.LicensePlate, "error", vehicle.Reason)
+		}
+
+		createdAt := time.Now().UTC()
+		for i := range adjustments {
+			adjustments[i], err = InvoiceStore.Record(adjustments[i], createdAt)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Error occurred %v", err), http.StatusInternalServerError)
+				return
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(RecalculationResultData{Adjustments: adjustments, Skipped: skipped})
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// renderInvoices writes the invoices in the requested format, JSON by default.
+func renderInvoices(w http.ResponseWriter, format string, invoices []invoicing.Invoice) error {
+	switch format {
+	case "", "json":
+		w.Header().Set("Content-Type", "application/json")
+		return invoicing.RenderJSON(w, invoices)
+	case "csv":
+		w.Header().Set("Content-Type", "text/csv")
+		return invoicing.RenderCSV(w, invoices)
+	case "html":
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		return invoicing.RenderHTML(w, invoices)
+	default:
+		return fmt.Errorf("unknown format %s", format)
+	}
+}
+
+// calculateVehiclePassages calculates stored passages of a single vehicle the same way
+// as requests sent by callers, with registration, plate detection and exemptions applied.
+// It serves the server's own running totals and is not audited; see auditedVehicleCalculation.
+func calculateVehiclePassages(licensePlate string, vehicleType string, passages []calculator.Passage) (calculator.TripResult, error) {
+	_, result, err := calculateVehicle(context.Background(), licensePlate, vehicleType, passages)
+	if err != nil {
+		return calculator.TripResult{}, err
+	}
+	return result.TripInfo, result.Error
+}
+
+// calculateVehicle classifies a vehicle, loads the rules of its passages and calculates them.
+//
+// Returns:
+//   - RequestData: The request calculated, with its passages resolved.
+//   - ResultData: The result of the calculation.
+//   - error: An error if the vehicle, reported as an invoicing.VehicleError, or the rules of its passages
+//     could not be resolved, so nothing was calculated.
+func calculateVehicle(ctx context.Context, licensePlate string, vehicleType string, passages []calculator.Passage) (RequestData, ResultData, error) {
+	requestData := RequestData{
+		Type:         vehicleType,
+		LicensePlate: licensePlate,
+		Passages:     passages,
+		Context:      ctx,
+	}
+	err := classifyVehicle(&requestData)
+	if err != nil {
+		return requestData, ResultData{}, &invoicing.VehicleError{Err: err}
+	}
+
+	requestData.CityRules, err = loadTripRules(ctx, requestData.Passages)
+	if err != nil {
+		return requestData, ResultData{}, err
+	}
+	return requestData, calculate(requestData), nil
+}
@@ -0,0 +1,242 @@
+package server
+
+import (
+	"congestion-calculator-manager/app/auth"
+	"congestion-calculator-manager/app/calculator"
+	"congestion-calculator-manager/app/helpers"
+	"congestion-calculator-manager/app/jobs"
+	taxrules "congestion-calculator-manager/app/tax_rules"
+	"congestion-calculator-manager/app/webhooks"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Limits of the job queue.
+const (
+	// maxUnfinishedJobs is the number of queued and running jobs above which submissions are rejected.
+	maxUnfinishedJobs = 100
+	// jobRetention is how long the results of finished jobs are kept.
+	jobRetention = 24 * time.Hour
+)
+
+// JobEventFinished is the event of the notification sent to a job's webhook when it finishes.
+const JobEventFinished = "job_finished"
+
+// JobRequestData represents the structure for incoming job submissions. Every request is calculated
+// like a /Trip request; requests with dates only are taken as passages in their city, Gothenburg by default.
+type JobRequestData struct {
+	Requests      []RequestData `json:"requests"`
+	WebhookURL    string        `json:"webhook_url"`
+	WebhookSecret string        `json:"webhook_secret"`
+}
+
+// JobResult represents the outcome of a single request of a job.
+type JobResult struct {
+	Index        int                    `json:"index"`
+	LicensePlate string                 `json:"licenseplate"`
+	Trip         *calculator.TripResult `json:"trip,omitempty"`
+	Error        string                 `json:"error,omitempty"`
+}
+
+// JobResultsData represents the structure for the results of a finished job.
+type JobResultsData struct {
+	Job     jobs.Job    `json:"job"`
+	Results []JobResult `json:"results"`
+}
+
+// JobNotification represents the body of the notification sent to a job's webhook.
+type JobNotification struct {
+	Event string   `json:"event"`
+	Job   jobs.Job `json:"job"`
+}
+
+// queuedJob holds the requests of a job waiting for the job runner, and the caller who submitted it.
+type queuedJob struct {
+	id        string
+	requests  []RequestData
+	principal auth.Principal
+	logger    *helpers.Logger
+}
+
+var (
+	// JobStore holds the asynchronous jobs submitted to /Jobs.
+	JobStore = jobs.NewStore(jobRetention, maxUnfinishedJobs)
+
+	// WebhookSender delivers the notifications of finished jobs.
+	WebhookSender = webhooks.NewSender()
+
+	// jobQueue holds at most as many jobs as the store accepts unfinished, so queueing never blocks.
+	jobQueue = make(chan queuedJob, maxUnfinishedJobs)
+)
+
+// jobsHandler handles submission of asynchronous calculation jobs (POST) and their status (GET).
+func jobsHandler(w http.ResponseWriter, r *http.Request) {
+	principal, _ := auth.PrincipalFromContext(r.Context())
+	switch r.Method {
+	case http.MethodGet:
+		job, exists := findJob(r, principal)
+		if !exists {
+			http.Error(w, fmt.Sprintf("job %s not found", r.URL.Query().Get("id")), http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(job)
+	case http.MethodPost:
+		var requestData JobRequestData
+		if !decodeJSON(w, r, &requestData) {
+			return
+		}
+		if len(requestData.Requests) == 0 {
+			http.Error(w, "no requests provided", http.StatusBadRequest)
+			return
+		}
+		if requestData.WebhookURL != "" {
+			if err := webhooks.ValidateTarget(requestData.WebhookURL, requestData.WebhookSecret); err != nil {
+				http.Error(w, fmt.Sprintf("Error occurred %v", err), http.StatusBadRequest)
+				return
+			}
+		}
+
+		job, err := JobStore.Create(principal.Subject, len(requestData.Requests), requestData.WebhookURL, requestData.WebhookSecret, time.Now())
+		if err != nil {
+			w.Header().Set("Retry-After", "60")
+			http.Error(w, fmt.Sprintf("Error occurred %v", err), http.StatusServiceUnavailable)
+			return
+		}
+		logger := helpers.LoggerFromContext(r.Context()).With("job_id", job.ID)
+		jobQueue <- queuedJob{id: job.ID, requests: requestData.Requests, principal: principal, logger: logger}
+		logger.Info("job submitted", "requests", len(requestData.Requests))
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Location", "/Jobs?id="+job.ID)
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(job)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// jobResultsHandler handles retrieval of the results of finished jobs; unfinished jobs are answered with 409.
+func jobResultsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		principal, _ := auth.PrincipalFromContext(r.Context())
+		job, exists := findJob(r, principal)
+		if !exists {
+			http.Error(w, fmt.Sprintf("job %s not found", r.URL.Query().Get("id")), http.StatusNotFound)
+			return
+		}
+		if !job.Finished() {
+			http.Error(w, fmt.Sprintf("job %s is %s, %d of %d requests done", job.ID, job.Status, job.Progress.Done, job.Progress.Total), http.StatusConflict)
+			return
+		}
+		job, results, _ := JobStore.Results(job.ID)
+		jobResults, _ := results.([]JobResult)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(JobResultsData{Job: job, Results: jobResults})
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// findJob returns the job of the id query parameter if the caller submitted it or is an admin.
+func findJob(r *http.Request, principal auth.Principal) (jobs.Job, bool) {
+	job, exists := JobStore.Get(r.URL.Query().Get("id"))
+	if !exists || (job.Owner != principal.Subject && !principal.HasRole(auth.RoleAdmin)) {
+		return jobs.Job{}, false
+	}
+	return job, true
+}
+
+// runJobs calculates queued jobs one at a time, next to the worker serving synchronous requests.
+func runJobs() {
+	for queued := range jobQueue {
+		JobStore.Start(queued.id, time.Now())
+		ctx := auth.ContextWithPrincipal(helpers.ContextWithLogger(context.Background(), queued.logger), queued.principal)
+
+		results := make([]JobResult, len(queued.requests))
+		failures := 0
+		for i, requestData := range queued.requests {
+			results[i] = JobResult{Index: i, LicensePlate: requestData.LicensePlate}
+			trip, err := calculateJobRequest(ctx, requestData)
+			if err != nil {
+				results[i].Error = err.Error()
+				failures++
+			} else {
+				results[i].Trip = &trip
+			}
+			JobStore.Advance(queued.id)
+		}
+
+		var err error
+		if failures == len(results) {
+			err = errors.New("every request of the job failed")
+		}
+		job, secret := JobStore.Finish(queued.id, results, err, time.Now())
+		jobsFinished.Inc(string(job.Status))
+		queued.logger.Info("job finished", "status", job.Status, "requests", len(results), "failures", failures)
+
+		if job.WebhookURL != "" {
+			go notifyJobFinished(job, secret, queued.logger)
+		}
+	}
+}
+
+// calculateJobRequest calculates a single request of a job the same way as /Trip requests.
+func calculateJobRequest(ctx context.Context, requestData RequestData) (calculator.TripResult, error) {
+	if err := classifyVehicle(&requestData); err != nil {
+		return calculator.TripResult{}, err
+	}
+	if len(requestData.Passages) == 0 && len(requestData.Dates) > 0 {
+		city := requestData.City
+		if city == "" {
+			city = taxrules.DefaultCity
+		}
+		for _, date := range requestData.Dates {
+			requestData.Passages = append(requestData.Passages, calculator.Passage{City: city, Time: date})
+		}
+	}
+	if len(requestData.Passages) == 0 && (!requestData.From.IsZero() || !requestData.To.IsZero()) {
+		loadPassagesFromLedger(&requestData)
+	}
+	if len(requestData.Passages) == 0 {
+		return calculator.TripResult{}, errors.New("no passages provided")
+	}
+	if maxPassages := ServerLimits().MaxPassages; maxPassages > 0 && len(requestData.Passages) > maxPassages {
+		return calculator.TripResult{}, fmt.Errorf("%d passages exceed the maximum of %d per request", len(requestData.Passages), maxPassages)
+	}
+
+	cityRules, err := loadTripRules(ctx, requestData.Passages)
+	if err != nil {
+		return calculator.TripResult{}, err
+	}
+	requestData.CityRules = cityRules
+	requestData.Context = ctx
+
+	result := calculate(requestData)
+	if err := auditCalculation(ctx, requestData, result); err != nil {
+		return calculator.TripResult{}, err
+	}
+	return result.TripInfo, result.Error
+}
+
+// notifyJobFinished sends the notification of a finished job to its webhook.
+func notifyJobFinished(job jobs.Job, secret string, logger *helpers.Logger) {
+	body, err := json.Marshal(JobNotification{Event: JobEventFinished, Job: job})
+	if err != nil {
+		logger.Error("job notification not encoded", "error", err)
+		return
+	}
+	delivery := WebhookSender.Send(job.WebhookURL, []byte(secret), JobEventFinished, body)
+	webhookDeliveries.Inc(JobEventFinished, strconv.FormatBool(delivery.Delivered))
+	if !delivery.Delivered {
+		logger.Warn("job notification not delivered", "url", job.WebhookURL, "attempts", delivery.Attempts, "error", delivery.Error)
+		return
+	}
+	logger.Info("job notification delivered", "url", job.WebhookURL, "attempts", delivery.Attempts, "delivery_id", delivery.ID)
+}
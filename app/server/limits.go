@@ -0,0 +1,239 @@
+package server
+
+import (
+	"congestion-calculator-manager/app/helpers"
+	"congestion-calculator-manager/app/ratelimit"
+	"congestion-calculator-manager/app/tracing"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Environment variables overriding the default limits.
+const (
+	RateLimitPerKeyEnv = "CONGESTION_RATE_LIMIT_PER_KEY"
+	RateBurstPerKeyEnv = "CONGESTION_RATE_BURST_PER_KEY"
+	RateLimitPerIPEnv  = "CONGESTION_RATE_LIMIT_PER_IP"
+	RateBurstPerIPEnv  = "CONGESTION_RATE_BURST_PER_IP"
+	MaxBodyBytesEnv    = "CONGESTION_MAX_BODY_BYTES"
+	MaxPassagesEnv     = "CONGESTION_MAX_PASSAGES"
+)
+
+// Limits represents the limits protecting the server from oversized and excessive requests.
+// Rates are requests per second; a rate of 0 disables the limit.
+type Limits struct {
+	RatePerKey   float64
+	BurstPerKey  int
+	RatePerIP    float64
+	BurstPerIP   int
+	MaxBodyBytes int64
+	MaxPassages  int
+}
+
+// DefaultLimits are the limits applied unless overridden through the environment.
+var DefaultLimits = Limits{
+	RatePerKey:   20,
+	BurstPerKey:  40,
+	RatePerIP:    50,
+	BurstPerIP:   100,
+	MaxBodyBytes: 1 << 20,
+	MaxPassages:  10000,
+}
+
+// errBodyTooLarge is returned when reading a request body beyond the maximum size.
+var errBodyTooLarge = errors.New("request body too large")
+
+// limitState represents the limits in effect together with the rate limiters applying them.
+type limitState struct {
+	limits     Limits
+	keyLimiter *ratelimit.Limiter
+	ipLimiter  *ratelimit.Limiter
+}
+
+var (
+	// limitsMu guards currentLimits, which requests read while SetLimits may replace it.
+	limitsMu      sync.RWMutex
+	currentLimits = newLimitState(DefaultLimits)
+)
+
+// newLimitState creates the rate limiters of the given limits.
+func newLimitState(limits Limits) limitState {
+	return limitState{
+		limits:     limits,
+		keyLimiter: ratelimit.NewLimiter(limits.RatePerKey, limits.BurstPerKey),
+		ipLimiter:  ratelimit.NewLimiter(limits.RatePerIP, limits.BurstPerIP),
+	}
+}
+
+// limitsInEffect returns the limits in effect and their rate limiters.
+func limitsInEffect() limitState {
+	limitsMu.RLock()
+	defer limitsMu.RUnlock()
+	return currentLimits
+}
+
+// ServerLimits returns the limits in effect.
+func ServerLimits() Limits {
+	return limitsInEffect().limits
+}
+
+// LoadLimits returns the default limits with the overrides set in the environment.
+//
+// Returns:
+//   - Limits: The limits to apply.
+//   - error: An error naming the first override that is not a valid number; the default is kept for it.
+func LoadLimits() (Limits, error) {
+	limits := DefaultLimits
+	var firstErr error
+	parse := func(name string, apply func(value float64)) {
+		text := os.Getenv(name)
+		if text == "" {
+			return
+		}
+		value, err := strconv.ParseFloat(text, 64)
+		if err != nil || value < 0 {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("%s: invalid limit %q", name, text)
+			}
+			return
+		}
+		apply(value)
+	}
+	parse(RateLimitPerKeyEnv, func(value float64) { limits.RatePerKey = value })
+	parse(RateBurstPerKeyEnv, func(value float64) { limits.BurstPerKey = int(value) })
+	parse(RateLimitPerIPEnv, func(value float64) { limits.RatePerIP = value })
+	parse(RateBurstPerIPEnv, func(value float64) { limits.BurstPerIP = int(value) })
+	parse(MaxBodyBytesEnv, func(value float64) { limits.MaxBodyBytes = int64(value) })
+	parse(MaxPassagesEnv, func(value float64) { limits.MaxPassages = int(value) })
+	return limits, firstErr
+}
+
+// SetLimits replaces the limits in effect and resets the rate limiters. It is safe to call while serving requests.
+func SetLimits(limits Limits) {
+	state := newLimitState(limits)
+	limitsMu.Lock()
+	defer limitsMu.Unlock()
+	currentLimits = state
+}
+
+// LimitErrorData represents the body of responses to requests rejected by a limit.
+type LimitErrorData struct {
+	Error             string `json:"error"`
+	Limit             string `json:"limit"`
+	RetryAfterSeconds int    `json:"retry_after_seconds,omitempty"`
+}
+
+// writeLimitError rejects a request exceeding a limit. Rate limited requests get a Retry-After header.
+func writeLimitError(w http.ResponseWriter, status int, limit string, message string, retryAfter time.Duration) {
+	limitRejections.Inc(limit)
+	body := LimitErrorData{Error: message, Limit: limit}
+	if status == http.StatusTooManyRequests {
+		body.RetryAfterSeconds = int(math.Ceil(retryAfter.Seconds()))
+		if body.RetryAfterSeconds < 1 {
+			body.RetryAfterSeconds = 1
+		}
+		w.Header().Set("Retry-After", strconv.Itoa(body.RetryAfterSeconds))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+// withIPRateLimit rejects requests of clients exceeding the rate allowed per IP address.
+// The address is the peer of the connection; forwarding headers are not trusted.
+func withIPRateLimit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			ip = r.RemoteAddr
+		}
+		if allowed, retryAfter := limitsInEffect().ipLimiter.Allow(ip, time.Now()); !allowed {
+			helpers.LoggerFromContext(r.Context()).Warn("rate limited", "ip", ip)
+			writeLimitError(w, http.StatusTooManyRequests, "rate_per_ip", "too many requests from this address", retryAfter)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// allowKey takes a token of the authenticated caller's rate limit, rejecting the request if none is left.
+func allowKey(w http.ResponseWriter, r *http.Request, subject string) bool {
+	allowed, retryAfter := limitsInEffect().keyLimiter.Allow(subject, time.Now())
+	if !allowed {
+		helpers.LoggerFromContext(r.Context()).Warn("rate limited", "subject", subject)
+		writeLimitError(w, http.StatusTooManyRequests, "rate_per_key", "too many requests for this API key", retryAfter)
+	}
+	return allowed
+}
+
+// limitedBody reads at most limit bytes of a request body and fails with errBodyTooLarge beyond that.
+type limitedBody struct {
+	body      io.ReadCloser
+	remaining int64
+}
+
+// Read reads from the body, failing once more than the limit has been read.
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.remaining < 0 {
+		return 0, errBodyTooLarge
+	}
+	if int64(len(p)) > b.remaining+1 {
+		p = p[:b.remaining+1]
+	}
+	n, err := b.body.Read(p)
+	b.remaining -= int64(n)
+	if b.remaining < 0 {
+		return n, errBodyTooLarge
+	}
+	return n, err
+}
+
+// Close closes the body.
+func (b *limitedBody) Close() error {
+	return b.body.Close()
+}
+
+// decodeJSON decodes the JSON body of a request of at most the maximum body size,
+// measured in a span of the request's trace. If decoding fails it responds with
+// 413 for oversized bodies or 400 otherwise, and returns false.
+func decodeJSON(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	_, span := tracing.Start(r.Context(), "decode request")
+	defer span.End()
+
+	maxBodyBytes := ServerLimits().MaxBodyBytes
+	body := io.ReadCloser(r.Body)
+	if maxBodyBytes > 0 {
+		body = &limitedBody{body: r.Body, remaining: maxBodyBytes}
+	}
+	err := json.NewDecoder(body).Decode(v)
+	span.RecordError(err)
+	switch {
+	case err == nil:
+		return true
+	case errors.Is(err, errBodyTooLarge):
+		writeLimitError(w, http.StatusRequestEntityTooLarge, "max_body_bytes",
+			fmt.Sprintf("request body exceeds %d bytes", maxBodyBytes), 0)
+	default:
+		http.Error(w, "Error decoding JSON", http.StatusBadRequest)
+	}
+	return false
+}
+
+// allowPassages rejects requests with more passages than allowed, responding with 413.
+func allowPassages(w http.ResponseWriter, count int) bool {
+	maxPassages := ServerLimits().MaxPassages
+	if maxPassages > 0 && count > maxPassages {
+		writeLimitError(w, http.StatusRequestEntityTooLarge, "max_passages",
+			fmt.Sprintf("%d passages exceed the maximum of %d per request", count, maxPassages), 0)
+		return false
+	}
+	return true
+}
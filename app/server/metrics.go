@@ -0,0 +1,104 @@
+package server
+
+import (
+	"congestion-calculator-manager/app/jobs"
+	"congestion-calculator-manager/app/metrics"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// Metrics of the server, exposed on /metrics.
+var (
+	httpRequests = metrics.Default.NewCounterVec("congestion_http_requests_total",
+		"HTTP requests handled, by route, method and status code.", "route", "method", "status")
+	httpDuration = metrics.Default.NewHistogramVec("congestion_http_request_duration_seconds",
+		"Time spent handling HTTP requests, by route.", metrics.DefaultBuckets, "route")
+	calculationDuration = metrics.Default.NewHistogramVec("congestion_calculation_duration_seconds",
+		"Time spent calculating the tax of a request in the worker.", metrics.DefaultBuckets)
+	calculationErrors = metrics.Default.NewCounterVec("congestion_calculation_errors_total",
+		"Calculations that failed.")
+	passagesProcessed = metrics.Default.NewCounterVec("congestion_passages_processed_total",
+		"Passages calculated, by city.", "city")
+	feesCharged = metrics.Default.NewCounterVec("congestion_fees_charged_sek_total",
+		"Fees in SEK of calculated passages after the single charge rule and daily cap, by city.", "city")
+	ruleReloads = metrics.Default.NewCounterVec("congestion_rule_reloads_total",
+		"City rule files read again after they changed on disk, by city.", "city")
+	limitRejections = metrics.Default.NewCounterVec("congestion_limit_rejections_total",
+		"Requests rejected for exceeding a rate or size limit, by limit.", "limit")
+	grpcRequests = metrics.Default.NewCounterVec("congestion_grpc_requests_total",
+		"gRPC calls handled, by method and status code.", "method", "code")
+	jobsFinished = metrics.Default.NewCounterVec("congestion_jobs_finished_total",
+		"Asynchronous jobs finished, by status.", "status")
+	webhookDeliveries = metrics.Default.NewCounterVec("congestion_webhook_deliveries_total",
+		"Webhook notifications sent, by event and whether they were delivered.", "event", "delivered")
+	gantryEvents = metrics.Default.NewCounterVec("congestion_gantry_events_total",
+		"Passage events received from gantries, by transport and status.", "transport", "status")
+	queueEvents = metrics.Default.NewCounterVec("congestion_queue_events_total",
+		"Passage events consumed from queues, by kind of source and outcome.", "source", "outcome")
+
+	// pendingCalculations counts requests waiting for or being calculated by the worker.
+	pendingCalculations int64
+)
+
+func init() {
+	metrics.Default.NewGaugeFunc("congestion_worker_queue_depth",
+		"Calculation requests waiting for or being processed by the worker.",
+		func() float64 { return float64(atomic.LoadInt64(&pendingCalculations)) })
+	metrics.Default.NewCounterFunc("congestion_city_cache_hits_total",
+		"Lookups of city data found in the cache.",
+		func() float64 { return float64(LocalCityCache.Stats().Hits) })
+	metrics.Default.NewCounterFunc("congestion_city_cache_misses_total",
+		"Lookups of city data not found in the cache.",
+		func() float64 { return float64(LocalCityCache.Stats().Misses) })
+	metrics.Default.NewGaugeFunc("congestion_city_cache_entries",
+		"City files held in the cache.",
+		func() float64 { return float64(LocalCityCache.Stats().Entries) })
+	metrics.Default.NewGaugeFunc("congestion_jobs_unfinished",
+		"Asynchronous jobs queued or running.",
+		func() float64 {
+			counts := JobStore.Counts()
+			return float64(counts[jobs.Queued] + counts[jobs.Running])
+		})
+}
+
+// metricsHandler exposes the metrics of the server in the Prometheus text exposition format.
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		metrics.Default.WriteText(w)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// methodLabel returns the method of a request as counted, OTHER for methods that are not standard,
+// so that clients cannot create new series with made-up methods.
+func methodLabel(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+		http.MethodDelete, http.MethodConnect, http.MethodOptions, http.MethodTrace:
+		return method
+	}
+	return "OTHER"
+}
+
+// withMetrics counts every request and measures its duration by the route it was dispatched to.
+func withMetrics(mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started := time.Now()
+		// routes are the registered patterns, so unknown paths do not create new series
+		_, route := mux.Handler(r)
+		if route == "" {
+			route = "unmatched"
+		}
+
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		mux.ServeHTTP(recorder, r)
+
+		httpRequests.Inc(route, methodLabel(r.Method), strconv.Itoa(recorder.status))
+		httpDuration.Observe(time.Since(started).Seconds(), route)
+	})
+}
@@ -0,0 +1,137 @@
+package server
+
+import (
+	"bufio"
+	"congestion-calculator-manager/app/auth"
+	"congestion-calculator-manager/app/helpers"
+	"congestion-calculator-manager/app/tracing"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+)
+
+// RequestIDHeader is the header carrying the id that correlates a request with its log lines.
+const RequestIDHeader = "X-Request-ID"
+
+// maxRequestIDLength is the length above which a propagated request id is replaced by a generated one.
+const maxRequestIDLength = 128
+
+// statusRecorder remembers the status code written by a handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+// WriteHeader records the status code and writes it to the underlying response.
+func (s *statusRecorder) WriteHeader(status int) {
+	s.status = status
+	s.ResponseWriter.WriteHeader(status)
+}
+
+// Flush sends buffered data to the caller, for handlers streaming their response.
+func (s *statusRecorder) Flush() {
+	if flusher, ok := s.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Hijack takes over the connection, for handlers switching protocols; the request is recorded with status 101.
+func (s *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := s.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response does not support hijacking")
+	}
+	s.status = http.StatusSwitchingProtocols
+	return hijacker.Hijack()
+}
+
+// withRequestLogging attaches a request id, taken from the X-Request-ID header or generated,
+// to the response and to a logger carried by the request context, and logs every completed request.
+func withRequestLogging(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started := time.Now()
+		id := requestID(r)
+		w.Header().Set(RequestIDHeader, id)
+
+		logger := helpers.Log.With("request_id", id)
+		if span := tracing.SpanFromContext(r.Context()); span != nil {
+			logger = logger.With("trace_id", span.SpanContext().TraceID.String())
+		}
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r.WithContext(helpers.ContextWithLogger(r.Context(), logger)))
+
+		logger.Info("request completed",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", recorder.status,
+			"duration_ms", float64(time.Since(started).Microseconds())/1000)
+	})
+}
+
+// requestID returns the id sent by the caller, or a new one if it is missing or unreasonably long.
+func requestID(r *http.Request) string {
+	id := r.Header.Get(RequestIDHeader)
+	if id != "" && len(id) <= maxRequestIDLength {
+		return id
+	}
+
+	buffer := make([]byte, 8)
+	if _, err := rand.Read(buffer); err != nil {
+		return time.Now().UTC().Format("20060102150405.000000000")
+	}
+	return hex.EncodeToString(buffer)
+}
+
+// withTracing measures every request in a span continuing the trace of the caller's traceparent header,
+// and returns the traceparent of that span so callers can find it.
+func withTracing(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		if parent, err := tracing.ParseTraceParent(r.Header.Get(tracing.TraceParentHeader)); err == nil {
+			ctx = tracing.ContextWithRemoteParent(ctx, parent)
+		}
+		ctx, span := tracing.Start(ctx, "HTTP "+r.Method+" "+r.URL.Path)
+		defer span.End()
+		w.Header().Set(tracing.TraceParentHeader, span.SpanContext().TraceParent())
+
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r.WithContext(ctx))
+
+		span.SetAttribute("http.method", r.Method)
+		span.SetAttribute("http.target", r.URL.Path)
+		span.SetAttribute("http.status_code", recorder.status)
+		if recorder.status >= http.StatusInternalServerError {
+			span.RecordError(fmt.Errorf("status %d", recorder.status))
+		}
+	})
+}
+
+// requireRole authenticates the caller of a handler and rejects callers without the given role
+// with 403. An empty role only requires the caller to be authenticated; handlers then check
+// permissions that depend on the request, such as editing the rules of a city.
+func requireRole(role string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		principal, err := Authenticator.Authenticate(r)
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="congestion-calculator"`)
+			http.Error(w, fmt.Sprintf("Error occurred %v", err), http.StatusUnauthorized)
+			return
+		}
+		if role != "" && !principal.HasRole(role) {
+			http.Error(w, fmt.Sprintf("%s does not have the %s role", principal.Subject, role), http.StatusForbidden)
+			return
+		}
+
+		if !allowKey(w, r, principal.Subject) {
+			return
+		}
+
+		ctx := auth.ContextWithPrincipal(r.Context(), principal)
+		ctx = helpers.ContextWithLogger(ctx, helpers.LoggerFromContext(ctx).With("subject", principal.Subject))
+		handler(w, r.WithContext(ctx))
+	}
+}
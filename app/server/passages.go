@@ -0,0 +1,137 @@
+package server
+
+import (
+	"congestion-calculator-manager/app/calculator"
+	"congestion-calculator-manager/app/helpers"
+	"congestion-calculator-manager/app/ledger"
+	"congestion-calculator-manager/app/plates"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// PassageEvent represents a single passage sent for ingestion into the ledger.
+type PassageEvent struct {
+	PassageId    string    `json:"passage_id"`
+	LicensePlate string    `json:"licenseplate"`
+	Type         string    `json:"type"`
+	City         string    `json:"city"`
+	Station      string    `json:"station"`
+	Time         time.Time `json:"time"`
+}
+
+// IngestRequestData represents the structure for incoming passage ingestion requests.
+type IngestRequestData struct {
+	Passages []PassageEvent `json:"passages"`
+}
+
+// IngestResultData represents the structure for the result of a passage ingestion.
+type IngestResultData struct {
+	Accepted   int `json:"accepted"`
+	Duplicates int `json:"duplicates"`
+}
+
+// passagesHandler handles ingestion of passages into the ledger.
+// Passages already recorded under the same passage id are counted as duplicates and ignored.
+func passagesHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+		if PassageLedger == nil {
+			http.Error(w, "passage ledger is not available", http.StatusServiceUnavailable)
+			return
+		}
+
+		var requestData IngestRequestData
+		if !decodeJSON(w, r, &requestData) || !allowPassages(w, len(requestData.Passages)) {
+			return
+		}
+
+		entries, err := toLedgerEntries(r.Context(), requestData.Passages)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error occurred %v", err), http.StatusBadRequest)
+			return
+		}
+
+		result := IngestResultData{}
+		for _, entry := range entries {
+			accepted, err := PassageLedger.Append(entry)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Error occurred %v", err), http.StatusInternalServerError)
+				return
+			}
+			if accepted {
+				result.Accepted++
+				if _, err := DailyTotals.Record(entry, time.Now()); err != nil {
+					helpers.LoggerFromContext(r.Context()).Warn("daily total not recalculated", "passage_id", entry.PassageId, "error", err)
+				}
+			} else {
+				result.Duplicates++
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(result)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// toLedgerEntries validates passage events and resolves their cities, so that
+// either all passages of a request are recorded or none of them.
+func toLedgerEntries(ctx context.Context, events []PassageEvent) ([]ledger.Entry, error) {
+	passages := make([]calculator.Passage, len(events))
+	for i, event := range events {
+		if event.PassageId == "" {
+			return nil, fmt.Errorf("passage at %v has no passage id", event.Time)
+		}
+		if event.Time.IsZero() {
+			return nil, fmt.Errorf("passage %s has no time", event.PassageId)
+		}
+		if !plates.IsValid(event.LicensePlate) {
+			return nil, fmt.Errorf("passage %s: %v", event.PassageId, plates.ErrInvalidPlate)
+		}
+		passages[i] = calculator.Passage{City: event.City, Station: event.Station, Time: event.Time}
+	}
+
+	// validates that every city has tax rules and fills in cities of passages given by station
+	_, err := loadTripRules(ctx, passages)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]ledger.Entry, len(events))
+	for i, event := range events {
+		entries[i] = ledger.Entry{
+			PassageId:    event.PassageId,
+			LicensePlate: plates.Normalize(event.LicensePlate),
+			VehicleType:  event.Type,
+			City:         passages[i].City,
+			Station:      event.Station,
+			Time:         event.Time,
+		}
+	}
+	return entries, nil
+}
+
+// loadPassagesFromLedger fills the passages of a request with the vehicle's passages
+// recorded in the ledger between From and To. If the caller did not state the vehicle type,
+// the type recorded with the passages is used, chosen as for invoices.
+func loadPassagesFromLedger(requestData *RequestData) {
+	if PassageLedger == nil {
+		return
+	}
+
+	entries := PassageLedger.Passages(requestData.LicensePlate, requestData.From, requestData.To)
+	for _, entry := range entries {
+		requestData.Passages = append(requestData.Passages, calculator.Passage{
+			City:    entry.City,
+			Station: entry.Station,
+			Time:    entry.Time,
+		})
+	}
+	if requestData.Type == "" {
+		requestData.Type = ledger.VehicleType(entries)
+	}
+}
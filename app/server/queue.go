@@ -0,0 +1,164 @@
+package server
+
+import (
+	"congestion-calculator-manager/app/helpers"
+	"congestion-calculator-manager/app/queue"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// QueueSourceEnv is the environment variable naming the queue passage events are consumed from:
+// file:<path> tails a file of JSON lines and nats://<host>:<port>/<stream>/<consumer> pulls from a
+// durable JetStream consumer. Passages published to PassageBroker are consumed regardless.
+const QueueSourceEnv = "CONGESTION_QUEUE_SOURCE"
+
+// PassageTopic is the topic of PassageBroker passage events are consumed from.
+const PassageTopic = "passages"
+
+// Settings of the queue consumers.
+const (
+	queueRetryBackoff    = time.Second
+	queueCheckpointEvery = 100
+	queuePollInterval    = 500 * time.Millisecond
+	queueRestartDelay    = 5 * time.Second
+)
+
+var (
+	// PassageBroker is the in-process broker producers running in the server publish passage events to.
+	PassageBroker = queue.NewBroker()
+
+	// QueueCheckpoints holds the offsets of the queue consumers; it is nil if the file could not be opened.
+	QueueCheckpoints *queue.Checkpoints
+
+	// DeadLetterStore holds the queued passage events that could not be ingested; it is nil if the file could not be opened.
+	DeadLetterStore *queue.DeadLetters
+)
+
+// openQueueStores opens the checkpoint and dead letter files of the queue consumers in the data store.
+func openQueueStores() error {
+	dir, err := helpers.DataDirectory()
+	if err != nil {
+		return err
+	}
+	QueueCheckpoints, err = queue.OpenCheckpoints(filepath.Join(dir, "queue", "checkpoints.json"))
+	if err != nil {
+		return err
+	}
+	DeadLetterStore, err = queue.OpenDeadLetters(filepath.Join(dir, "queue", "deadletters.jsonl"))
+	return err
+}
+
+// startQueueConsumers consumes the passage events of PassageBroker and of the queue configured in the environment.
+func startQueueConsumers() {
+	if PassageLedger == nil || QueueCheckpoints == nil || DeadLetterStore == nil {
+		helpers.Log.Warn("queue consumers not started, the ledger or queue stores are not available")
+		return
+	}
+
+	// the broker lives in memory, so its checkpoint from a previous run does not apply
+	go ConsumePassages(context.Background(), PassageBroker.Subscribe(PassageTopic, 0))
+
+	configured := os.Getenv(QueueSourceEnv)
+	if configured == "" {
+		return
+	}
+	go func() {
+		for {
+			source, err := openQueueSource(configured)
+			if err == nil {
+				helpers.Log.Info("consuming passage events", "source", source.Name())
+				err = ConsumePassages(context.Background(), source)
+				source.Close()
+			}
+			helpers.Log.Error("queue consumer stopped, restarting", "source", configured, "error", err, "delay_ms", queueRestartDelay.Milliseconds())
+			time.Sleep(queueRestartDelay)
+		}
+	}()
+}
+
+// openQueueSource opens the source named by the QueueSourceEnv variable.
+func openQueueSource(configured string) (queue.Source, error) {
+	if strings.HasPrefix(configured, "file:") {
+		path := strings.TrimPrefix(configured, "file:")
+		// checkpoints are kept under the name of the source
+		return queue.OpenFile(path, QueueCheckpoints.Offset("file:"+path), queuePollInterval), nil
+	}
+
+	parsed, err := url.Parse(configured)
+	if err != nil || parsed.Scheme != "nats" {
+		return nil, fmt.Errorf("%s: unsupported queue source %q", QueueSourceEnv, configured)
+	}
+	names := strings.Split(strings.Trim(parsed.Path, "/"), "/")
+	if len(names) != 2 || names[0] == "" || names[1] == "" {
+		return nil, fmt.Errorf("%s: expected nats://host:port/stream/consumer, but got %q", QueueSourceEnv, configured)
+	}
+	return queue.DialNATS(parsed.Host, names[0], names[1])
+}
+
+// ConsumePassages ingests the passage events of a source until ctx is done or the source fails, the same
+// way as events sent by gantries. Events that are not valid passages are dead-lettered; events that
+// cannot be recorded are retried.
+//
+// Parameters:
+//   - ctx: The context stopping the consumer.
+//   - source: The source, opened at the checkpointed offset.
+//
+// Returns:
+//   - error: The error that stopped the consumer.
+func ConsumePassages(ctx context.Context, source queue.Source) error {
+	if PassageLedger == nil || QueueCheckpoints == nil || DeadLetterStore == nil {
+		return errors.New("passage ledger or queue stores are not available")
+	}
+	logger := helpers.Log.With("source", source.Name())
+	consumer := queue.Consumer{
+		Source:          source,
+		Checkpoints:     QueueCheckpoints,
+		DeadLetters:     DeadLetterStore,
+		RetryBackoff:    queueRetryBackoff,
+		CheckpointEvery: queueCheckpointEvery,
+		OnProcessed: func(outcome string) {
+			queueEvents.Inc(strings.SplitN(source.Name(), ":", 2)[0], outcome)
+		},
+		Handler: func(ctx context.Context, message queue.Message) error {
+			ctx = helpers.ContextWithLogger(ctx, logger.With("offset", message.Offset))
+			var event PassageEvent
+			if err := json.Unmarshal(message.Data, &event); err != nil {
+				return queue.Malformed(err)
+			}
+			ack, err := ingestPassage(ctx, event)
+			if err != nil {
+				logger.Warn("queued passage not recorded, retrying", "passage_id", event.PassageId, "error", err)
+				return err
+			}
+			if ack.Status == PassageRejected {
+				logger.Warn("queued passage dead-lettered", "passage_id", event.PassageId, "error", ack.Error)
+				return queue.Malformed(errors.New(ack.Error))
+			}
+			return nil
+		},
+	}
+	return consumer.Run(ctx)
+}
+
+// deadLettersHandler handles retrieval of the queued passage events that could not be ingested.
+func deadLettersHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		if DeadLetterStore == nil {
+			http.Error(w, "dead letter store is not available", http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(DeadLetterStore.List(r.URL.Query().Get("source")))
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
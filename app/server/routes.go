@@ -0,0 +1,259 @@
+package server
+
+import (
+	"congestion-calculator-manager/app/audit"
+	"congestion-calculator-manager/app/auth"
+	"congestion-calculator-manager/app/calculator"
+	"congestion-calculator-manager/app/dailytotals"
+	"congestion-calculator-manager/app/invoicing"
+	"congestion-calculator-manager/app/jobs"
+	"congestion-calculator-manager/app/openapi"
+	"congestion-calculator-manager/app/queue"
+	"congestion-calculator-manager/app/registry"
+	"congestion-calculator-manager/app/simulation"
+	"congestion-calculator-manager/app/subscriptions"
+	taxrules "congestion-calculator-manager/app/tax_rules"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+// route binds a documented path to its handler. The OpenAPI document is generated from the
+// same table the handlers are registered from, so every route is documented.
+type route struct {
+	openapi.Route
+	handler http.HandlerFunc
+}
+
+// query returns the documentation of query parameters, which are optional unless named in required.
+func query(names map[string]string, required ...string) []openapi.Parameter {
+	sorted := make([]string, 0, len(names))
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+
+	parameters := make([]openapi.Parameter, 0, len(names))
+	for _, name := range sorted {
+		parameter := openapi.Parameter{Name: name, Description: names[name]}
+		for _, requiredName := range required {
+			parameter.Required = parameter.Required || requiredName == name
+		}
+		parameters = append(parameters, parameter)
+	}
+	return parameters
+}
+
+// routes returns the routes of the server.
+func routes() []route {
+	return []route{
+		{openapi.Route{Path: "/Gothenburg", Role: auth.RoleCalculator, Operations: []openapi.Operation{
+			{Method: http.MethodPost, Summary: "Calculate the congestion tax of a vehicle in Gothenburg",
+				Request: RequestData{}, Response: "", ContentType: "text/plain"},
+		}}, gothenburgTaxHandler},
+		{openapi.Route{Path: "/City", Role: auth.RoleCalculator, Operations: []openapi.Operation{
+			{Method: http.MethodGet, Summary: "Calculate the congestion tax of the sample vehicle of a city",
+				Query: query(map[string]string{"name": "The city"}, "name"), Response: "", ContentType: "text/plain"},
+		}}, customCityTaxHandler},
+		{openapi.Route{Path: "/Trip", Role: auth.RoleCalculator, Operations: []openapi.Operation{
+			{Method: http.MethodPost, Summary: "Calculate the congestion tax of a trip through several cities",
+				Request: RequestData{}, Response: calculator.TripResult{}},
+		}}, tripTaxHandler},
+		{openapi.Route{Path: "/Vehicle", Role: auth.RoleCalculator, Operations: []openapi.Operation{
+			{Method: http.MethodGet, Summary: "Look up a registered vehicle",
+				Query: query(map[string]string{"plate": "The license plate"}, "plate"), Response: registry.Registration{}},
+		}}, vehicleHandler},
+		{openapi.Route{Path: "/Passages", Role: auth.RoleCalculator, Operations: []openapi.Operation{
+			{Method: http.MethodPost, Summary: "Record passages in the ledger",
+				Request: IngestRequestData{}, Response: IngestResultData{}},
+		}}, passagesHandler},
+		{openapi.Route{Path: "/PassageStream", Role: auth.RoleCalculator, Operations: []openapi.Operation{
+			{Method: http.MethodPost, Summary: "Record a stream of passage events, one JSON event per line, as they arrive",
+				Request: PassageEvent{}, RequestContentType: "application/x-ndjson", Response: StreamResultData{}},
+		}}, passageStreamHandler},
+		{openapi.Route{Path: "/PassageSocket", Role: auth.RoleCalculator, Operations: []openapi.Operation{
+			{Method: http.MethodGet, Summary: "Record passage events sent as WebSocket text messages, each answered with a PassageAck",
+				Response: PassageAck{}, Status: http.StatusSwitchingProtocols},
+		}}, passageSocketHandler},
+		{openapi.Route{Path: "/DailyTotals", Role: auth.RoleCalculator, Operations: []openapi.Operation{
+			{Method: http.MethodGet, Summary: "Get the running totals of a vehicle on a day, from the passages ingested so far",
+				Query: query(map[string]string{
+					"plate": "The license plate",
+					"date":  "The day, as 2006-01-02; today by default",
+				}, "plate"),
+				Response: []dailytotals.Total{}},
+		}}, dailyTotalsHandler},
+		{openapi.Route{Path: "/DailyStatus", Role: auth.RoleCalculator, Operations: []openapi.Operation{
+			{Method: http.MethodGet, Summary: "Get the charge windows, running total and amount left before the daily cap of a vehicle in a city today",
+				Query: query(map[string]string{
+					"plate": "The license plate",
+					"city":  "The city",
+					"time":  "The moment of the status in RFC 3339 format; now by default",
+				}, "plate", "city"),
+				Response: dailytotals.Status{}},
+		}}, dailyStatusHandler},
+		{openapi.Route{Path: "/Explain", Role: auth.RoleCalculator, Operations: []openapi.Operation{
+			{Method: http.MethodGet, Summary: "Explain the fee of a single passage",
+				Query: query(map[string]string{
+					"city":    "The city of the passage",
+					"station": "The station of the passage, if the city is not given",
+					"plate":   "The license plate",
+					"type":    "The vehicle type, if the vehicle is not registered",
+					"time":    "The time of the passage in RFC 3339 format",
+					"format":  "json (default) or text",
+				}, "plate", "time"),
+				Response: calculator.Explanation{}},
+		}}, explainHandler},
+		{openapi.Route{Path: "/Jobs", Role: auth.RoleCalculator, Operations: []openapi.Operation{
+			{Method: http.MethodPost, Summary: "Submit calculations as an asynchronous job, optionally notifying a webhook when it finishes",
+				Request: JobRequestData{}, Response: jobs.Job{}, Status: http.StatusAccepted},
+			{Method: http.MethodGet, Summary: "Get the status and progress of a job",
+				Query: query(map[string]string{"id": "The job id"}, "id"), Response: jobs.Job{}},
+		}}, jobsHandler},
+		{openapi.Route{Path: "/JobResults", Role: auth.RoleCalculator, Operations: []openapi.Operation{
+			{Method: http.MethodGet, Summary: "Get the results of a finished job; 409 until it finishes",
+				Query: query(map[string]string{"id": "The job id"}, "id"), Response: JobResultsData{}},
+		}}, jobResultsHandler},
+		{openapi.Route{Path: "/Invoices", Role: auth.RoleAdmin, Operations: []openapi.Operation{
+			{Method: http.MethodGet, Summary: "Find issued invoices",
+				Query: query(map[string]string{
+					"city":   "The city",
+					"period": "The month, as 2006-01",
+					"plate":  "The license plate",
+					"format": "json (default), csv or html",
+				}),
+				Response: []invoicing.Invoice{}},
+			{Method: http.MethodPost, Summary: "Issue the monthly invoices of a city, reporting the vehicles that could not be calculated",
+				Request: InvoiceRequestData{}, Response: InvoiceResultData{}},
+		}}, invoicesHandler},
+		{openapi.Route{Path: "/DeadLetters", Role: auth.RoleAdmin, Operations: []openapi.Operation{
+			{Method: http.MethodGet, Summary: "List the queued passage events that could not be ingested",
+				Query:    query(map[string]string{"source": "The queue source, such as broker:passages; every source by default"}),
+				Response: []queue.DeadLetter{}},
+		}}, deadLettersHandler},
+		{openapi.Route{Path: "/Recalculations", Role: auth.RoleAdmin, Operations: []openapi.Operation{
+			{Method: http.MethodGet, Summary: "Find recorded adjustments",
+				Query:    query(map[string]string{"city": "The city", "period": "The month, as 2006-01", "plate": "The license plate"}),
+				Response: []invoicing.Adjustment{}},
+			{Method: http.MethodPost, Summary: "Recalculate issued invoices and record adjustments",
+				Request: InvoiceRequestData{}, Response: RecalculationResultData{}},
+		}}, recalculationsHandler},
+		{openapi.Route{Path: "/Subscriptions", Role: auth.RoleAdmin, Operations: []openapi.Operation{
+			{Method: http.MethodGet, Summary: "List the event subscriptions", Response: []subscriptions.Subscription{}},
+			{Method: http.MethodPost, Summary: "Subscribe a URL to daily_cap_reached, invoice_issued, rules_published or exemption_expiring events",
+				Request: SubscriptionRequestData{}, Response: subscriptions.Subscription{}, Status: http.StatusCreated},
+			{Method: http.MethodDelete, Summary: "Delete a subscription; its deliveries stay in the log",
+				Query: query(map[string]string{"id": "The subscription id"}, "id"), Status: http.StatusNoContent},
+		}}, subscriptionsHandler},
+		{openapi.Route{Path: "/Deliveries", Role: auth.RoleAdmin, Operations: []openapi.Operation{
+			{Method: http.MethodGet, Summary: "Get a page of the delivery log of a subscription, newest first",
+				Query: query(map[string]string{
+					"subscription": "The subscription id",
+					"before":       "The id of the last delivery of the previous page",
+					"limit":        "The maximum number of deliveries, 100 by default and at most 1000",
+				}, "subscription"),
+				Response: []subscriptions.DeliveryRecord{}},
+		}}, deliveriesHandler},
+		{openapi.Route{Path: "/Replays", Role: auth.RoleAdmin, Operations: []openapi.Operation{
+			{Method: http.MethodPost, Summary: "Send a logged delivery to its subscription again, with the original event id and body",
+				Query:    query(map[string]string{"delivery": "The delivery id"}, "delivery"),
+				Response: ReplayData{}, Status: http.StatusAccepted},
+		}}, replaysHandler},
+		{openapi.Route{Path: "/Audit", Role: auth.RoleAdmin, Operations: []openapi.Operation{
+			{Method: http.MethodGet, Summary: "Find audit records of calculations and rules edits, oldest first",
+				Query: query(map[string]string{
+					"kind":  "calculation or rules_edit",
+					"plate": "The license plate",
+					"city":  "The city",
+					"from":  "The start of the time range, as RFC 3339",
+					"to":    "The end of the time range, excluded, as RFC 3339",
+				}),
+				Response: []audit.Record{}},
+		}}, auditHandler},
+		{openapi.Route{Path: "/AuditVerification", Role: auth.RoleAdmin, Operations: []openapi.Operation{
+			{Method: http.MethodGet, Summary: "Check the hash chain of the audit log; a broken chain is answered with 409",
+				Response: audit.Verification{}},
+		}}, auditVerificationHandler},
+		{openapi.Route{Path: "/Simulations", Operations: []openapi.Operation{
+			{Method: http.MethodPost, Summary: "Compare the rules of a city with a draft; requires the city-editor role of the city",
+				Request: SimulationRequestData{}, Response: simulation.Report{}},
+		}}, simulationsHandler},
+		{openapi.Route{Path: "/Rules", Operations: []openapi.Operation{
+			{Method: http.MethodGet, Summary: "Get the rules of a city",
+				Query: query(map[string]string{"city": "The city"}, "city"), Response: RulesResultData{}},
+			{Method: http.MethodPut, Summary: "Replace the rules of a city; requires the city-editor role of the city",
+				Query:   query(map[string]string{"city": "The city"}, "city"),
+				Request: taxrules.TaxRule{}, Response: RulesResultData{}},
+		}}, rulesHandler},
+		{openapi.Route{Path: "/RuleDiff", Operations: []openapi.Operation{
+			{Method: http.MethodPost, Summary: "Compare two versions of tax rules, or the rules of a city with a draft, in domain terms",
+				Request: RuleDiffRequestData{}, Response: taxrules.RuleDiff{}},
+		}}, ruleDiffHandler},
+		{openapi.Route{Path: "/metrics", Public: true, Operations: []openapi.Operation{
+			{Method: http.MethodGet, Summary: "Prometheus metrics", Response: "", ContentType: "text/plain"},
+		}}, metricsHandler},
+		{openapi.Route{Path: "/healthz", Public: true, Operations: []openapi.Operation{
+			{Method: http.MethodGet, Summary: "Liveness", Response: "", ContentType: "text/plain"},
+		}}, healthHandler},
+		{openapi.Route{Path: "/readyz", Public: true, Operations: []openapi.Operation{
+			{Method: http.MethodGet, Summary: "Readiness; 503 if not ready", Response: Readiness{}},
+		}}, readyHandler},
+		{openapi.Route{Path: "/version", Public: true, Operations: []openapi.Operation{
+			{Method: http.MethodGet, Summary: "Build information", Response: BuildInfo{}},
+		}}, versionHandler},
+		{openapi.Route{Path: "/openapi.json", Public: true, Operations: []openapi.Operation{
+			{Method: http.MethodGet, Summary: "This document", Response: map[string]interface{}{}},
+		}}, openAPIHandler},
+	}
+}
+
+// OpenAPIDocument returns the OpenAPI document of the server.
+func OpenAPIDocument() openapi.Document {
+	table := routes()
+	documented := make([]openapi.Route, len(table))
+	for i, r := range table {
+		documented[i] = r.Route
+	}
+	return openapi.Build("Congestion Calculator", Version, documented)
+}
+
+// openAPIHandler serves the OpenAPI document of the server.
+func openAPIHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(OpenAPIDocument()); err != nil {
+			http.Error(w, fmt.Sprintf("Error occurred %v", err), http.StatusInternalServerError)
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+var (
+	handler     http.Handler
+	handlerOnce sync.Once
+)
+
+// Handler returns the handler of every route with the middleware of the server, and starts the
+// calculation worker and job runner on first use. It is used by StartServer and by tests calling the server in process.
+func Handler() http.Handler {
+	handlerOnce.Do(func() {
+		mux := http.NewServeMux()
+		for _, r := range routes() {
+			if r.Public {
+				mux.HandleFunc(r.Path, r.handler)
+			} else {
+				mux.HandleFunc(r.Path, requireRole(r.Role, r.handler))
+			}
+		}
+		go handleAPiRequests()
+		go runJobs()
+		handler = withTracing(withRequestLogging(withIPRateLimit(withMetrics(mux))))
+	})
+	return handler
+}
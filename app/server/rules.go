@@ -0,0 +1,200 @@
+package server
+
+import (
+	"congestion-calculator-manager/app/auth"
+	"congestion-calculator-manager/app/helpers"
+	"congestion-calculator-manager/app/subscriptions"
+	taxrules "congestion-calculator-manager/app/tax_rules"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// RulesResultData represents the tax rules of a city as returned to callers.
+type RulesResultData struct {
+	City     string           `json:"city"`
+	Version  string           `json:"version"`
+	TaxRules taxrules.TaxRule `json:"tax_rules"`
+}
+
+// rulesLock serializes edits of city files.
+var rulesLock sync.Mutex
+
+// rulesHandler handles retrieval (GET) and replacement (PUT) of the tax rules of a city.
+// Only editors of the city and admins may replace its rules; the built-in rules of the default city cannot be replaced.
+func rulesHandler(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("city")
+	if name == "" {
+		http.Error(w, "city not provided in url", http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		if strings.EqualFold(name, taxrules.DefaultCity) {
+			http.Error(w, "the default city uses built-in rules", http.StatusNotFound)
+			return
+		}
+		cityData, err := loadCityData(r.Context(), name)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("no tax rules found for city %s", name), http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(RulesResultData{City: cityData.CityName, Version: cityData.TaxRules.Version(), TaxRules: cityData.TaxRules})
+	case http.MethodPut:
+		principal, _ := auth.PrincipalFromContext(r.Context())
+		if !principal.CanEditCity(name) {
+			http.Error(w, fmt.Sprintf("%s may not edit the rules of %s", principal.Subject, name), http.StatusForbidden)
+			return
+		}
+		if strings.EqualFold(name, taxrules.DefaultCity) {
+			http.Error(w, "the built-in rules of the default city cannot be edited", http.StatusBadRequest)
+			return
+		}
+
+		var taxRule taxrules.TaxRule
+		if !decodeJSON(w, r, &taxRule) {
+			return
+		}
+		if err := taxRule.Validate(); err != nil {
+			http.Error(w, fmt.Sprintf("Error occurred %v", err), http.StatusBadRequest)
+			return
+		}
+
+		rulesLock.Lock()
+		defer rulesLock.Unlock()
+
+		// only existing cities can be edited, which also keeps the name from pointing outside of the cities folder
+		if !isCityFile(name) {
+			http.Error(w, fmt.Sprintf("no tax rules found for city %s", name), http.StatusNotFound)
+			return
+		}
+		cityData, err := loadCityData(r.Context(), name)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("no tax rules found for city %s", name), http.StatusNotFound)
+			return
+		}
+		previousRules := cityData.TaxRules
+		previousVersion := previousRules.Version()
+		cityData.TaxRules = taxRule
+		content, err := json.MarshalIndent(cityData, "", "    ")
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error occurred %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		result := RulesResultData{City: cityData.CityName, Version: taxRule.Version(), TaxRules: taxRule}
+		logger := helpers.LoggerFromContext(r.Context())
+		if err := auditRulesEdit(result.City, principal.Subject, previousRules, taxRule); err != nil {
+			logger.Error("rules edit not audited, refused", "city", result.City, "error", err)
+			http.Error(w, fmt.Sprintf("Error occurred rules edit not audited: %v", err), http.StatusServiceUnavailable)
+			return
+		}
+		if err := helpers.WriteContentToDataFile("cities", name, string(content)); err != nil {
+			if auditErr := auditRulesEditFailed(result.City, principal.Subject, result.Version, err); auditErr != nil {
+				logger.Error("failed rules edit not audited", "city", result.City, "error", auditErr)
+			}
+			http.Error(w, fmt.Sprintf("Error occurred %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		logger.Info("city rules edited",
+			"city", result.City,
+			"editor", principal.Subject,
+			"previous_version", previousVersion,
+			"version", result.Version)
+		publishEvent(subscriptions.EventRulesPublished,
+			fmt.Sprintf("%s:%s:%s", subscriptions.EventRulesPublished, result.City, result.Version),
+			RulesPublishedData{
+				City:            result.City,
+				PreviousVersion: previousVersion,
+				Version:         result.Version,
+				Editor:          principal.Subject,
+				TaxRules:        taxRule,
+			})
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(result)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// isCityFile checks if the name is one of the city files of the data store.
+func isCityFile(name string) bool {
+	cityNames, err := helpers.ListJsonFiles("cities")
+	if err != nil {
+		return false
+	}
+	for _, cityName := range cityNames {
+		if cityName == strings.ToLower(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// RuleDiffRequestData represents the structure for incoming rule diff requests. Before is compared with
+// After; without Before, the current rules of City are compared with After.
+type RuleDiffRequestData struct {
+	City   string            `json:"city"`
+	Before *taxrules.TaxRule `json:"before"`
+	After  taxrules.TaxRule  `json:"after"`
+}
+
+// DiffCityRules compares the current tax rules of a city with other rules.
+//
+// Parameters:
+//   - ctx: The context of the request, carrying its logger and trace.
+//   - city: The city whose rules are compared.
+//   - after: The rules compared with those of the city, such as an editor's draft.
+//
+// Returns:
+//   - taxrules.RuleDiff: The changes from the rules of the city to after.
+//   - error: An error if the city has no rules file.
+func DiffCityRules(ctx context.Context, city string, after taxrules.TaxRule) (taxrules.RuleDiff, error) {
+	if strings.EqualFold(city, taxrules.DefaultCity) {
+		return taxrules.RuleDiff{}, errors.New("the default city uses built-in rules")
+	}
+	cityData, err := loadCityData(ctx, city)
+	if err != nil {
+		return taxrules.RuleDiff{}, fmt.Errorf("no tax rules found for city %s", city)
+	}
+	return taxrules.Diff(cityData.TaxRules, after), nil
+}
+
+// ruleDiffHandler handles comparing two versions of tax rules, or the rules of a city with a draft.
+func ruleDiffHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+		var requestData RuleDiffRequestData
+		if !decodeJSON(w, r, &requestData) {
+			return
+		}
+
+		var diff taxrules.RuleDiff
+		switch {
+		case requestData.Before != nil:
+			diff = taxrules.Diff(*requestData.Before, requestData.After)
+		case requestData.City != "":
+			var err error
+			diff, err = DiffCityRules(r.Context(), requestData.City, requestData.After)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Error occurred %v", err), http.StatusNotFound)
+				return
+			}
+		default:
+			http.Error(w, "neither before nor city provided", http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(diff)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
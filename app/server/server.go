@@ -2,15 +2,26 @@
 package server
 
 import (
+	"congestion-calculator-manager/app/auth"
 	"congestion-calculator-manager/app/calculator"
+	"congestion-calculator-manager/app/exemptions"
 	"congestion-calculator-manager/app/helpers"
+	"congestion-calculator-manager/app/invoicing"
+	"congestion-calculator-manager/app/ledger"
+	"congestion-calculator-manager/app/plates"
+	"congestion-calculator-manager/app/registry"
 	taxrules "congestion-calculator-manager/app/tax_rules"
+	"congestion-calculator-manager/app/tracing"
 	"congestion-calculator-manager/app/vehicles"
+	"congestion-calculator-manager/app/webhooks"
+	"context"
 	"errors"
 
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"strings"
+	"sync/atomic"
 	"time"
 )
 
@@ -18,33 +29,154 @@ import (
 type RequestData struct {
 	Type         string           `json:"type"`
 	LicensePlate string           `json:"licenseplate"`
+	City         string           `json:"city"`
 	Dates        []time.Time      `json:"dates"`
 	TaxRule      taxrules.TaxRule `json:"tax_rules"`
 	IsCustomData bool             `json:"iscustomdata"`
+
+	// Passages is used instead of Dates for trips through several cities.
+	Passages  []calculator.Passage        `json:"passages"`
+	CityRules map[string]taxrules.TaxRule `json:"-"`
+
+	// From and To select passages stored in the ledger when no passages are sent.
+	From time.Time `json:"from"`
+	To   time.Time `json:"to"`
+
+	// Context carries the logger and trace of the HTTP request into the worker.
+	Context context.Context `json:"-"`
+
+	// result receives the outcome from the worker; it is buffered so the worker never waits for a caller that gave up.
+	result chan ResultData
 }
 
 // ResultData represents the structure for the result of a congestion tax calculation.
 type ResultData struct {
-	FeeInfo int
-	Error   error
+	FeeInfo  int
+	TripInfo calculator.TripResult
+	Error    error
 }
 
 var (
 	// RequestChannel is a channel for receiving congestion tax calculation requests.
 	RequestChannel = make(chan RequestData)
-	// ResultChannel is a channel for sending the result of congestion tax calculation.
-	ResultChannel = make(chan ResultData)
+
+	// CalculationTimeout is how long handlers wait for a calculation; longer calculations are submitted as jobs.
+	CalculationTimeout = 3 * time.Second
 
 	// LocalCityCache is a cache for storing city data to avoid reading from disk multiple times.
 	LocalCityCache *helpers.Cache = helpers.NewCache()
+
+	// VehicleRegistry holds the registered vehicles whose classification wins over the type sent by callers.
+	VehicleRegistry *registry.Registry = registry.NewRegistry()
+
+	// ExemptionStore holds the exemptions consulted for every calculated passage.
+	ExemptionStore *exemptions.Store = exemptions.NewStore()
+
+	// PassageLedger records ingested passages; it is nil if the ledger could not be opened.
+	PassageLedger *ledger.Ledger
+
+	// InvoiceStore records issued invoices; it is nil if the store could not be opened.
+	InvoiceStore *invoicing.Store
+
+	// Authenticator identifies callers; until LoadData runs it rejects everyone.
+	Authenticator *auth.Authenticator = auth.NewAuthenticator(nil, nil)
 )
 
+// LoadCalculationData loads the vehicle registry, vehicle types and exemptions that calculations consult.
+// It only reads the data store, so tools answering questions about calculations can use it without
+// opening the stores of the server; city rules are loaded when a city is first calculated.
+func LoadCalculationData() {
+	vehicleRegistry, err := registry.LoadRegistry()
+	if err != nil {
+		helpers.Log.Warn("vehicle registry not loaded, using caller supplied vehicle types", "error", err)
+	}
+	VehicleRegistry = vehicleRegistry
+
+	vehicleTypes, err := vehicles.LoadTypeRegistry()
+	if err != nil {
+		helpers.Log.Info("vehicle types not configured, using default types", "error", err)
+	}
+	vehicles.Types = vehicleTypes
+
+	exemptionStore, err := exemptions.LoadStore()
+	if err != nil {
+		helpers.Log.Warn("exemptions not loaded, only vehicle types are exempted", "error", err)
+	}
+	ExemptionStore = exemptionStore
+}
+
+// LoadData loads the vehicle registry, vehicle types and exemptions and opens the passage ledger
+// and invoice store. Data that cannot be loaded is reported and the related features are disabled.
+func LoadData() {
+	LoadCalculationData()
+
+	ledgerPath, err := ledger.DefaultPath()
+	if err == nil {
+		PassageLedger, err = ledger.Open(ledgerPath)
+	}
+	if err != nil {
+		helpers.Log.Error("passage ledger not opened, ingestion is disabled", "error", err)
+	}
+	rebuildDailyTotals(time.Now())
+
+	if err := openQueueStores(); err != nil {
+		helpers.Log.Error("queue stores not opened, queue consumers are disabled", "error", err)
+	}
+
+	if err := openAuditLog(); err != nil {
+		helpers.Log.Error("audit log not opened, calculations and rules edits are refused", "error", err)
+	}
+
+	if err := openSubscriptionStore(); err != nil {
+		helpers.Log.Error("subscription store not opened, event subscriptions are disabled", "error", err)
+	}
+
+	authenticator, err := auth.LoadAuthenticator()
+	if err != nil {
+		helpers.Log.Warn("API keys not loaded, only bearer tokens are accepted", "error", err)
+	}
+	if authenticator.Disabled() {
+		helpers.Log.Warn("authentication is disabled, every caller is treated as an admin")
+	}
+	Authenticator = authenticator
+
+	allowedNetworks, err := webhooks.LoadAllowedNetworks()
+	if err != nil {
+		helpers.Log.Error("allowed webhook networks not loaded, webhooks to internal addresses are refused", "error", err)
+	}
+	webhooks.AllowedNetworks = allowedNetworks
+
+	invoiceDir, err := invoicing.DefaultDirectory()
+	if err == nil {
+		InvoiceStore, err = invoicing.OpenStore(invoiceDir)
+	}
+	if err != nil {
+		helpers.Log.Error("invoice store not opened, invoicing is disabled", "error", err)
+	}
+}
+
 // StartServer initializes and starts the congestion tax calculation server.
 func StartServer() {
-	http.HandleFunc("/City", customCityTaxHandler)
-	http.HandleFunc("/Gothenburg", gothenburgTaxHandler)
-	go handleAPiRequests()
-	http.ListenAndServe(":8080", nil)
+	LoadData()
+	limits, err := LoadLimits()
+	if err != nil {
+		helpers.Log.Warn("limit not configured, using the default", "error", err)
+	}
+	SetLimits(limits)
+	exporter, err := tracing.ExporterFromEnvironment()
+	if err != nil {
+		helpers.Log.Warn("trace exporter not configured, spans are not exported", "error", err)
+	}
+	if exporter != nil {
+		tracing.Default.SetExporter(exporter)
+	}
+
+	go startGRPCServer()
+	startQueueConsumers()
+	go watchExpiringExemptions()
+	helpers.Log.Info("server listening", "address", ":8080", "version", Version, "commit", Commit)
+	err = http.ListenAndServe(":8080", Handler())
+	helpers.Log.Error("server stopped", "error", err)
 }
 
 // gothenburgTaxHandler handles congestion tax calculation requests for Gothenburg.
@@ -54,22 +186,27 @@ func gothenburgTaxHandler(w http.ResponseWriter, r *http.Request) {
 		fmt.Fprintf(w, "GET request received\n")
 	case http.MethodPost:
 		var requestData RequestData
-		err := json.NewDecoder(r.Body).Decode(&requestData)
-		if err != nil {
-			http.Error(w, "Error decoding JSON", http.StatusBadRequest)
+		if !decodeJSON(w, r, &requestData) || !allowPassages(w, len(requestData.Dates)) {
 			return
 		}
-		RequestChannel <- requestData
 		requestData.IsCustomData = false
-		select {
-		case resultInfo := <-ResultChannel:
-			if resultInfo.Error != nil {
-				http.Error(w, fmt.Sprintf("Error occurred %v", resultInfo.Error), http.StatusInternalServerError)
-			} else {
-				fmt.Fprintf(w, "Received from server: Type:%v LicensePlate: %v TotalFee:%v\n", requestData.Type, requestData.LicensePlate, resultInfo.FeeInfo)
-			}
-		case <-time.After(time.Second * 3):
-			fmt.Fprintf(w, "request timeout after 3s")
+		requestData.City = taxrules.DefaultCity
+		if err := classifyVehicle(&requestData); err != nil {
+			http.Error(w, fmt.Sprintf("Error occurred %v", err), http.StatusBadRequest)
+			return
+		}
+		requestData.Context = r.Context()
+		resultInfo, finished := submitCalculation(requestData)
+		if finished && !writeAuditedCalculation(w, r, requestData, resultInfo) {
+			return
+		}
+		switch {
+		case !finished:
+			writeCalculationTimeout(w, requestData)
+		case resultInfo.Error != nil:
+			http.Error(w, fmt.Sprintf("Error occurred %v", resultInfo.Error), http.StatusInternalServerError)
+		default:
+			fmt.Fprintf(w, "Received from server: Type:%v LicensePlate: %v TotalFee:%v\n", requestData.Type, requestData.LicensePlate, resultInfo.FeeInfo)
 		}
 	default:
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
@@ -86,51 +223,39 @@ func customCityTaxHandler(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, fmt.Sprintln("city name not provided in url"), http.StatusBadRequest)
 			break
 		}
-		//WE can enable cache so that we do not load file from disk each time
-		//but then we should set some expiration or way to cleanup/update cache,
-		//and remove vehicle information from json
-
-		// jsonSerializedData, exists := LocalCityCache.Get(name)
-		// if exists {
-		// 	fmt.Println("loaded from cache")
-		// } else {
-		// 	cityJsonData, err := helpers.ReadContentFromJsonFile(name)
-		// 	if err != nil {
-		// 		http.Error(w, fmt.Sprintf("Error occurred %v", err), http.StatusInternalServerError)
-		// 	}
-		// 	jsonSerializedData = cityJsonData
-		// 	LocalCityCache.Set(name, jsonSerializedData)
-		// }
-
-		cityJsonData, err := helpers.ReadContentFromJsonFile(name)
+		cityTaxInfo, err := loadCityData(r.Context(), name)
 		if err != nil {
 			http.Error(w, fmt.Sprintf("Error occurred %v", err), http.StatusInternalServerError)
 			break
 		}
-		cityTaxInfo, err := taxrules.LoadJsonDataForCity(cityJsonData)
-		if err != nil {
-			http.Error(w, fmt.Sprintf("Error occurred %v", err), http.StatusInternalServerError)
-			break
+		if cityTaxInfo.CityName == "" {
+			cityTaxInfo.CityName = name
 		}
 
 		requestData := RequestData{
 			Type:         cityTaxInfo.Vehicle.Type,
 			LicensePlate: cityTaxInfo.Vehicle.LicensePlate,
+			City:         cityTaxInfo.CityName,
 			Dates:        cityTaxInfo.Vehicle.Times,
 			TaxRule:      cityTaxInfo.TaxRules,
 			IsCustomData: true,
 		}
-		RequestChannel <- requestData
-		select {
-		case resultInfo := <-ResultChannel:
-			if resultInfo.Error != nil {
-				http.Error(w, fmt.Sprintf("Error occurred %v", resultInfo.Error), http.StatusInternalServerError)
-				break
-			} else {
-				fmt.Fprintf(w, "Received from server: Type:%v LicensePlate: %v TotalFee:%v\n", requestData.Type, requestData.LicensePlate, resultInfo.FeeInfo)
-			}
-		case <-time.After(time.Second * 3):
-			fmt.Fprintf(w, "request timeout after 3s")
+		if err := classifyVehicle(&requestData); err != nil {
+			http.Error(w, fmt.Sprintf("Error occurred %v", err), http.StatusBadRequest)
+			return
+		}
+		requestData.Context = r.Context()
+		resultInfo, finished := submitCalculation(requestData)
+		if finished && !writeAuditedCalculation(w, r, requestData, resultInfo) {
+			return
+		}
+		switch {
+		case !finished:
+			writeCalculationTimeout(w, requestData)
+		case resultInfo.Error != nil:
+			http.Error(w, fmt.Sprintf("Error occurred %v", resultInfo.Error), http.StatusInternalServerError)
+		default:
+			fmt.Fprintf(w, "Received from server: Type:%v LicensePlate: %v TotalFee:%v\n", requestData.Type, requestData.LicensePlate, resultInfo.FeeInfo)
 		}
 	case http.MethodPost:
 		fmt.Fprintf(w, "POST request received\n")
@@ -139,26 +264,311 @@ func customCityTaxHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// handleAPiRequests continuously listens for incoming congestion tax calculation requests.
-func handleAPiRequests() {
-	for {
-		select {
-		case reqData := <-RequestChannel:
-			result := ResultData{}
-			veh, err := vehicles.GetVehicle(reqData.Type, reqData.LicensePlate)
+// tripTaxHandler handles congestion tax calculation requests for passages through several cities.
+func tripTaxHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+		var requestData RequestData
+		if !decodeJSON(w, r, &requestData) {
+			return
+		}
+		if err := classifyVehicle(&requestData); err != nil {
+			http.Error(w, fmt.Sprintf("Error occurred %v", err), http.StatusBadRequest)
+			return
+		}
+		if len(requestData.Passages) == 0 && (!requestData.From.IsZero() || !requestData.To.IsZero()) {
+			loadPassagesFromLedger(&requestData)
+		}
+		if len(requestData.Passages) == 0 {
+			http.Error(w, "no passages provided", http.StatusBadRequest)
+			return
+		}
+		if !allowPassages(w, len(requestData.Passages)) {
+			return
+		}
+
+		cityRules, err := loadTripRules(r.Context(), requestData.Passages)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error occurred %v", err), http.StatusBadRequest)
+			return
+		}
+		requestData.CityRules = cityRules
+
+		requestData.Context = r.Context()
+		resultInfo, finished := submitCalculation(requestData)
+		if finished && !writeAuditedCalculation(w, r, requestData, resultInfo) {
+			return
+		}
+		switch {
+		case !finished:
+			writeCalculationTimeout(w, requestData)
+		case resultInfo.Error != nil:
+			http.Error(w, fmt.Sprintf("Error occurred %v", resultInfo.Error), http.StatusInternalServerError)
+		default:
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(resultInfo.TripInfo)
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// loadTripRules resolves the city of every passage given only by station
+// and loads the tax rules of every custom city passed through.
+func loadTripRules(ctx context.Context, passages []calculator.Passage) (map[string]taxrules.TaxRule, error) {
+	ctx, span := tracing.Start(ctx, "rule lookup")
+	defer span.End()
+	span.SetAttribute("passages", len(passages))
+
+	cityRules := make(map[string]taxrules.TaxRule)
+	cityNames := make(map[string]string)
+	for i := range passages {
+		if passages[i].City == "" {
+			if passages[i].Station == "" {
+				return nil, fmt.Errorf("passage at %v has neither city nor station", passages[i].Time)
+			}
+			city, err := taxrules.FindCityByStation(passages[i].Station)
 			if err != nil {
-				result.Error = errors.New("error in vehicle information")
-			} else {
-				result.FeeInfo = calculator.GetTax(
-					veh.(vehicles.Vehicle),
-					reqData.Dates,
-					reqData.IsCustomData,
-					reqData.TaxRule)
+				span.RecordError(err)
+				return nil, err
 			}
-			ResultChannel <- result
-		default:
-			fmt.Println("Listening...")
-			time.Sleep(time.Second)
+			passages[i].City = city
+		}
+
+		// city names are matched case-insensitively, so use the name from the city file
+		key := strings.ToLower(passages[i].City)
+		if strings.EqualFold(key, taxrules.DefaultCity) {
+			passages[i].City = taxrules.DefaultCity
+			continue
+		}
+		if cityName, loaded := cityNames[key]; loaded {
+			passages[i].City = cityName
+			continue
+		}
+		cityData, err := loadCityData(ctx, passages[i].City)
+		if err != nil {
+			err = fmt.Errorf("no tax rules found for city %s", passages[i].City)
+			span.RecordError(err)
+			return nil, err
+		}
+		if cityData.CityName == "" {
+			cityData.CityName = passages[i].City
+		}
+		cityNames[key] = cityData.CityName
+		cityRules[cityData.CityName] = cityData.TaxRules
+		passages[i].City = cityData.CityName
+	}
+	return cityRules, nil
+}
+
+// vehicleHandler handles license plate lookups in the vehicle registry.
+func vehicleHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		plate := r.URL.Query().Get("plate")
+		if plate == "" {
+			http.Error(w, fmt.Sprintln("license plate not provided in url"), http.StatusBadRequest)
+			return
+		}
+		registration, exists := VehicleRegistry.Lookup(plate)
+		if !exists {
+			http.Error(w, fmt.Sprintf("vehicle %s is not registered", plate), http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(registration)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// classifyVehicle normalizes the license plate and determines the vehicle type.
+// The registered type wins over the type sent by the caller; unregistered diplomatic
+// and foreign plates are classified by their format. Plates of no known format are
+// foreign unless the caller sent a type.
+//
+// Returns:
+//   - error: plates.ErrInvalidPlate if the license plate is not valid.
+func classifyVehicle(requestData *RequestData) error {
+	plate, err := plates.Parse(requestData.LicensePlate)
+	if err != nil {
+		return err
+	}
+	requestData.LicensePlate = plate.Number
+
+	registration, exists := VehicleRegistry.Lookup(plate.Number)
+	if exists {
+		plate = plates.Registered(plate)
+	}
+	switch {
+	case exists && registration.Type != "":
+		requestData.Type = registration.Type
+	case plate.IsDiplomatic():
+		requestData.Type = "Diplomat"
+	case plate.IsForeign() && (plate.Series != plates.SeriesUnrecognized || requestData.Type == ""):
+		requestData.Type = "Foreign"
+	}
+	return nil
+}
+
+// vehicleExemptions returns the exemptions of a vehicle: those of the exemption store and the certificates
+// of its registration, which exempt the vehicle in every city while they are valid.
+func vehicleExemptions(licensePlate string) exemptions.Lookup {
+	stored := ExemptionStore.ForVehicle(licensePlate)
+	registration, registered := VehicleRegistry.Lookup(licensePlate)
+	if !registered || len(registration.Certificates) == 0 {
+		return stored
+	}
+	return func(city string, t time.Time) (exemptions.Exemption, bool) {
+		exemption, exempt := stored(city, t)
+		if exempt && exemption.DiscountPercentage >= 100 {
+			return exemption, true
+		}
+		certificate, active := registration.ActiveCertificate(t)
+		if !active {
+			return exemption, exempt
+		}
+		reason := certificate.Reason
+		if reason == "" {
+			reason = "exemption certificate"
+		}
+		return exemptions.Exemption{
+			LicensePlate:       licensePlate,
+			Reason:             fmt.Sprintf("%s (certificate %s)", reason, certificate.Id),
+			ValidFrom:          certificate.ValidFrom,
+			ValidTo:            certificate.ValidTo,
+			DiscountPercentage: 100,
+		}, true
+	}
+}
+
+// datesToPassages converts the dates of a single-city request into passages of its city, as they are audited.
+func datesToPassages(reqData RequestData) ([]calculator.Passage, map[string]taxrules.TaxRule) {
+	city := taxrules.DefaultCity
+	cityRules := map[string]taxrules.TaxRule{}
+	if reqData.IsCustomData {
+		city = reqData.City
+		cityRules[city] = reqData.TaxRule
+	}
+
+	passages := make([]calculator.Passage, 0, len(reqData.Dates))
+	for _, date := range reqData.Dates {
+		passages = append(passages, calculator.Passage{City: city, Time: date})
+	}
+	return passages, cityRules
+}
+
+// calculate computes the congestion tax of a single request, exemptions included.
+func calculate(reqData RequestData) ResultData {
+	started := time.Now()
+	result := ResultData{}
+	logger := reqData.logger()
+	veh, err := vehicles.GetVehicle(reqData.Type, reqData.LicensePlate)
+	if err != nil {
+		calculationErrors.Inc()
+		logger.Warn("vehicle not recognized", "type", reqData.Type, "license_plate", reqData.LicensePlate, "error", err)
+		result.Error = errors.New("error in vehicle information")
+		return result
+	}
+
+	if len(reqData.Passages) == 0 {
+		city := taxrules.DefaultCity
+		if reqData.IsCustomData {
+			city = reqData.City
+		}
+		ctx, span := tracing.Start(reqData.context(), "calculator.GetDatesTax")
+		span.SetAttribute("passages", len(reqData.Dates))
+		result.TripInfo = calculator.GetDatesTax(ctx, veh, city, reqData.Dates, reqData.TaxRule, vehicleExemptions(reqData.LicensePlate))
+		span.SetAttribute("total_fee", result.TripInfo.TotalFee)
+		span.End()
+	} else {
+		ctx, span := tracing.Start(reqData.context(), "calculator.GetTripTax")
+		span.SetAttribute("passages", len(reqData.Passages))
+		result.TripInfo, result.Error = calculator.GetTripTax(
+			ctx,
+			veh,
+			reqData.Passages,
+			reqData.CityRules,
+			vehicleExemptions(reqData.LicensePlate))
+		span.SetAttribute("total_fee", result.TripInfo.TotalFee)
+		span.RecordError(result.Error)
+		span.End()
+	}
+	result.FeeInfo = result.TripInfo.TotalFee
+	calculationDuration.Observe(time.Since(started).Seconds())
+	if result.Error != nil {
+		calculationErrors.Inc()
+		logger.Warn("calculation failed", "license_plate", reqData.LicensePlate, "error", result.Error)
+	} else {
+		for _, passage := range result.TripInfo.Passages {
+			passagesProcessed.Inc(passage.City)
+		}
+		for _, city := range result.TripInfo.Cities {
+			feesCharged.Add(float64(city.TotalFee), city.City)
+		}
+		logger.Debug("calculation completed",
+			"license_plate", reqData.LicensePlate,
+			"type", reqData.Type,
+			"passages", len(result.TripInfo.Passages),
+			"total_fee", result.FeeInfo)
+	}
+	return result
+}
+
+// context returns the context of the request, or an empty context for requests not made over HTTP.
+func (reqData RequestData) context() context.Context {
+	if reqData.Context != nil {
+		return reqData.Context
+	}
+	return context.Background()
+}
+
+// logger returns the logger of the request, or the application logger for requests not made over HTTP.
+func (reqData RequestData) logger() *helpers.Logger {
+	return helpers.LoggerFromContext(reqData.context())
+}
+
+// submitCalculation passes a request to the worker and waits for its result until the calculation timeout.
+//
+// Returns:
+//   - ResultData: The result of the calculation.
+//   - bool: False if the calculation did not finish in time; its result is then dropped.
+func submitCalculation(requestData RequestData) (ResultData, bool) {
+	requestData.result = make(chan ResultData, 1)
+	timeout := time.NewTimer(CalculationTimeout)
+	defer timeout.Stop()
+
+	atomic.AddInt64(&pendingCalculations, 1)
+	select {
+	case RequestChannel <- requestData:
+	case <-timeout.C:
+		atomic.AddInt64(&pendingCalculations, -1)
+		return ResultData{}, false
+	}
+	select {
+	case result := <-requestData.result:
+		return result, true
+	case <-timeout.C:
+		return ResultData{}, false
+	}
+}
+
+// writeCalculationTimeout responds with 503 to a request whose calculation did not finish in time.
+func writeCalculationTimeout(w http.ResponseWriter, requestData RequestData) {
+	requestData.logger().Warn("calculation timed out", "timeout", CalculationTimeout.String())
+	w.Header().Set("Retry-After", "1")
+	http.Error(w, fmt.Sprintf("calculation did not finish within %v, submit it to /Jobs instead", CalculationTimeout), http.StatusServiceUnavailable)
+}
+
+// handleAPiRequests calculates incoming congestion tax calculation requests until the channel is closed.
+func handleAPiRequests() {
+	atomic.StoreInt32(&workerRunning, 1)
+	defer atomic.StoreInt32(&workerRunning, 0)
+	for reqData := range RequestChannel {
+		result := calculate(reqData)
+		atomic.AddInt64(&pendingCalculations, -1)
+		if reqData.result != nil {
+			reqData.result <- result
 		}
 	}
 }
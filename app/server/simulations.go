@@ -0,0 +1,98 @@
+package server
+
+import (
+	"congestion-calculator-manager/app/auth"
+	"congestion-calculator-manager/app/exemptions"
+	"congestion-calculator-manager/app/ledger"
+	"congestion-calculator-manager/app/simulation"
+	taxrules "congestion-calculator-manager/app/tax_rules"
+	"congestion-calculator-manager/app/vehicles"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// SimulationRequestData represents the structure for incoming rule simulation requests.
+// Passages are taken from the ledger between From and To unless a dataset is sent with the request.
+type SimulationRequestData struct {
+	City       string           `json:"city"`
+	Draft      taxrules.TaxRule `json:"draft"`
+	From       time.Time        `json:"from"`
+	To         time.Time        `json:"to"`
+	SampleSize int              `json:"sample_size"`
+	Passages   []PassageEvent   `json:"passages"`
+}
+
+// simulationsHandler handles what-if comparisons of a city's current tax rules against a draft.
+func simulationsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+		var requestData SimulationRequestData
+		if !decodeJSON(w, r, &requestData) || !allowPassages(w, len(requestData.Passages)) {
+			return
+		}
+		if requestData.City == "" {
+			http.Error(w, "city not provided", http.StatusBadRequest)
+			return
+		}
+		principal, _ := auth.PrincipalFromContext(r.Context())
+		if !principal.CanEditCity(requestData.City) {
+			http.Error(w, fmt.Sprintf("%s may not simulate the rules of %s", principal.Subject, requestData.City), http.StatusForbidden)
+			return
+		}
+
+		cityData, err := loadCityData(r.Context(), requestData.City)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("no tax rules found for city %s", requestData.City), http.StatusNotFound)
+			return
+		}
+		city := cityData.CityName
+		if city == "" {
+			city = requestData.City
+		}
+
+		var entries []ledger.Entry
+		if len(requestData.Passages) > 0 {
+			// sample passages are never stored, so they do not need ids of their own
+			for i := range requestData.Passages {
+				if requestData.Passages[i].PassageId == "" {
+					requestData.Passages[i].PassageId = fmt.Sprintf("sample-%d", i)
+				}
+			}
+			entries, err = toLedgerEntries(r.Context(), requestData.Passages)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Error occurred %v", err), http.StatusBadRequest)
+				return
+			}
+		} else if PassageLedger != nil {
+			entries = PassageLedger.PassagesInCity(city, requestData.From, requestData.To)
+		}
+
+		report, err := simulation.Run(r.Context(), city, cityData.TaxRules, requestData.Draft, entries, requestData.SampleSize, resolveVehicle)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error occurred %v", err), http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(report)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// resolveVehicle classifies a vehicle the same way as calculation requests and returns its exemptions.
+func resolveVehicle(licensePlate string, vehicleType string) (vehicles.Vehicle, exemptions.Lookup, error) {
+	requestData := RequestData{Type: vehicleType, LicensePlate: licensePlate}
+	err := classifyVehicle(&requestData)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	veh, err := vehicles.GetVehicle(requestData.Type, requestData.LicensePlate)
+	if err != nil {
+		return nil, nil, err
+	}
+	return veh, vehicleExemptions(requestData.LicensePlate), nil
+}
@@ -0,0 +1,285 @@
+package server
+
+import (
+	"congestion-calculator-manager/app/auth"
+	"congestion-calculator-manager/app/calculator"
+	"congestion-calculator-manager/app/dailytotals"
+	"congestion-calculator-manager/app/helpers"
+	"congestion-calculator-manager/app/subscriptions"
+	taxrules "congestion-calculator-manager/app/tax_rules"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// Settings of the exemption_expiring event.
+const (
+	// exemptionNotice is how long before its end an expiring exemption is announced.
+	exemptionNotice = 7 * 24 * time.Hour
+	// exemptionCheckInterval is how often exemptions are checked for their end.
+	exemptionCheckInterval = time.Hour
+)
+
+// Page sizes of the delivery log.
+const (
+	defaultDeliveryPage = 100
+	maxDeliveryPage     = 1000
+)
+
+// SubscriptionRequestData represents the structure for incoming subscriptions.
+type SubscriptionRequestData struct {
+	URL    string   `json:"url"`
+	Secret string   `json:"secret"`
+	Events []string `json:"events"`
+}
+
+// ReplayData represents the structure for the result of a replay request.
+type ReplayData struct {
+	ReplayOf       string `json:"replay_of"`
+	SubscriptionID string `json:"subscription_id"`
+	EventID        string `json:"event_id"`
+}
+
+// DailyCapReachedData represents the data of the daily_cap_reached event.
+type DailyCapReachedData struct {
+	LicensePlate string `json:"licenseplate"`
+	City         string `json:"city"`
+	Date         string `json:"date"`
+	TotalFee     int    `json:"total_fee"`
+	DailyCap     int    `json:"daily_cap"`
+}
+
+// RulesPublishedData represents the data of the rules_published event.
+type RulesPublishedData struct {
+	City            string           `json:"city"`
+	PreviousVersion string           `json:"previous_version"`
+	Version         string           `json:"version"`
+	Editor          string           `json:"editor"`
+	TaxRules        taxrules.TaxRule `json:"tax_rules"`
+}
+
+// SubscriptionStore holds the event subscriptions and their delivery log; it is nil if the store could not be opened.
+var SubscriptionStore *subscriptions.Store
+
+// openSubscriptionStore opens the subscription store in the data store.
+func openSubscriptionStore() error {
+	dir, err := helpers.DataDirectory()
+	if err != nil {
+		return err
+	}
+	SubscriptionStore, err = subscriptions.Open(filepath.Join(dir, "subscriptions"))
+	return err
+}
+
+// publishEvent delivers an event to every subscription to its type, in the background.
+//
+// Parameters:
+//   - eventType: The event type.
+//   - eventID: The id of the event, the same for every subscription, so receivers can recognize repeated deliveries.
+//   - data: The data of the event.
+func publishEvent(eventType string, eventID string, data interface{}) {
+	store := SubscriptionStore
+	if store == nil {
+		return
+	}
+	targets := store.Targets(eventType)
+	if len(targets) == 0 {
+		return
+	}
+	body, err := json.Marshal(subscriptions.Event{ID: eventID, Type: eventType, OccurredAt: time.Now().UTC(), Data: data})
+	if err != nil {
+		helpers.Log.Error("event not encoded", "event", eventType, "event_id", eventID, "error", err)
+		return
+	}
+	for _, target := range targets {
+		go deliverEvent(store, target, eventType, eventID, body, "")
+	}
+}
+
+// deliverEvent sends an event to a subscription, retrying with backoff, and records the delivery in the log of the store.
+func deliverEvent(store *subscriptions.Store, target subscriptions.Target, eventType string, eventID string, body []byte, replayOf string) {
+	delivery := WebhookSender.Send(target.URL, []byte(target.Secret), eventType, body)
+	webhookDeliveries.Inc(eventType, strconv.FormatBool(delivery.Delivered))
+
+	logger := helpers.Log.With("subscription_id", target.ID, "event", eventType, "event_id", eventID, "delivery_id", delivery.ID)
+	err := store.Record(subscriptions.DeliveryRecord{
+		Delivery:       delivery,
+		SubscriptionID: target.ID,
+		EventID:        eventID,
+		ReplayOf:       replayOf,
+		Body:           body,
+	})
+	if err != nil {
+		logger.Error("delivery not logged", "error", err)
+	}
+	if !delivery.Delivered {
+		logger.Warn("event not delivered", "url", target.URL, "attempts", delivery.Attempts, "error", delivery.Error)
+		return
+	}
+	logger.Info("event delivered", "url", target.URL, "attempts", delivery.Attempts)
+}
+
+// notifyDailyCapReached publishes daily_cap_reached when a recorded passage brings a vehicle's total to the daily cap of its city.
+func notifyDailyCapReached(previous dailytotals.Total, current dailytotals.Total) {
+	if current.TotalFee == previous.TotalFee || SubscriptionStore == nil {
+		return
+	}
+	cityRules, err := loadTripRules(context.Background(), []calculator.Passage{{City: current.City}})
+	if err != nil {
+		return
+	}
+	dailyCap := calculator.DailyCap(current.City, cityRules[current.City])
+	if previous.TotalFee >= dailyCap || current.TotalFee < dailyCap {
+		return
+	}
+	publishEvent(subscriptions.EventDailyCapReached,
+		fmt.Sprintf("%s:%s:%s:%s", subscriptions.EventDailyCapReached, current.LicensePlate, current.City, current.Date),
+		DailyCapReachedData{
+			LicensePlate: current.LicensePlate,
+			City:         current.City,
+			Date:         current.Date,
+			TotalFee:     current.TotalFee,
+			DailyCap:     dailyCap,
+		})
+}
+
+// watchExpiringExemptions publishes exemption_expiring for exemptions ending within the notice period,
+// once per exemption and until the server stops.
+func watchExpiringExemptions() {
+	for {
+		publishExpiringExemptions(time.Now())
+		time.Sleep(exemptionCheckInterval)
+	}
+}
+
+// publishExpiringExemptions publishes exemption_expiring for the exemptions ending within the notice period
+// that were not announced before.
+func publishExpiringExemptions(now time.Time) {
+	if SubscriptionStore == nil {
+		return
+	}
+	for _, exemption := range ExemptionStore.Expiring(now, now.Add(exemptionNotice)) {
+		eventID := fmt.Sprintf("%s:%s:%s", subscriptions.EventExemptionExpiring, exemption.LicensePlate, exemption.ValidTo.UTC().Format(time.RFC3339))
+		if !SubscriptionStore.Published(eventID) {
+			publishEvent(subscriptions.EventExemptionExpiring, eventID, exemption)
+		}
+	}
+}
+
+// subscriptionsHandler handles listing (GET), creation (POST) and removal (DELETE) of event subscriptions.
+func subscriptionsHandler(w http.ResponseWriter, r *http.Request) {
+	if SubscriptionStore == nil {
+		http.Error(w, "subscription store is not available", http.StatusServiceUnavailable)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(SubscriptionStore.List(""))
+	case http.MethodPost:
+		var requestData SubscriptionRequestData
+		if !decodeJSON(w, r, &requestData) {
+			return
+		}
+		principal, _ := auth.PrincipalFromContext(r.Context())
+		subscription, err := SubscriptionStore.Create(principal.Subject, requestData.URL, requestData.Secret, requestData.Events, time.Now())
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error occurred %v", err), http.StatusBadRequest)
+			return
+		}
+		helpers.LoggerFromContext(r.Context()).Info("subscription created", "subscription_id", subscription.ID, "events", subscription.Events)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Location", "/Deliveries?subscription="+subscription.ID)
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(subscription)
+	case http.MethodDelete:
+		id := r.URL.Query().Get("id")
+		if err := SubscriptionStore.Delete(id); err != nil {
+			status := http.StatusInternalServerError
+			if err == subscriptions.ErrNotFound {
+				status = http.StatusNotFound
+			}
+			http.Error(w, fmt.Sprintf("Error occurred %v", err), status)
+			return
+		}
+		helpers.LoggerFromContext(r.Context()).Info("subscription deleted", "subscription_id", id)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// deliveriesHandler handles retrieval of the delivery log of a subscription, a page at a time.
+func deliveriesHandler(w http.ResponseWriter, r *http.Request) {
+	if SubscriptionStore == nil {
+		http.Error(w, "subscription store is not available", http.StatusServiceUnavailable)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		id := r.URL.Query().Get("subscription")
+		if _, exists := SubscriptionStore.Get(id); !exists {
+			http.Error(w, fmt.Sprintf("subscription %s not found", id), http.StatusNotFound)
+			return
+		}
+		limit := defaultDeliveryPage
+		if text := r.URL.Query().Get("limit"); text != "" {
+			value, err := strconv.Atoi(text)
+			if err != nil || value < 1 || value > maxDeliveryPage {
+				http.Error(w, fmt.Sprintf("limit must be a number between 1 and %d", maxDeliveryPage), http.StatusBadRequest)
+				return
+			}
+			limit = value
+		}
+		before := r.URL.Query().Get("before")
+		records, err := SubscriptionStore.Deliveries(id, before, limit)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("delivery %s of subscription %s not found", before, id), http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(records)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// replaysHandler handles replaying a logged delivery to its subscription. The event is sent again with its
+// original id and body in the background; the new delivery appears in the log with replay_of set.
+func replaysHandler(w http.ResponseWriter, r *http.Request) {
+	if SubscriptionStore == nil {
+		http.Error(w, "subscription store is not available", http.StatusServiceUnavailable)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPost:
+		id := r.URL.Query().Get("delivery")
+		record, exists := SubscriptionStore.Delivery(id)
+		if !exists {
+			http.Error(w, fmt.Sprintf("delivery %s not found", id), http.StatusNotFound)
+			return
+		}
+		target, exists := SubscriptionStore.Target(record.SubscriptionID)
+		if !exists {
+			http.Error(w, fmt.Sprintf("subscription %s of delivery %s was deleted", record.SubscriptionID, id), http.StatusGone)
+			return
+		}
+		go deliverEvent(SubscriptionStore, target, record.Event, record.EventID, record.Body, record.ID)
+		helpers.LoggerFromContext(r.Context()).Info("delivery replayed", "delivery_id", id, "subscription_id", target.ID)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Location", "/Deliveries?subscription="+target.ID)
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(ReplayData{ReplayOf: record.ID, SubscriptionID: target.ID, EventID: record.EventID})
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
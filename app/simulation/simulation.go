@@ -0,0 +1,195 @@
+// Package simulation provides what-if comparisons of a city's current tax rules against a draft,
+// run over recorded or sample passages before the draft is published.
+package simulation
+
+import (
+	"congestion-calculator-manager/app/calculator"
+	"congestion-calculator-manager/app/exemptions"
+	"congestion-calculator-manager/app/ledger"
+	taxrules "congestion-calculator-manager/app/tax_rules"
+	"congestion-calculator-manager/app/vehicles"
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// UntaxedBand is the band of passages outside of every hourly price of both rule versions.
+const UntaxedBand = "untaxed"
+
+// Difference represents the charges of a group of passages under both rule versions.
+type Difference struct {
+	Key              string `json:"key"`
+	Passages         int    `json:"passages"`
+	Vehicles         int    `json:"vehicles"`
+	AffectedVehicles int    `json:"affected_vehicles"`
+	CurrentTotal     int    `json:"current_total"`
+	DraftTotal       int    `json:"draft_total"`
+	Difference       int    `json:"difference"`
+}
+
+// Report represents the outcome of running a dataset through the current and the draft rules.
+// Band totals are the fees of single passages, before the single charge rule and the daily cap;
+// all other totals are the amounts actually charged.
+type Report struct {
+	City           string       `json:"city"`
+	CurrentVersion string       `json:"current_version"`
+	DraftVersion   string       `json:"draft_version"`
+	Total          Difference   `json:"total"`
+	Bands          []Difference `json:"bands"`
+	Days           []Difference `json:"days"`
+	VehicleTypes   []Difference `json:"vehicle_types"`
+}
+
+// ResolveVehicle returns the vehicle and its exemptions for a license plate and the vehicle type recorded with its passages.
+type ResolveVehicle func(licensePlate string, vehicleType string) (vehicles.Vehicle, exemptions.Lookup, error)
+
+// Run compares the charges of the given passages under the current and the draft rules of a city.
+//
+// Parameters:
+//   - ctx: The context of the simulation, carrying the logger of the request.
+//   - city: The city whose rules are changed.
+//   - current: The published tax rules of the city.
+//   - draft: The draft tax rules of the city.
+//   - entries: The passages to run, typically taken from the ledger.
+//   - sampleSize: The number of vehicles to include, or 0 to include all of them.
+//   - resolve: The classification of every vehicle.
+//
+// Returns:
+//   - Report: Differences per band, day and vehicle type.
+//   - error: An error if the city has no editable rules or a vehicle could not be calculated.
+func Run(ctx context.Context, city string, current taxrules.TaxRule, draft taxrules.TaxRule, entries []ledger.Entry, sampleSize int, resolve ResolveVehicle) (Report, error) {
+	if strings.EqualFold(city, taxrules.DefaultCity) {
+		return Report{}, errors.New("the built-in rules of the default city cannot be simulated")
+	}
+
+	report := Report{
+		City:           city,
+		CurrentVersion: current.Version(),
+		DraftVersion:   draft.Version(),
+		Total:          Difference{Key: "total"},
+	}
+	bands := newGroups()
+	days := newGroups()
+	vehicleTypes := newGroups()
+
+	for _, vehicle := range sample(ledger.GroupByPlate(city, time.Time{}, time.Time{}, entries), sampleSize) {
+		veh, exemptionLookup, err := resolve(vehicle.LicensePlate, vehicle.VehicleType)
+		if err != nil {
+			return report, fmt.Errorf("vehicle %s: %v", vehicle.LicensePlate, err)
+		}
+		// every passage is calculated under the simulated city's name, whatever its casing in the dataset
+		for i := range vehicle.Passages {
+			vehicle.Passages[i].City = city
+		}
+		currentResult, err := calculator.GetTripTax(ctx, veh, vehicle.Passages, map[string]taxrules.TaxRule{city: current}, exemptionLookup)
+		if err != nil {
+			return report, err
+		}
+		draftResult, err := calculator.GetTripTax(ctx, veh, vehicle.Passages, map[string]taxrules.TaxRule{city: draft}, exemptionLookup)
+		if err != nil {
+			return report, err
+		}
+
+		affected := currentResult.TotalFee != draftResult.TotalFee
+		report.Total.add(len(vehicle.Passages), currentResult.TotalFee, draftResult.TotalFee)
+		report.Total.countVehicle(affected)
+		vehicleType := vehicleTypes.get(veh.GetVehicleType())
+		vehicleType.add(len(vehicle.Passages), currentResult.TotalFee, draftResult.TotalFee)
+		vehicleType.countVehicle(affected)
+
+		// results of both versions contain the same days and passages in the same order
+		for i, day := range currentResult.Days {
+			draftDay := draftResult.Days[i]
+			dayDifference := days.get(day.Date)
+			dayDifference.add(day.Passages, day.TotalFee, draftDay.TotalFee)
+			dayDifference.countVehicle(day.TotalFee != draftDay.TotalFee)
+		}
+		vehicleBands := map[string]bool{}
+		for i, passage := range currentResult.Passages {
+			draftPassage := draftResult.Passages[i]
+			key := bandOf(passage.Time, draft, current)
+			bands.get(key).add(1, passage.Fee, draftPassage.Fee)
+			vehicleBands[key] = vehicleBands[key] || passage.Fee != draftPassage.Fee
+		}
+		for key, bandAffected := range vehicleBands {
+			bands.get(key).countVehicle(bandAffected)
+		}
+	}
+
+	report.Bands = bands.sorted()
+	report.Days = days.sorted()
+	report.VehicleTypes = vehicleTypes.sorted()
+	return report, nil
+}
+
+// add adds passages and their charges under both rule versions.
+func (d *Difference) add(passages int, currentTotal int, draftTotal int) {
+	d.Passages += passages
+	d.CurrentTotal += currentTotal
+	d.DraftTotal += draftTotal
+	d.Difference = d.DraftTotal - d.CurrentTotal
+}
+
+// countVehicle counts a vehicle, and whether its charge differs between the rule versions.
+func (d *Difference) countVehicle(affected bool) {
+	d.Vehicles++
+	if affected {
+		d.AffectedVehicles++
+	}
+}
+
+// bandOf returns the label of the tariff band the time falls into, looking at the draft rules first.
+func bandOf(t time.Time, rules ...taxrules.TaxRule) string {
+	for _, rule := range rules {
+		if band, found := calculator.FindCustomBand(t, rule); found {
+			return band.Start + "-" + band.End
+		}
+	}
+	return UntaxedBand
+}
+
+// groups represents differences keyed by band, day or vehicle type.
+type groups map[string]*Difference
+
+// newGroups creates an empty set of differences.
+func newGroups() groups {
+	return make(groups)
+}
+
+// get returns the difference with the given key, creating it if needed.
+func (g groups) get(key string) *Difference {
+	difference, exists := g[key]
+	if !exists {
+		difference = &Difference{Key: key}
+		g[key] = difference
+	}
+	return difference
+}
+
+// sorted returns the differences ordered by key.
+func (g groups) sorted() []Difference {
+	result := make([]Difference, 0, len(g))
+	for _, difference := range g {
+		result = append(result, *difference)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Key < result[j].Key
+	})
+	return result
+}
+
+// sample picks sampleSize vehicles spread evenly over the ordered vehicles, so that repeated runs use the same sample.
+func sample(all []ledger.VehiclePassages, sampleSize int) []ledger.VehiclePassages {
+	if sampleSize <= 0 || sampleSize >= len(all) {
+		return all
+	}
+	result := make([]ledger.VehiclePassages, 0, sampleSize)
+	step := float64(len(all)) / float64(sampleSize)
+	for i := 0; i < sampleSize; i++ {
+		result = append(result, all[int(float64(i)*step)])
+	}
+	return result
+}
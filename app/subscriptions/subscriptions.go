@@ -0,0 +1,363 @@
+// Package subscriptions keeps the webhook subscriptions of downstream systems to billing events and the
+// log of every delivery made to them, so failed deliveries can be inspected and replayed. The log file
+// keeps every delivery; only the most recent MaxDeliveries are kept in memory to be listed and replayed.
+package subscriptions
+
+import (
+	"bytes"
+	"congestion-calculator-manager/app/webhooks"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Event types subscriptions can be made to.
+const (
+	EventDailyCapReached   = "daily_cap_reached"
+	EventInvoiceIssued     = "invoice_issued"
+	EventRulesPublished    = "rules_published"
+	EventExemptionExpiring = "exemption_expiring"
+)
+
+// EventTypes are the event types subscriptions can be made to.
+var EventTypes = []string{EventDailyCapReached, EventInvoiceIssued, EventRulesPublished, EventExemptionExpiring}
+
+// ErrNotFound is returned for unknown subscriptions and deliveries.
+var ErrNotFound = errors.New("not found")
+
+// MaxDeliveries is the number of most recent deliveries kept in memory.
+const MaxDeliveries = 10000
+
+// Subscription represents a URL notified of events of the given types.
+type Subscription struct {
+	ID        string    `json:"id"`
+	Owner     string    `json:"owner"`
+	URL       string    `json:"url"`
+	Events    []string  `json:"events"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Subscribes checks if the subscription is notified of an event type.
+func (s Subscription) Subscribes(eventType string) bool {
+	for _, subscribed := range s.Events {
+		if subscribed == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// Target represents a subscription together with the secret its deliveries are signed with.
+type Target struct {
+	Subscription
+	Secret string `json:"secret"`
+}
+
+// Event represents the body of a delivery.
+type Event struct {
+	ID         string      `json:"id"`
+	Type       string      `json:"type"`
+	OccurredAt time.Time   `json:"occurred_at"`
+	Data       interface{} `json:"data"`
+}
+
+// DeliveryRecord represents an entry of the delivery log: the outcome of delivering an event to a
+// subscription, with the body sent so the delivery can be replayed.
+type DeliveryRecord struct {
+	webhooks.Delivery
+	SubscriptionID string          `json:"subscription_id"`
+	EventID        string          `json:"event_id"`
+	ReplayOf       string          `json:"replay_of,omitempty"`
+	Body           json.RawMessage `json:"body"`
+}
+
+// Store holds the subscriptions in a JSON file and appends the delivery log to a file of JSON lines.
+// Deliveries are numbered in the order they were logged; the kept ones are indexed by id and subscription.
+type Store struct {
+	mu               sync.Mutex
+	subscriptionPath string
+	subscriptions    []Target
+	log              *os.File
+	// deliveries holds the kept deliveries, the first of them numbered first.
+	deliveries     []DeliveryRecord
+	first          int
+	byID           map[string]int
+	bySubscription map[string][]int
+	// published holds the ids of every event logged, including the deliveries no longer kept.
+	published map[string]bool
+}
+
+// Open loads the subscriptions and delivery log kept in a directory, creating the files if they do not exist.
+//
+// Parameters:
+//   - dir: The directory of the files.
+//
+// Returns:
+//   - *Store: A pointer to the opened Store.
+//   - error: An error if the files could not be created or contain corrupt entries.
+func Open(dir string) (*Store, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	store := &Store{
+		subscriptionPath: filepath.Join(dir, "subscriptions.json"),
+		subscriptions:    []Target{},
+		byID:             make(map[string]int),
+		bySubscription:   make(map[string][]int),
+		published:        make(map[string]bool),
+	}
+
+	content, err := ioutil.ReadFile(store.subscriptionPath)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if len(content) > 0 {
+		if err := json.Unmarshal(content, &store.subscriptions); err != nil {
+			return nil, fmt.Errorf("corrupt subscription file %s: %v", store.subscriptionPath, err)
+		}
+	}
+
+	logPath := filepath.Join(dir, "deliveries.jsonl")
+	content, err = ioutil.ReadFile(logPath)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	for decoder.More() {
+		var record DeliveryRecord
+		if err := decoder.Decode(&record); err != nil {
+			return nil, fmt.Errorf("corrupt delivery log %s: %v", logPath, err)
+		}
+		store.add(record)
+	}
+	store.log, err = os.OpenFile(logPath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// Create adds a subscription.
+//
+// Parameters:
+//   - owner: The subject of the caller subscribing.
+//   - url: The URL events are POSTed to.
+//   - secret: The secret signing the deliveries.
+//   - events: The event types to deliver.
+//   - now: The time of the subscription.
+//
+// Returns:
+//   - Subscription: The created subscription.
+//   - error: An error if the URL, secret or event types are invalid, or the subscription could not be saved.
+func (s *Store) Create(owner string, url string, secret string, events []string, now time.Time) (Subscription, error) {
+	if err := webhooks.ValidateTarget(url, secret); err != nil {
+		return Subscription{}, err
+	}
+	if len(events) == 0 {
+		return Subscription{}, errors.New("no event types provided")
+	}
+	for _, event := range events {
+		known := false
+		for _, eventType := range EventTypes {
+			known = known || event == eventType
+		}
+		if !known {
+			return Subscription{}, fmt.Errorf("unknown event type %s", event)
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	subscription := Subscription{ID: newID(), Owner: owner, URL: url, Events: events, CreatedAt: now.UTC()}
+	s.subscriptions = append(s.subscriptions, Target{Subscription: subscription, Secret: secret})
+	if err := s.save(); err != nil {
+		s.subscriptions = s.subscriptions[:len(s.subscriptions)-1]
+		return Subscription{}, err
+	}
+	return subscription, nil
+}
+
+// Delete removes a subscription; its deliveries stay in the log.
+func (s *Store) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, target := range s.subscriptions {
+		if target.ID == id {
+			remaining := append(append([]Target{}, s.subscriptions[:i]...), s.subscriptions[i+1:]...)
+			previous := s.subscriptions
+			s.subscriptions = remaining
+			if err := s.save(); err != nil {
+				s.subscriptions = previous
+				return err
+			}
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+// Get returns a subscription.
+func (s *Store) Get(id string) (Subscription, bool) {
+	target, exists := s.Target(id)
+	return target.Subscription, exists
+}
+
+// Target returns a subscription with its secret.
+func (s *Store) Target(id string) (Target, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, target := range s.subscriptions {
+		if target.ID == id {
+			return target, true
+		}
+	}
+	return Target{}, false
+}
+
+// List returns the subscriptions of an owner, or every subscription if owner is empty, oldest first.
+func (s *Store) List(owner string) []Subscription {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	subscriptions := []Subscription{}
+	for _, target := range s.subscriptions {
+		if owner == "" || target.Owner == owner {
+			subscriptions = append(subscriptions, target.Subscription)
+		}
+	}
+	return subscriptions
+}
+
+// Targets returns the subscriptions to an event type with their secrets.
+func (s *Store) Targets(eventType string) []Target {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var targets []Target
+	for _, target := range s.subscriptions {
+		if target.Subscribes(eventType) {
+			targets = append(targets, target)
+		}
+	}
+	return targets
+}
+
+// Record appends a delivery to the log.
+func (s *Store) Record(record DeliveryRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.log.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	s.add(record)
+	return nil
+}
+
+// add indexes a logged delivery and drops the oldest kept delivery beyond MaxDeliveries. The caller must hold the lock.
+func (s *Store) add(record DeliveryRecord) {
+	number := s.first + len(s.deliveries)
+	s.deliveries = append(s.deliveries, record)
+	s.byID[record.ID] = number
+	s.bySubscription[record.SubscriptionID] = append(s.bySubscription[record.SubscriptionID], number)
+	s.published[record.EventID] = true
+
+	if len(s.deliveries) > MaxDeliveries {
+		oldest := s.deliveries[0]
+		delete(s.byID, oldest.ID)
+		if numbers := s.bySubscription[oldest.SubscriptionID][1:]; len(numbers) > 0 {
+			s.bySubscription[oldest.SubscriptionID] = numbers
+		} else {
+			delete(s.bySubscription, oldest.SubscriptionID)
+		}
+		s.deliveries[0] = DeliveryRecord{}
+		s.deliveries = s.deliveries[1:]
+		s.first++
+	}
+}
+
+// Deliveries returns a page of the kept deliveries of a subscription, newest logged first.
+//
+// Parameters:
+//   - subscriptionID: The subscription id.
+//   - before: The id of a delivery of the subscription; only the deliveries logged before it are returned.
+//     If empty, the page starts with the newest delivery.
+//   - limit: The maximum number of deliveries returned.
+//
+// Returns:
+//   - []DeliveryRecord: The deliveries of the page.
+//   - error: ErrNotFound if before is not a kept delivery of the subscription.
+func (s *Store) Deliveries(subscriptionID string, before string, limit int) ([]DeliveryRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	numbers := s.bySubscription[subscriptionID]
+	end := len(numbers)
+	if before != "" {
+		number, exists := s.byID[before]
+		if !exists || s.deliveries[number-s.first].SubscriptionID != subscriptionID {
+			return nil, ErrNotFound
+		}
+		end = sort.SearchInts(numbers, number)
+	}
+
+	records := []DeliveryRecord{}
+	for i := end - 1; i >= 0 && len(records) < limit; i-- {
+		records = append(records, s.deliveries[numbers[i]-s.first])
+	}
+	return records, nil
+}
+
+// Delivery returns a kept delivery.
+func (s *Store) Delivery(id string) (DeliveryRecord, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	number, exists := s.byID[id]
+	if !exists {
+		return DeliveryRecord{}, false
+	}
+	return s.deliveries[number-s.first], true
+}
+
+// Published checks if an event was delivered to any subscription before, to publish recurring checks once.
+func (s *Store) Published(eventID string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.published[eventID]
+}
+
+// Close closes the delivery log.
+func (s *Store) Close() error {
+	return s.log.Close()
+}
+
+// save replaces the subscription file atomically with the subscriptions in memory.
+func (s *Store) save() error {
+	content, err := json.MarshalIndent(s.subscriptions, "", "  ")
+	if err != nil {
+		return err
+	}
+	temporary := s.subscriptionPath + ".tmp"
+	if err := ioutil.WriteFile(temporary, content, 0600); err != nil {
+		return err
+	}
+	return os.Rename(temporary, s.subscriptionPath)
+}
+
+// newID returns a random, unguessable id.
+func newID() string {
+	buffer := make([]byte, 16)
+	if _, err := rand.Read(buffer); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 36)
+	}
+	return hex.EncodeToString(buffer)
+}
@@ -0,0 +1,221 @@
+package taxrules
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Kinds of rule changes.
+const (
+	ChangeAdded   = "added"
+	ChangeRemoved = "removed"
+	ChangeChanged = "changed"
+	// ChangeDuplicated reports a tariff band whose hours are listed more than once in one version.
+	ChangeDuplicated = "duplicated"
+)
+
+// Change represents a single difference between two versions of tax rules, in domain terms.
+type Change struct {
+	Field       string      `json:"field"`
+	Kind        string      `json:"kind"`
+	Description string      `json:"description"`
+	Before      interface{} `json:"before,omitempty"`
+	After       interface{} `json:"after,omitempty"`
+}
+
+// RuleDiff represents the differences between two versions of tax rules.
+type RuleDiff struct {
+	FromVersion string   `json:"from_version"`
+	ToVersion   string   `json:"to_version"`
+	Changes     []Change `json:"changes"`
+}
+
+// Diff compares two versions of tax rules. Tariff bands are matched by their hours, so a band
+// whose hours moved is reported as removed and added, and a band whose hours are listed more
+// than once is reported as duplicated; excluded months, days and dates are compared as sets.
+//
+// Parameters:
+//   - before: The rules before the change.
+//   - after: The rules after the change.
+//
+// Returns:
+//   - RuleDiff: The changes, in the order bands, excluded months, days and dates, cap, weekend and default price.
+func Diff(before TaxRule, after TaxRule) RuleDiff {
+	diff := RuleDiff{FromVersion: before.Version(), ToVersion: after.Version(), Changes: []Change{}}
+	diff.Changes = append(diff.Changes, diffBands(before.HourlyPrices, after.HourlyPrices)...)
+	diff.Changes = append(diff.Changes, diffSet("excluded_months", "excluded month", before.ExcludedMonths, after.ExcludedMonths, monthName)...)
+	diff.Changes = append(diff.Changes, diffSet("excluded_days", "excluded day of month", before.ExcludedDays, after.ExcludedDays, strconv.Itoa)...)
+	diff.Changes = append(diff.Changes, diffDates(before.ExcludedDates, after.ExcludedDates)...)
+
+	if before.MaxTaxedFee != after.MaxTaxedFee {
+		diff.Changes = append(diff.Changes, Change{Field: "max_taxed_fee", Kind: ChangeChanged,
+			Description: fmt.Sprintf("daily cap changed from %d to %d", before.MaxTaxedFee, after.MaxTaxedFee),
+			Before:      before.MaxTaxedFee, After: after.MaxTaxedFee})
+	}
+	if before.TaxOnWeekend != after.TaxOnWeekend {
+		description := "weekends are no longer taxed"
+		if after.TaxOnWeekend {
+			description = "weekends are now taxed"
+		}
+		diff.Changes = append(diff.Changes, Change{Field: "tax_on_weekend", Kind: ChangeChanged,
+			Description: description, Before: before.TaxOnWeekend, After: after.TaxOnWeekend})
+	}
+	if before.DefaultHourlyPrice != after.DefaultHourlyPrice {
+		diff.Changes = append(diff.Changes, Change{Field: "default_hourly_price", Kind: ChangeChanged,
+			Description: fmt.Sprintf("default hourly price field changed from %d to %d, which has no effect on fees", before.DefaultHourlyPrice, after.DefaultHourlyPrice),
+			Before:      before.DefaultHourlyPrice, After: after.DefaultHourlyPrice})
+	}
+	return diff
+}
+
+// Text describes the changes as plain text, one change per line.
+func (d RuleDiff) Text() string {
+	var builder strings.Builder
+	fmt.Fprintf(&builder, "Tax rules version %s compared with version %s:\n", d.ToVersion, d.FromVersion)
+	if len(d.Changes) == 0 {
+		builder.WriteString("  no changes\n")
+	}
+	for _, change := range d.Changes {
+		fmt.Fprintf(&builder, "  %-8s %s\n", change.Kind, change.Description)
+	}
+	return builder.String()
+}
+
+// diffBands compares tariff bands by their hours, ordered by the hour the band starts. Only the first
+// band listed for some hours is compared; the ones after it are reported as duplicated.
+func diffBands(before []HourlyPrice, after []HourlyPrice) []Change {
+	hours := func(price HourlyPrice) string {
+		return fmt.Sprintf("%02d:00-%02d:59", price.StartHour, price.EndHour)
+	}
+	var changes []Change
+	bands := func(prices []HourlyPrice, version string) ([]HourlyPrice, map[string]HourlyPrice) {
+		var unique []HourlyPrice
+		byHours := make(map[string]HourlyPrice)
+		for _, price := range prices {
+			if _, listed := byHours[hours(price)]; listed {
+				change := Change{Field: "hourly_prices", Kind: ChangeDuplicated,
+					Description: fmt.Sprintf("tariff band %s at %d listed more than once %s the change", hours(price), price.Rate, version)}
+				if version == "before" {
+					change.Before = price
+				} else {
+					change.After = price
+				}
+				changes = append(changes, change)
+				continue
+			}
+			byHours[hours(price)] = price
+			unique = append(unique, price)
+		}
+		return unique, byHours
+	}
+	before, beforeBands := bands(before, "before")
+	after, afterBands := bands(after, "after")
+
+	for _, price := range before {
+		if _, kept := afterBands[hours(price)]; !kept {
+			changes = append(changes, Change{Field: "hourly_prices", Kind: ChangeRemoved,
+				Description: fmt.Sprintf("tariff band %s at %d removed", hours(price), price.Rate), Before: price})
+		}
+	}
+	for _, price := range after {
+		previous, existed := beforeBands[hours(price)]
+		switch {
+		case !existed:
+			changes = append(changes, Change{Field: "hourly_prices", Kind: ChangeAdded,
+				Description: fmt.Sprintf("tariff band %s at %d added", hours(price), price.Rate), After: price})
+		case previous.Rate != price.Rate:
+			changes = append(changes, Change{Field: "hourly_prices", Kind: ChangeChanged,
+				Description: fmt.Sprintf("tariff band %s changed from %d to %d", hours(price), previous.Rate, price.Rate),
+				Before:      previous, After: price})
+		}
+	}
+	sort.SliceStable(changes, func(i, j int) bool { return bandStart(changes[i]) < bandStart(changes[j]) })
+	return changes
+}
+
+// bandStart returns the hour the band of a change starts.
+func bandStart(change Change) int {
+	if price, ok := change.After.(HourlyPrice); ok {
+		return price.StartHour
+	}
+	return change.Before.(HourlyPrice).StartHour
+}
+
+// diffSet compares two sets of numbers, reporting removed numbers before added ones, each in ascending order.
+func diffSet(field string, noun string, before []int, after []int, name func(int) string) []Change {
+	var changes []Change
+	for _, value := range sortedDifference(before, after) {
+		changes = append(changes, Change{Field: field, Kind: ChangeRemoved,
+			Description: fmt.Sprintf("%s %s removed", noun, name(value)), Before: value})
+	}
+	for _, value := range sortedDifference(after, before) {
+		changes = append(changes, Change{Field: field, Kind: ChangeAdded,
+			Description: fmt.Sprintf("%s %s added", noun, name(value)), After: value})
+	}
+	return changes
+}
+
+// sortedDifference returns the distinct numbers of a that are not in b, in ascending order.
+func sortedDifference(a []int, b []int) []int {
+	excluded := make(map[int]bool)
+	for _, value := range b {
+		excluded[value] = true
+	}
+	var difference []int
+	for _, value := range a {
+		if !excluded[value] {
+			difference = append(difference, value)
+			excluded[value] = true
+		}
+	}
+	sort.Ints(difference)
+	return difference
+}
+
+// diffDates compares excluded dates by calendar day, since the calculator excludes whole days.
+func diffDates(before []time.Time, after []time.Time) []Change {
+	days := func(dates []time.Time) []string {
+		var formatted []string
+		for _, date := range dates {
+			formatted = append(formatted, date.Format("2006-01-02"))
+		}
+		return formatted
+	}
+	beforeDays, afterDays := days(before), days(after)
+
+	var changes []Change
+	for _, day := range sortedStringDifference(beforeDays, afterDays) {
+		changes = append(changes, Change{Field: "excluded_dates", Kind: ChangeRemoved,
+			Description: fmt.Sprintf("excluded date %s removed", day), Before: day})
+	}
+	for _, day := range sortedStringDifference(afterDays, beforeDays) {
+		changes = append(changes, Change{Field: "excluded_dates", Kind: ChangeAdded,
+			Description: fmt.Sprintf("excluded date %s added", day), After: day})
+	}
+	return changes
+}
+
+// sortedStringDifference returns the distinct strings of a that are not in b, in ascending order.
+func sortedStringDifference(a []string, b []string) []string {
+	excluded := make(map[string]bool)
+	for _, value := range b {
+		excluded[value] = true
+	}
+	var difference []string
+	for _, value := range a {
+		if !excluded[value] {
+			difference = append(difference, value)
+			excluded[value] = true
+		}
+	}
+	sort.Strings(difference)
+	return difference
+}
+
+// monthName returns the name of a month number.
+func monthName(month int) string {
+	return time.Month(month).String()
+}
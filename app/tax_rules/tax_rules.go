@@ -5,13 +5,23 @@ package taxrules
 import (
 	"congestion-calculator-manager/app/helpers"
 	"congestion-calculator-manager/app/vehicles"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"strings"
 	"time"
 )
 
+// DefaultCity is the city whose tax rules are built into the calculator and do not need a JSON file.
+const DefaultCity = "Gothenburg"
+
+// DefaultRuleVersion is the version of the tax rules built into the calculator.
+const DefaultRuleVersion = "builtin-2013"
+
 // TaxRule represents the structure for tax rules used in congestion tax calculation.
 type TaxRule struct {
+	RuleVersion        string        `json:"version"`
 	HourlyPrices       []HourlyPrice `json:"hourly_prices"`
 	TaxOnWeekend       bool          `json:"tax_on_weekend"`
 	ExcludedMonths     []int         `json:"excluded_months"`
@@ -21,6 +31,58 @@ type TaxRule struct {
 	DefaultHourlyPrice int           `json:"default_hourly_price"`
 }
 
+// Version returns the version of the tax rules. Rules without an explicit version are identified
+// by a hash of their content, so that every edit of a city file results in a new version.
+func (t TaxRule) Version() string {
+	if t.RuleVersion != "" {
+		return t.RuleVersion
+	}
+	content, err := json.Marshal(t)
+	if err != nil {
+		return ""
+	}
+	hash := sha256.Sum256(content)
+	return hex.EncodeToString(hash[:6])
+}
+
+// Validate checks that the tax rules can be applied: hourly prices within a day, not overlapping and
+// not negative, and excluded months and days that exist.
+//
+// Returns:
+//   - error: An error describing the first problem found.
+func (t TaxRule) Validate() error {
+	if len(t.HourlyPrices) == 0 {
+		return fmt.Errorf("no hourly prices")
+	}
+	for i, price := range t.HourlyPrices {
+		if price.StartHour < 0 || price.EndHour > 23 || price.StartHour > price.EndHour {
+			return fmt.Errorf("hourly price %d: hours %d-%d are not within a day", i, price.StartHour, price.EndHour)
+		}
+		if price.Rate < 0 {
+			return fmt.Errorf("hourly price %d: negative rate %d", i, price.Rate)
+		}
+		for j, other := range t.HourlyPrices[:i] {
+			if price.StartHour <= other.EndHour && other.StartHour <= price.EndHour {
+				return fmt.Errorf("hourly price %d overlaps hourly price %d", i, j)
+			}
+		}
+	}
+	for _, month := range t.ExcludedMonths {
+		if month < 1 || month > 12 {
+			return fmt.Errorf("excluded month %d does not exist", month)
+		}
+	}
+	for _, day := range t.ExcludedDays {
+		if day < 1 || day > 31 {
+			return fmt.Errorf("excluded day %d does not exist", day)
+		}
+	}
+	if t.MaxTaxedFee < 0 || t.DefaultHourlyPrice < 0 {
+		return fmt.Errorf("negative daily cap or default price")
+	}
+	return nil
+}
+
 // HourlyPrice represents the structure for hourly prices within tax rules.
 type HourlyPrice struct {
 	StartHour int `json:"start_hour"`
@@ -31,6 +93,7 @@ type HourlyPrice struct {
 // CityData represents the structure for the entire tax rules and vehicle data for a city.
 type CityData struct {
 	CityName string                  `json:"city_name"`
+	Stations []string                `json:"stations"`
 	Vehicle  vehicles.GenericVehicle `json:"vehicle"`
 	TaxRules TaxRule                 `json:"tax_rules"`
 }
@@ -43,14 +106,51 @@ func LoadJsonDataForCity(cityName string) (CityData, error) {
 	// Read JSON content from the file
 	jsonData, err := helpers.ReadContentFromJsonFile(cityName)
 	if err != nil {
-		return cityData, nil
+		return cityData, err
 	}
 
-	// Unmarshal JSON data into CityData structure
-	err = json.Unmarshal([]byte(jsonData), &cityData)
+	cityData, err = ParseCityData(jsonData)
 	if err != nil {
-		fmt.Println("Error decoding JSON:", err)
+		helpers.Log.Warn("city data is not valid JSON", "city", cityName, "error", err)
 		return cityData, err
 	}
 	return cityData, nil
 }
+
+// ParseCityData decodes the JSON content of a city file, for callers that cache the content.
+func ParseCityData(jsonData string) (CityData, error) {
+	cityData := CityData{}
+	err := json.Unmarshal([]byte(jsonData), &cityData)
+	return cityData, err
+}
+
+// DefaultStations holds the toll stations of the default city, which has no JSON file listing them.
+var DefaultStations = []string{"GBG-TINGSTADSTUNNELN", "GBG-ALVSBORGSBRON", "GBG-GOTAALVBRON"}
+
+// FindCityByStation looks through the default city and all cities of the data store and returns
+// the name of the city owning the given toll station.
+func FindCityByStation(station string) (string, error) {
+	for _, defaultStation := range DefaultStations {
+		if strings.EqualFold(defaultStation, station) {
+			return DefaultCity, nil
+		}
+	}
+
+	cityNames, err := helpers.ListJsonFiles("cities")
+	if err != nil {
+		return "", err
+	}
+
+	for _, cityName := range cityNames {
+		cityData, err := LoadJsonDataForCity(cityName)
+		if err != nil {
+			return "", err
+		}
+		for _, cityStation := range cityData.Stations {
+			if strings.EqualFold(cityStation, station) {
+				return cityData.CityName, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("unknown toll station %s", station)
+}
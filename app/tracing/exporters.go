@@ -0,0 +1,231 @@
+package tracing
+
+import (
+	"congestion-calculator-manager/app/helpers"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+)
+
+// Environment variables selecting the exporter of the Default tracer.
+const (
+	// ExporterEnv selects the exporter: stdout, otlp-file or none.
+	ExporterEnv = "CONGESTION_TRACE_EXPORTER"
+	// FileEnv is the path of the file written by the otlp-file exporter.
+	FileEnv = "CONGESTION_TRACE_FILE"
+)
+
+// ServiceName is the name of the service recorded with exported spans.
+const ServiceName = "congestion-calculator"
+
+// ExporterFromEnvironment creates the exporter selected by CONGESTION_TRACE_EXPORTER.
+// The otlp-file exporter writes to CONGESTION_TRACE_FILE, or traces/spans.jsonl in the data store.
+//
+// Returns:
+//   - Exporter: The selected exporter, or nil if tracing is not exported.
+//   - error: An error if the exporter is unknown or its file cannot be opened.
+func ExporterFromEnvironment() (Exporter, error) {
+	switch name := os.Getenv(ExporterEnv); name {
+	case "", "none":
+		return nil, nil
+	case "stdout":
+		return NewWriterExporter(os.Stdout), nil
+	case "otlp-file":
+		path := os.Getenv(FileEnv)
+		if path == "" {
+			dir, err := helpers.DataDirectory()
+			if err != nil {
+				return nil, err
+			}
+			path = filepath.Join(dir, "traces", "spans.jsonl")
+		}
+		return OpenOTLPFileExporter(path)
+	default:
+		return nil, fmt.Errorf("unknown trace exporter %s", name)
+	}
+}
+
+// WriterExporter writes every span as a readable JSON line, for local debugging.
+type WriterExporter struct {
+	mu  sync.Mutex
+	out io.Writer
+}
+
+// NewWriterExporter creates an exporter writing to the given writer.
+//
+// Parameters:
+//   - out: The writer spans are written to, typically standard output.
+//
+// Returns:
+//   - *WriterExporter: A pointer to the newly created WriterExporter instance.
+func NewWriterExporter(out io.Writer) *WriterExporter {
+	return &WriterExporter{out: out}
+}
+
+// writtenSpan represents a span as written by the WriterExporter.
+type writtenSpan struct {
+	Name       string      `json:"name"`
+	TraceID    string      `json:"trace_id"`
+	SpanID     string      `json:"span_id"`
+	ParentID   string      `json:"parent_id,omitempty"`
+	Start      string      `json:"start"`
+	DurationMs float64     `json:"duration_ms"`
+	Attributes []Attribute `json:"attributes,omitempty"`
+	Error      string      `json:"error,omitempty"`
+}
+
+// ExportSpan writes the span as a single JSON line.
+func (e *WriterExporter) ExportSpan(span SpanData) error {
+	written := writtenSpan{
+		Name:       span.Name,
+		TraceID:    span.Context.TraceID.String(),
+		SpanID:     span.Context.SpanID.String(),
+		Start:      span.Start.UTC().Format("2006-01-02T15:04:05.000000Z07:00"),
+		DurationMs: float64(span.End.Sub(span.Start).Microseconds()) / 1000,
+		Attributes: span.Attributes,
+		Error:      span.Error,
+	}
+	if !span.ParentSpanID.IsZero() {
+		written.ParentID = span.ParentSpanID.String()
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return json.NewEncoder(e.out).Encode(written)
+}
+
+// OTLPFileExporter appends every span to a file as an OTLP/JSON trace export request per line,
+// the format of the OpenTelemetry collector's file exporter, so that the file can be replayed into a collector.
+type OTLPFileExporter struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+// OpenOTLPFileExporter opens or creates the file spans are appended to.
+//
+// Parameters:
+//   - path: The path of the file.
+//
+// Returns:
+//   - *OTLPFileExporter: A pointer to the newly created OTLPFileExporter instance.
+//   - error: An error if the file could not be opened.
+func OpenOTLPFileExporter(path string) (*OTLPFileExporter, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &OTLPFileExporter{file: file}, nil
+}
+
+// OTLP/JSON structures of an export request with a single span.
+type (
+	otlpRequest struct {
+		ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+	}
+	otlpResourceSpans struct {
+		Resource   otlpResource     `json:"resource"`
+		ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+	}
+	otlpResource struct {
+		Attributes []otlpAttribute `json:"attributes"`
+	}
+	otlpScopeSpans struct {
+		Scope otlpScope  `json:"scope"`
+		Spans []otlpSpan `json:"spans"`
+	}
+	otlpScope struct {
+		Name string `json:"name"`
+	}
+	otlpSpan struct {
+		TraceID           string          `json:"traceId"`
+		SpanID            string          `json:"spanId"`
+		ParentSpanID      string          `json:"parentSpanId,omitempty"`
+		Name              string          `json:"name"`
+		Kind              int             `json:"kind"`
+		StartTimeUnixNano string          `json:"startTimeUnixNano"`
+		EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+		Attributes        []otlpAttribute `json:"attributes,omitempty"`
+		Status            otlpStatus      `json:"status"`
+	}
+	otlpAttribute struct {
+		Key   string                 `json:"key"`
+		Value map[string]interface{} `json:"value"`
+	}
+	otlpStatus struct {
+		Code    int    `json:"code,omitempty"`
+		Message string `json:"message,omitempty"`
+	}
+)
+
+// OTLP span kinds and status codes used by the exporter.
+const (
+	otlpKindInternal = 1
+	otlpStatusError  = 2
+)
+
+// ExportSpan appends the span to the file.
+func (e *OTLPFileExporter) ExportSpan(span SpanData) error {
+	converted := otlpSpan{
+		TraceID:           span.Context.TraceID.String(),
+		SpanID:            span.Context.SpanID.String(),
+		Name:              span.Name,
+		Kind:              otlpKindInternal,
+		StartTimeUnixNano: strconv.FormatInt(span.Start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(span.End.UnixNano(), 10),
+	}
+	if !span.ParentSpanID.IsZero() {
+		converted.ParentSpanID = span.ParentSpanID.String()
+	}
+	for _, attribute := range span.Attributes {
+		converted.Attributes = append(converted.Attributes, toOTLPAttribute(attribute))
+	}
+	if span.Error != "" {
+		converted.Status = otlpStatus{Code: otlpStatusError, Message: span.Error}
+	}
+
+	request := otlpRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource: otlpResource{Attributes: []otlpAttribute{
+			toOTLPAttribute(Attribute{Key: "service.name", Value: ServiceName}),
+		}},
+		ScopeSpans: []otlpScopeSpans{{
+			Scope: otlpScope{Name: "congestion-calculator-manager/app/tracing"},
+			Spans: []otlpSpan{converted},
+		}},
+	}}}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return json.NewEncoder(e.file).Encode(request)
+}
+
+// Close closes the file.
+func (e *OTLPFileExporter) Close() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.file.Close()
+}
+
+// toOTLPAttribute converts an attribute to its typed OTLP/JSON value.
+func toOTLPAttribute(attribute Attribute) otlpAttribute {
+	var value map[string]interface{}
+	switch v := attribute.Value.(type) {
+	case bool:
+		value = map[string]interface{}{"boolValue": v}
+	case int:
+		value = map[string]interface{}{"intValue": strconv.Itoa(v)}
+	case int64:
+		value = map[string]interface{}{"intValue": strconv.FormatInt(v, 10)}
+	case float64:
+		value = map[string]interface{}{"doubleValue": v}
+	default:
+		value = map[string]interface{}{"stringValue": fmt.Sprint(v)}
+	}
+	return otlpAttribute{Key: attribute.Key, Value: value}
+}
@@ -0,0 +1,271 @@
+// Package tracing provides spans measuring the steps of a request, propagated between services
+// with the W3C traceparent header and handed to an exporter when they end.
+package tracing
+
+import (
+	"congestion-calculator-manager/app/helpers"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TraceParentHeader is the W3C Trace Context header carrying the parent of a span.
+const TraceParentHeader = "traceparent"
+
+// ErrInvalidTraceParent is returned when a traceparent header does not follow the W3C format.
+var ErrInvalidTraceParent = errors.New("invalid traceparent")
+
+// TraceID identifies all spans of a trace.
+type TraceID [16]byte
+
+// String returns the trace id as lower-case hex.
+func (id TraceID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// SpanID identifies a single span of a trace.
+type SpanID [8]byte
+
+// String returns the span id as lower-case hex.
+func (id SpanID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// IsZero checks if the span id is unset, as it is for the parent of a root span.
+func (id SpanID) IsZero() bool {
+	return id == SpanID{}
+}
+
+// SpanContext represents the identity of a span as propagated to other services.
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	Sampled bool
+}
+
+// TraceParent formats the span context as a version 00 traceparent header value.
+func (sc SpanContext) TraceParent() string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return fmt.Sprintf("00-%s-%s-%s", sc.TraceID, sc.SpanID, flags)
+}
+
+// ParseTraceParent parses a traceparent header value.
+//
+// Parameters:
+//   - value: The header value, e.g. 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01.
+//
+// Returns:
+//   - SpanContext: The remote parent span.
+//   - error: ErrInvalidTraceParent if the value does not follow the format or has all-zero ids.
+func ParseTraceParent(value string) (SpanContext, error) {
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return SpanContext{}, ErrInvalidTraceParent
+	}
+	// version 00 has exactly four fields; later versions may append more
+	if parts[0] == "00" && len(parts) != 4 {
+		return SpanContext{}, ErrInvalidTraceParent
+	}
+
+	var sc SpanContext
+	var flags [1]byte
+	if _, err := hex.Decode(sc.TraceID[:], []byte(parts[1])); err != nil {
+		return SpanContext{}, ErrInvalidTraceParent
+	}
+	if _, err := hex.Decode(sc.SpanID[:], []byte(parts[2])); err != nil {
+		return SpanContext{}, ErrInvalidTraceParent
+	}
+	if _, err := hex.Decode(flags[:], []byte(parts[3])); err != nil {
+		return SpanContext{}, ErrInvalidTraceParent
+	}
+	if sc.TraceID == (TraceID{}) || sc.SpanID.IsZero() || strings.ToLower(value) != value {
+		return SpanContext{}, ErrInvalidTraceParent
+	}
+	sc.Sampled = flags[0]&1 == 1
+	return sc, nil
+}
+
+// Attribute represents a key-value pair describing a span.
+type Attribute struct {
+	Key   string      `json:"key"`
+	Value interface{} `json:"value"`
+}
+
+// SpanData represents a finished span as handed to an exporter.
+type SpanData struct {
+	Name         string
+	Context      SpanContext
+	ParentSpanID SpanID
+	Start        time.Time
+	End          time.Time
+	Attributes   []Attribute
+	Error        string
+}
+
+// Exporter receives every sampled span when it ends.
+type Exporter interface {
+	ExportSpan(span SpanData) error
+}
+
+// Tracer creates spans and hands the finished ones to its exporter.
+type Tracer struct {
+	mu       sync.RWMutex
+	exporter Exporter
+}
+
+// Default is the tracer of the application; it exports nothing until an exporter is set.
+var Default = NewTracer(nil)
+
+// NewTracer creates a tracer exporting to the given exporter.
+//
+// Parameters:
+//   - exporter: The exporter of finished spans, or nil to only propagate trace ids.
+//
+// Returns:
+//   - *Tracer: A pointer to the newly created Tracer instance.
+func NewTracer(exporter Exporter) *Tracer {
+	return &Tracer{exporter: exporter}
+}
+
+// SetExporter replaces the exporter of finished spans; nil disables exporting.
+func (t *Tracer) SetExporter(exporter Exporter) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.exporter = exporter
+}
+
+// currentExporter returns the exporter of finished spans, if any.
+func (t *Tracer) currentExporter() Exporter {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.exporter
+}
+
+// Span represents a step of a request being measured.
+type Span struct {
+	tracer *Tracer
+	mu     sync.Mutex
+	data   SpanData
+	ended  bool
+}
+
+// spanKey and remoteParentKey are the context keys of the current span and of a propagated parent.
+type (
+	spanKey         struct{}
+	remoteParentKey struct{}
+)
+
+// ContextWithRemoteParent returns a copy of the context whose next span continues the trace of a remote parent.
+func ContextWithRemoteParent(ctx context.Context, parent SpanContext) context.Context {
+	return context.WithValue(ctx, remoteParentKey{}, parent)
+}
+
+// SpanFromContext returns the current span of the context, or nil if there is none.
+func SpanFromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanKey{}).(*Span)
+	return span
+}
+
+// Start starts a span with the Default tracer.
+func Start(ctx context.Context, name string) (context.Context, *Span) {
+	return Default.Start(ctx, name)
+}
+
+// Start starts a span as a child of the current span of the context, of a remote parent,
+// or as the root of a new trace.
+//
+// Parameters:
+//   - ctx: The context of the caller.
+//   - name: The name of the step being measured.
+//
+// Returns:
+//   - context.Context: A copy of the context carrying the new span.
+//   - *Span: The new span; the caller must call End.
+func (t *Tracer) Start(ctx context.Context, name string) (context.Context, *Span) {
+	span := &Span{tracer: t, data: SpanData{Name: name, Start: time.Now()}}
+	span.data.Context.SpanID = newSpanID()
+
+	if parent := SpanFromContext(ctx); parent != nil {
+		parentContext := parent.SpanContext()
+		span.data.Context.TraceID = parentContext.TraceID
+		span.data.Context.Sampled = parentContext.Sampled
+		span.data.ParentSpanID = parentContext.SpanID
+	} else if remote, exists := ctx.Value(remoteParentKey{}).(SpanContext); exists {
+		span.data.Context.TraceID = remote.TraceID
+		span.data.Context.Sampled = remote.Sampled
+		span.data.ParentSpanID = remote.SpanID
+	} else {
+		span.data.Context.TraceID = newTraceID()
+		span.data.Context.Sampled = true
+	}
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+// SpanContext returns the identity of the span.
+func (s *Span) SpanContext() SpanContext {
+	return s.data.Context
+}
+
+// SetAttribute adds a key-value pair describing the span.
+func (s *Span) SetAttribute(key string, value interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data.Attributes = append(s.data.Attributes, Attribute{Key: key, Value: value})
+}
+
+// RecordError marks the span as failed; nil errors are ignored.
+func (s *Span) RecordError(err error) {
+	if err == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data.Error = err.Error()
+}
+
+// End finishes the span and exports it if it is sampled. Only the first call has an effect.
+func (s *Span) End() {
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.data.End = time.Now()
+	data := s.data
+	s.mu.Unlock()
+
+	exporter := s.tracer.currentExporter()
+	if exporter == nil || !data.Context.Sampled {
+		return
+	}
+	if err := exporter.ExportSpan(data); err != nil {
+		helpers.Log.Warn("span not exported", "span", data.Name, "trace_id", data.Context.TraceID.String(), "error", err)
+	}
+}
+
+// newTraceID returns a random trace id.
+func newTraceID() TraceID {
+	var id TraceID
+	for id == (TraceID{}) {
+		rand.Read(id[:])
+	}
+	return id
+}
+
+// newSpanID returns a random span id.
+func newSpanID() SpanID {
+	var id SpanID
+	for id.IsZero() {
+		rand.Read(id[:])
+	}
+	return id
+}
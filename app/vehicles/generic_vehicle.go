@@ -2,14 +2,16 @@
 package vehicles
 
 import (
+	"congestion-calculator-manager/app/plates"
 	"time"
 )
 
-// GenericVehicle represents the structure for a generic vehicle, including license plate, type, tax exclusion status, and times.
+// GenericVehicle represents the structure for a generic vehicle, including license plate, type, tax exclusion status, category and times.
 type GenericVehicle struct {
 	LicensePlate string      `json:"license_plate"`
 	Type         string      `json:"type"`
 	TaxExcluded  bool        `json:"tax_excluded"`
+	Category     string      `json:"category"`
 	Times        []time.Time `json:"times"`
 }
 
@@ -20,7 +22,7 @@ func (gv GenericVehicle) GetVehicleType() string {
 
 // IsValidLicensePlate checks if the license plate of the generic vehicle is valid.
 func (gv GenericVehicle) IsValidLicensePlate() bool {
-	return gv.LicensePlate != ""
+	return plates.IsValid(gv.LicensePlate)
 }
 
 // IsTaxExcluded checks if the generic vehicle is tax excluded.
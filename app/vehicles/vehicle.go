@@ -2,7 +2,10 @@
 
 package vehicles
 
-import "errors"
+import (
+	"congestion-calculator-manager/app/plates"
+	"errors"
+)
 
 // Vehicle is an interface that defines the methods expected from a vehicle type.
 type Vehicle interface {
@@ -12,35 +15,28 @@ type Vehicle interface {
 }
 
 // GetVehicle creates and returns a Vehicle object based on the provided type and license information.
+// The type is resolved by name or alias through the Types registry.
 func GetVehicle(vehicleType string, licenseInfo string) (Vehicle, error) {
-	var vehicle Vehicle
-
-	switch vehicleType {
-	case "Car":
-		vehicle = Car{LicensePlate: licenseInfo}
-	case "Bus":
-		vehicle = Bus{LicensePlate: licenseInfo}
-	case "Motorbike":
-		vehicle = Motorbike{LicensePlate: licenseInfo}
-	case "Military":
-		vehicle = Military{LicensePlate: licenseInfo}
-	case "Diplomat":
-		vehicle = Diplomat{LicensePlate: licenseInfo}
-	case "Emergency":
-		vehicle = Emergency{LicensePlate: licenseInfo}
-	case "Foreign":
-		vehicle = Foreign{LicensePlate: licenseInfo}
-	default:
+	definition, exists := Types.Resolve(vehicleType)
+	if !exists {
 		// Default to an unknown vehicle type
 		return nil, errors.New("unknown or missing vehicle type")
 	}
-	if licenseInfo == "" {
+	if !plates.IsValid(licenseInfo) {
 		return nil, errors.New("invalid license for specified vehicle")
 	}
 
-	return vehicle, nil
+	return GenericVehicle{
+		LicensePlate: licenseInfo,
+		Type:         definition.Name,
+		TaxExcluded:  definition.TaxExcluded,
+		Category:     definition.Category,
+	}, nil
 }
 
+// The vehicle types below predate the Types registry and are kept for existing callers.
+// New vehicle types should be added to the registry configuration instead.
+
 // Bus represents a bus vehicle type.
 type Bus struct {
 	LicensePlate string
@@ -53,7 +49,7 @@ func (b Bus) GetVehicleType() string {
 
 // IsValidLicensePlate checks if the license plate is valid for the bus.
 func (b Bus) IsValidLicensePlate() bool {
-	return b.LicensePlate != ""
+	return plates.IsValid(b.LicensePlate)
 }
 
 // IsTaxExcluded checks if the bus is tax excluded.
@@ -64,7 +60,6 @@ func (b Bus) IsTaxExcluded() bool {
 // Motorbike represents a motorbike vehicle type.
 type Motorbike struct {
 	LicensePlate string
-	Type         int
 }
 
 // GetVehicleType returns the type of the motorbike.
@@ -74,7 +69,7 @@ func (m Motorbike) GetVehicleType() string {
 
 // IsValidLicensePlate checks if the license plate is valid for the motorbike.
 func (m Motorbike) IsValidLicensePlate() bool {
-	return m.LicensePlate != ""
+	return plates.IsValid(m.LicensePlate)
 }
 
 // IsTaxExcluded checks if the motorbike is tax excluded.
@@ -94,7 +89,7 @@ func (c Car) GetVehicleType() string {
 
 // IsValidLicensePlate checks if the license plate is valid for the car.
 func (c Car) IsValidLicensePlate() bool {
-	return c.LicensePlate != ""
+	return plates.IsValid(c.LicensePlate)
 }
 
 // IsTaxExcluded checks if the car is tax excluded.
@@ -114,7 +109,7 @@ func (m Military) GetVehicleType() string {
 
 // IsValidLicensePlate checks if the license plate is valid for the military vehicle.
 func (m Military) IsValidLicensePlate() bool {
-	return m.LicensePlate != ""
+	return plates.IsValid(m.LicensePlate)
 }
 
 // IsTaxExcluded checks if the military vehicle is tax excluded.
@@ -134,7 +129,7 @@ func (d Diplomat) GetVehicleType() string {
 
 // IsValidLicensePlate checks if the license plate is valid for the diplomat vehicle.
 func (d Diplomat) IsValidLicensePlate() bool {
-	return d.LicensePlate != ""
+	return plates.IsValid(d.LicensePlate)
 }
 
 // IsTaxExcluded checks if the diplomat vehicle is tax excluded.
@@ -154,7 +149,7 @@ func (e Emergency) GetVehicleType() string {
 
 // IsValidLicensePlate checks if the license plate is valid for the emergency vehicle.
 func (e Emergency) IsValidLicensePlate() bool {
-	return e.LicensePlate != ""
+	return plates.IsValid(e.LicensePlate)
 }
 
 // IsTaxExcluded checks if the emergency vehicle is tax excluded.
@@ -174,7 +169,7 @@ func (f Foreign) GetVehicleType() string {
 
 // IsValidLicensePlate checks if the license plate is valid for the foreign vehicle.
 func (f Foreign) IsValidLicensePlate() bool {
-	return f.LicensePlate != ""
+	return plates.IsValid(f.LicensePlate)
 }
 
 // IsTaxExcluded checks if the foreign vehicle is tax excluded.
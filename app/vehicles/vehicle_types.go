@@ -0,0 +1,91 @@
+package vehicles
+
+import (
+	"congestion-calculator-manager/app/helpers"
+	"encoding/json"
+	"strings"
+	"sync"
+)
+
+// TypeDefinition represents a vehicle type defined by data instead of code.
+type TypeDefinition struct {
+	Name        string   `json:"name"`
+	Aliases     []string `json:"aliases"`
+	TaxExcluded bool     `json:"tax_excluded"`
+	Category    string   `json:"category"`
+}
+
+// DefaultTypes are the vehicle types known without any configuration.
+var DefaultTypes = []TypeDefinition{
+	{Name: "Car", TaxExcluded: false, Category: "passenger"},
+	{Name: "Bus", TaxExcluded: true, Category: "public-transport"},
+	{Name: "Motorbike", Aliases: []string{"Motorcycle"}, TaxExcluded: true, Category: "two-wheeler"},
+	{Name: "Military", TaxExcluded: true, Category: "military"},
+	{Name: "Diplomat", TaxExcluded: true, Category: "diplomatic"},
+	{Name: "Emergency", TaxExcluded: true, Category: "emergency"},
+	{Name: "Foreign", TaxExcluded: true, Category: "foreign"},
+}
+
+// TypeRegistry represents the set of known vehicle types, resolvable by name or alias.
+type TypeRegistry struct {
+	types map[string]TypeDefinition // Definitions keyed by lower case name and aliases
+	mu    sync.RWMutex              // Mutex for concurrent access
+}
+
+// Types is the registry used by GetVehicle to resolve vehicle types.
+var Types = NewTypeRegistry(DefaultTypes)
+
+// NewTypeRegistry creates a new TypeRegistry containing the given definitions.
+func NewTypeRegistry(definitions []TypeDefinition) *TypeRegistry {
+	registry := &TypeRegistry{
+		types: make(map[string]TypeDefinition),
+	}
+	for _, definition := range definitions {
+		registry.Register(definition)
+	}
+	return registry
+}
+
+// LoadTypeRegistry creates a TypeRegistry with the default types, extended and overridden
+// by the types configured in "vehicles/types.json" of the data store.
+//
+// Returns:
+//   - *TypeRegistry: A pointer to the loaded TypeRegistry instance.
+//   - error: An error if the file could not be read or decoded.
+func LoadTypeRegistry() (*TypeRegistry, error) {
+	registry := NewTypeRegistry(DefaultTypes)
+
+	jsonData, err := helpers.ReadContentFromDataFile("vehicles", "types")
+	if err != nil {
+		return registry, err
+	}
+
+	var definitions []TypeDefinition
+	err = json.Unmarshal([]byte(jsonData), &definitions)
+	if err != nil {
+		return registry, err
+	}
+
+	for _, definition := range definitions {
+		registry.Register(definition)
+	}
+	return registry, nil
+}
+
+// Register adds or replaces a vehicle type under its name and all of its aliases.
+func (r *TypeRegistry) Register(definition TypeDefinition) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.types[strings.ToLower(definition.Name)] = definition
+	for _, alias := range definition.Aliases {
+		r.types[strings.ToLower(alias)] = definition
+	}
+}
+
+// Resolve returns the definition of the vehicle type with the given name or alias.
+func (r *TypeRegistry) Resolve(name string) (TypeDefinition, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	definition, exists := r.types[strings.ToLower(strings.TrimSpace(name))]
+	return definition, exists
+}
@@ -0,0 +1,309 @@
+// Package webhooks delivers signed event notifications to URLs registered by callers, retrying
+// failed deliveries with exponential backoff.
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Headers of webhook requests. The signature is the hex HMAC-SHA256 of the timestamp, a dot and the body,
+// prefixed with "sha256=", so receivers can reject forged and replayed notifications.
+const (
+	SignatureHeader = "X-Congestion-Signature"
+	TimestampHeader = "X-Congestion-Timestamp"
+	EventHeader     = "X-Congestion-Event"
+	DeliveryHeader  = "X-Congestion-Delivery"
+)
+
+// MinSecretLength is the minimum length of webhook secrets.
+const MinSecretLength = 16
+
+// AllowedNetworksEnv is the environment variable listing the internal networks webhooks may be sent to,
+// as comma-separated CIDRs or addresses, such as "10.1.0.0/16,192.168.1.20".
+const AllowedNetworksEnv = "CONGESTION_WEBHOOK_ALLOWED_NETWORKS"
+
+// Errors returned when verifying a notification.
+var (
+	ErrInvalidSignature = errors.New("invalid webhook signature")
+	ErrStaleTimestamp   = errors.New("webhook timestamp outside of the tolerance")
+)
+
+// ErrInternalTarget is returned for webhooks pointing to a loopback, link-local, private or unspecified address
+// outside of the allowed networks, so that callers cannot make the server reach its own network.
+var ErrInternalTarget = errors.New("webhook target is an internal address")
+
+// AllowedNetworks holds the internal networks webhooks may be sent to; see AllowedNetworksEnv.
+var AllowedNetworks []*net.IPNet
+
+// internalNetworks are the private and shared address ranges, which the net package of Go 1.15 does not classify.
+var internalNetworks = mustParseNetworks("10.0.0.0/8,172.16.0.0/12,192.168.0.0/16,100.64.0.0/10,fc00::/7")
+
+// LoadAllowedNetworks returns the internal networks webhooks may be sent to, configured in AllowedNetworksEnv.
+//
+// Returns:
+//   - []*net.IPNet: The allowed networks, none if the variable is not set.
+//   - error: An error if an entry is neither a CIDR nor an address.
+func LoadAllowedNetworks() ([]*net.IPNet, error) {
+	return ParseNetworks(os.Getenv(AllowedNetworksEnv))
+}
+
+// ParseNetworks parses comma-separated CIDRs or addresses; a single address is a network of its own.
+func ParseNetworks(list string) ([]*net.IPNet, error) {
+	networks := []*net.IPNet{}
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if ip := net.ParseIP(entry); ip != nil {
+			bits := 8 * len(ip)
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("allowed webhook network %q is neither a CIDR nor an address", entry)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// mustParseNetworks parses built-in networks.
+func mustParseNetworks(list string) []*net.IPNet {
+	networks, err := ParseNetworks(list)
+	if err != nil {
+		panic(err)
+	}
+	return networks
+}
+
+// CheckAddress checks that a webhook may be sent to an address.
+//
+// Returns:
+//   - error: ErrInternalTarget if the address is internal and not in the allowed networks.
+func CheckAddress(ip net.IP) error {
+	for _, network := range AllowedNetworks {
+		if network.Contains(ip) {
+			return nil
+		}
+	}
+	internal := ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsUnspecified()
+	for _, network := range internalNetworks {
+		internal = internal || network.Contains(ip)
+	}
+	if internal {
+		return fmt.Errorf("%w %s", ErrInternalTarget, ip)
+	}
+	return nil
+}
+
+// ValidateTarget checks that a webhook can be registered with the given URL and secret.
+// The host must resolve to addresses that are not internal; deliveries check the address
+// they connect to again, since the host may resolve differently later.
+func ValidateTarget(target string, secret string) error {
+	parsed, err := url.Parse(target)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return fmt.Errorf("webhook URL %q must be an absolute http or https URL", target)
+	}
+	if len(secret) < MinSecretLength {
+		return fmt.Errorf("webhook secret must have at least %d characters", MinSecretLength)
+	}
+
+	addresses := []net.IP{net.ParseIP(parsed.Hostname())}
+	if addresses[0] == nil {
+		addresses, err = net.LookupIP(parsed.Hostname())
+		if err != nil {
+			return fmt.Errorf("webhook host %q could not be resolved: %v", parsed.Hostname(), err)
+		}
+	}
+	for _, address := range addresses {
+		if err := CheckAddress(address); err != nil {
+			return fmt.Errorf("webhook URL %q is not allowed: %w", target, err)
+		}
+	}
+	return nil
+}
+
+// dialControl refuses connections to internal addresses, checked after the host was resolved.
+func dialControl(network string, address string, conn syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return fmt.Errorf("webhook address %q is not an IP address", host)
+	}
+	return CheckAddress(ip)
+}
+
+// NewClient creates the HTTP client of webhook deliveries, which only connects to addresses allowed by CheckAddress,
+// after redirects as well.
+func NewClient() *http.Client {
+	dialer := &net.Dialer{Timeout: 5 * time.Second, Control: dialControl}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = func(ctx context.Context, network string, address string) (net.Conn, error) {
+		return dialer.DialContext(ctx, network, address)
+	}
+	return &http.Client{Timeout: 10 * time.Second, Transport: transport}
+}
+
+// Sign returns the signature of a notification body sent at the given Unix time.
+func Sign(secret []byte, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify checks the signature of a received notification, for receivers written in Go and in tests.
+//
+// Parameters:
+//   - secret: The secret the webhook was registered with.
+//   - timestamp: The value of the X-Congestion-Timestamp header.
+//   - body: The request body.
+//   - signature: The value of the X-Congestion-Signature header.
+//   - now: The time of receipt.
+//   - tolerance: The maximum age of accepted notifications.
+//
+// Returns:
+//   - error: ErrInvalidSignature or ErrStaleTimestamp if the notification must be rejected.
+func Verify(secret []byte, timestamp string, body []byte, signature string, now time.Time, tolerance time.Duration) error {
+	sent, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return ErrInvalidSignature
+	}
+	if !hmac.Equal([]byte(signature), []byte(Sign(secret, sent, body))) {
+		return ErrInvalidSignature
+	}
+	if age := now.Sub(time.Unix(sent, 0)); age > tolerance || age < -tolerance {
+		return ErrStaleTimestamp
+	}
+	return nil
+}
+
+// Delivery represents the outcome of delivering a notification.
+type Delivery struct {
+	ID         string    `json:"id"`
+	Event      string    `json:"event"`
+	URL        string    `json:"url"`
+	Attempts   int       `json:"attempts"`
+	StatusCode int       `json:"status_code,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	Delivered  bool      `json:"delivered"`
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+}
+
+// Sender delivers notifications. A delivery is retried after network errors, 429 and 5xx responses;
+// other responses end it.
+type Sender struct {
+	Client      *http.Client
+	MaxAttempts int
+	// Backoff is the wait before the first retry; it doubles with every further retry.
+	Backoff time.Duration
+}
+
+// NewSender creates a sender making up to 5 attempts, waiting 1s, 2s, 4s and 8s between them,
+// with a client refusing internal addresses.
+//
+// Returns:
+//   - *Sender: A pointer to the newly created Sender instance.
+func NewSender() *Sender {
+	return &Sender{Client: NewClient(), MaxAttempts: 5, Backoff: time.Second}
+}
+
+// Send delivers a notification, blocking until it is delivered or the attempts are exhausted.
+//
+// Parameters:
+//   - target: The URL to POST the notification to.
+//   - secret: The secret signing the notification.
+//   - event: The event type, sent in the X-Congestion-Event header.
+//   - body: The JSON body of the notification.
+//
+// Returns:
+//   - Delivery: The outcome of the delivery.
+func (s *Sender) Send(target string, secret []byte, event string, body []byte) Delivery {
+	delivery := Delivery{ID: newID(), Event: event, URL: target, StartedAt: time.Now().UTC()}
+	wait := s.Backoff
+	for delivery.Attempts < s.MaxAttempts {
+		if delivery.Attempts > 0 {
+			time.Sleep(wait)
+			wait *= 2
+		}
+		delivery.Attempts++
+
+		retry := s.attempt(&delivery, target, secret, body)
+		if !retry {
+			break
+		}
+	}
+	delivery.FinishedAt = time.Now().UTC()
+	return delivery
+}
+
+// attempt makes a single delivery attempt and reports whether it should be retried.
+func (s *Sender) attempt(delivery *Delivery, target string, secret []byte, body []byte) bool {
+	request, err := http.NewRequest(http.MethodPost, target, bytes.NewReader(body))
+	if err != nil {
+		delivery.Error = err.Error()
+		return false
+	}
+	timestamp := time.Now().Unix()
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set(EventHeader, delivery.Event)
+	request.Header.Set(DeliveryHeader, delivery.ID)
+	request.Header.Set(TimestampHeader, strconv.FormatInt(timestamp, 10))
+	request.Header.Set(SignatureHeader, Sign(secret, timestamp, body))
+
+	response, err := s.Client.Do(request)
+	if err != nil {
+		delivery.StatusCode = 0
+		delivery.Error = err.Error()
+		return !errors.Is(err, ErrInternalTarget)
+	}
+	io.Copy(ioutil.Discard, io.LimitReader(response.Body, 64<<10))
+	response.Body.Close()
+
+	delivery.StatusCode = response.StatusCode
+	delivery.Delivered = response.StatusCode >= 200 && response.StatusCode < 300
+	if delivery.Delivered {
+		delivery.Error = ""
+		return false
+	}
+	delivery.Error = fmt.Sprintf("receiver responded with %d", response.StatusCode)
+	return response.StatusCode == http.StatusTooManyRequests || response.StatusCode >= 500
+}
+
+// newID returns a random id identifying a delivery to the receiver, which stays the same across retries.
+func newID() string {
+	buffer := make([]byte, 16)
+	if _, err := rand.Read(buffer); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 36)
+	}
+	return hex.EncodeToString(buffer)
+}
@@ -0,0 +1,277 @@
+// Package websocket implements the server side of the WebSocket protocol (RFC 6455) on top of a
+// hijacked net/http connection. Only what the server needs is supported: text and binary messages,
+// fragmentation, ping and close; extensions such as compression are not negotiated.
+package websocket
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// acceptGUID is appended to the key of the client to compute the accept header of the handshake.
+const acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// Opcodes of frames.
+const (
+	opContinuation = 0x0
+	opText         = 0x1
+	opBinary       = 0x2
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xA
+)
+
+// Status codes of close frames.
+const (
+	CloseNormal          = 1000
+	CloseProtocolError   = 1002
+	CloseUnsupportedData = 1003
+	CloseInvalidPayload  = 1007
+	ClosePolicyViolation = 1008
+	CloseMessageTooBig   = 1009
+	CloseInternalError   = 1011
+)
+
+// Errors returned by Upgrade and ReadMessage.
+var (
+	ErrNotWebSocket    = errors.New("not a WebSocket handshake")
+	ErrMessageTooLarge = errors.New("WebSocket message too large")
+	ErrProtocol        = errors.New("WebSocket protocol error")
+)
+
+// Conn represents a WebSocket connection accepted by the server.
+type Conn struct {
+	conn           net.Conn
+	reader         *bufio.Reader
+	maxMessageSize int64
+	writeMu        sync.Mutex
+}
+
+// IsUpgrade checks if a request asks to switch to the WebSocket protocol.
+func IsUpgrade(r *http.Request) bool {
+	return headerContains(r.Header, "Connection", "upgrade") && headerContains(r.Header, "Upgrade", "websocket")
+}
+
+// headerContains checks if a comma-separated header contains a token, ignoring case.
+func headerContains(header http.Header, name string, token string) bool {
+	for _, value := range header[http.CanonicalHeaderKey(name)] {
+		for _, element := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(element), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Upgrade completes the WebSocket handshake of a request and takes over its connection.
+// Headers already set on the response, such as the request id, are sent with the handshake.
+//
+// Parameters:
+//   - w: The response writer; it must support hijacking.
+//   - r: The handshake request.
+//   - maxMessageSize: The size above which messages are rejected with ErrMessageTooLarge.
+//
+// Returns:
+//   - *Conn: The connection.
+//   - error: ErrNotWebSocket if the request is not a valid handshake, which has then been answered with 400.
+func Upgrade(w http.ResponseWriter, r *http.Request, maxMessageSize int64) (*Conn, error) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	decodedKey, err := base64.StdEncoding.DecodeString(key)
+	if r.Method != http.MethodGet || !IsUpgrade(r) || r.Header.Get("Sec-WebSocket-Version") != "13" || err != nil || len(decodedKey) != 16 {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, ErrNotWebSocket.Error(), http.StatusBadRequest)
+		return nil, ErrNotWebSocket
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "connection cannot be taken over", http.StatusInternalServerError)
+		return nil, errors.New("response does not support hijacking")
+	}
+
+	header := w.Header().Clone()
+	conn, buffered, err := hijacker.Hijack()
+	if err != nil {
+		return nil, err
+	}
+	accept := sha1.Sum([]byte(key + acceptGUID))
+	header.Set("Upgrade", "websocket")
+	header.Set("Connection", "Upgrade")
+	header.Set("Sec-WebSocket-Accept", base64.StdEncoding.EncodeToString(accept[:]))
+	header.Del("Content-Type")
+
+	buffered.WriteString("HTTP/1.1 101 Switching Protocols\r\n")
+	header.Write(buffered)
+	buffered.WriteString("\r\n")
+	if err := buffered.Flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &Conn{conn: conn, reader: buffered.Reader, maxMessageSize: maxMessageSize}, nil
+}
+
+// ReadMessage reads the next text or binary message, answering pings on the way.
+//
+// Returns:
+//   - []byte: The payload of the message.
+//   - error: io.EOF once the client closed the connection, ErrMessageTooLarge or ErrProtocol
+//     if the client broke the limits or the protocol; the connection is closed in every case.
+func (c *Conn) ReadMessage() ([]byte, error) {
+	var message []byte
+	fragmented := false
+	for {
+		fin, opcode, payload, err := c.readFrame()
+		if err != nil {
+			c.closeWith(err)
+			return nil, err
+		}
+
+		switch opcode {
+		case opPing:
+			if err := c.writeFrame(opPong, payload); err != nil {
+				return nil, err
+			}
+		case opPong:
+		case opClose:
+			code := CloseNormal
+			if len(payload) >= 2 {
+				code = int(binary.BigEndian.Uint16(payload))
+			}
+			c.Close(code, "")
+			return nil, io.EOF
+		case opText, opBinary, opContinuation:
+			if (opcode == opContinuation) != fragmented {
+				c.closeWith(ErrProtocol)
+				return nil, ErrProtocol
+			}
+			message = append(message, payload...)
+			if int64(len(message)) > c.maxMessageSize {
+				c.closeWith(ErrMessageTooLarge)
+				return nil, ErrMessageTooLarge
+			}
+			if fin {
+				return message, nil
+			}
+			fragmented = true
+		default:
+			c.closeWith(ErrProtocol)
+			return nil, ErrProtocol
+		}
+	}
+}
+
+// readFrame reads a single frame and unmasks its payload.
+func (c *Conn) readFrame() (bool, byte, []byte, error) {
+	var head [2]byte
+	if _, err := io.ReadFull(c.reader, head[:]); err != nil {
+		return false, 0, nil, err
+	}
+	fin, opcode, masked := head[0]&0x80 != 0, head[0]&0x0F, head[1]&0x80 != 0
+	if head[0]&0x70 != 0 || !masked {
+		// reserved bits need a negotiated extension, and clients must mask every frame
+		return false, 0, nil, ErrProtocol
+	}
+
+	length := uint64(head[1] & 0x7F)
+	switch length {
+	case 126:
+		var extended [2]byte
+		if _, err := io.ReadFull(c.reader, extended[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(extended[:]))
+	case 127:
+		var extended [8]byte
+		if _, err := io.ReadFull(c.reader, extended[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(extended[:])
+	}
+	if opcode >= opClose && (length > 125 || !fin) {
+		return false, 0, nil, ErrProtocol
+	}
+	if length > uint64(c.maxMessageSize) {
+		return false, 0, nil, ErrMessageTooLarge
+	}
+
+	var mask [4]byte
+	if _, err := io.ReadFull(c.reader, mask[:]); err != nil {
+		return false, 0, nil, err
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(c.reader, payload); err != nil {
+		return false, 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return fin, opcode, payload, nil
+}
+
+// WriteText sends a text message.
+func (c *Conn) WriteText(message []byte) error {
+	return c.writeFrame(opText, message)
+}
+
+// writeFrame sends a single unmasked frame, as servers must not mask frames.
+func (c *Conn) writeFrame(opcode byte, payload []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	header := []byte{0x80 | opcode, 0}
+	switch {
+	case len(payload) <= 125:
+		header[1] = byte(len(payload))
+	case len(payload) <= 0xFFFF:
+		header[1] = 126
+		header = append(header, 0, 0)
+		binary.BigEndian.PutUint16(header[2:], uint16(len(payload)))
+	default:
+		header[1] = 127
+		header = append(header, make([]byte, 8)...)
+		binary.BigEndian.PutUint64(header[2:], uint64(len(payload)))
+	}
+
+	c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	if _, err := c.conn.Write(append(header, payload...)); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Close sends a close frame with the status code and reason and closes the connection.
+func (c *Conn) Close(code int, reason string) error {
+	payload := make([]byte, 2, 2+len(reason))
+	binary.BigEndian.PutUint16(payload, uint16(code))
+	if len(reason) > 123 {
+		reason = reason[:123]
+	}
+	c.writeFrame(opClose, append(payload, reason...))
+	return c.conn.Close()
+}
+
+// closeWith closes the connection with the status code matching a read error.
+func (c *Conn) closeWith(err error) {
+	switch {
+	case errors.Is(err, ErrMessageTooLarge):
+		c.Close(CloseMessageTooBig, err.Error())
+	case errors.Is(err, ErrProtocol):
+		c.Close(CloseProtocolError, err.Error())
+	default:
+		c.conn.Close()
+	}
+}
+
+// SetReadDeadline sets the time after which waiting for a message fails, to drop idle clients.
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
@@ -0,0 +1,14 @@
+// Package main is the entry point for the command line interface of the Congestion Calculator Manager application.
+
+package main
+
+import (
+	"congestion-calculator-manager/app/cli"
+	"os"
+)
+
+// main is the entry point for the command line interface.
+// It invokes the Run function from the cli package with the command line arguments.
+func main() {
+	os.Exit(cli.Run(os.Args[1:], os.Stdout, os.Stderr))
+}
@@ -1,10 +1,47 @@
 package test
 
 import (
+	"bufio"
+	"bytes"
+	"congestion-calculator-manager/app/audit"
+	"congestion-calculator-manager/app/auth"
 	"congestion-calculator-manager/app/calculator"
+	"congestion-calculator-manager/app/cli"
+	"congestion-calculator-manager/app/dailytotals"
+	"congestion-calculator-manager/app/exemptions"
+	"congestion-calculator-manager/app/grpcapi"
+	"congestion-calculator-manager/app/grpcwire"
 	"congestion-calculator-manager/app/helpers"
+	"congestion-calculator-manager/app/invoicing"
+	"congestion-calculator-manager/app/jobs"
+	"congestion-calculator-manager/app/ledger"
+	"congestion-calculator-manager/app/metrics"
+	"congestion-calculator-manager/app/openapi"
+	"congestion-calculator-manager/app/plates"
+	"congestion-calculator-manager/app/queue"
+	"congestion-calculator-manager/app/queue/natstest"
+	"congestion-calculator-manager/app/ratelimit"
+	"congestion-calculator-manager/app/registry"
+	"congestion-calculator-manager/app/server"
+	"congestion-calculator-manager/app/simulation"
+	"congestion-calculator-manager/app/subscriptions"
 	taxrules "congestion-calculator-manager/app/tax_rules"
+	"congestion-calculator-manager/app/tracing"
 	"congestion-calculator-manager/app/vehicles"
+	"congestion-calculator-manager/app/webhooks"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
 
 	"time"
@@ -177,3 +214,1837 @@ func TestIsTollFreeDate(t *testing.T) {
 		}
 	}
 }
+
+func TestGetTripTax(t *testing.T) {
+	vehicle := vehicles.Car{LicensePlate: "ABC123"}
+	belgradeRule := taxrules.TaxRule{
+		HourlyPrices: []taxrules.HourlyPrice{{StartHour: 0, EndHour: 23, Rate: 10}},
+		MaxTaxedFee:  15,
+	}
+	passages := []calculator.Passage{
+		{City: "Gothenburg", Time: time.Date(2013, 2, 7, 6, 23, 27, 0, time.UTC)},
+		{City: "Belgrade", Time: time.Date(2013, 2, 7, 8, 0, 0, 0, time.UTC)},
+		{City: "Gothenburg", Time: time.Date(2013, 2, 7, 15, 27, 0, 0, time.UTC)},
+		{City: "Belgrade", Time: time.Date(2013, 2, 7, 10, 0, 0, 0, time.UTC)},
+		{City: "Belgrade", Time: time.Date(2013, 2, 7, 12, 0, 0, 0, time.UTC)},
+	}
+
+	result, err := calculator.GetTripTax(context.Background(), vehicle, passages, map[string]taxrules.TaxRule{"Belgrade": belgradeRule}, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+
+	expected := []calculator.CityFee{{City: "Belgrade", TotalFee: 15}, {City: "Gothenburg", TotalFee: 21}}
+	if len(result.Cities) != len(expected) {
+		t.Fatalf("Expected %d cities, but got %d", len(expected), len(result.Cities))
+	}
+	for i, cityFee := range expected {
+		if result.Cities[i].City != cityFee.City || result.Cities[i].TotalFee != cityFee.TotalFee {
+			t.Errorf("Expected %v, but got %v", cityFee, result.Cities[i])
+		}
+	}
+	if result.TotalFee != 36 {
+		t.Errorf("Expected total fee %d, but got %d", 36, result.TotalFee)
+	}
+
+	_, err = calculator.GetTripTax(context.Background(), vehicle, passages, nil, nil)
+	if err == nil {
+		t.Error("Expected error for city without tax rules, got nil")
+	}
+}
+
+func TestFindCityByStation(t *testing.T) {
+	withDataDir(t, "belgrade.json")
+
+	for station, expected := range map[string]string{"bg-gazela": "Belgrade", "GBG-TINGSTADSTUNNELN": taxrules.DefaultCity} {
+		if city, err := taxrules.FindCityByStation(station); err != nil || city != expected {
+			t.Errorf("Expected station %s in %s, but got %q %v", station, expected, city, err)
+		}
+	}
+	if _, err := taxrules.FindCityByStation("NOWHERE"); err == nil {
+		t.Error("Expected error for an unknown station, got nil")
+	}
+}
+
+func TestRegistry(t *testing.T) {
+	vehicleRegistry := registry.NewRegistry()
+	vehicleRegistry.Register(registry.Registration{
+		LicensePlate: "ABC 123",
+		Type:         "Bus",
+		Certificates: []registry.Certificate{{
+			Id:        "CERT-1",
+			ValidFrom: time.Date(2013, 1, 1, 0, 0, 0, 0, time.UTC),
+			ValidTo:   time.Date(2013, 6, 30, 0, 0, 0, 0, time.UTC),
+		}},
+	})
+
+	registration, exists := vehicleRegistry.Lookup("abc-123")
+	if !exists {
+		t.Fatal("Expected registered vehicle to be found, but it wasn't.")
+	}
+	if registration.Type != "Bus" {
+		t.Errorf("Expected type %s, but got %s", "Bus", registration.Type)
+	}
+
+	if _, active := registration.ActiveCertificate(time.Date(2013, 3, 1, 0, 0, 0, 0, time.UTC)); !active {
+		t.Error("Expected active certificate in March, got none")
+	}
+	if _, active := registration.ActiveCertificate(time.Date(2013, 7, 1, 0, 0, 0, 0, time.UTC)); active {
+		t.Error("Expected no active certificate in July, got one")
+	}
+
+	// calculations exempt a vehicle fully while one of its certificates is valid
+	vehicleRegistry.Register(registry.Registration{
+		LicensePlate: "CRT123",
+		Type:         "Car",
+		Certificates: []registry.Certificate{{
+			Id:        "CERT-2",
+			Reason:    "emergency service",
+			ValidFrom: time.Date(2013, 1, 1, 0, 0, 0, 0, time.UTC),
+			ValidTo:   time.Date(2013, 6, 30, 0, 0, 0, 0, time.UTC),
+		}},
+	})
+	previousRegistry := server.VehicleRegistry
+	server.VehicleRegistry = vehicleRegistry
+	defer func() { server.VehicleRegistry = previousRegistry }()
+
+	passage := calculator.Passage{City: "Gothenburg", Time: time.Date(2013, 3, 1, 7, 10, 0, 0, time.UTC)}
+	certified, err := server.ExplainPassage(context.Background(), passage, "CRT123", "")
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if certified.Exemption == nil || certified.FinalFee != 0 || !strings.Contains(certified.Exemption.Reason, "CERT-2") {
+		t.Errorf("Expected the certificate to exempt the passage, but got %d with %v", certified.FinalFee, certified.Exemption)
+	}
+	passage.Time = time.Date(2013, 9, 2, 7, 10, 0, 0, time.UTC)
+	if expired, _ := server.ExplainPassage(context.Background(), passage, "CRT123", ""); expired.Exemption != nil || expired.FinalFee != 18 {
+		t.Errorf("Expected 18 after the certificate expired, but got %d with %v", expired.FinalFee, expired.Exemption)
+	}
+}
+
+func TestGetTripTaxWithExemptions(t *testing.T) {
+	vehicle := vehicles.Car{LicensePlate: "ABC123"}
+	store := exemptions.NewStore()
+	store.Add(exemptions.Exemption{
+		LicensePlate:       "ABC123",
+		Cities:             []string{"Gothenburg"},
+		Reason:             "Disabled driver",
+		ValidFrom:          time.Date(2013, 2, 8, 0, 0, 0, 0, time.UTC),
+		ValidTo:            time.Date(2013, 2, 8, 23, 59, 59, 0, time.UTC),
+		DiscountPercentage: 50,
+	})
+	passages := []calculator.Passage{
+		{City: "Gothenburg", Time: time.Date(2013, 2, 7, 7, 0, 0, 0, time.UTC)},
+		{City: "Gothenburg", Time: time.Date(2013, 2, 8, 7, 0, 0, 0, time.UTC)},
+	}
+
+	result, err := calculator.GetTripTax(context.Background(), vehicle, passages, nil, store.ForVehicle("ABC123"))
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+
+	// 18 on the 7th without exemption, 9 on the 8th with 50% discount
+	if result.TotalFee != 27 {
+		t.Errorf("Expected total fee %d, but got %d", 27, result.TotalFee)
+	}
+	if result.Passages[0].Exemption != nil {
+		t.Error("Expected no exemption outside of the validity period, got one")
+	}
+	if result.Passages[1].Exemption == nil || result.Passages[1].Exemption.Reason != "Disabled driver" {
+		t.Error("Expected applied exemption in the breakdown, got none")
+	}
+
+	// the decisions of the calculation are logged with the fields of the request
+	var out bytes.Buffer
+	ctx := helpers.ContextWithLogger(context.Background(), helpers.NewLogger(&out, helpers.LevelDebug).With("request_id", "abc"))
+	passages = append(passages,
+		calculator.Passage{City: "Gothenburg", Time: time.Date(2013, 2, 9, 7, 0, 0, 0, time.UTC)},
+		calculator.Passage{City: "Gothenburg", Time: time.Date(2013, 2, 7, 15, 30, 0, 0, time.UTC)},
+		calculator.Passage{City: "Gothenburg", Time: time.Date(2013, 2, 7, 16, 45, 0, 0, time.UTC)},
+		calculator.Passage{City: "Gothenburg", Time: time.Date(2013, 2, 7, 17, 50, 0, 0, time.UTC)})
+	if _, err := calculator.GetTripTax(ctx, vehicle, passages, nil, store.ForVehicle("ABC123")); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	for _, expected := range []string{
+		`"msg":"passage not charged","request_id":"abc","city":"Gothenburg","time":"2013-02-09T07:00:00Z","reason":"toll-free date"`,
+		`"msg":"exemption applied","request_id":"abc","city":"Gothenburg","time":"2013-02-08T07:00:00Z","reason":"Disabled driver"`,
+		`"msg":"daily cap reached","request_id":"abc","city":"Gothenburg","date":"2013-02-07","daily_cap":60`,
+	} {
+		if !strings.Contains(out.String(), expected) {
+			t.Errorf("Expected log line containing %s, but got %s", expected, out.String())
+		}
+	}
+}
+
+func TestParsePlate(t *testing.T) {
+	testCases := []struct {
+		input   string
+		number  string
+		country string
+		series  string
+	}{
+		{"abc 123", "ABC123", plates.Sweden, plates.SeriesStandard},
+		{"ABC12A", "ABC12A", plates.Sweden, plates.SeriesStandard},
+		{"AB 123 C", "AB123C", plates.Sweden, plates.SeriesDiplomatic},
+		{"bg-123-ab", "BG123AB", plates.Serbia, plates.SeriesStandard},
+		{"CD 123-456", "CD123456", plates.Serbia, plates.SeriesDiplomatic},
+		// plates of no known format, such as personalized or foreign plates, are not taken as Swedish
+		{"HAIRY", "HAIRY", plates.CountryUnknown, plates.SeriesUnrecognized},
+		{"BAB 1234", "BAB1234", plates.CountryUnknown, plates.SeriesUnrecognized},
+		{"xyz", "XYZ", plates.CountryUnknown, plates.SeriesUnrecognized},
+		{"1A", "1A", plates.CountryUnknown, plates.SeriesUnrecognized},
+		{"QQQQQQQ", "QQQQQQQ", plates.CountryUnknown, plates.SeriesUnrecognized},
+		{"M 123 ABC", "M123ABC", plates.CountryUnknown, plates.SeriesUnrecognized},
+	}
+
+	for _, testCase := range testCases {
+		plate, err := plates.Parse(testCase.input)
+		if err != nil {
+			t.Errorf("Expected %s to be valid, got %v", testCase.input, err)
+			continue
+		}
+		if plate.Number != testCase.number || plate.Country != testCase.country || plate.Series != testCase.series {
+			t.Errorf("Expected %s %s %s for %s, but got %v", testCase.number, testCase.country, testCase.series, testCase.input, plate)
+		}
+	}
+
+	for _, invalid := range []string{"", "A", "123456", "ABCDEFGHIJ", "AB?123"} {
+		if plates.IsValid(invalid) {
+			t.Errorf("Expected %q to be invalid, got valid", invalid)
+		}
+	}
+
+	// only plates of the vehicle registry are personalized, and only if they follow the personalized rules
+	for input, personalized := range map[string]bool{"HAIRY": true, "XYZ": true, "QQQQQQQ": true, "1A": true, "BAB1234": false} {
+		plate, _ := plates.Parse(input)
+		registered := plates.Registered(plate)
+		if got := registered.Series == plates.SeriesPersonalized; got != personalized || registered.IsForeign() == personalized {
+			t.Errorf("Expected registered %s to be personalized %v, but got %v", input, personalized, registered)
+		}
+		if !plate.IsForeign() {
+			t.Errorf("Expected unregistered %s to be foreign, but got %v", input, plate)
+		}
+	}
+	if plate, _ := plates.Parse("BG123AB"); plates.Registered(plate).Country != plates.Serbia {
+		t.Error("Expected a registered plate of a known foreign format to keep its country")
+	}
+}
+
+func TestGetVehicleFromTypeRegistry(t *testing.T) {
+	vehicle, err := vehicles.GetVehicle("Motorcycle", "ABC123")
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if vehicle.GetVehicleType() != "Motorbike" || !vehicle.IsTaxExcluded() {
+		t.Errorf("Expected tax excluded Motorbike for alias Motorcycle, got %v", vehicle)
+	}
+
+	if _, err := vehicles.GetVehicle("Truck", "ABC123"); err == nil {
+		t.Error("Expected error for unregistered type Truck, got nil")
+	}
+
+	defaultTypes := vehicles.Types
+	defer func() { vehicles.Types = defaultTypes }()
+	vehicles.Types = vehicles.NewTypeRegistry(append(vehicles.DefaultTypes,
+		vehicles.TypeDefinition{Name: "Truck", Aliases: []string{"Lorry"}, Category: "heavy"}))
+
+	vehicle, err = vehicles.GetVehicle("lorry", "ABC123")
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if vehicle.GetVehicleType() != "Truck" || vehicle.IsTaxExcluded() {
+		t.Errorf("Expected taxed Truck for alias lorry, got %v", vehicle)
+	}
+}
+
+func TestLedgerDeduplicatesAndReloads(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "ledger", "passages.jsonl")
+
+	passageLedger, err := ledger.Open(path)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	entry := ledger.Entry{PassageId: "p-1", LicensePlate: "abc 123", City: "Gothenburg", Time: time.Date(2013, 2, 7, 7, 0, 0, 0, time.UTC)}
+	if accepted, err := passageLedger.Append(entry); err != nil || !accepted {
+		t.Fatalf("Expected first passage to be accepted, got %v %v", accepted, err)
+	}
+	if accepted, err := passageLedger.Append(entry); err != nil || accepted {
+		t.Fatalf("Expected retried passage to be a duplicate, got %v %v", accepted, err)
+	}
+	passageLedger.Close()
+
+	passageLedger, err = ledger.Open(path)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if accepted, _ := passageLedger.Append(entry); accepted {
+		t.Error("Expected passage to be a duplicate after reopening the ledger, got accepted")
+	}
+
+	passages := passageLedger.Passages("ABC-123", time.Date(2013, 2, 1, 0, 0, 0, 0, time.UTC), time.Date(2013, 3, 1, 0, 0, 0, 0, time.UTC))
+	if len(passages) != 1 {
+		t.Errorf("Expected %d passage in range, but got %d", 1, len(passages))
+	}
+	passages = passageLedger.Passages("ABC123", time.Date(2013, 3, 1, 0, 0, 0, 0, time.UTC), time.Time{})
+	if len(passages) != 0 {
+		t.Errorf("Expected %d passages in range, but got %d", 0, len(passages))
+	}
+	passageLedger.Close()
+
+	// a crash while appending leaves a partial last line, which is dropped on the next open
+	file, _ := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	file.Write([]byte(`{"passage_id":"p-2","licen`))
+	file.Close()
+	passageLedger, err = ledger.Open(path)
+	if err != nil {
+		t.Fatalf("Expected the partial entry to be dropped, but got %v", err)
+	}
+	second := entry
+	second.PassageId = "p-2"
+	if accepted, err := passageLedger.Append(second); err != nil || !accepted {
+		t.Errorf("Expected the passage of the partial entry to be accepted, got %v %v", accepted, err)
+	}
+	passageLedger.Close()
+	passageLedger, err = ledger.Open(path)
+	if err != nil || len(passageLedger.Passages("ABC123", time.Time{}, time.Time{})) != 2 {
+		t.Fatalf("Expected 2 passages after reopening, but got %v", err)
+	}
+	passageLedger.Close()
+
+	// the type of the latest passage wins, whatever the order of the entries
+	mixed := []ledger.Entry{
+		{LicensePlate: "ABC123", VehicleType: "Motorbike", City: "Gothenburg", Time: time.Date(2013, 2, 8, 7, 0, 0, 0, time.UTC)},
+		{LicensePlate: "ABC123", VehicleType: "Car", City: "Gothenburg", Time: time.Date(2013, 2, 7, 7, 0, 0, 0, time.UTC)},
+		{LicensePlate: "ABC123", City: "Gothenburg", Time: time.Date(2013, 2, 9, 7, 0, 0, 0, time.UTC)},
+	}
+	grouped := ledger.GroupByPlate("Gothenburg", time.Time{}, time.Time{}, mixed)
+	if ledger.VehicleType(mixed) != "Motorbike" || len(grouped) != 1 || grouped[0].VehicleType != "Motorbike" {
+		t.Errorf("Expected the type of the latest passage stating one, but got %s and %+v", ledger.VehicleType(mixed), grouped)
+	}
+
+	// corruption before the last line is not repaired
+	content, _ := ioutil.ReadFile(path)
+	ioutil.WriteFile(path, append([]byte("not json\n"), content...), 0644)
+	if corrupt, err := ledger.Open(path); err == nil {
+		corrupt.Close()
+		t.Error("Expected a corrupt entry before the last line to fail, got nil")
+	}
+}
+
+func TestGenerateInvoices(t *testing.T) {
+	period, err := invoicing.ParsePeriod("2013-02")
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	entries := []ledger.Entry{
+		{PassageId: "1", LicensePlate: "ABC123", City: "Gothenburg", Time: time.Date(2013, 2, 7, 7, 0, 0, 0, time.UTC)},
+		{PassageId: "2", LicensePlate: "ABC123", City: "Gothenburg", Time: time.Date(2013, 2, 7, 7, 30, 0, 0, time.UTC)},
+		{PassageId: "3", LicensePlate: "ABC123", City: "Gothenburg", Time: time.Date(2013, 2, 8, 15, 10, 0, 0, time.UTC)},
+		{PassageId: "4", LicensePlate: "ABC123", City: "Gothenburg", Time: time.Date(2013, 3, 1, 7, 0, 0, 0, time.UTC)},
+		{PassageId: "5", LicensePlate: "XYZ789", City: "Gothenburg", Time: time.Date(2013, 2, 9, 7, 0, 0, 0, time.UTC)},
+		{PassageId: "6", LicensePlate: "UNTYPED", City: "Gothenburg", Time: time.Date(2013, 2, 7, 7, 0, 0, 0, time.UTC)},
+	}
+	calculate := func(licensePlate string, vehicleType string, passages []calculator.Passage) (calculator.TripResult, error) {
+		if licensePlate == "UNTYPED" {
+			_, err := vehicles.GetVehicle(vehicleType, licensePlate)
+			return calculator.TripResult{}, &invoicing.VehicleError{Err: err}
+		}
+		return calculator.GetTripTax(context.Background(), vehicles.Car{LicensePlate: licensePlate}, passages, nil, nil)
+	}
+
+	invoices, skipped, err := invoicing.Generate("Gothenburg", period, entries, calculate)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+
+	// the vehicle without a type is reported instead of failing the invoices of the city
+	if len(skipped) != 1 || skipped[0].LicensePlate != "UNTYPED" || skipped[0].Passages != 1 || skipped[0].Reason == "" {
+		t.Errorf("Expected UNTYPED to be skipped with a reason, but got %v", skipped)
+	}
+
+	// XYZ789 only passed on a Saturday and is not invoiced
+	if len(invoices) != 1 {
+		t.Fatalf("Expected %d invoice, but got %d", 1, len(invoices))
+	}
+	invoice := invoices[0]
+	if len(invoice.Lines) != 2 || invoice.Total != 31 {
+		t.Errorf("Expected 2 lines totalling 31, but got %d lines totalling %d", len(invoice.Lines), invoice.Total)
+	}
+
+	var csv bytes.Buffer
+	if err := invoicing.RenderCSV(&csv, invoices); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if rows := strings.Count(csv.String(), "\n"); rows != 3 {
+		t.Errorf("Expected header and 2 rows in CSV, but got %d rows", rows)
+	}
+
+	failing := func(licensePlate string, vehicleType string, passages []calculator.Passage) (calculator.TripResult, error) {
+		return calculator.TripResult{}, errors.New("audit log is not available")
+	}
+	if _, _, err := invoicing.Generate("Gothenburg", period, entries, failing); err == nil {
+		t.Error("Expected error for a calculation failing every vehicle, got nil")
+	}
+}
+
+func TestRecalculateIssuedInvoices(t *testing.T) {
+	dir := t.TempDir()
+	store, err := invoicing.OpenStore(dir)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	defer store.Close()
+
+	period, _ := invoicing.ParsePeriod("2013-11")
+	entries := []ledger.Entry{
+		{PassageId: "1", LicensePlate: "ABC123", City: "Belgrade", Time: time.Date(2013, 11, 7, 11, 0, 0, 0, time.UTC)},
+	}
+	calculateWithRate := func(rate int) invoicing.Calculate {
+		rule := taxrules.TaxRule{HourlyPrices: []taxrules.HourlyPrice{{StartHour: 0, EndHour: 23, Rate: rate}}}
+		return func(licensePlate string, vehicleType string, passages []calculator.Passage) (calculator.TripResult, error) {
+			return calculator.GetTripTax(context.Background(), vehicles.Car{LicensePlate: licensePlate}, passages, map[string]taxrules.TaxRule{"Belgrade": rule}, nil)
+		}
+	}
+
+	invoices, _, err := invoicing.Generate("Belgrade", period, entries, calculateWithRate(10))
+	if err != nil || len(invoices) != 1 {
+		t.Fatalf("Expected 1 invoice, got %v %v", invoices, err)
+	}
+	invoice, _, err := store.Issue(invoices[0], time.Now())
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+
+	testCases := []struct {
+		rate   int
+		kind   string
+		amount int
+	}{
+		{rate: 20, kind: invoicing.KindDebit, amount: 10},
+		{rate: 5, kind: invoicing.KindCredit, amount: 15},
+	}
+	for _, testCase := range testCases {
+		adjustments, _, err := invoicing.Recalculate("Belgrade", period, entries, calculateWithRate(testCase.rate), store, "corrected tariff")
+		if err != nil || len(adjustments) != 1 {
+			t.Fatalf("Expected 1 adjustment, got %v %v", adjustments, err)
+		}
+		adjustment, err := store.Record(adjustments[0], time.Now())
+		if err != nil {
+			t.Fatalf("Unexpected error %v", err)
+		}
+		if adjustment.Kind != testCase.kind || adjustment.Amount != testCase.amount {
+			t.Errorf("Expected %s of %d, but got %s of %d", testCase.kind, testCase.amount, adjustment.Kind, adjustment.Amount)
+		}
+		if adjustment.InvoiceNumber != invoice.Number || adjustment.PreviousRuleVersion == adjustment.RuleVersion {
+			t.Errorf("Expected adjustment of %s between rule versions, got %v", invoice.Number, adjustment)
+		}
+	}
+
+	adjustments, _, _ := invoicing.Recalculate("Belgrade", period, entries, calculateWithRate(5), store, "no change")
+	if len(adjustments) != 0 {
+		t.Errorf("Expected no adjustment without a rule change, but got %d", len(adjustments))
+	}
+
+	// a vehicle that passed in the period but was never invoiced gets no adjustment without an invoice number
+	uninvoiced := append(entries, ledger.Entry{PassageId: "2", LicensePlate: "NEW123", City: "Belgrade", Time: time.Date(2013, 11, 8, 11, 0, 0, 0, time.UTC)})
+	adjustments, _, err = invoicing.Recalculate("Belgrade", period, uninvoiced, calculateWithRate(20), store, "corrected tariff")
+	if err != nil || len(adjustments) != 1 || adjustments[0].LicensePlate != "ABC123" || adjustments[0].InvoiceNumber != invoice.Number {
+		t.Errorf("Expected only the adjustment of %s, got %v %v", invoice.Number, adjustments, err)
+	}
+
+	// a charge moved to another day nets to zero, but its days are still adjusted
+	moved := func(licensePlate string, vehicleType string, passages []calculator.Passage) (calculator.TripResult, error) {
+		return calculator.TripResult{
+			TotalFee: 5,
+			Cities:   []calculator.CityFee{{City: "Belgrade", RuleVersion: "moved", TotalFee: 5}},
+			Days:     []calculator.DayFee{{City: "Belgrade", Date: "2013-11-08", Passages: 1, TotalFee: 5}},
+		}, nil
+	}
+	adjustments, _, err = invoicing.Recalculate("Belgrade", period, entries, moved, store, "passage moved")
+	if err != nil || len(adjustments) != 1 || len(adjustments[0].Lines) != 2 || adjustments[0].Amount != 0 {
+		t.Errorf("Expected an adjustment of 0 moving the charge between two days, got %+v %v", adjustments, err)
+	}
+
+	// a vehicle that cannot be calculated is reported instead of failing the recalculation
+	unclassified := func(licensePlate string, vehicleType string, passages []calculator.Passage) (calculator.TripResult, error) {
+		return calculator.TripResult{}, &invoicing.VehicleError{Err: errors.New("error in vehicle information")}
+	}
+	adjustments, skipped, err := invoicing.Recalculate("Belgrade", period, entries, unclassified, store, "corrected tariff")
+	if err != nil || len(adjustments) != 0 || len(skipped) != 1 || skipped[0].LicensePlate != "ABC123" {
+		t.Errorf("Expected ABC123 to be skipped, got %v %v %v", adjustments, skipped, err)
+	}
+}
+
+func TestSimulateDraftRules(t *testing.T) {
+	current := taxrules.TaxRule{HourlyPrices: []taxrules.HourlyPrice{
+		{StartHour: 6, EndHour: 9, Rate: 10},
+		{StartHour: 15, EndHour: 18, Rate: 10},
+	}}
+	draft := taxrules.TaxRule{HourlyPrices: []taxrules.HourlyPrice{
+		{StartHour: 6, EndHour: 9, Rate: 15},
+		{StartHour: 15, EndHour: 18, Rate: 10},
+	}}
+	entries := []ledger.Entry{
+		{LicensePlate: "ABC123", VehicleType: "Car", City: "Belgrade", Time: time.Date(2013, 11, 7, 7, 0, 0, 0, time.UTC)},
+		{LicensePlate: "ABC123", VehicleType: "Car", City: "Belgrade", Time: time.Date(2013, 11, 7, 16, 0, 0, 0, time.UTC)},
+		{LicensePlate: "XYZ789", VehicleType: "Car", City: "Belgrade", Time: time.Date(2013, 11, 8, 16, 0, 0, 0, time.UTC)},
+		{LicensePlate: "BUS001", VehicleType: "Bus", City: "Belgrade", Time: time.Date(2013, 11, 8, 7, 0, 0, 0, time.UTC)},
+	}
+	resolve := func(licensePlate string, vehicleType string) (vehicles.Vehicle, exemptions.Lookup, error) {
+		vehicle, err := vehicles.GetVehicle(vehicleType, licensePlate)
+		return vehicle, nil, err
+	}
+
+	report, err := simulation.Run(context.Background(), "Belgrade", current, draft, entries, 0, resolve)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+
+	if report.Total.Vehicles != 3 || report.Total.AffectedVehicles != 1 || report.Total.Difference != 5 {
+		t.Errorf("Expected 1 of 3 vehicles affected by +5, but got %v", report.Total)
+	}
+	if len(report.Bands) != 2 || report.Bands[0].Key != "06:00-09:59" || report.Bands[0].Difference != 5 || report.Bands[1].Difference != 0 {
+		t.Errorf("Expected +5 in the morning band only, but got %v", report.Bands)
+	}
+	if len(report.Days) != 2 || report.Days[0].Difference != 5 || report.Days[1].Difference != 0 {
+		t.Errorf("Expected +5 on the first day only, but got %v", report.Days)
+	}
+	if len(report.VehicleTypes) != 2 || report.VehicleTypes[0].Key != "Bus" || report.VehicleTypes[0].Difference != 0 {
+		t.Errorf("Expected no difference for tax excluded buses, but got %v", report.VehicleTypes)
+	}
+
+	if _, err := simulation.Run(context.Background(), "Gothenburg", current, draft, entries, 0, resolve); err == nil {
+		t.Error("Expected error for the built-in rules, got nil")
+	}
+}
+
+func TestExplainPassage(t *testing.T) {
+	car, _ := vehicles.GetVehicle("Car", "ABC123")
+	passageTime := time.Date(2013, 2, 8, 15, 29, 0, 0, time.UTC)
+
+	explanation, err := calculator.ExplainPassage(car, "Gothenburg", passageTime, nil, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if explanation.Band == nil || explanation.Band.Start != "15:00" || explanation.Band.End != "15:29" || explanation.Fee != 13 {
+		t.Errorf("Expected 13 from the 15:00-15:29 band, but got %d from %v", explanation.Fee, explanation.Band)
+	}
+	if explanation.RuleVersion != taxrules.DefaultRuleVersion {
+		t.Errorf("Expected rule version %s, but got %s", taxrules.DefaultRuleVersion, explanation.RuleVersion)
+	}
+	if !strings.Contains(explanation.Text(), "13 SEK") {
+		t.Errorf("Expected text to state the fee, but got %s", explanation.Text())
+	}
+
+	halfOff := func(city string, t time.Time) (exemptions.Exemption, bool) {
+		return exemptions.Exemption{Reason: "test", DiscountPercentage: 50}, true
+	}
+	exempted, _ := calculator.ExplainPassage(car, "Gothenburg", passageTime, nil, halfOff)
+	if exempted.Exemption == nil || exempted.FinalFee != 6 {
+		t.Errorf("Expected exemption to reduce the fee to 6, but got %d", exempted.FinalFee)
+	}
+
+	saturday, _ := calculator.ExplainPassage(car, "Gothenburg", time.Date(2013, 2, 9, 15, 29, 0, 0, time.UTC), nil, nil)
+	if saturday.Fee != 0 || !saturday.Checks[0].Applies {
+		t.Errorf("Expected weekend check to apply with fee 0, but got %v", saturday)
+	}
+
+	if _, err := calculator.ExplainPassage(car, "Belgrade", passageTime, nil, nil); err == nil {
+		t.Error("Expected error for a city without tax rules, got nil")
+	}
+
+	// explaining a passage only reads the data store, it must not create the stores of the server
+	dir := withDataDir(t)
+	var stdout, stderr bytes.Buffer
+	if code := cli.Run([]string{"explain", "-city", "Gothenburg", "-type", "Car", "-plate", "ABC123", "-time", passageTime.Format(time.RFC3339)}, &stdout, &stderr); code != 0 {
+		t.Fatalf("Expected explain to succeed, but got %d: %s", code, stderr.String())
+	}
+	if !strings.Contains(stdout.String(), "13 SEK") {
+		t.Errorf("Expected explain to state the fee, but got %s", stdout.String())
+	}
+	if entries, _ := ioutil.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("Expected explain to leave the data store untouched, but found %d entries", len(entries))
+	}
+}
+
+func TestLoggerWritesLeveledJSONLines(t *testing.T) {
+	var out bytes.Buffer
+	logger := helpers.NewLogger(&out, helpers.LevelInfo).With("request_id", "abc")
+
+	logger.Debug("hidden")
+	logger.Warn("city data is not valid JSON", "city", "Belgrade", "error", os.ErrNotExist)
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("Expected 1 line above the debug level, but got %d: %s", len(lines), out.String())
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[0]), &fields); err != nil {
+		t.Fatalf("Expected a JSON line, but got %s: %v", lines[0], err)
+	}
+	if fields["level"] != "warn" || fields["request_id"] != "abc" || fields["city"] != "Belgrade" || fields["error"] != os.ErrNotExist.Error() {
+		t.Errorf("Unexpected fields %v", fields)
+	}
+
+	if _, err := helpers.ParseLevel("verbose"); err == nil {
+		t.Error("Expected error for an unknown level, got nil")
+	}
+}
+
+func TestMetricsTextExposition(t *testing.T) {
+	registry := metrics.NewRegistry()
+	requests := registry.NewCounterVec("requests_total", "Requests.", "route")
+	durations := registry.NewHistogramVec("duration_seconds", "Durations.", []float64{0.1, 1}, "route")
+	registry.NewGaugeFunc("queue_depth", "Queue depth.", func() float64 { return 3 })
+
+	requests.Inc("/Trip")
+	requests.Add(2, `/odd"route`)
+	durations.Observe(0.05, "/Trip")
+	durations.Observe(0.5, "/Trip")
+	durations.Observe(5, "/Trip")
+
+	var out bytes.Buffer
+	if err := registry.WriteText(&out); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	for _, expected := range []string{
+		"# TYPE requests_total counter\n",
+		"requests_total{route=\"/Trip\"} 1\n",
+		"requests_total{route=\"/odd\\\"route\"} 2\n",
+		"duration_seconds_bucket{route=\"/Trip\",le=\"0.1\"} 1\n",
+		"duration_seconds_bucket{route=\"/Trip\",le=\"1\"} 2\n",
+		"duration_seconds_bucket{route=\"/Trip\",le=\"+Inf\"} 3\n",
+		"duration_seconds_count{route=\"/Trip\"} 3\n",
+		"queue_depth 3\n",
+	} {
+		if !strings.Contains(out.String(), expected) {
+			t.Errorf("Expected %q in\n%s", expected, out.String())
+		}
+	}
+
+	// made-up methods are counted together instead of creating a series each
+	handler := server.Handler()
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("BREW", "/metrics", nil))
+	response := httptest.NewRecorder()
+	handler.ServeHTTP(response, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if strings.Contains(response.Body.String(), `method="BREW"`) || !strings.Contains(response.Body.String(), `method="OTHER"`) {
+		t.Errorf("Expected the BREW request to be counted as OTHER, but got\n%s", response.Body.String())
+	}
+}
+
+func TestCacheStats(t *testing.T) {
+	cache := helpers.NewCache()
+	cache.Set("belgrade", "{}")
+	cache.Get("belgrade")
+	cache.Get("gothenburg")
+	cache.Delete("belgrade")
+
+	stats := cache.Stats()
+	if stats.Hits != 1 || stats.Misses != 1 || stats.Entries != 0 {
+		t.Errorf("Expected 1 hit, 1 miss and no entries, but got %v", stats)
+	}
+}
+
+func TestReadinessRequiresAValidCity(t *testing.T) {
+	dir := withDataDir(t)
+
+	checks := func() map[string]bool {
+		result := map[string]bool{}
+		for _, check := range server.CheckReadiness().Checks {
+			result[check.Name] = check.Ok
+		}
+		return result
+	}
+
+	if checks()["rules store"] {
+		t.Error("Expected the rules store check to fail without a cities folder")
+	}
+
+	os.MkdirAll(filepath.Join(dir, "cities"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "cities", "broken.json"), []byte("{"), 0644)
+	if result := checks(); !result["rules store"] || result["valid city"] {
+		t.Errorf("Expected a reachable store without valid cities, but got %v", result)
+	}
+
+	ioutil.WriteFile(filepath.Join(dir, "cities", "belgrade.json"), []byte(`{"city_name":"Belgrade","tax_rules":{"hourly_prices":[{"start_hour":6,"end_hour":9,"rate":10}]}}`), 0644)
+	if result := checks(); !result["valid city"] {
+		t.Errorf("Expected a valid city, but got %v", result)
+	}
+}
+
+// recordingExporter keeps exported spans in memory.
+type recordingExporter struct {
+	spans []tracing.SpanData
+}
+
+func (e *recordingExporter) ExportSpan(span tracing.SpanData) error {
+	e.spans = append(e.spans, span)
+	return nil
+}
+
+func TestTraceParentPropagation(t *testing.T) {
+	parent, err := tracing.ParseTraceParent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	for _, invalid := range []string{"", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7", "00-00000000000000000000000000000000-00f067aa0ba902b7-01", "00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01"} {
+		if _, err := tracing.ParseTraceParent(invalid); err == nil {
+			t.Errorf("Expected error for %q, got nil", invalid)
+		}
+	}
+
+	exporter := &recordingExporter{}
+	tracer := tracing.NewTracer(exporter)
+	ctx, root := tracer.Start(tracing.ContextWithRemoteParent(context.Background(), parent), "HTTP POST /Trip")
+	_, child := tracer.Start(ctx, "rule lookup")
+	child.End()
+	root.End()
+
+	if len(exporter.spans) != 2 {
+		t.Fatalf("Expected 2 exported spans, but got %d", len(exporter.spans))
+	}
+	if exporter.spans[0].Context.TraceID != parent.TraceID || exporter.spans[0].ParentSpanID != root.SpanContext().SpanID {
+		t.Errorf("Expected child of %v in trace %v, but got %v", root.SpanContext().SpanID, parent.TraceID, exporter.spans[0])
+	}
+	if exporter.spans[1].ParentSpanID != parent.SpanID {
+		t.Errorf("Expected root span to continue the remote parent, but got %v", exporter.spans[1].ParentSpanID)
+	}
+	if traceParent := root.SpanContext().TraceParent(); !strings.HasPrefix(traceParent, "00-4bf92f3577b34da6a3ce929d0e0e4736-") || !strings.HasSuffix(traceParent, "-01") {
+		t.Errorf("Unexpected traceparent %s", traceParent)
+	}
+
+	unsampled, _ := tracing.ParseTraceParent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+	_, span := tracer.Start(tracing.ContextWithRemoteParent(context.Background(), unsampled), "not sampled")
+	span.End()
+	if len(exporter.spans) != 2 {
+		t.Error("Expected spans of unsampled traces not to be exported")
+	}
+}
+
+func TestOTLPFileExporter(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "spans.jsonl")
+
+	exporter, err := tracing.OpenOTLPFileExporter(path)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	_, span := tracing.NewTracer(exporter).Start(context.Background(), "calculator.GetTripTax")
+	span.SetAttribute("total_fee", 13)
+	span.RecordError(errors.New("failed"))
+	span.End()
+	exporter.Close()
+
+	content, _ := ioutil.ReadFile(path)
+	var request struct {
+		ResourceSpans []struct {
+			ScopeSpans []struct {
+				Spans []struct {
+					TraceID    string `json:"traceId"`
+					Name       string `json:"name"`
+					Attributes []struct {
+						Key   string            `json:"key"`
+						Value map[string]string `json:"value"`
+					} `json:"attributes"`
+					Status struct {
+						Code int `json:"code"`
+					} `json:"status"`
+				} `json:"spans"`
+			} `json:"scopeSpans"`
+		} `json:"resourceSpans"`
+	}
+	if err := json.Unmarshal(content, &request); err != nil {
+		t.Fatalf("Expected an OTLP/JSON line, but got %s: %v", content, err)
+	}
+	exported := request.ResourceSpans[0].ScopeSpans[0].Spans[0]
+	if exported.Name != "calculator.GetTripTax" || len(exported.TraceID) != 32 || exported.Status.Code != 2 {
+		t.Errorf("Unexpected span %+v", exported)
+	}
+	if len(exported.Attributes) != 1 || exported.Attributes[0].Value["intValue"] != "13" {
+		t.Errorf("Expected integer attribute, but got %+v", exported.Attributes)
+	}
+}
+
+func TestAuthenticateAPIKeysAndTokens(t *testing.T) {
+	secret := []byte("test-secret")
+	authenticator := auth.NewAuthenticator([]auth.APIKey{
+		{Name: "call-centre", KeySHA256: auth.HashKey("key-1"), Roles: []string{auth.RoleCalculator}},
+	}, secret)
+
+	request := func(header string, value string) *http.Request {
+		r, _ := http.NewRequest(http.MethodGet, "/Trip", nil)
+		if header != "" {
+			r.Header.Set(header, value)
+		}
+		return r
+	}
+
+	principal, err := authenticator.Authenticate(request(auth.APIKeyHeader, "key-1"))
+	if err != nil || principal.Subject != "call-centre" || !principal.HasRole(auth.RoleCalculator) || principal.HasRole(auth.RoleAdmin) {
+		t.Errorf("Expected the call-centre calculator, but got %v, %v", principal, err)
+	}
+	if _, err := authenticator.Authenticate(request(auth.APIKeyHeader, "key-2")); err != auth.ErrInvalidAPIKey {
+		t.Errorf("Expected %v, but got %v", auth.ErrInvalidAPIKey, err)
+	}
+	if _, err := authenticator.Authenticate(request("", "")); err != auth.ErrNoCredentials {
+		t.Errorf("Expected %v, but got %v", auth.ErrNoCredentials, err)
+	}
+
+	token, _ := auth.SignToken(secret, auth.Claims{Subject: "editor", Roles: []string{auth.CityEditorRole("Belgrade")}, ExpiresAt: time.Now().Add(time.Hour).Unix()})
+	principal, err = authenticator.Authenticate(request("Authorization", "Bearer "+token))
+	if err != nil || !principal.CanEditCity("belgrade") || principal.CanEditCity("Gothenburg") || principal.HasRole(auth.RoleCalculator) {
+		t.Errorf("Expected an editor of Belgrade only, but got %v, %v", principal, err)
+	}
+
+	expired, _ := auth.SignToken(secret, auth.Claims{Subject: "editor", ExpiresAt: time.Now().Add(-time.Minute).Unix()})
+	if _, err := authenticator.VerifyToken(expired, time.Now()); err != auth.ErrExpiredToken {
+		t.Errorf("Expected %v, but got %v", auth.ErrExpiredToken, err)
+	}
+	forged, _ := auth.SignToken([]byte("other-secret"), auth.Claims{Subject: "admin", Roles: []string{auth.RoleAdmin}, ExpiresAt: time.Now().Add(time.Hour).Unix()})
+	if _, err := authenticator.VerifyToken(forged, time.Now()); err != auth.ErrInvalidToken {
+		t.Errorf("Expected %v for a token signed with another secret, but got %v", auth.ErrInvalidToken, err)
+	}
+	parts := strings.Split(token, ".")
+	unsigned := "eyJhbGciOiJub25lIn0." + parts[1] + "."
+	if _, err := authenticator.VerifyToken(unsigned, time.Now()); err != auth.ErrInvalidToken {
+		t.Errorf("Expected %v for an unsigned token, but got %v", auth.ErrInvalidToken, err)
+	}
+
+	admin := auth.Principal{Subject: "root", Roles: []string{auth.RoleAdmin}}
+	if !admin.CanEditCity("Gothenburg") || !admin.HasRole(auth.RoleCalculator) {
+		t.Error("Expected admins to have every role")
+	}
+}
+
+func TestValidateTaxRules(t *testing.T) {
+	valid := taxrules.TaxRule{HourlyPrices: []taxrules.HourlyPrice{{StartHour: 6, EndHour: 9, Rate: 10}, {StartHour: 15, EndHour: 18, Rate: 12}}}
+	if err := valid.Validate(); err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+
+	invalid := []taxrules.TaxRule{
+		{},
+		{HourlyPrices: []taxrules.HourlyPrice{{StartHour: 6, EndHour: 24, Rate: 10}}},
+		{HourlyPrices: []taxrules.HourlyPrice{{StartHour: 6, EndHour: 9, Rate: 10}, {StartHour: 9, EndHour: 10, Rate: 10}}},
+		{HourlyPrices: []taxrules.HourlyPrice{{StartHour: 6, EndHour: 9, Rate: -1}}},
+		{HourlyPrices: []taxrules.HourlyPrice{{StartHour: 6, EndHour: 9, Rate: 10}}, ExcludedMonths: []int{13}},
+	}
+	for i, taxRule := range invalid {
+		if err := taxRule.Validate(); err == nil {
+			t.Errorf("Expected error for rules %d, got nil", i)
+		}
+	}
+}
+
+func TestTokenBucketLimiter(t *testing.T) {
+	limiter := ratelimit.NewLimiter(2, 3)
+	now := time.Date(2013, 2, 8, 12, 0, 0, 0, time.UTC)
+
+	for i := 0; i < 3; i++ {
+		if allowed, _ := limiter.Allow("key-1", now); !allowed {
+			t.Fatalf("Expected request %d of the burst to be allowed", i+1)
+		}
+	}
+	allowed, retryAfter := limiter.Allow("key-1", now)
+	if allowed || retryAfter != 500*time.Millisecond {
+		t.Errorf("Expected rejection with retry after 500ms, but got %v, %v", allowed, retryAfter)
+	}
+	if allowed, _ := limiter.Allow("key-2", now); !allowed {
+		t.Error("Expected other callers to have their own bucket")
+	}
+	if allowed, _ := limiter.Allow("key-1", now.Add(500*time.Millisecond)); !allowed {
+		t.Error("Expected a token to be refilled after 500ms")
+	}
+
+	unlimited := ratelimit.NewLimiter(0, 0)
+	for i := 0; i < 100; i++ {
+		if allowed, _ := unlimited.Allow("key-1", now); !allowed {
+			t.Fatal("Expected a rate of 0 to disable limiting")
+		}
+	}
+}
+
+func TestSetLimitsWhileServing(t *testing.T) {
+	defer server.SetLimits(server.DefaultLimits)
+	handler := server.Handler()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			limits := server.DefaultLimits
+			limits.MaxBodyBytes = int64(1000 + i)
+			server.SetLimits(limits)
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/Trip", strings.NewReader("{}")))
+	}
+	<-done
+	if limits := server.ServerLimits(); limits.MaxBodyBytes != 1099 {
+		t.Errorf("Expected the last limits to be in effect, but got %+v", limits)
+	}
+}
+
+func TestHandlerResponsesMatchOpenAPIDocument(t *testing.T) {
+	withDataDir(t, "belgrade.json")
+	useAPIKeys(t, []auth.APIKey{
+		{Name: "contract-test", KeySHA256: auth.HashKey("contract-key"), Roles: []string{auth.RoleAdmin}},
+	})
+
+	document := server.OpenAPIDocument()
+	handler := server.Handler()
+	call := func(method string, target string, body string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(method, target, strings.NewReader(body))
+		request.Header.Set(auth.APIKeyHeader, "contract-key")
+		response := httptest.NewRecorder()
+		handler.ServeHTTP(response, request)
+		return response
+	}
+
+	tests := []struct {
+		method string
+		path   string
+		query  string
+		body   string
+	}{
+		{http.MethodPost, "/Trip", "", `{"type":"Car","licenseplate":"ABC123","passages":[
+			{"city":"Gothenburg","time":"2013-02-08T06:20:27Z"},
+			{"city":"Belgrade","time":"2013-02-08T08:30:00Z"}]}`},
+		{http.MethodGet, "/Explain", "?city=Belgrade&plate=ABC123&type=Car&time=2013-02-08T08:30:00Z", ""},
+		{http.MethodGet, "/Rules", "?city=belgrade", ""},
+		{http.MethodGet, "/readyz", "", ""},
+		{http.MethodGet, "/version", "", ""},
+		{http.MethodGet, "/openapi.json", "", ""},
+	}
+	for _, test := range tests {
+		response := call(test.method, test.path+test.query, test.body)
+		if response.Code != http.StatusOK {
+			t.Errorf("%s %s: expected 200, but got %d: %s", test.method, test.path, response.Code, response.Body.String())
+			continue
+		}
+		schema, documented := document.ResponseSchema(test.path, test.method)
+		if !documented {
+			t.Errorf("%s %s: no JSON response documented", test.method, test.path)
+			continue
+		}
+		var body interface{}
+		if err := json.Unmarshal(response.Body.Bytes(), &body); err != nil {
+			t.Errorf("%s %s: response is not JSON: %v", test.method, test.path, err)
+			continue
+		}
+		if err := openapi.Validate(body, schema, document.Components.Schemas); err != nil {
+			t.Errorf("%s %s: response does not match the document: %v", test.method, test.path, err)
+		}
+	}
+
+	response := call(http.MethodPost, "/Gothenburg", `{"type":"Car","licenseplate":"ABC123","dates":["2013-02-08T06:20:27Z"]}`)
+	if response.Code != http.StatusOK || !strings.HasPrefix(response.Header().Get("Content-Type"), "text/plain") {
+		t.Errorf("Expected a text/plain response from /Gothenburg, but got %d %s", response.Code, response.Header().Get("Content-Type"))
+	}
+	if _, documented := document.Paths["/Gothenburg"]["post"]; !documented {
+		t.Error("Expected POST /Gothenburg to be documented")
+	}
+}
+
+func TestSingleCityEndpointsCapAllDates(t *testing.T) {
+	dir := withDataDir(t)
+	os.MkdirAll(filepath.Join(dir, "cities"), 0755)
+	// 15 at every passage, three passages a day on four weekdays, capped at 20 a day
+	cityData := `{"city_name":"Testville","vehicle":{"license_plate":"ABC123","type":"Car","times":[` +
+		`"2013-11-04T08:00:00Z","2013-11-04T10:00:00Z","2013-11-04T12:00:00Z",` +
+		`"2013-11-05T08:00:00Z","2013-11-05T10:00:00Z","2013-11-05T12:00:00Z",` +
+		`"2013-11-06T08:00:00Z","2013-11-06T10:00:00Z","2013-11-06T12:00:00Z",` +
+		`"2013-11-07T08:00:00Z","2013-11-07T10:00:00Z","2013-11-07T12:00:00Z"]},` +
+		`"tax_rules":{"hourly_prices":[{"start_hour":0,"end_hour":23,"rate":15}],"tax_on_weekend":false,` +
+		`"excluded_months":[],"max_taxed_fee":20,"excluded_dates":[],"excluded_days":[],"default_hourly_price":0}}`
+	ioutil.WriteFile(filepath.Join(dir, "cities", "testville.json"), []byte(cityData), 0644)
+	useAPIKeys(t, []auth.APIKey{
+		{Name: "calculator", KeySHA256: auth.HashKey("calculator-key"), Roles: []string{auth.RoleCalculator}},
+	})
+
+	handler := server.Handler()
+	call := func(method string, target string, body string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(method, target, strings.NewReader(body))
+		request.Header.Set(auth.APIKeyHeader, "calculator-key")
+		response := httptest.NewRecorder()
+		handler.ServeHTTP(response, request)
+		return response
+	}
+
+	// the dates of all days are capped at 60 together, regardless of the custom max_taxed_fee
+	response := call(http.MethodGet, "/City?name=testville", "")
+	if response.Code != http.StatusOK || !strings.Contains(response.Body.String(), "TotalFee:60") {
+		t.Errorf("Expected 60 for all dates, but got %d %s", response.Code, response.Body.String())
+	}
+
+	// 70 a day on three weekdays, capped at 60 for all of them
+	var dates []string
+	for _, day := range []string{"2013-02-05", "2013-02-06", "2013-02-07"} {
+		for _, clock := range []string{"06:00", "07:05", "08:10", "15:00", "16:05"} {
+			dates = append(dates, fmt.Sprintf("%q", day+"T"+clock+":00Z"))
+		}
+	}
+	response = call(http.MethodPost, "/Gothenburg", `{"type":"Car","licenseplate":"ABC123","dates":[`+strings.Join(dates, ",")+`]}`)
+	if response.Code != http.StatusOK || !strings.Contains(response.Body.String(), "TotalFee:60") {
+		t.Errorf("Expected 60 for all dates, but got %d %s", response.Code, response.Body.String())
+	}
+
+	// toll-free vehicle types are charged in custom cities by the single-city endpoints, but not on trips
+	motorbike, _ := vehicles.GetVehicle("Motorbike", "MC123")
+	taxRule := taxrules.TaxRule{HourlyPrices: []taxrules.HourlyPrice{{StartHour: 0, EndHour: 23, Rate: 15}}}
+	passageTimes := []time.Time{time.Date(2013, 11, 4, 8, 0, 0, 0, time.UTC)}
+	if result := calculator.GetDatesTax(context.Background(), motorbike, "Testville", passageTimes, taxRule, nil); result.TotalFee != 15 {
+		t.Errorf("Expected the motorbike to be charged 15 in Testville, but got %+v", result)
+	}
+	trip, err := calculator.GetTripTax(context.Background(), motorbike, []calculator.Passage{{City: "Testville", Time: passageTimes[0]}}, map[string]taxrules.TaxRule{"Testville": taxRule}, nil)
+	if err != nil || trip.TotalFee != 0 {
+		t.Errorf("Expected the motorbike to be toll-free on a trip, but got %+v and %v", trip, err)
+	}
+}
+
+// withDataDir points the data store at a temporary directory until the test ends, with copies of
+// the given city files of the server.
+func withDataDir(t *testing.T, cityFiles ...string) string {
+	dir := t.TempDir()
+	if len(cityFiles) > 0 {
+		os.MkdirAll(filepath.Join(dir, "cities"), 0755)
+	}
+	for _, cityFile := range cityFiles {
+		cityData, err := ioutil.ReadFile(filepath.Join("server", "cities", cityFile))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ioutil.WriteFile(filepath.Join(dir, "cities", cityFile), cityData, 0644)
+	}
+	t.Setenv(helpers.DataDirectoryEnv, dir)
+	return dir
+}
+
+// useAPIKeys makes the server accept the given API keys until the test ends.
+func useAPIKeys(t *testing.T, keys []auth.APIKey) {
+	previous := server.Authenticator
+	server.Authenticator = auth.NewAuthenticator(keys, nil)
+	t.Cleanup(func() { server.Authenticator = previous })
+}
+
+// grpcCall sends the messages of a gRPC call and returns the response messages and the grpc-status trailer.
+func grpcCall(t *testing.T, client *http.Client, url string, method string, key string, messages ...[]byte) ([][]byte, string) {
+	var body bytes.Buffer
+	for _, message := range messages {
+		grpcwire.WriteMessage(&body, message)
+	}
+	request, _ := http.NewRequest(http.MethodPost, url+method, &body)
+	request.Header.Set("Content-Type", grpcwire.ContentType)
+	request.Header.Set(auth.APIKeyHeader, key)
+	response, err := client.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+
+	var responses [][]byte
+	for {
+		message, err := grpcwire.ReadMessage(response.Body, 0)
+		if err != nil {
+			break
+		}
+		responses = append(responses, message)
+	}
+	return responses, response.Trailer.Get("Grpc-Status")
+}
+
+func TestGRPCService(t *testing.T) {
+	withDataDir(t, "belgrade.json")
+	useAPIKeys(t, []auth.APIKey{
+		{Name: "grpc-test", KeySHA256: auth.HashKey("grpc-key"), Roles: []string{auth.RoleCalculator}},
+		{Name: "editor", KeySHA256: auth.HashKey("editor-key"), Roles: []string{auth.CityEditorRole("Belgrade")}},
+	})
+
+	grpcServer := httptest.NewUnstartedServer(server.GRPCHandler())
+	grpcServer.EnableHTTP2 = true
+	grpcServer.StartTLS()
+	defer grpcServer.Close()
+	client := grpcServer.Client()
+
+	at := func(hour int, minute int) time.Time {
+		return time.Date(2013, 2, 8, hour, minute, 0, 0, time.UTC)
+	}
+	calculate := grpcapi.CalculateRequest{LicensePlate: "ABC123", VehicleType: "Car", Passages: []grpcapi.Passage{
+		{City: "Gothenburg", Time: at(6, 20)},
+		{Station: "BG-GAZELA", Time: time.Date(2013, 11, 7, 8, 30, 0, 0, time.UTC)},
+	}}
+	responses, status := grpcCall(t, client, grpcServer.URL, grpcapi.CalculateMethod, "grpc-key", calculate.Marshal())
+	if status != "0" || len(responses) != 1 {
+		t.Fatalf("Expected a single response with status 0, but got %d responses and status %s", len(responses), status)
+	}
+	var trip grpcapi.CalculateResponse
+	if err := trip.Unmarshal(responses[0]); err != nil {
+		t.Fatal(err)
+	}
+	if trip.TotalFee != 18 || len(trip.Cities) != 2 || len(trip.Passages) != 2 || trip.Passages[0].City != "Belgrade" {
+		t.Errorf("Expected 18 in two cities with the station resolved to Belgrade, but got %+v", trip)
+	}
+
+	stream := []grpcapi.StreamPassage{
+		{LicensePlate: "ABC123", VehicleType: "Car", Passage: grpcapi.Passage{City: "Gothenburg", Time: at(6, 20)}},
+		{LicensePlate: "ABC123", VehicleType: "Car", Passage: grpcapi.Passage{City: "Gothenburg", Time: at(6, 40)}},
+		{LicensePlate: "XYZ789", VehicleType: "Car", Passage: grpcapi.Passage{City: "Gothenburg", Time: at(6, 40)}},
+		{LicensePlate: "ABC123", VehicleType: "Car", Passage: grpcapi.Passage{City: "Gothenburg", Time: at(6, 20).AddDate(0, 0, 3)}},
+	}
+	messages := make([][]byte, len(stream))
+	for i, passage := range stream {
+		messages[i] = passage.Marshal()
+	}
+	responses, status = grpcCall(t, client, grpcServer.URL, grpcapi.CalculateStreamMethod, "grpc-key", messages...)
+	if status != "0" || len(responses) != 4 {
+		t.Fatalf("Expected a response per passage with status 0, but got %d responses and status %s", len(responses), status)
+	}
+	expected := []grpcapi.StreamResult{
+		{LicensePlate: "ABC123", City: "Gothenburg", Time: at(6, 20), FeeAdded: 8, TotalFee: 8},
+		{LicensePlate: "ABC123", City: "Gothenburg", Time: at(6, 40), FeeAdded: 5, TotalFee: 13},
+		{LicensePlate: "XYZ789", City: "Gothenburg", Time: at(6, 40), FeeAdded: 13, TotalFee: 13},
+		{LicensePlate: "ABC123", City: "Gothenburg", Time: at(6, 20).AddDate(0, 0, 3), FeeAdded: 8, TotalFee: 21},
+	}
+	for i, message := range responses {
+		var result grpcapi.StreamResult
+		if err := result.Unmarshal(message); err != nil {
+			t.Fatal(err)
+		}
+		if result != expected[i] {
+			t.Errorf("Expected stream result %+v, but got %+v", expected[i], result)
+		}
+	}
+
+	limits := server.DefaultLimits
+	limits.MaxPassages = 2
+	server.SetLimits(limits)
+	responses, status = grpcCall(t, client, grpcServer.URL, grpcapi.CalculateStreamMethod, "grpc-key", messages...)
+	server.SetLimits(server.DefaultLimits)
+	if status != "8" || len(responses) != 2 {
+		t.Errorf("Expected status 8 after 2 streamed passages, but got %d responses and status %s", len(responses), status)
+	}
+
+	oversized := []byte{0, 0xff, 0xff, 0xff, 0xff}
+	if _, err := grpcwire.ReadMessage(bytes.NewReader(oversized), 0); grpcwire.StatusOf(err).Code != grpcwire.ResourceExhausted {
+		t.Errorf("Expected a message above the default maximum size to be rejected, but got %v", err)
+	}
+
+	explain := grpcapi.ExplainRequest{LicensePlate: "ABC123", VehicleType: "Car", Passage: grpcapi.Passage{City: "Belgrade", Time: time.Date(2013, 11, 7, 8, 30, 0, 0, time.UTC)}}
+	responses, status = grpcCall(t, client, grpcServer.URL, grpcapi.ExplainMethod, "grpc-key", explain.Marshal())
+	var explanation grpcapi.ExplainResponse
+	if status != "0" || len(responses) != 1 || explanation.Unmarshal(responses[0]) != nil || explanation.FinalFee != 10 || explanation.Text == "" {
+		t.Errorf("Expected an explained fee of 10, but got status %s and %+v", status, explanation)
+	}
+
+	responses, status = grpcCall(t, client, grpcServer.URL, grpcapi.ListCitiesMethod, "grpc-key", nil)
+	var cities grpcapi.ListCitiesResponse
+	if status != "0" || len(responses) != 1 || cities.Unmarshal(responses[0]) != nil || len(cities.Cities) != 2 || len(cities.Cities[0].Stations) != 2 {
+		t.Errorf("Expected Belgrade with its stations and Gothenburg, but got status %s and %+v", status, cities)
+	}
+
+	if _, status := grpcCall(t, client, grpcServer.URL, grpcapi.ListCitiesMethod, "wrong-key", nil); status != "16" {
+		t.Errorf("Expected status 16 for an invalid key, but got %s", status)
+	}
+	if _, status := grpcCall(t, client, grpcServer.URL, grpcapi.ListCitiesMethod, "editor-key", nil); status != "7" {
+		t.Errorf("Expected status 7 without the calculator role, but got %s", status)
+	}
+	if _, status := grpcCall(t, client, grpcServer.URL, "/congestion.v1.CongestionCalculator/Unknown", "grpc-key", nil); status != "12" {
+		t.Errorf("Expected status 12 for an unknown method, but got %s", status)
+	}
+}
+
+func TestJobsWithSignedWebhook(t *testing.T) {
+	useAPIKeys(t, []auth.APIKey{
+		{Name: "jobs-test", KeySHA256: auth.HashKey("jobs-key"), Roles: []string{auth.RoleCalculator}},
+		{Name: "other", KeySHA256: auth.HashKey("other-key"), Roles: []string{auth.RoleCalculator}},
+	})
+	server.WebhookSender = &webhooks.Sender{Client: webhooks.NewClient(), MaxAttempts: 3, Backoff: time.Millisecond}
+
+	secret := "0123456789abcdef"
+	notifications := make(chan error, 1)
+	attempts := 0
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		if attempts == 1 {
+			http.Error(w, "busy", http.StatusServiceUnavailable)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		err := webhooks.Verify([]byte(secret), r.Header.Get(webhooks.TimestampHeader), body, r.Header.Get(webhooks.SignatureHeader), time.Now(), time.Minute)
+		var notification server.JobNotification
+		if err == nil {
+			err = json.Unmarshal(body, &notification)
+		}
+		if err == nil && notification.Job.Status != jobs.Succeeded {
+			err = fmt.Errorf("unexpected job status %s", notification.Job.Status)
+		}
+		notifications <- err
+	}))
+	defer receiver.Close()
+
+	handler := server.Handler()
+	call := func(method string, target string, key string, body string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(method, target, strings.NewReader(body))
+		request.Header.Set(auth.APIKeyHeader, key)
+		response := httptest.NewRecorder()
+		handler.ServeHTTP(response, request)
+		return response
+	}
+
+	// webhooks must not reach the network of the server unless it is allowed
+	for _, target := range []string{receiver.URL, "http://10.0.0.8/hook", "http://169.254.169.254/latest", "http://[::1]:8080/", "http://0.0.0.0/"} {
+		if err := webhooks.ValidateTarget(target, secret); !errors.Is(err, webhooks.ErrInternalTarget) {
+			t.Errorf("Expected %s to be refused as internal, but got %v", target, err)
+		}
+	}
+	if err := webhooks.CheckAddress(net.ParseIP("93.184.216.34")); err != nil {
+		t.Errorf("Expected a public address to be allowed, but got %v", err)
+	}
+	refused := (&webhooks.Sender{Client: webhooks.NewClient(), MaxAttempts: 3, Backoff: time.Millisecond}).Send(receiver.URL, []byte(secret), "job", []byte("{}"))
+	if refused.Delivered || refused.Attempts != 1 || attempts != 0 {
+		t.Errorf("Expected a delivery to an internal address to be refused without retries, but got %+v", refused)
+	}
+	webhooks.AllowedNetworks, _ = webhooks.ParseNetworks("127.0.0.1, 10.1.0.0/16")
+	defer func() { webhooks.AllowedNetworks = nil }()
+	if webhooks.CheckAddress(net.ParseIP("10.1.2.3")) != nil || webhooks.CheckAddress(net.ParseIP("10.2.0.1")) == nil {
+		t.Error("Expected only the allowed private network to be accepted")
+	}
+
+	submission := call(http.MethodPost, "/Jobs", "jobs-key", `{"webhook_url":"`+receiver.URL+`","webhook_secret":"`+secret+`","requests":[
+		{"type":"Car","licenseplate":"ABC123","dates":["2013-02-08T06:20:27Z","2013-02-08T15:29:00Z"]},
+		{"type":"Car","licenseplate":"not a plate!","dates":["2013-02-08T06:20:27Z"]}]}`)
+	var job jobs.Job
+	if submission.Code != http.StatusAccepted || json.Unmarshal(submission.Body.Bytes(), &job) != nil || job.Progress.Total != 2 {
+		t.Fatalf("Expected the job to be accepted, but got %d: %s", submission.Code, submission.Body.String())
+	}
+	if location := submission.Header().Get("Location"); location != "/Jobs?id="+job.ID {
+		t.Errorf("Expected the location of the job, but got %s", location)
+	}
+	if response := call(http.MethodGet, "/Jobs?id="+job.ID, "other-key", ""); response.Code != http.StatusNotFound {
+		t.Errorf("Expected jobs of other callers to be hidden, but got %d", response.Code)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !job.Finished() && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		json.Unmarshal(call(http.MethodGet, "/Jobs?id="+job.ID, "jobs-key", "").Body.Bytes(), &job)
+	}
+	if job.Status != jobs.Succeeded || job.Progress.Done != 2 {
+		t.Fatalf("Expected the job to succeed with both requests done, but got %+v", job)
+	}
+
+	var results server.JobResultsData
+	response := call(http.MethodGet, "/JobResults?id="+job.ID, "jobs-key", "")
+	if err := json.Unmarshal(response.Body.Bytes(), &results); err != nil || len(results.Results) != 2 {
+		t.Fatalf("Expected two results, but got %d: %s", response.Code, response.Body.String())
+	}
+	if results.Results[0].Trip == nil || results.Results[0].Trip.TotalFee != 21 || results.Results[1].Error == "" {
+		t.Errorf("Expected 21 SEK for the first request and an error for the invalid plate, but got %+v", results.Results)
+	}
+
+	select {
+	case err := <-notifications:
+		if err != nil {
+			t.Error(err)
+		}
+		if attempts != 2 {
+			t.Errorf("Expected the notification to be delivered on the second attempt, but took %d", attempts)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("Expected the webhook to be notified")
+	}
+}
+
+// writeMaskedFrame writes a single text frame the way WebSocket clients must, masked.
+func writeMaskedFrame(conn net.Conn, payload []byte) error {
+	mask := []byte{0x12, 0x34, 0x56, 0x78}
+	frame := []byte{0x81, 0x80 | byte(len(payload))}
+	frame = append(frame, mask...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+	_, err := conn.Write(frame)
+	return err
+}
+
+func TestGantryIngestion(t *testing.T) {
+	dir := withDataDir(t)
+	useAPIKeys(t, []auth.APIKey{
+		{Name: "gantry", KeySHA256: auth.HashKey("gantry-key"), Roles: []string{auth.RoleCalculator}},
+	})
+	var err error
+	server.PassageLedger, err = ledger.Open(filepath.Join(dir, "ledger", "passages.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		server.PassageLedger.Close()
+		server.PassageLedger = nil
+	}()
+
+	httpServer := httptest.NewServer(server.Handler())
+	defer httpServer.Close()
+
+	stream := strings.Join([]string{
+		`{"passage_id":"g-1","licenseplate":"GNT123","type":"Car","city":"Gothenburg","time":"2013-02-08T06:20:00Z"}`,
+		`{"passage_id":"g-2","licenseplate":"GNT123","type":"Car","city":"Gothenburg","time":"2013-02-08T06:35:00Z"}`,
+		`{"passage_id":"g-1","licenseplate":"GNT123","type":"Car","city":"Gothenburg","time":"2013-02-08T06:20:00Z"}`,
+		`{"passage_id":"g-3","licenseplate":"GNT123","city":"Atlantis","time":"2013-02-08T07:00:00Z"}`,
+		`not json`,
+	}, "\n")
+	request, _ := http.NewRequest(http.MethodPost, httpServer.URL+"/PassageStream", strings.NewReader(stream))
+	request.Header.Set(auth.APIKeyHeader, "gantry-key")
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var result server.StreamResultData
+	json.NewDecoder(response.Body).Decode(&result)
+	response.Body.Close()
+	if result.Accepted != 2 || result.Duplicates != 1 || result.Rejected != 2 || len(result.Rejections) != 2 || result.Rejections[0].Line != 4 {
+		t.Fatalf("Expected 2 accepted, 1 duplicate and lines 4 and 5 rejected, but got %+v", result)
+	}
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(httpServer.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	fmt.Fprintf(conn, "GET /PassageSocket HTTP/1.1\r\nHost: gantry\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n"+
+		"Sec-WebSocket-Version: 13\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n%s: gantry-key\r\n\r\n", auth.APIKeyHeader)
+	reader := bufio.NewReader(conn)
+	handshake, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if handshake.StatusCode != http.StatusSwitchingProtocols || handshake.Header.Get("Sec-WebSocket-Accept") != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("Expected the WebSocket handshake to complete, but got %d %v", handshake.StatusCode, handshake.Header)
+	}
+
+	event := `{"passage_id":"g-4","licenseplate":"GNT123","type":"Car","city":"Gothenburg","time":"2013-02-08T15:10:00Z"}`
+	if err := writeMaskedFrame(conn, []byte(event)); err != nil {
+		t.Fatal(err)
+	}
+	head := make([]byte, 2)
+	if _, err := io.ReadFull(reader, head); err != nil {
+		t.Fatal(err)
+	}
+	length := int(head[1] & 0x7F)
+	if length == 126 {
+		extended := make([]byte, 2)
+		io.ReadFull(reader, extended)
+		length = int(extended[0])<<8 | int(extended[1])
+	}
+	payload := make([]byte, length)
+	io.ReadFull(reader, payload)
+	var ack server.PassageAck
+	if err := json.Unmarshal(payload, &ack); err != nil || ack.Status != server.PassageAccepted || ack.DailyTotal == nil {
+		t.Fatalf("Expected the passage to be accepted with its daily total, but got %s", payload)
+	}
+	if ack.DailyTotal.TotalFee != 26 || ack.DailyTotal.Passages != 3 {
+		t.Errorf("Expected 26 SEK for 3 passages, but got %+v", ack.DailyTotal)
+	}
+
+	request, _ = http.NewRequest(http.MethodGet, httpServer.URL+"/DailyTotals?plate=gnt123&date=2013-02-08", nil)
+	request.Header.Set(auth.APIKeyHeader, "gantry-key")
+	response, err = http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var totals []dailytotals.Total
+	json.NewDecoder(response.Body).Decode(&totals)
+	response.Body.Close()
+	if len(totals) != 1 || totals[0].City != "Gothenburg" || totals[0].TotalFee != 26 {
+		t.Errorf("Expected the running total of Gothenburg to be queryable, but got %+v", totals)
+	}
+	request, _ = http.NewRequest(http.MethodGet, httpServer.URL+"/DailyStatus?plate=GNT123&city=gothenburg&time=2013-02-08T15:30:00Z", nil)
+	request.Header.Set(auth.APIKeyHeader, "gantry-key")
+	response, err = http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var status dailytotals.Status
+	json.NewDecoder(response.Body).Decode(&status)
+	response.Body.Close()
+	if len(status.ChargedWindows) != 2 || status.ChargedWindows[0].Fee != 13 || status.ChargedWindows[0].Passages != 2 {
+		t.Fatalf("Expected a 13 SEK window for the morning passages and one for the afternoon, but got %+v", status.ChargedWindows)
+	}
+	if status.OpenWindow == nil || !status.OpenWindow.ClosesAt.Equal(time.Date(2013, 2, 8, 16, 10, 0, 0, time.UTC)) {
+		t.Errorf("Expected the afternoon window to be open until 16:10, but got %+v", status.OpenWindow)
+	}
+	if status.TotalFee != 26 || status.DailyCap != 60 || status.RemainingBeforeCap != 34 {
+		t.Errorf("Expected 26 SEK charged with 34 SEK left before the cap of 60, but got %+v", status)
+	}
+}
+
+func TestQueueConsumers(t *testing.T) {
+	dir := withDataDir(t)
+	var err error
+	server.PassageLedger, err = ledger.Open(filepath.Join(dir, "ledger", "passages.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.QueueCheckpoints, _ = queue.OpenCheckpoints(filepath.Join(dir, "queue", "checkpoints.json"))
+	server.DeadLetterStore, err = queue.OpenDeadLetters(filepath.Join(dir, "queue", "deadletters.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		server.PassageLedger.Close()
+		server.DeadLetterStore.Close()
+		server.PassageLedger, server.QueueCheckpoints, server.DeadLetterStore = nil, nil, nil
+	}()
+
+	// consume runs the consumer of a source until the condition holds
+	consume := func(source queue.Source, condition func() bool) {
+		ctx, cancel := context.WithCancel(context.Background())
+		stopped := make(chan error)
+		go func() { stopped <- server.ConsumePassages(ctx, source) }()
+		deadline := time.Now().Add(5 * time.Second)
+		for !condition() && time.Now().Before(deadline) {
+			time.Sleep(5 * time.Millisecond)
+		}
+		cancel()
+		if err := <-stopped; err != context.Canceled {
+			t.Errorf("Expected the consumer to stop with its context, but got %v", err)
+		}
+		if !condition() {
+			t.Errorf("Expected %s to be consumed", source.Name())
+		}
+	}
+	passage := func(id string) []byte {
+		return []byte(`{"passage_id":"` + id + `","licenseplate":"QUE123","type":"Car","city":"Gothenburg","time":"2013-02-08T06:20:00Z"}`)
+	}
+	recorded := func(count int) func() bool {
+		return func() bool { return len(server.PassageLedger.Passages("QUE123", time.Time{}, time.Time{})) == count }
+	}
+
+	broker := queue.NewBroker()
+	broker.Publish("passages", passage("q-1"))
+	broker.Publish("passages", []byte(`{"passage_id":`))
+	broker.Publish("passages", []byte(`{"passage_id":"q-2","licenseplate":"QUE123","city":"Atlantis","time":"2013-02-08T06:20:00Z"}`))
+	subscription := broker.Subscribe("passages", 0)
+	consume(subscription, func() bool {
+		return recorded(1)() && len(server.DeadLetterStore.List("broker:passages")) == 2
+	})
+	if offset := server.QueueCheckpoints.Offset("broker:passages"); offset != 3 {
+		t.Errorf("Expected the broker to be checkpointed after the third message, but got %d", offset)
+	}
+	if offset := broker.Publish("passages", passage("q-1")); offset != 4 {
+		t.Errorf("Expected the fourth message to end at offset 4, but got %d", offset)
+	}
+	trimmed := broker.Subscribe("passages", 0)
+	if _, err := trimmed.Receive(context.Background()); err == nil {
+		t.Errorf("Expected the acknowledged messages to be trimmed")
+	}
+	trimmed.Close()
+	resumed := broker.Subscribe("passages", 3)
+	if message, err := resumed.Receive(context.Background()); err != nil || message.Offset != 4 {
+		t.Errorf("Expected the message after offset 3 to be kept, but got %+v and %v", message, err)
+	}
+	resumed.Close()
+	subscription.Close()
+
+	path := filepath.Join(dir, "gantries.jsonl")
+	ioutil.WriteFile(path, append(passage("q-3"), '\n'), 0644)
+	source := queue.OpenFile(path, server.QueueCheckpoints.Offset("file:"+path), time.Millisecond)
+	consume(source, recorded(2))
+	source.Close()
+	file, _ := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	file.Write(append(passage("q-4"), '\n'))
+	file.Close()
+	source = queue.OpenFile(path, server.QueueCheckpoints.Offset("file:"+path), time.Millisecond)
+	consume(source, recorded(3))
+	source.Close()
+	if info, _ := os.Stat(path); server.QueueCheckpoints.Offset("file:"+path) != info.Size() {
+		t.Errorf("Expected the file to be checkpointed at its end, but got %d", server.QueueCheckpoints.Offset("file:"+path))
+	}
+
+	nats, err := natstest.NewServer("PASSAGES", "calculator", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nats.Close()
+	nats.Publish(passage("q-5"))
+	nats.Publish([]byte("not json"))
+	natsSource, err := queue.DialNATS(nats.Addr(), "PASSAGES", "calculator")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer natsSource.Close()
+	consume(natsSource, func() bool { return len(nats.Acked()) == 2 })
+	if !recorded(4)() || nats.Deliveries(1) != 1 {
+		t.Errorf("Expected the NATS passage to be recorded after a single delivery, but it was delivered %d times", nats.Deliveries(1))
+	}
+	letters := server.DeadLetterStore.List(natsSource.Name())
+	if len(letters) != 1 || letters[0].Offset != 2 || letters[0].Data != "not json" {
+		t.Errorf("Expected the malformed NATS message to be dead-lettered, but got %+v", letters)
+	}
+}
+
+func TestEventSubscriptions(t *testing.T) {
+	dir := withDataDir(t, "belgrade.json")
+	useAPIKeys(t, []auth.APIKey{
+		{Name: "billing", KeySHA256: auth.HashKey("billing-key"), Roles: []string{auth.RoleAdmin}},
+	})
+	server.WebhookSender = &webhooks.Sender{Client: webhooks.NewClient(), MaxAttempts: 2, Backoff: time.Millisecond}
+	var err error
+	server.SubscriptionStore, err = subscriptions.Open(filepath.Join(dir, "subscriptions"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		server.SubscriptionStore.Close()
+		server.SubscriptionStore = nil
+	}()
+
+	secret := "0123456789abcdef"
+	failing := true
+	events := make(chan subscriptions.Event, 10)
+	var receiverLock sync.Mutex
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		receiverLock.Lock()
+		defer receiverLock.Unlock()
+		if failing {
+			http.Error(w, "down", http.StatusInternalServerError)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		if err := webhooks.Verify([]byte(secret), r.Header.Get(webhooks.TimestampHeader), body, r.Header.Get(webhooks.SignatureHeader), time.Now(), time.Minute); err != nil {
+			t.Errorf("Expected a signed delivery, but got %v", err)
+		}
+		var event subscriptions.Event
+		json.Unmarshal(body, &event)
+		events <- event
+	}))
+	defer receiver.Close()
+
+	handler := server.Handler()
+	call := func(method string, target string, body string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(method, target, strings.NewReader(body))
+		request.Header.Set(auth.APIKeyHeader, "billing-key")
+		response := httptest.NewRecorder()
+		handler.ServeHTTP(response, request)
+		return response
+	}
+	webhooks.AllowedNetworks, _ = webhooks.ParseNetworks("127.0.0.1")
+	defer func() { webhooks.AllowedNetworks = nil }()
+	if response := call(http.MethodPost, "/Subscriptions", `{"url":"`+receiver.URL+`","secret":"`+secret+`","events":["payment_received"]}`); response.Code != http.StatusBadRequest {
+		t.Errorf("Expected unknown event types to be rejected, but got %d", response.Code)
+	}
+	response := call(http.MethodPost, "/Subscriptions", `{"url":"`+receiver.URL+`","secret":"`+secret+`","events":["rules_published","daily_cap_reached"]}`)
+	var subscription subscriptions.Subscription
+	if response.Code != http.StatusCreated || json.Unmarshal(response.Body.Bytes(), &subscription) != nil {
+		t.Fatalf("Expected the subscription to be created, but got %d: %s", response.Code, response.Body.String())
+	}
+
+	rules := `{"hourly_prices":[{"start_hour":0,"end_hour":23,"rate":9}],"max_taxed_fee":60,"default_hourly_price":9}`
+	if response := call(http.MethodPut, "/Rules?city=belgrade", rules); response.Code != http.StatusOK {
+		t.Fatalf("Expected the rules to be published, but got %d: %s", response.Code, response.Body.String())
+	}
+	deliveries := func(count int) []subscriptions.DeliveryRecord {
+		var records []subscriptions.DeliveryRecord
+		deadline := time.Now().Add(5 * time.Second)
+		for len(records) < count && time.Now().Before(deadline) {
+			time.Sleep(5 * time.Millisecond)
+			json.Unmarshal(call(http.MethodGet, "/Deliveries?subscription="+subscription.ID, "").Body.Bytes(), &records)
+		}
+		return records
+	}
+	records := deliveries(1)
+	if len(records) != 1 || records[0].Delivered || records[0].Attempts != 2 || records[0].Event != subscriptions.EventRulesPublished {
+		t.Fatalf("Expected a failed rules_published delivery after 2 attempts, but got %+v", records)
+	}
+
+	receiverLock.Lock()
+	failing = false
+	receiverLock.Unlock()
+	if response := call(http.MethodPost, "/Replays?delivery="+records[0].ID, ""); response.Code != http.StatusAccepted {
+		t.Fatalf("Expected the replay to be accepted, but got %d: %s", response.Code, response.Body.String())
+	}
+	records = deliveries(2)
+	if len(records) != 2 || !records[0].Delivered || records[0].ReplayOf != records[1].ID || records[0].EventID != records[1].EventID {
+		t.Errorf("Expected the replay to be delivered and logged, but got %+v", records)
+	}
+	if event := <-events; event.Type != subscriptions.EventRulesPublished || event.ID != records[1].EventID {
+		t.Errorf("Expected the replayed rules_published event, but got %+v", event)
+	}
+	var page []subscriptions.DeliveryRecord
+	json.Unmarshal(call(http.MethodGet, "/Deliveries?subscription="+subscription.ID+"&limit=1", "").Body.Bytes(), &page)
+	if len(page) != 1 || page[0].ID != records[0].ID {
+		t.Errorf("Expected a page with the newest delivery, but got %+v", page)
+	}
+	json.Unmarshal(call(http.MethodGet, "/Deliveries?subscription="+subscription.ID+"&limit=1&before="+page[0].ID, "").Body.Bytes(), &page)
+	if len(page) != 1 || page[0].ID != records[1].ID {
+		t.Errorf("Expected the next page with the replayed delivery, but got %+v", page)
+	}
+	if response := call(http.MethodGet, "/Deliveries?subscription="+subscription.ID+"&before=unknown", ""); response.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for an unknown delivery to page from, but got %d", response.Code)
+	}
+	if response := call(http.MethodGet, "/Deliveries?subscription="+subscription.ID+"&limit=0", ""); response.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an invalid limit, but got %d", response.Code)
+	}
+
+	at := func(hour int, minute int) time.Time {
+		return time.Date(2013, 2, 8, hour, minute, 0, 0, time.UTC)
+	}
+	for i, passageTime := range []time.Time{at(7, 0), at(8, 5), at(15, 30), at(16, 35)} {
+		server.DailyTotals.Record(ledger.Entry{PassageId: fmt.Sprintf("cap-%d", i), LicensePlate: "CAP123", VehicleType: "Car", City: "Gothenburg", Time: passageTime}, time.Now())
+	}
+	select {
+	case event := <-events:
+		data, _ := event.Data.(map[string]interface{})
+		if event.Type != subscriptions.EventDailyCapReached || data["licenseplate"] != "CAP123" || data["total_fee"] != float64(60) {
+			t.Errorf("Expected daily_cap_reached for CAP123 at 60 SEK, but got %+v", event)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("Expected daily_cap_reached to be delivered")
+	}
+}
+
+func TestDeliveryLogIsBounded(t *testing.T) {
+	dir := t.TempDir()
+	store, err := subscriptions.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i <= subscriptions.MaxDeliveries; i++ {
+		record := subscriptions.DeliveryRecord{SubscriptionID: "sub", EventID: fmt.Sprintf("event-%d", i), Body: json.RawMessage("{}")}
+		record.ID = fmt.Sprintf("delivery-%d", i)
+		if err := store.Record(record); err != nil {
+			t.Fatal(err)
+		}
+	}
+	store.Close()
+
+	store, err = subscriptions.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if _, kept := store.Delivery("delivery-0"); kept {
+		t.Errorf("Expected the oldest delivery to be dropped from memory")
+	}
+	if !store.Published("event-0") {
+		t.Errorf("Expected the event of a dropped delivery to stay published")
+	}
+	records, err := store.Deliveries("sub", "", subscriptions.MaxDeliveries+1)
+	if err != nil || len(records) != subscriptions.MaxDeliveries || records[0].ID != fmt.Sprintf("delivery-%d", subscriptions.MaxDeliveries) {
+		t.Errorf("Expected the %d newest deliveries, but got %d and %v", subscriptions.MaxDeliveries, len(records), err)
+	}
+}
+
+func TestAuditTrail(t *testing.T) {
+	dir := withDataDir(t, "belgrade.json")
+	useAPIKeys(t, []auth.APIKey{
+		{Name: "auditor", KeySHA256: auth.HashKey("auditor-key"), Roles: []string{auth.RoleAdmin}},
+	})
+	auditPath := filepath.Join(dir, "audit", "audit.jsonl")
+	var err error
+	server.AuditLog, err = audit.Open(auditPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		server.AuditLog.Close()
+		server.AuditLog = nil
+	}()
+
+	handler := server.Handler()
+	call := func(method string, target string, body string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(method, target, strings.NewReader(body))
+		request.Header.Set(auth.APIKeyHeader, "auditor-key")
+		response := httptest.NewRecorder()
+		handler.ServeHTTP(response, request)
+		return response
+	}
+	if response := call(http.MethodPost, "/Trip", `{"type":"Car","licenseplate":"AUD123","passages":[{"city":"belgrade","time":"2013-11-07T11:00:00Z"},{"city":"Gothenburg","time":"2013-11-07T07:00:00Z"}]}`); response.Code != http.StatusOK {
+		t.Fatalf("Expected the trip to be calculated, but got %d: %s", response.Code, response.Body.String())
+	}
+	rules := `{"hourly_prices":[{"start_hour":0,"end_hour":23,"rate":9}],"max_taxed_fee":60,"excluded_months":[1,2,3],"excluded_days":[2,3,4],"default_hourly_price":9}`
+	if response := call(http.MethodPut, "/Rules?city=belgrade", rules); response.Code != http.StatusOK {
+		t.Fatalf("Expected the rules to be edited, but got %d: %s", response.Code, response.Body.String())
+	}
+
+	query := func(target string) []audit.Record {
+		var records []audit.Record
+		response := call(http.MethodGet, target, "")
+		if response.Code != http.StatusOK || json.Unmarshal(response.Body.Bytes(), &records) != nil {
+			t.Fatalf("Expected audit records for %s, but got %d: %s", target, response.Code, response.Body.String())
+		}
+		return records
+	}
+	calculations := query("/Audit?plate=aud123")
+	if len(calculations) != 1 || calculations[0].Kind != audit.KindCalculation || calculations[0].Actor != "auditor" ||
+		calculations[0].InputHash == "" || calculations[0].TotalFee != 28 ||
+		calculations[0].RuleVersions["Gothenburg"] != taxrules.DefaultRuleVersion || calculations[0].RuleVersions["Belgrade"] == "" {
+		t.Errorf("Expected the audited calculation of AUD123, but got %+v", calculations)
+	}
+	edits := query("/Audit?city=BELGRADE&kind=rules_edit")
+	if len(edits) != 1 || edits[0].Actor != "auditor" || strings.Join(edits[0].Changes, ",") != "default_hourly_price,excluded_dates,hourly_prices" ||
+		edits[0].PreviousHash != calculations[0].Hash {
+		t.Errorf("Expected the chained rules edit of Belgrade changing its prices and excluded dates, but got %+v", edits)
+	}
+	if records := query("/Audit?city=Gothenburg&from=" + time.Now().Add(time.Hour).UTC().Format(time.RFC3339)); len(records) != 0 {
+		t.Errorf("Expected no records after the time range, but got %+v", records)
+	}
+
+	// running totals are calculated for the server itself, jobs for the caller who submitted them
+	server.DailyTotals.Record(ledger.Entry{PassageId: "audit-1", LicensePlate: "TOT123", VehicleType: "Car", City: "Gothenburg", Time: time.Date(2013, 2, 8, 7, 0, 0, 0, time.UTC)}, time.Now())
+	if records := query("/Audit?plate=TOT123"); len(records) != 0 {
+		t.Errorf("Expected running daily totals not to be audited, but got %+v", records)
+	}
+	if response := call(http.MethodPost, "/Jobs", `{"requests":[{"type":"Car","licenseplate":"JOB123","dates":["2013-11-07T07:00:00Z"]}]}`); response.Code != http.StatusAccepted {
+		t.Fatalf("Expected the job to be accepted, but got %d: %s", response.Code, response.Body.String())
+	}
+	var jobRecords []audit.Record
+	for deadline := time.Now().Add(5 * time.Second); len(jobRecords) == 0 && time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		jobRecords = query("/Audit?plate=JOB123")
+	}
+	if len(jobRecords) != 1 || jobRecords[0].Actor != "auditor" || jobRecords[0].TotalFee != 18 {
+		t.Errorf("Expected the job's calculation to be audited for its submitter, but got %+v", jobRecords)
+	}
+
+	var verification audit.Verification
+	response := call(http.MethodGet, "/AuditVerification", "")
+	json.Unmarshal(response.Body.Bytes(), &verification)
+	if response.Code != http.StatusOK || !verification.Valid || verification.Records != 3 {
+		t.Errorf("Expected an intact chain of 3 records, but got %d: %+v", response.Code, verification)
+	}
+
+	content, _ := ioutil.ReadFile(auditPath)
+	ioutil.WriteFile(auditPath, bytes.Replace(content, []byte(`"total_fee":28`), []byte(`"total_fee":0`), 1), 0644)
+	response = call(http.MethodGet, "/AuditVerification", "")
+	verification = audit.Verification{}
+	json.Unmarshal(response.Body.Bytes(), &verification)
+	if response.Code != http.StatusConflict || verification.Valid || verification.BrokenAt != 1 {
+		t.Errorf("Expected the edited record to break the chain, but got %d: %+v", response.Code, verification)
+	}
+
+	// an audit log that cannot be written refuses calculations and rules edits instead of skipping the record
+	server.AuditLog.Close()
+	cityBefore, _ := ioutil.ReadFile(filepath.Join(dir, "cities", "belgrade.json"))
+	if response := call(http.MethodPut, "/Rules?city=belgrade", `{"hourly_prices":[{"start_hour":0,"end_hour":23,"rate":1}]}`); response.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected an unaudited rules edit to be refused, but got %d: %s", response.Code, response.Body.String())
+	}
+	if cityAfter, _ := ioutil.ReadFile(filepath.Join(dir, "cities", "belgrade.json")); !bytes.Equal(cityBefore, cityAfter) {
+		t.Error("Expected the refused rules edit not to be written")
+	}
+	if response := call(http.MethodPost, "/Trip", `{"type":"Car","licenseplate":"AUD123","passages":[{"city":"Gothenburg","time":"2013-11-07T07:00:00Z"}]}`); response.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected an unaudited calculation to be refused, but got %d: %s", response.Code, response.Body.String())
+	}
+}
+
+func TestAuditLogDropsPartialRecord(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "audit.jsonl")
+
+	log, err := audit.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, _ := log.Append(audit.Record{Kind: audit.KindCalculation, Actor: "auditor", LicensePlate: "ABC123"})
+	log.Close()
+
+	// a crash while writing the second record leaves half a line behind
+	file, _ := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	file.WriteString(`{"sequence":2,"kind":"calcul`)
+	file.Close()
+
+	log, err = audit.Open(path)
+	if err != nil {
+		t.Fatalf("Expected the partial record to be dropped, but got %v", err)
+	}
+	defer log.Close()
+	second, err := log.Append(audit.Record{Kind: audit.KindCalculation, Actor: "auditor", LicensePlate: "DEF456"})
+	if err != nil || second.Sequence != 2 || second.PreviousHash != first.Hash {
+		t.Errorf("Expected the next record to chain to the last complete one, but got %+v, %v", second, err)
+	}
+	if verification := log.Verify(); !verification.Valid || verification.Records != 2 {
+		t.Errorf("Expected an intact chain of 2 records, but got %+v", verification)
+	}
+}
+
+func TestDiffTaxRules(t *testing.T) {
+	dir := withDataDir(t, "belgrade.json")
+	cityPath := filepath.Join(dir, "cities", "belgrade.json")
+	cityData, err := ioutil.ReadFile(cityPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	before, err := taxrules.ParseCityData(string(cityData))
+	if err != nil {
+		t.Fatal(err)
+	}
+	draft := `{"hourly_prices":[{"start_hour":0,"end_hour":7,"rate":5},{"start_hour":8,"end_hour":11,"rate":15},{"start_hour":12,"end_hour":17,"rate":8},{"start_hour":18,"end_hour":21,"rate":12}],` +
+		`"tax_on_weekend":true,"excluded_months":[1,2,7],"max_taxed_fee":80,"excluded_dates":["2013-10-07T00:00:00Z","2013-12-24T00:00:00Z"],"excluded_days":[2,3,4],"default_hourly_price":7}`
+	var after taxrules.TaxRule
+	if err := json.Unmarshal([]byte(draft), &after); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		"tariff band 08:00-11:59 changed from 10 to 15",
+		"tariff band 18:00-23:59 at 12 removed",
+		"tariff band 18:00-21:59 at 12 added",
+		"excluded month March removed",
+		"excluded month July added",
+		"excluded date 2013-12-24 added",
+		"daily cap changed from 60 to 80",
+		"weekends are now taxed",
+	}
+	checkDiff := func(source string, ruleDiff taxrules.RuleDiff) {
+		var descriptions []string
+		for _, change := range ruleDiff.Changes {
+			descriptions = append(descriptions, change.Description)
+		}
+		if strings.Join(descriptions, "\n") != strings.Join(expected, "\n") || ruleDiff.ToVersion != after.Version() {
+			t.Errorf("Expected %s to report %v, but got %v", source, expected, descriptions)
+		}
+	}
+	checkDiff("Diff", taxrules.Diff(before.TaxRules, after))
+	if changes := taxrules.Diff(after, after).Changes; len(changes) != 0 {
+		t.Errorf("Expected identical rules to have no changes, but got %+v", changes)
+	}
+	duplicated := after
+	duplicated.HourlyPrices = append(append([]taxrules.HourlyPrice{}, after.HourlyPrices...), taxrules.HourlyPrice{StartHour: 8, EndHour: 11, Rate: 20})
+	duplicated.DefaultHourlyPrice = 9
+	changes := taxrules.Diff(after, duplicated).Changes
+	if len(changes) != 2 || changes[0].Kind != taxrules.ChangeDuplicated ||
+		changes[0].Description != "tariff band 08:00-11:59 at 20 listed more than once after the change" ||
+		changes[1].Description != "default hourly price field changed from 7 to 9, which has no effect on fees" {
+		t.Errorf("Expected the duplicated band and the default price to be reported, but got %+v", changes)
+	}
+
+	useAPIKeys(t, []auth.APIKey{
+		{Name: "reviewer", KeySHA256: auth.HashKey("reviewer-key"), Roles: []string{auth.RoleCalculator}},
+	})
+	request := httptest.NewRequest(http.MethodPost, "/RuleDiff", strings.NewReader(`{"city":"belgrade","after":`+draft+`}`))
+	request.Header.Set(auth.APIKeyHeader, "reviewer-key")
+	response := httptest.NewRecorder()
+	server.Handler().ServeHTTP(response, request)
+	var ruleDiff taxrules.RuleDiff
+	if response.Code != http.StatusOK || json.Unmarshal(response.Body.Bytes(), &ruleDiff) != nil {
+		t.Fatalf("Expected the rules of Belgrade to be compared, but got %d: %s", response.Code, response.Body.String())
+	}
+	checkDiff("/RuleDiff", ruleDiff)
+
+	draftPath := filepath.Join(dir, "draft.json")
+	ioutil.WriteFile(draftPath, []byte(draft), 0644)
+	var stdout, stderr bytes.Buffer
+	if code := cli.Run([]string{"diff", "-before", cityPath, "-after", draftPath, "-json"}, &stdout, &stderr); code != 0 {
+		t.Fatalf("Expected the diff command to succeed, but got %d: %s", code, stderr.String())
+	}
+	ruleDiff = taxrules.RuleDiff{}
+	json.Unmarshal(stdout.Bytes(), &ruleDiff)
+	checkDiff("the diff command", ruleDiff)
+
+	stdout.Reset()
+	if code := cli.Run([]string{"diff", "-city", "belgrade", "-after", draftPath}, &stdout, &stderr); code != 0 ||
+		!strings.Contains(stdout.String(), "removed  excluded month March removed") {
+		t.Errorf("Expected the changes as text, but got %d: %s%s", code, stdout.String(), stderr.String())
+	}
+}